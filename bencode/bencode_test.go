@@ -3,34 +3,34 @@ package bencode
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"reflect"
 	"testing"
+	"errors"
 )
 
 type any interface{}
 
-func checkMarshal(expected string, data any) (err os.Error) {
+func checkMarshal(expected string, data any) (err error) {
 	var b bytes.Buffer
 	if err = Marshal(&b, data); err != nil {
 		return
 	}
 	s := b.String()
 	if expected != s {
-		err = os.NewError(fmt.Sprintf("Expected %s got %s", expected, s))
+		err = errors.New(fmt.Sprintf("Expected %s got %s", expected, s))
 		return
 	}
 	return
 }
 
-func check(expected string, data any) (err os.Error) {
+func check(expected string, data any) (err error) {
 	if err = checkMarshal(expected, data); err != nil {
 		return
 	}
 	b2 := bytes.NewBufferString(expected)
 	val, err := Decode(b2)
 	if err != nil {
-		err = os.NewError(fmt.Sprint("Failed decoding ", expected, " ", err))
+		err = errors.New(fmt.Sprint("Failed decoding ", expected, " ", err))
 		return
 	}
 	if err = checkFuzzyEqual(data, val); err != nil {
@@ -39,64 +39,64 @@ func check(expected string, data any) (err os.Error) {
 	return
 }
 
-func checkFuzzyEqual(a any, b any) (err os.Error) {
+func checkFuzzyEqual(a any, b any) (err error) {
 	if !fuzzyEqual(a, b) {
-		err = os.NewError(fmt.Sprint(a, " != ", b,
-			":", reflect.NewValue(a), "!=", reflect.NewValue(b)))
+		err = errors.New(fmt.Sprint(a, " != ", b,
+			":", reflect.ValueOf(a), "!=", reflect.ValueOf(b)))
 	}
 	return
 }
 
 func fuzzyEqual(a, b any) bool {
-	return fuzzyEqualValue(reflect.NewValue(a), reflect.NewValue(b))
+	return fuzzyEqualValue(reflect.ValueOf(a), reflect.ValueOf(b))
 }
 
-func checkFuzzyEqualValue(a, b reflect.Value) (err os.Error) {
+func checkFuzzyEqualValue(a, b reflect.Value) (err error) {
 	if !fuzzyEqualValue(a, b) {
-		err = os.NewError(fmt.Sprint(a, " != ", b,
+		err = errors.New(fmt.Sprint(a, " != ", b,
 			":", a.Interface(), "!=", b.Interface()))
 	}
 	return
 }
 
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
 func fuzzyEqualInt64(a int64, b reflect.Value) bool {
-	switch vb := b.(type) {
-	case *reflect.IntValue:
-		return a == (vb.Get())
-	default:
-		return false
+	if isInt(b) {
+		return a == b.Int()
 	}
 	return false
 }
 
-func fuzzyEqualArrayOrSlice(va reflect.ArrayOrSliceValue, b reflect.Value) bool {
-	switch vb := b.(type) {
-	case *reflect.ArrayValue:
-		return fuzzyEqualArrayOrSlice2(va, vb)
-	case *reflect.SliceValue:
-		return fuzzyEqualArrayOrSlice2(va, vb)
-	default:
-		return false
+func fuzzyEqualArrayOrSlice(va reflect.Value, b reflect.Value) bool {
+	switch b.Kind() {
+	case reflect.Array, reflect.Slice:
+		return fuzzyEqualArrayOrSlice2(va, b)
 	}
 	return false
 }
 
 func deInterface(a reflect.Value) reflect.Value {
-	switch va := a.(type) {
-	case *reflect.InterfaceValue:
-		return va.Elem()
+	if a.Kind() == reflect.Interface {
+		return a.Elem()
 	}
 	return a
 }
 
-func fuzzyEqualArrayOrSlice2(a reflect.ArrayOrSliceValue, b reflect.ArrayOrSliceValue) bool {
+func fuzzyEqualArrayOrSlice2(a reflect.Value, b reflect.Value) bool {
 	if a.Len() != b.Len() {
 		return false
 	}
 
 	for i := 0; i < a.Len(); i++ {
-		ea := deInterface(a.Elem(i))
-		eb := deInterface(b.Elem(i))
+		ea := deInterface(a.Index(i))
+		eb := deInterface(b.Index(i))
 		if !fuzzyEqualValue(ea, eb) {
 			return false
 		}
@@ -104,31 +104,29 @@ func fuzzyEqualArrayOrSlice2(a reflect.ArrayOrSliceValue, b reflect.ArrayOrSlice
 	return true
 }
 
-func fuzzyEqualMap(a *reflect.MapValue, b *reflect.MapValue) bool {
-	key := a.Type().(*reflect.MapType).Key()
-	if _, ok := key.(*reflect.StringType); !ok {
+func fuzzyEqualMap(a reflect.Value, b reflect.Value) bool {
+	if a.Type().Key().Kind() != reflect.String {
 		return false
 	}
-	key = b.Type().(*reflect.MapType).Key()
-	if _, ok := key.(*reflect.StringType); !ok {
+	if b.Type().Key().Kind() != reflect.String {
 		return false
 	}
 
-	aKeys, bKeys := a.Keys(), b.Keys()
+	aKeys, bKeys := a.MapKeys(), b.MapKeys()
 
 	if len(aKeys) != len(bKeys) {
 		return false
 	}
 
 	for _, k := range aKeys {
-		if !fuzzyEqualValue(a.Elem(k), b.Elem(k)) {
+		if !fuzzyEqualValue(a.MapIndex(k), b.MapIndex(k)) {
 			return false
 		}
 	}
 	return true
 }
 
-func fuzzyEqualStruct(a *reflect.StructValue, b *reflect.StructValue) bool {
+func fuzzyEqualStruct(a reflect.Value, b reflect.Value) bool {
 	numA, numB := a.NumField(), b.NumField()
 	if numA != numB {
 		return false
@@ -143,53 +141,41 @@ func fuzzyEqualStruct(a *reflect.StructValue, b *reflect.StructValue) bool {
 }
 
 func fuzzyEqualValue(a, b reflect.Value) bool {
-	switch va := a.(type) {
-	case *reflect.StringValue:
-		switch vb := b.(type) {
-		case *reflect.StringValue:
-			return va.Get() == vb.Get()
-		default:
-			return false
+	switch a.Kind() {
+	case reflect.String:
+		if b.Kind() == reflect.String {
+			return a.String() == b.String()
 		}
-	case *reflect.IntValue:
-		return fuzzyEqualInt64(va.Get(), b)
-	case *reflect.ArrayValue:
-		return fuzzyEqualArrayOrSlice(va, b)
-	case *reflect.SliceValue:
-		return fuzzyEqualArrayOrSlice(va, b)
-	case *reflect.MapValue:
-		switch vb := b.(type) {
-		case *reflect.MapValue:
-			return fuzzyEqualMap(va, vb)
-		default:
-			return false
+		return false
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fuzzyEqualInt64(a.Int(), b)
+	case reflect.Array, reflect.Slice:
+		return fuzzyEqualArrayOrSlice(a, b)
+	case reflect.Map:
+		if b.Kind() == reflect.Map {
+			return fuzzyEqualMap(a, b)
 		}
-	case *reflect.StructValue:
-		switch vb := b.(type) {
-		case *reflect.StructValue:
-			return fuzzyEqualStruct(va, vb)
-		default:
-			return false
+		return false
+	case reflect.Struct:
+		if b.Kind() == reflect.Struct {
+			return fuzzyEqualStruct(a, b)
 		}
-	case *reflect.InterfaceValue:
-		switch vb := b.(type) {
-		case *reflect.InterfaceValue:
-			return fuzzyEqualValue(va.Elem(), vb.Elem())
-		default:
-			return false
+		return false
+	case reflect.Interface:
+		if b.Kind() == reflect.Interface {
+			return fuzzyEqualValue(a.Elem(), b.Elem())
 		}
-	default:
 		return false
 	}
 	return false
 }
 
-func checkUnmarshal(expected string, data any) (err os.Error) {
+func checkUnmarshal(expected string, data any) (err error) {
 	if err = checkMarshal(expected, data); err != nil {
 		return
 	}
-	dataValue := reflect.NewValue(data)
-	newOne := reflect.MakeZero(dataValue.Type())
+	dataValue := reflect.ValueOf(data)
+	newOne := reflect.New(dataValue.Type()).Elem()
 	buf := bytes.NewBufferString(expected)
 	if err = UnmarshalValue(buf, newOne); err != nil {
 		return
@@ -223,22 +209,22 @@ func TestDecode(t *testing.T) {
 	}
 	for _, sv := range tests {
 		if err := check(sv.s, sv.v); err != nil {
-			t.Error(err.String())
+			t.Error(err.Error())
 		}
 	}
 }
 
 type structA struct {
-	A int    "a"
-	B string "b"
+	A int    `bencode:"a"`
+	B string `bencode:"b"`
 }
 
 func TestUnmarshal(t *testing.T) {
 	type structNested struct {
-		T string            "t"
-		Y string            "y"
-		Q string            "q"
-		A map[string]string "a"
+		T string            `bencode:"t"`
+		Y string            `bencode:"y"`
+		Q string            `bencode:"q"`
+		A map[string]string `bencode:"a"`
 	}
 	innerDict := map[string]string{"id": "abcdefghij0123456789"}
 	nestedDictionary := structNested{"aa", "q", "ping", innerDict}
@@ -262,7 +248,64 @@ func TestUnmarshal(t *testing.T) {
 	}
 	for _, sv := range tests {
 		if err := checkUnmarshal(sv.s, sv.v); err != nil {
-			t.Error(err.String())
+			t.Error(err.Error())
+		}
+	}
+}
+
+func TestMarshalPointer(t *testing.T) {
+	type structPtr struct {
+		A *structA `bencode:"a"`
+		N *structA `bencode:"n"`
+	}
+	tests := []SVPair{
+		SVPair{"d1:ai10e1:b3:fooe", &structA{10, "foo"}},
+		SVPair{"d1:ad1:ai1e1:b1:xee", structPtr{A: &structA{1, "x"}}},
+	}
+	for _, sv := range tests {
+		if err := checkMarshal(sv.s, sv.v); err != nil {
+			t.Error(err.Error())
 		}
 	}
 }
+
+func TestStrict(t *testing.T) {
+	bad := []string{"i03e", "i-0e", "i00e", "ie", "03:abc", "d1:b0:1:a0:e", "d1:a0:1:a0:e", "ld1:bi1e1:ai2eee"}
+	for _, s := range bad {
+		if _, err := DecodeStrict(bytes.NewBufferString(s)); err == nil {
+			t.Error("Strict decoding accepted " + s)
+		}
+	}
+	good := []string{"i0e", "i-3e", "i30e", "0:", "3:abc", "de", "d1:a0:1:b0:e", "l3:abci0ee"}
+	for _, s := range good {
+		if _, err := DecodeStrict(bytes.NewBufferString(s)); err != nil {
+			t.Error(err.Error())
+		}
+	}
+	if _, err := Decode(bytes.NewBufferString("i03e")); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	d := NewDecoder(bytes.NewBufferString("i1e3:abcd1:ai10e1:b3:fooe"))
+	if v, err := d.Decode(); err != nil {
+		t.Error(err.Error())
+	} else if err = checkFuzzyEqual(v, 1); err != nil {
+		t.Error(err.Error())
+	}
+	if v, err := d.Decode(); err != nil {
+		t.Error(err.Error())
+	} else if err = checkFuzzyEqual(v, "abc"); err != nil {
+		t.Error(err.Error())
+	}
+	var a structA
+	if err := d.Unmarshal(&a); err != nil {
+		t.Error(err.Error())
+	} else if a.A != 10 || a.B != "foo" {
+		t.Error("Unmarshal from the decoder gave the wrong struct")
+	}
+	if _, err := d.Decode(); err == nil {
+		t.Error("Decoding past the end of the stream")
+	}
+}
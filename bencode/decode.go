@@ -8,9 +8,7 @@
 package bencode
 
 import (
-	"container/vector"
 	"io"
-	"os"
 )
 
 // Decode a bencode stream
@@ -23,7 +21,7 @@ import (
 //
 // If Decode encounters a syntax error, it returns with err set to an
 // instance of ParseError.  See ParseError documentation for details.
-func Decode(r io.Reader) (data interface{}, err os.Error) {
+func Decode(r io.Reader) (data interface{}, err error) {
 	jb := newDecoder(nil, nil)
 	err = Parse(r, jb)
 	if err == nil {
@@ -35,7 +33,7 @@ func Decode(r io.Reader) (data interface{}, err os.Error) {
 type decoder struct {
 	// A value being constructed.
 	value interface{}
-	// Container entity to flush into.  Can be either vector.Vector or
+	// Container entity to flush into.  Can be either *[]interface{} or
 	// map[string]interface{}.
 	container interface{}
 	// The index into the container interface.  Either int or string.
@@ -58,18 +56,18 @@ func (j *decoder) Bool(b bool) { j.value = b }
 
 func (j *decoder) Null() { j.value = nil }
 
-func (j *decoder) Array() { j.value = new(vector.Vector) }
+func (j *decoder) Array() { j.value = new([]interface{}) }
 
 func (j *decoder) Map() { j.value = make(map[string]interface{}) }
 
 func (j *decoder) Elem(i int) Builder {
-	v, ok := j.value.(*vector.Vector)
+	v, ok := j.value.(*[]interface{})
 	if !ok {
-		v = new(vector.Vector)
+		v = new([]interface{})
 		j.value = v
 	}
-	if v.Len() <= i {
-		v.Resize(i+1, (i+1)*2)
+	for len(*v) <= i {
+		*v = append(*v, nil)
 	}
 	return newDecoder(v, i)
 }
@@ -85,9 +83,9 @@ func (j *decoder) Key(s string) Builder {
 
 func (j *decoder) Flush() {
 	switch c := j.container.(type) {
-	case *vector.Vector:
+	case *[]interface{}:
 		index := j.index.(int)
-		c.Set(index, j.Copy())
+		(*c)[index] = j.Copy()
 	case map[string]interface{}:
 		index := j.index.(string)
 		c[index] = j.Copy()
@@ -97,8 +95,8 @@ func (j *decoder) Flush() {
 // Get the value built by this builder.
 func (j *decoder) Copy() interface{} {
 	switch v := j.value.(type) {
-	case *vector.Vector:
-		return v.Copy()
+	case *[]interface{}:
+		return append([]interface{}(nil), *v...)
 	}
 	return j.value
 }
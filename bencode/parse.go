@@ -11,14 +11,14 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
+	"errors"
 )
 
 type Reader interface {
 	io.Reader
-	ReadByte() (c byte, err os.Error)
-	UnreadByte() os.Error
+	ReadByte() (c byte, err error)
+	UnreadByte() error
 }
 
 // Parser
@@ -58,7 +58,7 @@ type Builder interface {
 	Flush()
 }
 
-func collectInt(r Reader, delim byte) (buf []byte, err os.Error) {
+func collectInt(r Reader, delim byte) (buf []byte, err error) {
 	for {
 		var c byte
 		c, err = r.ReadByte()
@@ -69,30 +69,50 @@ func collectInt(r Reader, delim byte) (buf []byte, err os.Error) {
 			return
 		}
 		if !(c == '-' || (c >= '0' && c <= '9')) {
-			err = os.NewError("expected digit")
+			err = errors.New("expected digit")
 			return
 		}
 		buf = append(buf, c)
 	}
-	return
 }
 
-func decodeInt64(r Reader, delim byte) (data int64, err os.Error) {
+// In strict mode the integers must be canonical: no leading zeros,
+// no -0 and no + sign
+func canonicalInt(buf []byte) error {
+	digits := buf
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if len(digits) > 0 && digits[0] == '0' {
+			return errors.New("non-canonical integer " + string(buf))
+		}
+	}
+	if len(digits) == 0 || (digits[0] == '0' && len(digits) > 1) {
+		return errors.New("non-canonical integer " + string(buf))
+	}
+	return nil
+}
+
+func decodeInt64(r Reader, delim byte, strict bool) (data int64, err error) {
 	buf, err := collectInt(r, delim)
 	if err != nil {
 		return
 	}
-	data, err = strconv.Atoi64(string(buf))
+	if strict {
+		if err = canonicalInt(buf); err != nil {
+			return
+		}
+	}
+	data, err = strconv.ParseInt(string(buf), 10, 64)
 	return
 }
 
-func decodeString(r Reader) (data string, err os.Error) {
-	length, err := decodeInt64(r, ':')
+func decodeString(r Reader, strict bool) (data string, err error) {
+	length, err := decodeInt64(r, ':', strict)
 	if err != nil {
 		return
 	}
 	if length < 0 {
-		err = os.NewError("Bad string length")
+		err = errors.New("Bad string length")
 		return
 	}
 	var buf = make([]byte, length)
@@ -104,7 +124,10 @@ func decodeString(r Reader) (data string, err os.Error) {
 	return
 }
 
-func parse(r Reader, build Builder) (err os.Error) {
+// In strict mode the encodings that are valid but not canonical are
+// rejected, so the data is the same when encoded again: integers
+// with leading zeros, and dictionaries with unsorted or repeated keys
+func parse(r Reader, build Builder, strict bool) (err error) {
 	c, err := r.ReadByte()
 	if err != nil {
 		goto exit
@@ -114,11 +137,11 @@ func parse(r Reader, build Builder) (err os.Error) {
 		// String
 		err = r.UnreadByte()
 		if err != nil {
-			err = os.NewError("Error reading string: " + err.String())
+			err = errors.New("Error reading string: " + err.Error())
 			goto exit
 		}
 		var str string
-		str, err = decodeString(r)
+		str, err = decodeString(r, strict)
 		if err != nil {
 			goto exit
 		}
@@ -128,6 +151,7 @@ func parse(r Reader, build Builder) (err os.Error) {
 		// dictionary
 
 		build.Map()
+		first, last := true, ""
 		for {
 			c, err = r.ReadByte()
 			if err != nil {
@@ -138,16 +162,20 @@ func parse(r Reader, build Builder) (err os.Error) {
 			}
 			err = r.UnreadByte()
 			if err != nil {
-				err = os.NewError("Error reading dictionary: " + err.String())
+				err = errors.New("Error reading dictionary: " + err.Error())
 				goto exit
 			}
 			var key string
-			key, err = decodeString(r)
+			key, err = decodeString(r, strict)
 			if err != nil {
 				goto exit
 			}
-			// TODO: in pendantic mode, check for keys in ascending order.
-			err = parse(r, build.Key(key))
+			if strict && !first && key <= last {
+				err = errors.New("dictionary keys not sorted: " + key)
+				goto exit
+			}
+			first, last = false, key
+			err = parse(r, build.Key(key), strict)
 			if err != nil {
 				goto exit
 			}
@@ -163,13 +191,18 @@ func parse(r Reader, build Builder) (err os.Error) {
 		var i int64
 		var i2 uint64
 		str = string(buf)
+		if strict {
+			if err = canonicalInt(buf); err != nil {
+				goto exit
+			}
+		}
 		// If the number is exactly an integer, use that.
-		if i, err = strconv.Atoi64(str); err == nil {
+		if i, err = strconv.ParseInt(str, 10, 64); err == nil {
 			build.Int64(i)
-		} else if i2, err = strconv.Atoui64(str); err == nil {
+		} else if i2, err = strconv.ParseUint(str, 10, 64); err == nil {
 			build.Uint64(i2)
 		} else {
-			err = os.NewError("Bad integer")
+			err = errors.New("Bad integer")
 		}
 
 	case c == 'l':
@@ -186,17 +219,17 @@ func parse(r Reader, build Builder) (err os.Error) {
 			}
 			err = r.UnreadByte()
 			if err != nil {
-				err = os.NewError("Error reading array: " + err.String())
+				err = errors.New("Error reading array: " + err.Error())
 				goto exit
 			}
-			err = parse(r, build.Elem(n))
+			err = parse(r, build.Elem(n), strict)
 			if err != nil {
 				goto exit
 			}
 			n++
 		}
 	default:
-		err = os.NewError(fmt.Sprintf("Unexpected character: '%v'", c))
+		err = errors.New(fmt.Sprintf("Unexpected character: '%v'", c))
 	}
 exit:
 	build.Flush()
@@ -205,7 +238,20 @@ exit:
 
 // Parse parses the bencode stream and makes calls to
 // the builder to construct a parsed representation.
-func Parse(r io.Reader, builder Builder) (err os.Error) {
-	rr := bufio.NewReader(r)
-	return parse(rr, builder)
+func Parse(r io.Reader, builder Builder) (err error) {
+	return parse(newReader(r), builder, false)
+}
+
+// ParseStrict is Parse rejecting the non-canonical encodings.
+func ParseStrict(r io.Reader, builder Builder) (err error) {
+	return parse(newReader(r), builder, true)
+}
+
+// Readers that can unread are used directly, so nothing past the
+// value is consumed
+func newReader(r io.Reader) Reader {
+	if rr, ok := r.(Reader); ok {
+		return rr
+	}
+	return bufio.NewReader(r)
 }
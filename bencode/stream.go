@@ -0,0 +1,54 @@
+// Streaming decoder, reading one bencoded value after another from
+// the same stream, in strict mode if the data must be canonical (as
+// the info dictionaries, whose hash is the one of the encoding).
+
+package bencode
+
+import (
+	"errors"
+	"io"
+	"reflect"
+)
+
+// A Decoder reads successive bencoded values from a stream.
+type Decoder struct {
+	r      Reader
+	Strict bool // Reject the non-canonical encodings
+}
+
+// NewDecoder returns a Decoder reading from r, if r can unread bytes
+// nothing past each value is read.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: newReader(r)}
+}
+
+// Decode reads the next value, with the types of the Decode function.
+func (d *Decoder) Decode() (data interface{}, err error) {
+	jb := newDecoder(nil, nil)
+	if err = parse(d.r, jb, d.Strict); err == nil {
+		data = jb.Copy()
+	}
+	return
+}
+
+// Unmarshal reads the next value into val, as the Unmarshal function.
+func (d *Decoder) Unmarshal(val interface{}) (err error) {
+	if reflect.TypeOf(val).Kind() != reflect.Ptr {
+		return errors.New("Attempt to unmarshal into a non-pointer")
+	}
+	return parse(d.r, newStructBuilder(reflect.ValueOf(val)), d.Strict)
+}
+
+// DecodeStrict is Decode rejecting the non-canonical encodings.
+func DecodeStrict(r io.Reader) (data interface{}, err error) {
+	d := NewDecoder(r)
+	d.Strict = true
+	return d.Decode()
+}
+
+// UnmarshalStrict is Unmarshal rejecting the non-canonical encodings.
+func UnmarshalStrict(r io.Reader, val interface{}) (err error) {
+	d := NewDecoder(r)
+	d.Strict = true
+	return d.Unmarshal(val)
+}
@@ -0,0 +1,259 @@
+package bit_field
+
+import(
+	"sync"
+	"encoding/binary"
+	"errors"
+	)
+
+// As defined by the bittorrent protocol, this bitset is big-endian, such that
+// the high bit of the first byte is block 0. The bits are kept in 64 bit words,
+// with bit 0 in the high bit of the first word, so the operations work on 64
+// pieces at a time.
+
+type Bitfield struct {
+	w        []uint64
+	n        int64
+	done     int64
+	endMask  uint64 // Which bits of the last word are valid
+	mutex *sync.RWMutex
+}
+
+// Number of bits set in x
+
+func popcount(x uint64) int64 {
+	x = x - ((x >> 1) & 0x5555555555555555)
+	x = (x & 0x3333333333333333) + ((x >> 2) & 0x3333333333333333)
+	x = (x + (x >> 4)) & 0x0f0f0f0f0f0f0f0f
+	return int64((x * 0x0101010101010101) >> 56)
+}
+
+// Position of the highest bit set in x, counting from the high bit,
+// x must not be 0
+
+func firstBit(x uint64) (n int64) {
+	for shift := uint(32); shift > 0; shift >>= 1 {
+		if x>>(64-shift) == 0 {
+			n += int64(shift)
+			x <<= shift
+		}
+	}
+	return
+}
+
+func mask(index int64) uint64 {
+	return 1 << (63 - uint(index&63))
+}
+
+func NewBitfield(n int64) (bitfield *Bitfield) {
+	endMask := ^uint64(0)
+	if n&63 != 0 {
+		endMask = ^(endMask >> uint(n&63))
+	}
+	bitfield = &Bitfield{make([]uint64, (n+63)>>6), n, 0, endMask, new(sync.RWMutex)}
+	return
+}
+
+// Creates a new bitset from a given byte stream.
+
+func NewBitfieldFromBytes(n int64, data []byte) (bitfield *Bitfield, err error) {
+	bitfield = NewBitfield(n)
+	if int64(len(data)) != (n+7)>>3 {
+		return bitfield, errors.New("Invalid length of bitfield")
+	}
+	buf := make([]byte, len(bitfield.w)*8)
+	copy(buf, data)
+	for i := range(bitfield.w) {
+		bitfield.w[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	if last := len(bitfield.w)-1; last >= 0 && bitfield.w[last]&^bitfield.endMask != 0 {
+		return bitfield, errors.New("Invalid bitfield")
+	}
+	for _, w := range(bitfield.w) {
+		bitfield.done += popcount(w)
+	}
+	return
+}
+
+func (b *Bitfield) Set(index int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if index < 0 || index >= b.n {
+		panic("Index out of range.")
+	}
+	if b.w[index>>6]&mask(index) == 0 {
+		b.w[index>>6] |= mask(index)
+		b.done++
+	}
+	return
+}
+
+func (b *Bitfield) Clear(index int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if index < 0 || index >= b.n {
+		panic("Index out of range.")
+	}
+	if b.w[index>>6]&mask(index) != 0 {
+		b.w[index>>6] &^= mask(index)
+		b.done--
+	}
+	return
+}
+
+func (b *Bitfield) IsSet(index int64) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if index < 0 || index >= b.n {
+		panic("Index out of range.")
+	}
+	return b.w[index>>6]&mask(index) != 0
+}
+
+func (b *Bitfield) Bytes() []byte {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	buf := make([]byte, len(b.w)*8)
+	for i, w := range(b.w) {
+		binary.BigEndian.PutUint64(buf[i*8:], w)
+	}
+	return buf[0:(b.n+7)>>3]
+}
+
+func (b *Bitfield) Len() int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.n
+}
+
+// Copy of the words, to work with two bitfields without holding
+// both locks
+
+func (b *Bitfield) words() []uint64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	w := make([]uint64, len(b.w))
+	copy(w, b.w)
+	return w
+}
+
+// Whether p has pieces that we don't have
+
+func (b *Bitfield) HasMorePieces(p *Bitfield) bool {
+	pw := p.words()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for i := 0; i < len(b.w) && i < len(pw); i++ {
+		if pw[i] &^ b.w[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// First piece from start that p has and we don't, -1 if there's none
+
+func (b *Bitfield) FindNextPiece(start int64, p *Bitfield) int64 {
+	pw := p.words()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return next(start, b.n, func(i int) uint64 {
+		if i >= len(pw) {
+			return 0
+		}
+		return pw[i] &^ b.w[i]
+	})
+}
+
+// First bit set in the words returned by word from start, -1 if there's none
+
+func next(start, n int64, word func(i int) uint64) int64 {
+	if start < 0 {
+		start = 0
+	}
+	for i := start>>6; i < (n+63)>>6; i++ {
+		w := word(int(i))
+		if i == start>>6 {
+			// Ignore the bits before start
+			w &= ^uint64(0) >> uint(start&63)
+		}
+		if w != 0 {
+			if index := i<<6 + firstBit(w); index < n {
+				return index
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// First piece from start that is set, -1 if there's none
+
+func (b *Bitfield) NextSet(start int64) int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return next(start, b.n, func(i int) uint64 { return b.w[i] })
+}
+
+// First piece from start that is not set, -1 if there's none
+
+func (b *Bitfield) NextUnset(start int64) int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return next(start, b.n, func(i int) uint64 { return ^b.w[i] })
+}
+
+// Call f with the index of every bit set, in order
+
+func (b *Bitfield) Each(f func(index int64)) {
+	for i := b.NextSet(0); i != -1; i = b.NextSet(i+1) {
+		f(i)
+	}
+}
+
+// Pieces of both bitfields
+
+func (b *Bitfield) And(p *Bitfield) *Bitfield {
+	return b.combine(p, func(x, y uint64) uint64 { return x & y })
+}
+
+// Pieces of b that are not in p
+
+func (b *Bitfield) AndNot(p *Bitfield) *Bitfield {
+	return b.combine(p, func(x, y uint64) uint64 { return x &^ y })
+}
+
+func (b *Bitfield) combine(p *Bitfield, op func(x, y uint64) uint64) (r *Bitfield) {
+	pw := p.words()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	r = NewBitfield(b.n)
+	for i, w := range(b.w) {
+		var y uint64
+		if i < len(pw) {
+			y = pw[i]
+		}
+		r.w[i] = op(w, y)
+		r.done += popcount(r.w[i])
+	}
+	if last := len(r.w)-1; last >= 0 {
+		r.done -= popcount(r.w[last] &^ r.endMask)
+		r.w[last] &= r.endMask
+	}
+	return
+}
+
+func (b *Bitfield) Count() int64 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.done
+}
+
+func (b *Bitfield) Completed() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.done == b.n {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package bit_field
+
+import "testing"
+
+type bitfieldTest struct {
+	length int64
+	set []int64
+	result []byte
+}
+
+var bitfieldTests = []bitfieldTest{
+	bitfieldTest{8, []int64{0, 7}, []byte{129}},
+	bitfieldTest{8, []int64{1, 5}, []byte{68}},
+	bitfieldTest{16, []int64{0, 8}, []byte{128, 128}},
+}
+
+
+func TestBitfield(t *testing.T) {
+	for _, bt := range bitfieldTests {
+		b := NewBitfield(bt.length)
+		for _, i := range bt.set {
+			b.Set(i)
+		}
+		for i := int64(0); i < bt.length; i++ {
+			if isInArray(bt.set, i) && !b.IsSet(i) {
+				t.Errorf("Bitfield[%d] = false, expected true", i)
+			} else if !isInArray(bt.set, i) && b.IsSet(i) {
+				t.Errorf("Bitfield[%d] = true, expected false", i)
+			}
+		}
+		bytes := b.Bytes()
+		for i, expected_bytes := range bt.result {
+			if expected_bytes != bytes[i] {
+				t.Errorf("Got %q, expected %q for position %d", b.Bytes(), bt.result, i)
+			}
+		}
+	}
+}
+
+func TestBitfieldFromBytes(t *testing.T) {
+	for _, bt := range bitfieldTests {
+		b, err := NewBitfieldFromBytes(bt.length, bt.result)
+		if err != nil {
+			t.Errorf("Unable to initialize bitfield from given bytes: %q", bt.result);
+		}
+		for i := int64(0); i < bt.length; i++ {
+			if isInArray(bt.set, i) && !b.IsSet(i) {
+				t.Errorf("Bitfield[%d] = false, expected true", i)
+			} else if !isInArray(bt.set, i) && b.IsSet(i) {
+				t.Errorf("Bitfield[%d] = true, expected false", i)
+			}
+		}
+		bytes := b.Bytes()
+		for i, expected_bytes := range bt.result {
+			if expected_bytes != bytes[i] {
+				t.Errorf("Got %q, expected %q for position %d", b.Bytes(), bt.result, i)
+			}
+		}
+	}
+}
+
+func isInArray(array []int64, value int64) bool {
+	for _, i := range array {
+		if i == value {
+			return true
+		}
+	}
+	return false
+}
+
+type nextTest struct {
+	length int64
+	set []int64
+	start int64
+	nextSet, nextUnset int64
+}
+
+var nextTests = []nextTest{
+	nextTest{8, []int64{0, 7}, 1, 7, 1},
+	nextTest{70, []int64{0, 1, 2, 69}, 0, 0, 3},
+	nextTest{70, []int64{3, 65}, 4, 65, 4},
+	nextTest{64, []int64{}, 10, -1, 10},
+	nextTest{65, []int64{64}, 1, 64, 1},
+}
+
+func TestNext(t *testing.T) {
+	for _, nt := range nextTests {
+		b := NewBitfield(nt.length)
+		for _, i := range nt.set {
+			b.Set(i)
+		}
+		if b.Count() != int64(len(nt.set)) {
+			t.Errorf("Count() = %d, expected %d", b.Count(), len(nt.set))
+		}
+		if next := b.NextSet(nt.start); next != nt.nextSet {
+			t.Errorf("NextSet(%d) = %d, expected %d", nt.start, next, nt.nextSet)
+		}
+		if next := b.NextUnset(nt.start); next != nt.nextUnset {
+			t.Errorf("NextUnset(%d) = %d, expected %d", nt.start, next, nt.nextUnset)
+		}
+	}
+	// Every piece set
+	b := NewBitfield(100)
+	for i := int64(0); i < 100; i++ {
+		b.Set(i)
+	}
+	if b.NextUnset(0) != -1 || !b.Completed() {
+		t.Errorf("NextUnset of a complete bitfield = %d, expected -1", b.NextUnset(0))
+	}
+}
+
+func TestCombine(t *testing.T) {
+	a, b := NewBitfield(130), NewBitfield(130)
+	for i := int64(0); i < 130; i += 2 {
+		a.Set(i)
+	}
+	for i := int64(0); i < 130; i += 3 {
+		b.Set(i)
+	}
+	and, andNot := a.And(b), a.AndNot(b)
+	for i := int64(0); i < 130; i++ {
+		if and.IsSet(i) != (i%2 == 0 && i%3 == 0) {
+			t.Errorf("And[%d] = %v", i, and.IsSet(i))
+		}
+		if andNot.IsSet(i) != (i%2 == 0 && i%3 != 0) {
+			t.Errorf("AndNot[%d] = %v", i, andNot.IsSet(i))
+		}
+	}
+	if and.Count() != 22 || andNot.Count() != 43 {
+		t.Errorf("Count() = %d and %d, expected 22 and 43", and.Count(), andNot.Count())
+	}
+	if !a.HasMorePieces(b) {
+		t.Errorf("HasMorePieces = false, expected true")
+	}
+	if next := a.FindNextPiece(4, b); next != 9 {
+		t.Errorf("FindNextPiece(4) = %d, expected 9", next)
+	}
+	if a.HasMorePieces(and) {
+		t.Errorf("HasMorePieces = true, expected false")
+	}
+}
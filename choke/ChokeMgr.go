@@ -2,21 +2,20 @@ package choke
 
 import(
 	"sort"
-	"log"
-	"os"
+	"sync"
 	"time"
-	"rand"
 	"wgo/stats"
 	"wgo/peers"
+	"wgo/logger"
 	)
 	
 const(
 	CHOKE_ROUND = 10
 	OPTIMISTIC_UNCHOKE = 30
 	UPLOADING_PEERS = 5
-	SNUBBED_PERIOD = 60
-	NS_PER_S = 1000000000
 )
+
+var chokeLog = logger.New("choke")
 	
 type PeerChoke struct {
 	am_choking, am_interested, peer_choking, peer_interested, snubbed bool
@@ -28,21 +27,42 @@ type PeerChoke struct {
 type ChokeMgr struct {
 	stats stats.Stats
 	peerMgr peers.PeerMgr
-	optimistic_unchoke int
+	optimistic *peers.Peer // Peer holding the optimistic unchoke slot
+	mutex *sync.Mutex
+	slots int // Unchoked peers, with the optimistic one
+	quit chan bool
 }
 
 type Speed []*PeerChoke
 
-func NewChokeMgr(st stats.Stats, pm peers.PeerMgr) (c *ChokeMgr, err os.Error) {
+func NewChokeMgr(st stats.Stats, pm peers.PeerMgr) (c *ChokeMgr, err error) {
 	c = new(ChokeMgr)
 	c.stats = st
 	c.peerMgr = pm
+	c.mutex = new(sync.Mutex)
+	c.slots = UPLOADING_PEERS
+	c.quit = make(chan bool)
 	go c.Run()
 	return
 }
 
+// Number of peers unchoked at once, one of them is the optimistic
+// unchoke. Used from the next choking round.
+
+func (c *ChokeMgr) SetUploadSlots(slots int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slots = slots
+}
+
+func (c *ChokeMgr) Stop() {
+	close(c.quit)
+}
+
+// Peers are sorted from the fastest to the slowest
+
 func (l Speed) Len() int { return len(l) }
-func (l Speed) Less(i, j int) bool { return l[i].speed < l[j].speed }
+func (l Speed) Less(i, j int) bool { return l[i].speed > l[j].speed }
 func (l Speed) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
 
 func Sort(list Speed) {
@@ -62,23 +82,13 @@ func SelectInterested(peers []*PeerChoke) (interested []*PeerChoke) {
 func SelectUninterested(peers []*PeerChoke) (uninterested []*PeerChoke) {
 	uninterested = make([]*PeerChoke, 0, 10)
 	for _, peer := range(peers) {
-		if !peer.peer_interested {
+		if !peer.peer_interested && !peer.snubbed {
 			uninterested = append(uninterested, peer)
 		}
 	}
 	return
 }
 
-func SelectChoked(peers []*PeerChoke) (choked []*PeerChoke) {
-	choked = make([]*PeerChoke, 0, 10)
-	for _, peer := range(peers) {
-		if !peer.unchoke && peer.am_choking  {
-			choked = append(choked, peer)
-		}
-	}
-	return
-}
-
 func apply(peers []*PeerChoke) {
 	// Apply changes to peers
 	num_unchoked := 0
@@ -95,84 +105,66 @@ func apply(peers []*PeerChoke) {
 			num_choked++
 		}
 	}
-	//log.Println("ChokeMgr -> Unchoked", num_unchoked, "peers")
-	//log.Println("ChokeMgr -> Choked", num_choked, "peers")
+	chokeLog.Debug("Choke round applied", "unchoked", num_unchoked, "choked", num_choked)
 }
 
 func (c *ChokeMgr) RequestPeers() []*PeerChoke {
-	// Prepare peer array
-	lastPiece := int64(0)
 	// Request info
-	//log.Println("ChokeMgr -> Receiving from channels")
 	//c.inStats <- inStats
 	stats := c.stats.GetStats()
 	list := c.peerMgr.GetPeers()
-	//log.Println("ChokeMgr -> Finished receiving")
 	// Prepare peer array
 	peers := make([]*PeerChoke, 0, 10)
 	for addr, peer := range(list) {
-		//log.Println("ChokeMgr -> Checking if completed")
 		if peer.Connected() && !peer.Completed() {
-			//log.Println("ChokeMgr -> Not completed, adding to list")
 			p := new(PeerChoke)
-			p.am_choking, p.am_interested, p.peer_choking, p.peer_interested, lastPiece = peer.Am_choking(), peer.Am_interested(), peer.Peer_choking(), peer.Peer_interested(), peer.LastPiece()
-			now := time.Seconds()
-			if ((now - lastPiece) > SNUBBED_PERIOD) && p.am_interested {
-				p.snubbed = true
-			}
+			p.am_choking, p.am_interested, p.peer_choking, p.peer_interested = peer.Am_choking(), peer.Am_interested(), peer.Peer_choking(), peer.Peer_interested()
+			// Snubbed peers are only unchoked by the optimistic unchoke
+			p.snubbed = peer.Snubbed()
 			p.peer = peer
 			if stat, ok := stats[addr]; ok {
 				p.speed = stat.Speed
 			}
 			peers = append(peers, p)
 		}
-		//log.Println("ChokeMgr -> Finished processing peer")
 	}
-	//log.Println("ChokeMgr -> Returning list with len:", len(peers))
 	return peers
 }
 
+// Tit-for-tat: unchoke the interested peers that give us the best
+// download rate (or that take the best upload rate when seeding), and
+// choke the rest of them.
+
 func (c *ChokeMgr) Choking(peers []*PeerChoke) {
-	//num_unchoked := 0
-	c.optimistic_unchoke = (c.optimistic_unchoke+CHOKE_ROUND)%OPTIMISTIC_UNCHOKE
-	speed := int64(0)
-	// Get interested peers and sort by upload
-	//log.Println("ChokeMgr -> Selecting interesting")
-	//log.Println("ChokeMgr -> Finished selecting")
+	// Slowest unchoked downloader, -1 if there's no unchoked downloader
+	speed := int64(-1)
+	// Reserve 1 slot for optimistic unchoking
+	c.mutex.Lock()
+	up_limit := c.slots - 1
+	c.mutex.Unlock()
+	// The optimistic unchoke is kept until the next optimistic round
+	for _, peer := range(peers) {
+		if c.optimistic != nil && peer.peer == c.optimistic {
+			peer.unchoke = true
+		}
+	}
+	// UnChoke peers starting by the one that has a higher rate and is interested
 	if interested := SelectInterested(peers); len(interested) > 0 {
-		//log.Println("ChokeMgr -> Sorting by upload")
 		Sort(interested)
-		//log.Println("ChokeMgr -> Finished sorting")
-		// UnChoke peers starting by the one that has a higher upload speed an is interested
-		// Reserve 1 slot for optimisting unchoking
-		up_limit := UPLOADING_PEERS
-		if c.optimistic_unchoke == 0 {
-			up_limit--
-		}
 		for i := 0; i < len(interested) && i < up_limit; i++ {
 			interested[i].unchoke = true
 			speed = interested[i].speed
 		}
 	}
-	// Unchoke peers which have a better upload rate than downloaders, but are not interested
-	// Leave 1 slot for optimistic unchoking
-	//log.Println("ChokeMgr -> Sorting by upload")
-	if uninterested := SelectUninterested(peers); len(uninterested) > 0 {
+	// Unchoke peers which have a better rate than the downloaders, but are not interested,
+	// so they can take the place of a downloader as soon as they become interested
+	if uninterested := SelectUninterested(peers); len(uninterested) > 0 && speed >= 0 {
 		Sort(uninterested)
-		for i := 0; i < len(uninterested) && speed <= uninterested[i].speed; i++ {
+		for i := 0; i < len(uninterested) && speed < uninterested[i].speed; i++ {
 			uninterested[i].unchoke = true
 		}
 	}
-	if c.optimistic_unchoke == 0 {
-		// Select 1 peer and unchoke it
-		for choked := SelectChoked(peers); len(choked) > 0; choked = SelectChoked(peers) {
-			n := rand.Intn(len(choked))
-			choked[n].unchoke = true
-			if choked[n].peer_interested {
-				break
-			}
-		}
-	}
+	// Every peer that has not been selected is choked
 	apply(peers)
 	return
 }
@@ -188,22 +180,39 @@ func (c *ChokeMgr) Stats(peers []*PeerChoke) {
 			num_unchoked++
 		}
 	}
-	log.Println("ChokeMgr -> Choked peers:", num_choked, "Unchoked peers:", num_unchoked, "Total:", len(peers))
+	chokeLog.Info("Choke state", "choked", num_choked, "unchoked", num_unchoked, "total", len(peers))
+}
+
+// Rotate the optimistic unchoke slot, giving a random choked and
+// interested peer the chance to prove itself
+
+func (c *ChokeMgr) OptimisticUnchoke() {
+	if peer := c.peerMgr.SelectOptimistic(); peer != nil {
+		c.optimistic = peer
+	} else if c.optimistic != nil && !c.optimistic.Connected() {
+		c.optimistic = nil
+	}
 }
 
 func (c *ChokeMgr) Run() {
-	choking := time.Tick(CHOKE_ROUND*NS_PER_S)
+	choking := time.NewTicker(CHOKE_ROUND*time.Second)
+	optimistic := time.NewTicker(OPTIMISTIC_UNCHOKE*time.Second)
 	for {
 		select {
-			case <- choking:
-				//log.Println("ChokeMgr -> Choke round")
+			case <- c.quit:
+				choking.Stop()
+				optimistic.Stop()
+				return
+			case <- choking.C:
 				if peers := c.RequestPeers(); len(peers) > 0 {
-					//log.Println("ChokeMgr -> Starting choke")
 					c.Choking(peers)
 					//c.Stats(peers)
-					//log.Println("ChokeMgr -> Finished choke")
 				}
-				//log.Println("ChokeMgr -> Finished choke round")
+			case <- optimistic.C:
+				c.OptimisticUnchoke()
+				if peers := c.RequestPeers(); len(peers) > 0 {
+					c.Choking(peers)
+				}
 		}
 	}
 }
@@ -0,0 +1,121 @@
+// Events of the session (a torrent added or finished, a piece checked,
+// a peer connected, a tracker that failed) sent to the subscribers, so
+// the programs using wgo as a library don't have to poll the stats.
+// A subscriber that doesn't keep up loses the events that don't fit in
+// its channel, the others don't wait for it.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package events
+
+import(
+	"sync"
+	"time"
+	)
+
+const(
+	TORRENT_ADDED = iota
+	TORRENT_FINISHED // Every piece downloaded
+	PIECE_COMPLETED // Passed the hash check
+	PIECE_FAILED // Failed the hash check, it's downloaded again
+	PEER_CONNECTED // Handshake finished
+	TRACKER_ERROR // An announce failed
+)
+
+var typeNames = []string{"torrent_added", "torrent_finished", "piece_completed", "piece_failed", "peer_connected", "tracker_error"}
+
+const(
+	BUFFER = 256 // Events kept in the channel of a subscriber
+)
+
+type Event struct {
+	Type int
+	Time int64 // Seconds since the epoch
+	Infohash, Name string // Of the torrent
+	Piece int64 // Of the PIECE_* events
+	Addr string // Of the peer, or the url of the tracker
+	Error string // Of TRACKER_ERROR
+}
+
+func (e *Event) TypeName() string {
+	if e.Type < 0 || e.Type >= len(typeNames) {
+		return "unknown"
+	}
+	return typeNames[e.Type]
+}
+
+type Bus struct {
+	mutex *sync.Mutex
+	subscribers map[<-chan Event]chan Event
+	dropped int64 // Events that didn't fit in a subscriber channel
+}
+
+func NewBus() *Bus {
+	return &Bus{mutex: new(sync.Mutex), subscribers: make(map[<-chan Event]chan Event)}
+}
+
+// Channel receiving the events from now on, until Unsubscribe
+
+func (b *Bus) Subscribe() <-chan Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := make(chan Event, BUFFER)
+	b.subscribers[c] = c
+	return c
+}
+
+// Stop sending events to the channel and close it
+
+func (b *Bus) Unsubscribe(c <-chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if sub, ok := b.subscribers[c]; ok {
+		delete(b.subscribers, c)
+		close(sub)
+	}
+}
+
+// Send the event to every subscriber without waiting
+
+func (b *Bus) Emit(e Event) {
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, c := range(b.subscribers) {
+		select {
+			case c <- e:
+			default:
+				b.dropped++
+		}
+	}
+}
+
+// Events lost because a subscriber channel was full
+
+func (b *Bus) Dropped() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.dropped
+}
+
+// Emits the events of a torrent, with its infohash and name. A nil
+// Emitter drops them, for the modules used without a session.
+
+type Emitter struct {
+	bus *Bus
+	infohash, name string
+}
+
+func (b *Bus) Emitter(infohash, name string) *Emitter {
+	return &Emitter{bus: b, infohash: infohash, name: name}
+}
+
+func (em *Emitter) Emit(e Event) {
+	if em == nil {
+		return
+	}
+	e.Infohash, e.Name = em.infohash, em.name
+	em.bus.Emit(e)
+}
@@ -0,0 +1,170 @@
+// Cache of the pieces read to serve the requests of the peers, shared
+// by every torrent. A peer usually requests all the blocks of a piece,
+// and a popular piece is requested by many peers, so whole pieces are
+// kept and the least recently used ones are dropped when it's full.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"sync"
+	"container/list"
+	"errors"
+	)
+
+const(
+	DEFAULT_CACHE_SIZE = 16 // MB
+)
+
+type cachedPiece struct {
+	key int64
+	data []byte
+}
+
+type pieceCache struct {
+	mutex *sync.Mutex
+	size, used int64 // In bytes
+	lru *list.List // Most recently used at the front
+	pieces map[int64]*list.Element
+	hits, misses int64
+	stores int64 // Ids given to the fileStores
+}
+
+var cache = &pieceCache{mutex: new(sync.Mutex), size: DEFAULT_CACHE_SIZE*1024*1024, lru: list.New(), pieces: make(map[int64]*list.Element)}
+
+// Memory used by the cache, in MB, 0 disables it
+
+func SetCacheSize(size int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.size != int64(size)*1024*1024 {
+		diskLog.Info("Cache size changed", "size_mb", size)
+	}
+	cache.size = int64(size)*1024*1024
+	cache.shrink()
+}
+
+// Bytes used, and the reads served from memory and from disk
+
+func CacheStats() (used, hits, misses int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.used, cache.hits, cache.misses
+}
+
+// Key of a piece, the id of the store in the high bits
+
+func cacheKey(id, index int64) int64 {
+	return id<<32 | index
+}
+
+func (c *pieceCache) newId() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stores++
+	return c.stores
+}
+
+func (c *pieceCache) get(key int64) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.pieces[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedPiece).data
+}
+
+// Whether a piece of length bytes fits in the cache
+
+func (c *pieceCache) fits(length int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return length <= c.size
+}
+
+func (c *pieceCache) put(key int64, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.pieces[key]; ok || int64(len(data)) > c.size {
+		return
+	}
+	c.pieces[key] = c.lru.PushFront(&cachedPiece{key, data})
+	c.used += int64(len(data))
+	c.shrink()
+}
+
+// Drop the least recently used pieces until the cache fits in its size
+
+func (c *pieceCache) shrink() {
+	for c.used > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *pieceCache) remove(e *list.Element) {
+	p := c.lru.Remove(e).(*cachedPiece)
+	delete(c.pieces, p.key)
+	c.used -= int64(len(p.data))
+}
+
+func (c *pieceCache) invalidate(key int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.pieces[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Drop the pieces of a store
+
+func (c *pieceCache) drop(id int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cachedPiece).key>>32 == id {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+func (fe *fileStore) pieceLength(index int64) int64 {
+	if length := fe.totalLength - index*fe.info.Piece_length; length < fe.info.Piece_length {
+		return length
+	}
+	return fe.info.Piece_length
+}
+
+// Read a block of a finished piece through the cache, used to serve
+// the requests of the peers
+
+func (fe *fileStore) ReadBlock(index, begin int64, bytes []byte) (err error) {
+	key := cacheKey(fe.id, index)
+	if data := cache.get(key); data != nil {
+		if begin < 0 || begin+int64(len(bytes)) > int64(len(data)) {
+			return errors.New("Read out of range")
+		}
+		copy(bytes, data[begin:])
+		return
+	}
+	length := fe.pieceLength(index)
+	if length <= 0 || fe.uncached || !cache.fits(length) {
+		return fe.ReadAt(index, begin, bytes)
+	}
+	data := make([]byte, length)
+	if err = fe.ReadAt(index, 0, data); err != nil {
+		return
+	}
+	if begin < 0 || begin+int64(len(bytes)) > length {
+		return errors.New("Read out of range")
+	}
+	cache.put(key, data)
+	copy(bytes, data[begin:])
+	return
+}
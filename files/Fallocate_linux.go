@@ -0,0 +1,20 @@
+// Space reservation with the fallocate system call
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"os"
+	"syscall"
+	)
+
+// Reserve the blocks of the first length bytes of the file, the
+// data already written is kept
+
+func fallocate(fd *os.File, length int64) error {
+	if err := syscall.Fallocate(int(fd.Fd()), 0, 0, length); err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
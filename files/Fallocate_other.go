@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+// Systems without fallocate, the files are filled with zeros
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"os"
+	"errors"
+	)
+
+func fallocate(fd *os.File, length int64) error {
+	return errors.New("fallocate is not supported")
+}
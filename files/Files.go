@@ -0,0 +1,514 @@
+// Create the structure of the files to download in the FS
+// This file in mainly the files.go found in Taipei-Torrent with some changes
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"io"
+	"os"
+	"strings"
+	"path/filepath"
+	"crypto/sha1"
+	"bytes"
+	"wgo/bencode"
+	"wgo/bit_field"
+	"wgo/logger"
+	"sync"
+	"errors"
+	)
+
+const(
+	readat = iota
+	writeat
+	checkpiece
+)
+
+const(
+	FILE_PERM = 0666
+	FOLDER_PERM = 0755
+	HASHERS = 5
+)
+
+var diskLog = logger.New("disk")
+
+// How the space of the files is allocated when they are created
+
+const(
+	ALLOCATE_SPARSE = iota // Extend the files without writing, the space is used as pieces arrive
+	ALLOCATE_ZERO // Write zeros up to the size of the files
+	ALLOCATE_FULL // Reserve the space with fallocate, zeros are written if it's not supported
+	ALLOCATE_MEMORY // Keep the pieces in memory, the ones past the spill limit go to sparse files
+)
+
+const ZERO_CHUNK = 1024*1024 // Bytes of zeros written at a time
+
+var allocationNames = []string{"sparse", "zero", "full", "memory"}
+
+func ParseAllocation(name string) (int, error) {
+	for a, n := range(allocationNames) {
+		if name == n {
+			return a, nil
+		}
+	}
+	return ALLOCATE_SPARSE, errors.New("Unknown allocation " + name)
+}
+
+func AllocationName(allocation int) string {
+	if allocation < 0 || allocation >= len(allocationNames) {
+		return "unknown"
+	}
+	return allocationNames[allocation]
+}
+
+// Download priority of a file
+
+const(
+	PRIORITY_SKIP = iota // Don't download the file
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
+type Files interface {
+	GetReaderAt(index, begin, length int64) (io.Reader)
+	ReadAt(index, begin int64, bytes []byte) (error)
+	ReadBlock(index, begin int64, bytes []byte) (error)
+	WriteAt(index, begin int64, bytes []byte) (error)
+	WriteAsync(index, begin int64, data []byte, done func(err error))
+	QueueDepth() int
+	CheckPiece(index int64) (error)
+	CheckPieces(progress func(checked, total int64)) (left int64, bf *bit_field.Bitfield, err error)
+	Hashes(root string, base, index, length, proofs int64) (hashes []byte, err error)
+	Stat() (stats []ResumeFile, err error)
+	NumFiles() int
+	FilePieces(file int) (first, last int64, err error)
+	Move(folder string) (error)
+	FreeSpace() (int64, error)
+	WriteErrors() (<-chan error)
+	Sync() (error)
+	Close() (error)
+	Delete() (error)
+}
+
+type fileEntry struct {
+	length int64
+	padding bool // Not stored, only zeros (BEP 47)
+	root, layer string // Merkle root and piece layer of v2 files
+}
+
+type fileStore struct {
+	mutex *sync.Mutex
+	writeMutex *sync.Mutex // Taken before mutex by the writes, held while the files are moved
+	offsets []int64
+	totalLength int64
+	files   []fileEntry // Stored in increasing globalOffset order
+	info *bencode.InfoDict
+	folder string // Of the files of a multi-file torrent, empty for a single file
+	storage Storage
+	uncached bool // The storage is in memory already
+	reader io.ReaderAt // The pieces of the storage, one after the other
+	w *writers
+	id int64 // Of the pieces in the cache
+	hashes pieceHashes // Of the pieces being written
+}
+
+type CheckPiece struct {
+	index int64
+	ok bool
+	err error
+}
+
+func (fe *fileStore) GetReaderAt(index, begin, length int64) (reader io.Reader) {
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+	globalOffset := index*fe.info.Piece_length + begin
+	return io.NewSectionReader(fe.reader, globalOffset, length)
+}
+
+// Read a block of a piece from disk, used to serve requests
+
+func (fe *fileStore) ReadAt(index, begin int64, bytes []byte) (err error) {
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+	globalOffset := index*fe.info.Piece_length + begin
+	if globalOffset < 0 || globalOffset+int64(len(bytes)) > fe.totalLength {
+		return errors.New("Read out of range")
+	}
+	_, err = fe.reader.ReadAt(bytes, globalOffset)
+	return
+}
+
+// Write a block of a piece to the storage
+
+func (fe *fileStore) WriteAt(index, begin int64, bytes []byte) (err error){
+	fe.writeMutex.Lock()
+	defer fe.writeMutex.Unlock()
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+	defer func() {
+		if err == nil {
+			fe.hashBlock(index, begin, bytes)
+		} else {
+			fe.dropHash(index)
+		}
+	}()
+	cache.invalidate(cacheKey(fe.id, index))
+	return fe.storage.WriteBlock(index, begin, bytes)
+}
+
+// Check a finished piece, with the hash of the blocks written if
+// they were all hashed, or reading it from disk
+
+func (fe *fileStore) CheckPiece(index int64) (error) {
+	fe.mutex.Lock()
+	defer fe.mutex.Unlock()
+	if hashed, err := fe.checkHashed(index); hashed {
+		return err
+	}
+	return fe.checkPiece(index)
+}
+
+// Open the files of a torrent in fileDir
+
+func NewFiles(info *bencode.InfoDict, fileDir string, allocation int) (f Files, totalSize int64, err error) {
+	fs, paths, err := newFileStore(info, fileDir)
+	if err != nil {
+		return fs, 0, err
+	}
+	diskLog.Info("Opening files", "files", len(fs.files), "folder", fileDir, "allocation", AllocationName(allocation))
+	lengths := make([]int64, len(fs.files))
+	for i, file := range(fs.files) {
+		lengths[i] = file.length
+	}
+	var storage Storage
+	if allocation == ALLOCATE_MEMORY {
+		spillMutex.Lock()
+		spill := memorySpill
+		spillMutex.Unlock()
+		fs.uncached = true
+		storage = newMemoryStorage(info.Piece_length, fs.totalLength, spill, func() (Storage, error) {
+			return newDiskStorage(info.Piece_length, paths, lengths, ALLOCATE_SPARSE)
+		})
+	} else if storage, err = newDiskStorage(info.Piece_length, paths, lengths, allocation); err != nil {
+		return fs, 0, err
+	}
+	fs.start(storage)
+	return fs, fs.totalLength, nil
+}
+
+// Keep the pieces of a torrent in another storage than its files
+
+func NewFilesStorage(info *bencode.InfoDict, storage Storage) (f Files, totalSize int64, err error) {
+	fs, _, err := newFileStore(info, "")
+	if err != nil {
+		return fs, 0, err
+	}
+	fs.start(storage)
+	return fs, fs.totalLength, nil
+}
+
+// The files of the torrent and their paths inside fileDir, empty for
+// the padding files
+
+func newFileStore(info *bencode.InfoDict, fileDir string) (fs *fileStore, paths []string, err error) {
+	fs = new(fileStore)
+	fs.mutex = new(sync.Mutex)
+	fs.writeMutex = new(sync.Mutex)
+	fs.info = info
+	fs.id = cache.newId()
+	numFiles := len(info.Files)
+	if numFiles == 0 {
+		// Create dummy Files structure.
+		info = &bencode.InfoDict{Files: []bencode.FileDict{bencode.FileDict{Length: info.Length, Path: []string{info.Name}, Md5sum: info.Md5sum, Pieces_root: info.Pieces_root, Layer: info.Layer}}}
+		numFiles = 1
+	} else {
+		// Files of a multi-file torrent go inside a folder
+		// with the name of the torrent
+		name, err := joinPath([]string{info.Name})
+		if err != nil {
+			diskLog.Error("Bad torrent name", "name", info.Name, "err", err)
+			return fs, nil, err
+		}
+		fileDir = fileDir + "/" + name
+		fs.folder = fileDir
+	}
+	fs.files = make([]fileEntry, numFiles)
+	fs.offsets = make([]int64, numFiles)
+	paths = make([]string, numFiles)
+	for i, _ := range (info.Files) {
+		src := &info.Files[i]
+		if src.Length < 0 {
+			err = errors.New("Negative file length")
+			diskLog.Error("Bad file", "file", i, "err", err)
+			return fs, nil, err
+		}
+		fs.offsets[i] = fs.totalLength
+		fs.totalLength += src.Length
+		fs.files[i].length = src.Length
+		fs.files[i].root, fs.files[i].layer = src.Pieces_root, src.Layer
+		if strings.Index(src.Attr, "p") >= 0 {
+			// Padding file (BEP 47), nothing in disk
+			fs.files[i].padding = true
+			continue
+		}
+		torrentPath, err := joinPath(src.Path)
+		if err != nil {
+			diskLog.Error("Bad file path", "file", i, "err", err)
+			return fs, nil, err
+		}
+		paths[i] = fileDir + "/" + torrentPath
+	}
+	return
+}
+
+func (fs *fileStore) start(storage Storage) {
+	fs.storage = storage
+	fs.reader = &storageReader{s: storage, pieceLength: fs.info.Piece_length, length: fs.totalLength}
+	fs.startWriters()
+}
+
+func (fs *fileStore) NumFiles() int {
+	return len(fs.files)
+}
+
+// Pieces that contain data of a file, last is smaller than
+// first if the file is empty
+
+func (fs *fileStore) FilePieces(file int) (first, last int64, err error) {
+	if file < 0 || file >= len(fs.files) {
+		err = errors.New("File out of range")
+		return
+	}
+	first = fs.offsets[file] / fs.info.Piece_length
+	if fs.files[file].length == 0 {
+		return first, first-1, nil
+	}
+	last = (fs.offsets[file] + fs.files[file].length - 1) / fs.info.Piece_length
+	return
+}
+
+// Find the file that matches the offset
+
+func (f *fileStore) find(offset int64) int {
+	return find(f.offsets, offset)
+}
+
+// Check the hash of every piece, progress (if not nil) is called
+// each time a piece has been checked
+
+func (fs *fileStore) CheckPieces(progress func(checked, total int64)) (left int64, bf *bit_field.Bitfield, err error) {
+	numPieces := (fs.totalLength + fs.info.Piece_length - 1) / fs.info.Piece_length
+	diskLog.Info("Checking pieces", "length", fs.totalLength, "piece_length", fs.info.Piece_length, "pieces", numPieces)
+	bf = bit_field.NewBitfield(numPieces)
+	input := make(chan *CheckPiece, HASHERS)
+	output := make(chan *CheckPiece, HASHERS)
+	for i := int64(0); i < HASHERS; i++ {
+		go func(i int64, output, input chan *CheckPiece) {
+			for piece := range input {
+				piece.err = fs.checkPiece(piece.index)
+				output <- piece
+			}
+		}(i, output, input)
+	}
+	go func(input chan *CheckPiece) {
+		for i:= int64(0); i < numPieces; i++ {
+			piece := new(CheckPiece)
+			piece.index = i
+			input <- piece
+		}
+		close(input)
+	}(input)
+	for i:= int64(0); i < numPieces; i++ {
+		piece := <- output
+		if piece.err != nil {
+			if piece.index == numPieces-1 {
+				left += fs.totalLength-piece.index*fs.info.Piece_length
+			} else {
+				left += fs.info.Piece_length
+			}
+		} else {
+			bf.Set(piece.index)
+		}
+		if progress != nil {
+			progress(i+1, numPieces)
+		}
+	}
+	close(output)
+	return
+}
+// Check a piece
+
+func (fs *fileStore) checkPiece(pieceIndex int64) (err error) {
+	if fs.info.Meta_version == 2 && len(fs.info.Pieces) == 0 {
+		return fs.checkPieceV2(pieceIndex)
+	}
+	ref := fs.info.Pieces
+	currentSum, err := fs.computePieceSum(pieceIndex)
+	if err != nil {
+		return
+	}
+	base := pieceIndex * sha1.Size
+	end := base + sha1.Size
+	if !bytes.Equal([]byte(ref[base:end]), currentSum) {
+		err = errors.New("Piece hash doesn't match")
+	}
+	return
+}
+
+
+func (fs *fileStore) computePieceSum(pieceIndex int64) (sum []byte, err error) {
+	numPieces := (fs.totalLength + fs.info.Piece_length - 1) / fs.info.Piece_length
+	hasher := sha1.New()
+	length := fs.info.Piece_length
+	if pieceIndex == numPieces-1 {
+		length = fs.totalLength-pieceIndex*fs.info.Piece_length
+	}
+	reader := io.NewSectionReader(fs.reader, pieceIndex*fs.info.Piece_length, length)
+	_, err = io.Copy(hasher, reader)
+	if err != nil {
+		return
+	}
+	sum = hasher.Sum(nil)
+	return
+}
+
+// Move the files to another folder. The pieces are still read from
+// the old files while they are copied, only the writes wait.
+
+func (fs *fileStore) Move(folder string) (err error) {
+	m, ok := fs.storage.(mover)
+	if !ok {
+		return errors.New("The storage can't be moved")
+	}
+	// Same layout in the new folder
+	moved, paths, err := newFileStore(fs.info, folder)
+	if err != nil {
+		return
+	}
+	fs.waitWrites()
+	fs.writeMutex.Lock()
+	defer fs.writeMutex.Unlock()
+	diskLog.Info("Moving files", "files", len(paths), "folder", folder)
+	if err = m.CopyTo(paths); err != nil {
+		return
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if err = m.Switch(paths); err != nil {
+		return
+	}
+	if len(fs.folder) > 0 {
+		removeEmpty(fs.folder)
+	}
+	fs.folder = moved.folder
+	return
+}
+
+// Remove the folders left empty inside root, and root if it's empty
+
+func removeEmpty(root string) {
+	folders := []string{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			folders = append(folders, path)
+		}
+		return nil
+	})
+	// The deepest ones first, a folder with files isn't removed
+	for i := len(folders) - 1; i >= 0; i-- {
+		os.Remove(folders[i])
+	}
+}
+
+// Flush the written data to the storage, after the queued blocks
+// are written
+
+func (f *fileStore) Sync() (err error) {
+	f.waitWrites()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.storage.Sync()
+}
+
+// Close the storage of the torrent
+
+func (f *fileStore) Close() (err error) {
+	f.stopWriters()
+	cache.drop(f.id)
+	// Waits for a move in progress
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.storage.Close()
+}
+
+// Bytes free where the files are, -1 if the storage doesn't use a
+// filesystem
+
+func (f *fileStore) FreeSpace() (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if s, ok := f.storage.(spacer); ok {
+		return s.FreeSpace()
+	}
+	return -1, nil
+}
+
+// Close the storage and delete the files of the torrent, and the
+// folders left empty
+
+func (f *fileStore) Delete() (err error) {
+	f.stopWriters()
+	cache.drop(f.id)
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	r, ok := f.storage.(remover)
+	if !ok {
+		return f.storage.Close()
+	}
+	if err = r.Remove(); err == nil && len(f.folder) > 0 {
+		removeEmpty(f.folder)
+	}
+	return
+}
+
+
+// Check that the parts of the path are correct
+func joinPath(parts []string) (path string, err error) {
+	// TODO: better, OS-specific sanitization.
+	if len(parts) == 0 {
+		err = errors.New("Empty path")
+		return
+	}
+	for key, part := range (parts) {
+		// Sanitize file names.
+		if strings.Index(part, "/") >= 0 || strings.Index(part, "\\") >= 0 || part == ".." || part == "." || len(strings.TrimSpace(part)) == 0 {
+			err = errors.New("Bad path part " + part)
+			return
+		}
+		// Remove tailing and leading spaces
+		if strings.HasPrefix(part, " ") || strings.HasSuffix(part, " ") {
+			parts[key] = strings.TrimSpace(part)
+		}
+	}
+
+	path = strings.Join(parts, "/")
+	return
+}
+
+// Create the appropiate folders (if needed)
+func ensureDirectory(fullPath string) (err error) {
+	pathParts := strings.Split(fullPath, "/")
+	if len(pathParts) < 2 {
+		return
+	}
+	dirParts := pathParts[0 : len(pathParts)-1]
+	path := strings.Join(dirParts, "/")
+	err = os.MkdirAll(path, FOLDER_PERM)
+	return
+}
+
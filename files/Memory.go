@@ -0,0 +1,136 @@
+// Storage of the pieces in memory, for small torrents, relays that
+// don't keep what they download, and tests. Past the spill limit the
+// new pieces are written to the files as usual.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"sync"
+	"errors"
+	)
+
+var(
+	spillMutex = new(sync.Mutex)
+	memorySpill int64 // Bytes of a torrent kept in memory, 0 means no limit
+)
+
+// MB kept in memory by each torrent with ALLOCATE_MEMORY, the pieces
+// after them are written to disk. Used by the torrents opened
+// afterwards.
+
+func SetMemorySpill(mb int) {
+	spillMutex.Lock()
+	defer spillMutex.Unlock()
+	memorySpill = int64(mb)*1024*1024
+}
+
+type memoryStorage struct {
+	mutex *sync.RWMutex
+	pieceLength, length int64
+	pieces map[int64][]byte // Written to, whole pieces
+	used, spill int64
+	open func() (Storage, error) // Opens the files when the first piece spills
+	disk Storage // nil until then
+	spilled map[int64]bool // Pieces written to disk
+}
+
+func newMemoryStorage(pieceLength, length, spill int64, open func() (Storage, error)) *memoryStorage {
+	return &memoryStorage{mutex: new(sync.RWMutex), pieceLength: pieceLength, length: length, pieces: make(map[int64][]byte),
+		spill: spill, open: open, spilled: make(map[int64]bool)}
+}
+
+func (m *memoryStorage) size(index int64) int64 {
+	if length := m.length - index*m.pieceLength; length < m.pieceLength {
+		return length
+	}
+	return m.pieceLength
+}
+
+// The pieces not written yet are zeros
+
+func (m *memoryStorage) ReadBlock(index, begin int64, data []byte) (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if index < 0 || begin < 0 || begin+int64(len(data)) > m.size(index) {
+		return errors.New("Read out of range")
+	}
+	if m.spilled[index] {
+		return m.disk.ReadBlock(index, begin, data)
+	}
+	piece, ok := m.pieces[index]
+	if !ok {
+		for i, _ := range(data) {
+			data[i] = 0
+		}
+		return
+	}
+	copy(data, piece[begin:])
+	return
+}
+
+func (m *memoryStorage) WriteBlock(index, begin int64, data []byte) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	size := m.size(index)
+	if index < 0 || begin < 0 || begin+int64(len(data)) > size {
+		return errors.New("Write out of range")
+	}
+	piece, ok := m.pieces[index]
+	if !ok && !m.spilled[index] && m.spill > 0 && m.used + size > m.spill {
+		if m.disk == nil {
+			if m.disk, err = m.open(); err != nil {
+				return
+			}
+			diskLog.Info("Memory full, writing the next pieces to disk", "used", m.used)
+		}
+		m.spilled[index] = true
+	}
+	if m.spilled[index] {
+		return m.disk.WriteBlock(index, begin, data)
+	}
+	if !ok {
+		piece = make([]byte, size)
+		m.pieces[index] = piece
+		m.used += size
+	}
+	copy(piece[begin:], data)
+	return
+}
+
+func (m *memoryStorage) Sync() (err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.disk != nil {
+		return m.disk.Sync()
+	}
+	return
+}
+
+// The pieces in memory are lost
+
+func (m *memoryStorage) Close() (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pieces = make(map[int64][]byte)
+	m.used = 0
+	if m.disk != nil {
+		return m.disk.Close()
+	}
+	return
+}
+
+// The files of the pieces that spilled are deleted too
+
+func (m *memoryStorage) Remove() (err error) {
+	if err = m.Close(); err != nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if r, ok := m.disk.(remover); ok {
+		return r.Remove()
+	}
+	return
+}
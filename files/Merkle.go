@@ -0,0 +1,189 @@
+// Hashes of the BitTorrent v2 torrents (BEP 52): each file has a merkle
+// tree of SHA-256 over its 16 KB blocks, a piece is checked against its
+// hash in the piece layer of the file (or the root of the tree for the
+// files of a single piece), and the piece layers are sent to the peers
+// that request them
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	)
+
+const(
+	MERKLE_BLOCK = 16*1024 // Data of each leaf of the tree
+)
+
+var zeroHash = make([]byte, sha256.Size)
+
+func hashPair(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// Smallest power of 2 that is at least n
+
+func nextPow2(n int64) int64 {
+	p := int64(1)
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// Root of the tree of the leaves, with pad as the missing leaves up
+// to width (a power of 2)
+
+func merkleRoot(leaves [][]byte, width int64, pad []byte) []byte {
+	level := merkleLevel(leaves, width, pad)
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+	return level[0]
+}
+
+func merkleLevel(leaves [][]byte, width int64, pad []byte) [][]byte {
+	level := make([][]byte, width)
+	for i, _ := range(level) {
+		if i < len(leaves) {
+			level[i] = leaves[i]
+		} else {
+			level[i] = pad
+		}
+	}
+	return level
+}
+
+func merkleParents(level [][]byte) [][]byte {
+	parents := make([][]byte, len(level)/2)
+	for i, _ := range(parents) {
+		parents[i] = hashPair(level[2*i], level[2*i+1])
+	}
+	return parents
+}
+
+// File of a v2 piece, every piece is inside a single file and its
+// padding
+
+func (fs *fileStore) pieceFile(index int64) (file int, err error) {
+	off := index*fs.info.Piece_length
+	if off < 0 || off >= fs.totalLength {
+		return 0, errors.New("Piece out of range")
+	}
+	file = fs.find(off)
+	for file < len(fs.files)-1 && fs.offsets[file]+fs.files[file].length <= off {
+		// Empty files at the same offset
+		file++
+	}
+	if fs.files[file].padding || len(fs.files[file].root) == 0 {
+		return file, errors.New("Piece without a v2 file")
+	}
+	return
+}
+
+func (fs *fileStore) checkPieceV2(index int64) (err error) {
+	file, err := fs.pieceFile(index)
+	if err != nil {
+		return
+	}
+	entry := &fs.files[file]
+	pieceLength := fs.info.Piece_length
+	fileOffset := index*pieceLength - fs.offsets[file]
+	length := entry.length - fileOffset
+	if length > pieceLength {
+		length = pieceLength
+	}
+	// The last block of the file is hashed without padding
+	leaves := make([][]byte, 0, (length + MERKLE_BLOCK - 1)/MERKLE_BLOCK)
+	block := make([]byte, MERKLE_BLOCK)
+	for done := int64(0); done < length; done += MERKLE_BLOCK {
+		chunk := block
+		if length - done < MERKLE_BLOCK {
+			chunk = block[0:length-done]
+		}
+		if _, err = fs.reader.ReadAt(chunk, index*pieceLength + done); err != nil {
+			return
+		}
+		hash := sha256.New()
+		hash.Write(chunk)
+		leaves = append(leaves, hash.Sum(nil))
+	}
+	var ref, sum []byte
+	if entry.length <= pieceLength {
+		ref = []byte(entry.root)
+		sum = merkleRoot(leaves, nextPow2(int64(len(leaves))), zeroHash)
+	} else {
+		k := fileOffset/pieceLength
+		ref = []byte(entry.layer[k*sha256.Size:(k+1)*sha256.Size])
+		sum = merkleRoot(leaves, pieceLength/MERKLE_BLOCK, zeroHash)
+	}
+	if !bytes.Equal(ref, sum) {
+		err = errors.New("Piece hash doesn't match")
+	}
+	return
+}
+
+// Layer of the pieces in the tree of a file, the first layer is the
+// one of the blocks
+
+func (fs *fileStore) pieceLayer() (layer int64) {
+	for blocks := fs.info.Piece_length/MERKLE_BLOCK; blocks > 1; blocks /= 2 {
+		layer++
+	}
+	return
+}
+
+// Hashes of the piece layer of the file with the root, from index,
+// followed by the uncle hashes of proofs layers above them. Only the
+// piece layer is kept, the requests of other layers are rejected.
+
+func (fs *fileStore) Hashes(root string, base, index, length, proofs int64) (hashes []byte, err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if base != fs.pieceLayer() {
+		return nil, errors.New("Only the piece layer is available")
+	}
+	var entry *fileEntry
+	for i, _ := range(fs.files) {
+		if fs.files[i].root == root && len(fs.files[i].layer) > 0 {
+			entry = &fs.files[i]
+			break
+		}
+	}
+	if entry == nil {
+		return nil, errors.New("Unknown pieces root")
+	}
+	numPieces := int64(len(entry.layer)/sha256.Size)
+	width := nextPow2(numPieces)
+	if length <= 0 || length != nextPow2(length) || index < 0 || index%length != 0 || index+length > width || proofs < 0 {
+		return nil, errors.New("Bad hash request")
+	}
+	leaves := make([][]byte, numPieces)
+	for i, _ := range(leaves) {
+		leaves[i] = []byte(entry.layer[i*sha256.Size:(i+1)*sha256.Size])
+	}
+	// The missing pieces are subtrees of zero blocks
+	pad := merkleRoot(nil, fs.info.Piece_length/MERKLE_BLOCK, zeroHash)
+	level := merkleLevel(leaves, width, pad)
+	var b bytes.Buffer
+	for _, hash := range(level[index:index+length]) {
+		b.Write(hash)
+	}
+	// Up to the root of the requested hashes, then the uncles
+	for n := length; n > 1; n /= 2 {
+		level = merkleParents(level)
+	}
+	node := index/length
+	for ; proofs > 0 && len(level) > 1; proofs-- {
+		b.Write(level[node^1])
+		level = merkleParents(level)
+		node /= 2
+	}
+	return b.Bytes(), nil
+}
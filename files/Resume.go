@@ -0,0 +1,129 @@
+// Fast-resume data, state of a torrent saved between runs so
+// the files don't have to be checked again
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"os"
+	"bytes"
+	"io/ioutil"
+	"wgo/bencode"
+	"errors"
+	)
+
+type ResumeFile struct {
+	Size int64 `bencode:"size"`
+	Mtime int64 `bencode:"mtime"`
+}
+
+// Blocks already written of an unfinished piece, and the SHA-1 of each
+// of them (in order) to check them if the files change
+
+type ResumePiece struct {
+	Index int64 `bencode:"index"`
+	Blocks string `bencode:"blocks"`
+	Hashes string `bencode:"hashes"`
+}
+
+// A peer of the cache, seen connected at Seen (Unix time) and its
+// score, the bytes/s it transferred with us
+
+type ResumePeer struct {
+	Addr string `bencode:"addr"`
+	Seen int64 `bencode:"seen"`
+	Score int64 `bencode:"score"`
+}
+
+type ResumeData struct {
+	Bitfield string `bencode:"bitfield"`
+	Files []ResumeFile `bencode:"files"`
+	Partial []ResumePiece `bencode:"partial"`
+	Uploaded int64 `bencode:"uploaded"`
+	Downloaded int64 `bencode:"downloaded"`
+	Seeding int64 `bencode:"seeding"` // Seconds seeding
+	Active int64 `bencode:"active"` // Seconds running
+	Peers []string `bencode:"peers"` // Peer cache without scores, of older versions
+	PeerCache []ResumePeer `bencode:"peer_cache"`
+	Folder string `bencode:"folder"` // Where the files were moved when finished, empty if not moved
+}
+
+func LoadResume(path string) (r *ResumeData, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	r = new(ResumeData)
+	err = bencode.Unmarshal(bytes.NewBuffer(data), r)
+	return
+}
+
+// Write the resume data to a temporary file and rename it, so a
+// crash never leaves a truncated resume file
+
+func SaveResume(path string, r *ResumeData) (err error) {
+	return saveBencode(path, r)
+}
+
+// Transfers of every torrent of a session, over all its runs
+
+type Totals struct {
+	Uploaded int64 `bencode:"uploaded"`
+	Downloaded int64 `bencode:"downloaded"`
+	Active int64 `bencode:"active"` // Seconds running
+}
+
+func LoadTotals(path string) (t *Totals, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	t = new(Totals)
+	err = bencode.Unmarshal(bytes.NewBuffer(data), t)
+	return
+}
+
+func SaveTotals(path string, t *Totals) (err error) {
+	return saveBencode(path, t)
+}
+
+func saveBencode(path string, v interface{}) (err error) {
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, v); err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b.Bytes(), FILE_PERM); err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// Size and modification time of each file of the torrent, an error
+// if the storage has no files
+
+func (fs *fileStore) Stat() (stats []ResumeFile, err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if s, ok := fs.storage.(statter); ok {
+		return s.Stat()
+	}
+	return nil, errors.New("The storage has no files")
+}
+
+// The resume data can be used if the files haven't changed since
+// it was saved
+
+func (r *ResumeData) Valid(f Files) bool {
+	stats, err := f.Stat()
+	if err != nil || len(stats) != len(r.Files) {
+		return false
+	}
+	for i, stat := range(stats) {
+		if stat.Size != r.Files[i].Size || stat.Mtime != r.Files[i].Mtime {
+			return false
+		}
+	}
+	return true
+}
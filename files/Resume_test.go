@@ -0,0 +1,32 @@
+package files
+
+import(
+	"reflect"
+	"testing"
+	)
+
+func TestResumeRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/resume"
+	r := &ResumeData{
+		Bitfield: "\xff\x80",
+		Files: []ResumeFile{ResumeFile{Size: 1024, Mtime: 1286000000}, ResumeFile{Size: 7, Mtime: 1286000001}},
+		Partial: []ResumePiece{ResumePiece{Index: 9, Blocks: "\x01", Hashes: "01234567890123456789"}},
+		Uploaded: 100,
+		Downloaded: 200,
+		Seeding: 30,
+		Active: 60,
+		Peers: []string{"10.0.0.1:6881"},
+		PeerCache: []ResumePeer{ResumePeer{Addr: "10.0.0.2:6881", Seen: 1286000002, Score: 5000}},
+		Folder: "/complete",
+	}
+	if err := SaveResume(path, r); err != nil {
+		t.Fatalf("SaveResume: %v", err)
+	}
+	loaded, err := LoadResume(path)
+	if err != nil {
+		t.Fatalf("LoadResume: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, r) {
+		t.Errorf("Loaded %+v, saved %+v", loaded, r)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+// Systems without statfs, the free space is unknown
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"syscall"
+	"errors"
+	)
+
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("statfs is not supported")
+}
+
+func IsNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
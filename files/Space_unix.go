@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd
+// +build linux darwin freebsd openbsd netbsd
+
+// Free space of the filesystem of the files
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"os"
+	"syscall"
+	"errors"
+	)
+
+// Bytes available to us in the filesystem of the path
+
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, os.NewSyscallError("statfs", err)
+	}
+	return int64(st.Bavail)*int64(st.Bsize), nil
+}
+
+// Whether a write failed because the filesystem (or our quota) is full
+
+func IsNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,404 @@
+// Where the data of the pieces is kept. The fileStore hashes, caches
+// and queues the blocks, and a Storage only reads and writes them, so
+// other backends than the files in disk can be plugged in.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"io"
+	"os"
+	"path/filepath"
+	"wgo/wgo_io"
+	"errors"
+	)
+
+// The blocks are inside a piece, begin is the offset in the piece.
+// ReadBlock may be called by several goroutines at once, the writes
+// are serialized by the fileStore.
+
+type Storage interface {
+	ReadBlock(index, begin int64, data []byte) (error)
+	WriteBlock(index, begin int64, data []byte) (error)
+	Sync() (error)
+	Close() (error)
+}
+
+// A Storage with files that survive a restart, it's used by the
+// resume data to know if the pieces have to be checked again
+
+type statter interface {
+	Stat() (stats []ResumeFile, err error)
+}
+
+// A Storage with files that can be moved to another folder. CopyTo
+// puts them in the new paths while the old ones are still read, and
+// Switch opens the new ones and removes the old ones. If either fails
+// the copies are removed and the storage keeps using the old files.
+
+type mover interface {
+	CopyTo(paths []string) (error)
+	Switch(paths []string) (error)
+}
+
+// A Storage with files that can be deleted, Remove closes it first
+
+type remover interface {
+	Remove() (error)
+}
+
+// A Storage in a filesystem that can run out of space
+
+type spacer interface {
+	FreeSpace() (int64, error)
+}
+
+// The files of the torrent in the download folder
+
+type diskStorage struct {
+	pieceLength int64
+	paths []string
+	offsets, lengths []int64
+	fds []*os.File // nil for the padding files
+	reader io.ReaderAt
+}
+
+// Open (creating them if needed) the files at paths, an empty path is
+// a padding file that isn't written to disk
+
+func newDiskStorage(pieceLength int64, paths []string, lengths []int64, allocation int) (d *diskStorage, err error) {
+	d = &diskStorage{pieceLength: pieceLength, paths: paths, lengths: lengths}
+	d.offsets = make([]int64, len(paths))
+	d.fds = make([]*os.File, len(paths))
+	offset := int64(0)
+	for i, path := range(paths) {
+		d.offsets[i] = offset
+		offset += lengths[i]
+		if len(path) == 0 {
+			continue
+		}
+		if err = ensureDirectory(path); err != nil {
+			diskLog.Error("Error creating the folder", "path", path, "err", err)
+			d.Close()
+			return
+		}
+		if d.fds[i], err = openFile(path, lengths[i], allocation); err != nil {
+			diskLog.Error("Error opening file", "path", path, "err", err)
+			d.Close()
+			return
+		}
+	}
+	if d.reader, err = wgo_io.MultiReaderAtSizes(d.fds, lengths); err != nil {
+		d.Close()
+	}
+	return
+}
+
+func openFile(name string, length int64, allocation int) (fd *os.File, err error) {
+	if fd, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, FILE_PERM); err != nil {
+		return
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	if allocation == ALLOCATE_FULL && fi.Size() <= length {
+		if err = fallocate(fd, length); err == nil {
+			return
+		}
+		diskLog.Warn("Can't preallocate, writing zeros", "file", name, "err", err)
+		allocation = ALLOCATE_ZERO
+	}
+	if allocation == ALLOCATE_ZERO && fi.Size() < length {
+		err = zero(fd, fi.Size(), length)
+		return
+	}
+	if fi.Size() != length {
+		// Seek past the end and truncate, nothing is written
+		err = fd.Truncate(length)
+	}
+	return
+}
+
+// Write zeros from the offset to the end of the file, the data
+// already in the file is kept
+
+func zero(fd *os.File, offset, length int64) (err error) {
+	zeros := make([]byte, ZERO_CHUNK)
+	for offset < length {
+		chunk := length - offset
+		if chunk > ZERO_CHUNK {
+			chunk = ZERO_CHUNK
+		}
+		if _, err = fd.WriteAt(zeros[0:chunk], offset); err != nil {
+			return
+		}
+		offset += chunk
+	}
+	return
+}
+
+func (d *diskStorage) ReadBlock(index, begin int64, data []byte) (err error) {
+	_, err = d.reader.ReadAt(data, index*d.pieceLength + begin)
+	return
+}
+
+// The block can span several files
+
+func (d *diskStorage) WriteBlock(index, begin int64, data []byte) (err error) {
+	off := index*d.pieceLength + begin
+	if off < 0 {
+		return errors.New("Write out of range")
+	}
+	for i := find(d.offsets, off); len(data) > 0 && i < len(d.offsets); i++ {
+		chunk := int64(len(data))
+		itemOffset := off - d.offsets[i]
+		if itemOffset >= d.lengths[i] {
+			continue
+		}
+		if space := d.lengths[i] - itemOffset; space < chunk {
+			chunk = space
+		}
+		if d.fds[i] == nil {
+			// Padding file, the data must be zeros
+			for j := int64(0); j < chunk; j++ {
+				if data[j] != 0 {
+					return errors.New("Unexpected non-zero padding")
+				}
+			}
+		} else if _, err = d.fds[i].WriteAt(data[0:chunk], itemOffset); err != nil {
+			return
+		}
+		data = data[chunk:]
+		off += chunk
+	}
+	// At this point if there's anything left to write it means we've run off the
+	// end of the file store. Check that the data is zeros.
+	// This is defined by the bittorrent protocol.
+	for i, _ := range (data) {
+		if data[i] != 0 {
+			return errors.New("Unexpected non-zero data at end of store.")
+		}
+	}
+	return
+}
+
+// Size and modification time of each file
+
+func (d *diskStorage) Stat() (stats []ResumeFile, err error) {
+	stats = make([]ResumeFile, len(d.fds))
+	for i, fd := range(d.fds) {
+		if fd == nil {
+			// Padding
+			stats[i] = ResumeFile{Size: d.lengths[i]}
+			continue
+		}
+		fi, err := fd.Stat()
+		if err != nil {
+			return stats, err
+		}
+		stats[i] = ResumeFile{Size: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+	}
+	return
+}
+
+// Bytes free in the filesystem of the files, the ones of a torrent are
+// in the same folder
+
+func (d *diskStorage) FreeSpace() (int64, error) {
+	for _, path := range(d.paths) {
+		if len(path) > 0 {
+			return freeSpace(filepath.Dir(path))
+		}
+	}
+	return 0, errors.New("No files")
+}
+
+// Flush the written data of every file to disk
+
+func (d *diskStorage) Sync() (err error) {
+	for _, fd := range(d.fds) {
+		if fd != nil {
+			if e := fd.Sync(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+func (d *diskStorage) Close() (err error) {
+	for i, fd := range(d.fds) {
+		if fd != nil {
+			fd.Close()
+			d.fds[i] = nil
+		}
+	}
+	return
+}
+
+// Close the files and delete them
+
+func (d *diskStorage) Remove() (err error) {
+	d.Close()
+	for _, path := range(d.paths) {
+		if len(path) == 0 {
+			continue
+		}
+		if e := os.Remove(path); e != nil && !os.IsNotExist(e) && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Link or copy the files to the new paths, the old ones are left as
+// they are. The copies already made are removed if one fails.
+
+func (d *diskStorage) CopyTo(paths []string) (err error) {
+	for i, path := range(d.paths) {
+		if len(path) == 0 || path == paths[i] {
+			continue
+		}
+		if err = copyFile(path, paths[i]); err != nil {
+			diskLog.Error("Error copying file", "from", path, "to", paths[i], "err", err)
+			d.removeCopies(paths, i)
+			return
+		}
+	}
+	return
+}
+
+// Remove the copies of the first n files
+
+func (d *diskStorage) removeCopies(paths []string, n int) {
+	for i := 0; i < n; i++ {
+		if len(d.paths[i]) > 0 && d.paths[i] != paths[i] {
+			os.Remove(paths[i])
+		}
+	}
+}
+
+// Open the copies made by CopyTo in place of the old files and remove
+// the old ones. Nothing changes if a copy can't be opened.
+
+func (d *diskStorage) Switch(paths []string) (err error) {
+	fds := make([]*os.File, len(d.fds))
+	for i, fd := range(d.fds) {
+		if fd == nil || d.paths[i] == paths[i] {
+			fds[i] = fd
+			continue
+		}
+		if fds[i], err = os.OpenFile(paths[i], os.O_RDWR, FILE_PERM); err != nil {
+			diskLog.Error("Error opening file", "path", paths[i], "err", err)
+			break
+		}
+	}
+	var reader io.ReaderAt
+	if err == nil {
+		reader, err = wgo_io.MultiReaderAtSizes(fds, d.lengths)
+	}
+	if err != nil {
+		for i, fd := range(fds) {
+			if fd != nil && fd != d.fds[i] {
+				fd.Close()
+			}
+		}
+		d.removeCopies(paths, len(paths))
+		return
+	}
+	for i, fd := range(d.fds) {
+		if fd == nil || fd == fds[i] {
+			continue
+		}
+		fd.Close()
+		if e := os.Remove(d.paths[i]); e != nil {
+			diskLog.Warn("Error removing the old file", "path", d.paths[i], "err", e)
+		}
+	}
+	d.fds, d.reader, d.paths = fds, reader, paths
+	return
+}
+
+// A hard link in the same filesystem, a copy in another one
+
+func copyFile(from, to string) (err error) {
+	if err = ensureDirectory(to); err != nil {
+		return
+	}
+	if err = os.Link(from, to); err == nil {
+		return
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, FILE_PERM)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(dst, src); err == nil {
+		err = dst.Sync()
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(to)
+	}
+	return
+}
+
+// The pieces of a Storage seen as one stream, to hash them. The reads
+// are split at the end of each piece.
+
+type storageReader struct {
+	s Storage
+	pieceLength, length int64
+}
+
+func (r *storageReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off >= r.length {
+		return 0, io.EOF
+	}
+	for len(p) > 0 && off < r.length {
+		index, begin := off / r.pieceLength, off % r.pieceLength
+		chunk := r.pieceLength - begin
+		if chunk > int64(len(p)) {
+			chunk = int64(len(p))
+		}
+		if chunk > r.length - off {
+			chunk = r.length - off
+		}
+		if err = r.s.ReadBlock(index, begin, p[0:chunk]); err != nil {
+			return
+		}
+		n += int(chunk)
+		p = p[chunk:]
+		off += chunk
+	}
+	if len(p) > 0 {
+		err = io.EOF
+	}
+	return
+}
+
+// Index of the file that contains the offset, offsets in increasing order
+
+func find(offsets []int64, offset int64) int {
+	// Binary search
+	low := 0
+	high := len(offsets)
+	for low < high-1 {
+		probe := (low + high) / 2
+		entry := offsets[probe]
+		if offset < entry {
+			high = probe
+		} else {
+			low = probe
+		}
+	}
+	return low
+}
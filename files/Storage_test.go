@@ -0,0 +1,95 @@
+package files
+
+import(
+	"bytes"
+	"os"
+	"testing"
+	"wgo/bencode"
+	)
+
+// A torrent of two files, one of them in a subfolder
+
+func testMoveFiles(t *testing.T, folder string) Files {
+	info := &bencode.InfoDict{Piece_length: 16, Name: "torrent", Files: []bencode.FileDict{
+		bencode.FileDict{Length: 20, Path: []string{"a"}},
+		bencode.FileDict{Length: 12, Path: []string{"sub", "b"}},
+	}}
+	f, _, err := NewFiles(info, folder, ALLOCATE_SPARSE)
+	if err != nil {
+		t.Fatalf("NewFiles: %v", err)
+	}
+	for i := int64(0); i < 2; i++ {
+		if err = f.WriteAt(i, 0, bytes.Repeat([]byte{byte('a' + i)}, 16)); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+	}
+	return f
+}
+
+func checkPieces(t *testing.T, f Files) {
+	data := make([]byte, 16)
+	for i := int64(0); i < 2; i++ {
+		if err := f.ReadAt(i, 0, data); err != nil {
+			t.Fatalf("ReadAt(%d): %v", i, err)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte('a' + i)}, 16)) {
+			t.Errorf("Piece %d = %q", i, data)
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestMove(t *testing.T) {
+	from, to := t.TempDir() + "/incomplete", t.TempDir() + "/complete"
+	f := testMoveFiles(t, from)
+	defer f.Close()
+	if err := f.Move(to); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if exists(from + "/torrent") {
+		t.Errorf("Old folder of the torrent not removed")
+	}
+	for _, path := range([]string{"/torrent/a", "/torrent/sub/b"}) {
+		if !exists(to + path) {
+			t.Errorf("File %s not moved", path)
+		}
+	}
+	checkPieces(t, f)
+	// The writes go to the new files
+	if err := f.WriteAt(1, 0, bytes.Repeat([]byte{'c'}, 16)); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	f.Sync()
+	if data, _ := os.ReadFile(to + "/torrent/sub/b"); !bytes.Equal(data, bytes.Repeat([]byte{'c'}, 12)) {
+		t.Errorf("Moved file = %q", data)
+	}
+}
+
+func TestMoveFailed(t *testing.T) {
+	from, to := t.TempDir() + "/incomplete", t.TempDir() + "/complete"
+	f := testMoveFiles(t, from)
+	defer f.Close()
+	// A file in the place of the subfolder, the second file can't be copied
+	if err := os.MkdirAll(to + "/torrent", FOLDER_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to + "/torrent/sub", nil, FILE_PERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Move(to); err == nil {
+		t.Fatalf("Move succeeded")
+	}
+	for _, path := range([]string{"/torrent/a", "/torrent/sub/b"}) {
+		if !exists(from + path) {
+			t.Errorf("File %s not in the old folder", path)
+		}
+	}
+	if exists(to + "/torrent/a") {
+		t.Errorf("Copy of the first file not removed")
+	}
+	checkPieces(t, f)
+}
@@ -0,0 +1,110 @@
+// Incremental verification of the pieces being downloaded, the
+// blocks are hashed as they are written so a finished piece is
+// checked without reading it back from disk. The blocks that arrive
+// before the ones in front of them are kept until they can be hashed.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"hash"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	)
+
+const(
+	MAX_HASH_BUFFER = 16*1024*1024 // Bytes of out of order blocks of all the pieces
+)
+
+type pieceHash struct {
+	h hash.Hash
+	next int64 // Bytes of the piece already hashed
+	pending map[int64][]byte // Out of order blocks, by begin
+	buffered int64
+}
+
+type pieceHashes struct {
+	pieces map[int64]*pieceHash
+	buffered int64 // Of all the pieces
+}
+
+// True if the pieces of the torrent have SHA1 hashes
+
+func (fs *fileStore) streamable() bool {
+	return len(fs.info.Pieces) > 0
+}
+
+// Hash a block that has just been written, called with the mutex held
+
+func (fs *fileStore) hashBlock(index, begin int64, data []byte) {
+	if !fs.streamable() {
+		return
+	}
+	if fs.hashes.pieces == nil {
+		fs.hashes.pieces = make(map[int64]*pieceHash)
+	}
+	p, ok := fs.hashes.pieces[index]
+	if !ok {
+		p = &pieceHash{h: sha1.New(), pending: make(map[int64][]byte)}
+		fs.hashes.pieces[index] = p
+	}
+	if _, dup := p.pending[begin]; dup || begin < p.next {
+		// Written again, the data on disk may not be the one hashed
+		fs.dropHash(index)
+		return
+	}
+	if begin > p.next {
+		if fs.hashes.buffered + int64(len(data)) > MAX_HASH_BUFFER {
+			// Too much waiting, the piece is read back when it's finished
+			fs.dropHash(index)
+			return
+		}
+		block := make([]byte, len(data))
+		copy(block, data)
+		p.pending[begin] = block
+		p.buffered += int64(len(block))
+		fs.hashes.buffered += int64(len(block))
+		return
+	}
+	p.h.Write(data)
+	p.next += int64(len(data))
+	for {
+		block, ok := p.pending[p.next]
+		if !ok {
+			break
+		}
+		delete(p.pending, p.next)
+		p.buffered -= int64(len(block))
+		fs.hashes.buffered -= int64(len(block))
+		p.h.Write(block)
+		p.next += int64(len(block))
+	}
+}
+
+func (fs *fileStore) dropHash(index int64) {
+	if p, ok := fs.hashes.pieces[index]; ok {
+		fs.hashes.buffered -= p.buffered
+		delete(fs.hashes.pieces, index)
+	}
+}
+
+// Check a finished piece with its running hash, ok is false if the
+// piece wasn't completely hashed and must be read from disk
+
+func (fs *fileStore) checkHashed(index int64) (ok bool, err error) {
+	p, found := fs.hashes.pieces[index]
+	if !found {
+		return
+	}
+	fs.dropHash(index)
+	if p.next != fs.pieceLength(index) {
+		return
+	}
+	base := index * sha1.Size
+	if !bytes.Equal([]byte(fs.info.Pieces[base:base+sha1.Size]), p.h.Sum(nil)) {
+		err = errors.New("Piece hash doesn't match")
+	}
+	return true, err
+}
@@ -0,0 +1,135 @@
+// Writers that save the blocks received from the peers, so a slow
+// disk doesn't stop the peers from reading. The queue is bounded,
+// when it's full the peers wait for a free slot.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package files
+
+import(
+	"sync"
+	"errors"
+	)
+
+const(
+	DISK_WRITERS = 4 // Writers of each torrent
+	DISK_QUEUE = 64 // Blocks waiting to be written
+)
+
+type writeJob struct {
+	index, begin int64
+	data []byte
+	done func(err error)
+}
+
+type writers struct {
+	queue chan *writeJob
+	quit chan bool
+	mutex *sync.Mutex
+	pending int // Queued or being written
+	stopped bool
+	idle []chan bool // Closed when there's nothing pending
+	failed chan error // Errors of the writes, holds one until it is read
+}
+
+func (fe *fileStore) startWriters() {
+	fe.w = &writers{queue: make(chan *writeJob, DISK_QUEUE), quit: make(chan bool), mutex: new(sync.Mutex), failed: make(chan error, 1)}
+	for i := 0; i < DISK_WRITERS; i++ {
+		go fe.writer()
+	}
+}
+
+func (fe *fileStore) writer() {
+	for {
+		select {
+			case <- fe.w.quit:
+				return
+			case job := <- fe.w.queue:
+				err := fe.WriteAt(job.index, job.begin, job.data)
+				if err != nil {
+					diskLog.Error("Error writing block", "index", job.index, "begin", job.begin, "err", err)
+					select {
+						case fe.w.failed <- err:
+						default:
+					}
+				}
+				job.done(err)
+				fe.w.finished()
+		}
+	}
+}
+
+func (w *writers) finished() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending--
+	if w.pending == 0 {
+		for _, idle := range(w.idle) {
+			close(idle)
+		}
+		w.idle = nil
+	}
+}
+
+// Queue a block to be written, done is called by the writer once
+// the data is on disk (or failed to be written). Waits if the queue
+// is full.
+
+func (fe *fileStore) WriteAsync(index, begin int64, data []byte, done func(err error)) {
+	fe.w.mutex.Lock()
+	if fe.w.stopped {
+		fe.w.mutex.Unlock()
+		done(errors.New("Files closed"))
+		return
+	}
+	fe.w.pending++
+	fe.w.mutex.Unlock()
+	fe.w.queue <- &writeJob{index, begin, data, done}
+}
+
+// The errors of the writes, so the torrent can stop downloading when
+// the disk is full. Only the last one not read is kept.
+
+func (fe *fileStore) WriteErrors() (<-chan error) {
+	return fe.w.failed
+}
+
+// Blocks queued or being written
+
+func (fe *fileStore) QueueDepth() int {
+	fe.w.mutex.Lock()
+	defer fe.w.mutex.Unlock()
+	return fe.w.pending
+}
+
+// Wait until every queued block has been written
+
+func (fe *fileStore) waitWrites() {
+	if fe.w == nil {
+		return
+	}
+	fe.w.mutex.Lock()
+	if fe.w.pending == 0 {
+		fe.w.mutex.Unlock()
+		return
+	}
+	idle := make(chan bool)
+	fe.w.idle = append(fe.w.idle, idle)
+	fe.w.mutex.Unlock()
+	<- idle
+}
+
+func (fe *fileStore) stopWriters() {
+	if fe.w == nil {
+		return
+	}
+	fe.w.mutex.Lock()
+	if fe.w.stopped {
+		fe.w.mutex.Unlock()
+		return
+	}
+	fe.w.stopped = true
+	fe.w.mutex.Unlock()
+	fe.waitWrites()
+	close(fe.w.quit)
+}
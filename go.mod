@@ -0,0 +1,3 @@
+module wgo
+
+go 1.21
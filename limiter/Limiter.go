@@ -0,0 +1,267 @@
+// Token bucket rate limiters, a global one shared by all the peer
+// connections and (optionally) one for each peer. The limits can change
+// with a Schedule.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package limiter
+
+import(
+	"time"
+	"sync"
+	//"log"
+	"wgo/logger"
+	"errors"
+)
+
+var limiterLog = logger.New("limiter")
+
+const(
+	NS_PER_S = 1000000000
+	REFILLS_PER_S = 10 // Waiting transfers check the bucket every 100ms
+)
+
+// Bytes that can be transfered, refilled at rate bytes/s up to
+// rate bytes (one second of traffic). A rate of 0 means no limit.
+
+type bucket struct {
+	mutex *sync.Mutex
+	tokens, rate int64
+	last int64 // Time of the last refill, in ns
+}
+
+type limiter struct {
+	up, down *bucket
+	mutex *sync.Mutex // Of the fields below
+	upLimit, downLimit int // Of SetLimits, used outside the windows of the schedule
+	schedule *Schedule // nil for none
+	window int // Of the schedule in effect, -1 for none
+	quit chan bool // Of the goroutine of the schedule
+}
+
+// Limiter of a single peer, the traffic is limited by the limits
+// of the peer and the ones of the parent (global) limiter
+
+type peerLimiter struct {
+	limiter
+	parent Limiter
+}
+
+type Limiter interface {
+	WaitSend(size int64) int64
+	WaitReceive(size int64) int64
+	SetLimits(up_limit, down_limit int) (error)
+	SetSchedule(schedule *Schedule)
+	Limits() (up_limit, down_limit int, scheduled bool)
+}
+
+func newBucket(limit int) (b *bucket) {
+	b = new(bucket)
+	b.mutex = new(sync.Mutex)
+	b.setLimit(limit)
+	return
+}
+
+func (b *bucket) setLimit(limit int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rate = int64(limit)*1000
+	b.tokens = b.rate
+	b.last = time.Now().UnixNano()
+}
+
+func (b *bucket) refill() {
+	now := time.Now().UnixNano()
+	elapsed := now - b.last
+	if elapsed > NS_PER_S {
+		elapsed = NS_PER_S
+	}
+	if add := elapsed*b.rate/NS_PER_S; add > 0 {
+		b.tokens += add
+		b.last = now
+	}
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// Wait until there are tokens in the bucket, and take up to size
+// of them. Returns the number of bytes that can be transfered.
+
+func (b *bucket) wait(size int64) int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for {
+		if b.rate == 0 {
+			return size
+		}
+		b.refill()
+		if b.tokens > 0 {
+			break
+		}
+		b.mutex.Unlock()
+		time.Sleep(time.Second/REFILLS_PER_S)
+		b.mutex.Lock()
+	}
+	if size > b.tokens {
+		size = b.tokens
+	}
+	b.tokens -= size
+	return size
+}
+
+// Give back tokens taken but not used
+
+func (b *bucket) put(size int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rate > 0 {
+		b.tokens += size
+	}
+}
+
+func checkLimits(up_limit, down_limit int) (error) {
+	if up_limit < 0 || down_limit < 0 {
+		return errors.New("Invalid bandwidth limit")
+	}
+	return nil
+}
+
+func NewLimiter(up_limit, down_limit int) (Limiter, error) {
+	if err := checkLimits(up_limit, down_limit); err != nil {
+		return nil, err
+	}
+	l := new(limiter)
+	l.init(up_limit, down_limit)
+	return l, nil
+}
+
+// Create a limiter for a peer, without limits of its own until
+// SetLimits is called
+
+func NewPeerLimiter(parent Limiter) Limiter {
+	l := new(peerLimiter)
+	l.init(0, 0)
+	l.parent = parent
+	return l
+}
+
+func (l *limiter) init(up_limit, down_limit int) {
+	l.up, l.down = newBucket(up_limit), newBucket(down_limit)
+	l.mutex = new(sync.Mutex)
+	l.upLimit, l.downLimit = up_limit, down_limit
+	l.window = -1
+}
+
+func (l *limiter) WaitSend(size int64) int64 {
+	return l.up.wait(size)
+}
+
+func (l *limiter) WaitReceive(size int64) int64 {
+	return l.down.wait(size)
+}
+
+// Change the limits (in KB/s, 0 means no limit), can be used while
+// the connections are transfering data. Inside a window of the schedule
+// they are used when the window ends.
+
+func (l *limiter) SetLimits(up_limit, down_limit int) (error) {
+	if err := checkLimits(up_limit, down_limit); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.upLimit, l.downLimit = up_limit, down_limit
+	if l.window < 0 {
+		l.up.setLimit(up_limit)
+		l.down.setLimit(down_limit)
+	}
+	return nil
+}
+
+// Replace the schedule, nil removes it. The limits of the window we are
+// in are applied at once, and the others when their windows start.
+
+func (l *limiter) SetSchedule(schedule *Schedule) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.quit != nil {
+		close(l.quit)
+		l.quit = nil
+	}
+	l.schedule = schedule
+	l.window = -2 // Applied by the next update whatever window it is
+	l.update(time.Now())
+	if schedule != nil && len(schedule.Windows) > 0 {
+		l.quit = make(chan bool)
+		go l.runSchedule(l.quit)
+	}
+}
+
+// The limits in effect, and whether they are the ones of a window of
+// the schedule
+
+func (l *limiter) Limits() (up_limit, down_limit int, scheduled bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.window >= 0 {
+		w := &l.schedule.Windows[l.window]
+		return w.UpLimit, w.DownLimit, true
+	}
+	return l.upLimit, l.downLimit, false
+}
+
+// The windows start and end at whole minutes
+
+func (l *limiter) runSchedule(quit chan bool) {
+	for {
+		now := time.Now()
+		next := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+			case <- quit:
+				next.Stop()
+				return
+			case now = <- next.C:
+				l.mutex.Lock()
+				l.update(now)
+				l.mutex.Unlock()
+		}
+	}
+}
+
+// Called with the mutex held
+
+func (l *limiter) update(now time.Time) {
+	window := -1
+	if l.schedule != nil {
+		window = l.schedule.find(now)
+	}
+	if window == l.window {
+		return
+	}
+	l.window = window
+	up, down := l.upLimit, l.downLimit
+	if window >= 0 {
+		w := &l.schedule.Windows[window]
+		up, down = w.UpLimit, w.DownLimit
+		limiterLog.Info("Schedule window started", "window", window, "up_limit", up, "down_limit", down)
+	} else if l.schedule != nil {
+		limiterLog.Info("Outside the windows of the schedule", "up_limit", up, "down_limit", down)
+	}
+	l.up.setLimit(up)
+	l.down.setLimit(down)
+}
+
+func (l *peerLimiter) WaitSend(size int64) int64 {
+	size = l.up.wait(size)
+	send := l.parent.WaitSend(size)
+	l.up.put(size - send)
+	return send
+}
+
+func (l *peerLimiter) WaitReceive(size int64) int64 {
+	size = l.down.wait(size)
+	receive := l.parent.WaitReceive(size)
+	l.down.put(size - receive)
+	return receive
+}
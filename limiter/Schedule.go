@@ -0,0 +1,164 @@
+// Alternative limits for windows of time of the week, like no limit at
+// night and a low one during office hours. Written in the config as
+// windows separated by ";":
+//
+//	mon-fri 08:00-18:00 100/50; 01:00-07:00 0/0
+//
+// with the days of the week the windows start in (every day if left
+// out) and the upload/download limits in KB/s, 0 means no limit.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package limiter
+
+import(
+	"time"
+	"strings"
+	"strconv"
+	"errors"
+)
+
+const(
+	MINUTES_PER_DAY = 24*60
+)
+
+var days = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type Window struct {
+	Days [7]bool // By time.Weekday, of the start of the window
+	Start, End int // Minutes since midnight, a window with the end before the start goes past midnight
+	UpLimit, DownLimit int // In KB/s, 0 means no limit
+}
+
+// The windows and the time zone of their times, the first window that
+// contains the time gives the limits
+
+type Schedule struct {
+	Windows []Window
+	Location *time.Location
+}
+
+func ParseSchedule(value string) (windows []Window, err error) {
+	for _, entry := range(strings.Split(value, ";")) {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var w Window
+		if len(fields) == 3 {
+			if w.Days, err = parseDays(fields[0]); err != nil {
+				return
+			}
+			fields = fields[1:]
+		} else if len(fields) == 2 {
+			for i, _ := range(w.Days) {
+				w.Days[i] = true
+			}
+		} else {
+			return nil, errors.New("Expected [days] HH:MM-HH:MM up/down in " + strings.TrimSpace(entry))
+		}
+		times := strings.Split(fields[0], "-")
+		if len(times) != 2 {
+			return nil, errors.New("Expected HH:MM-HH:MM, not " + fields[0])
+		}
+		if w.Start, err = parseTime(times[0]); err != nil {
+			return
+		}
+		if w.End, err = parseTime(times[1]); err != nil {
+			return
+		}
+		if w.Start == w.End || w.Start == MINUTES_PER_DAY {
+			return nil, errors.New("Empty window " + fields[0])
+		}
+		limits := strings.Split(fields[1], "/")
+		if len(limits) != 2 {
+			return nil, errors.New("Expected up/down limits, not " + fields[1])
+		}
+		if w.UpLimit, err = strconv.Atoi(limits[0]); err != nil {
+			return
+		}
+		if w.DownLimit, err = strconv.Atoi(limits[1]); err != nil {
+			return
+		}
+		if err = checkLimits(w.UpLimit, w.DownLimit); err != nil {
+			return
+		}
+		windows = append(windows, w)
+	}
+	return
+}
+
+// A list of days and ranges of days, like mon,wed or fri-mon
+
+func parseDays(value string) (d [7]bool, err error) {
+	for _, item := range(strings.Split(value, ",")) {
+		bounds := strings.Split(item, "-")
+		if len(bounds) > 2 {
+			return d, errors.New("Invalid days " + item)
+		}
+		first, last := -1, -1
+		for i, day := range(days) {
+			if strings.EqualFold(bounds[0], day) {
+				first = i
+			}
+			if strings.EqualFold(bounds[len(bounds)-1], day) {
+				last = i
+			}
+		}
+		if first < 0 || last < 0 {
+			return d, errors.New("Invalid days " + item)
+		}
+		for i := first; ; i = (i + 1) % 7 {
+			d[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+	return
+}
+
+// HH:MM, up to 24:00
+
+func parseTime(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, errors.New("Expected HH:MM, not " + value)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	if hours < 0 || minutes < 0 || minutes >= 60 || hours*60 + minutes > MINUTES_PER_DAY {
+		return 0, errors.New("Invalid time " + value)
+	}
+	return hours*60 + minutes, nil
+}
+
+func (w *Window) contains(day time.Weekday, minute int) bool {
+	if w.Start < w.End {
+		return w.Days[day] && minute >= w.Start && minute < w.End
+	}
+	// Past midnight, the part after it belongs to the window of the day before
+	yesterday := (day + 6) % 7
+	return (w.Days[day] && minute >= w.Start) || (w.Days[yesterday] && minute < w.End)
+}
+
+// Index of the window of the time, -1 if it isn't in any of them
+
+func (s *Schedule) find(now time.Time) int {
+	if s.Location != nil {
+		now = now.In(s.Location)
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for i, _ := range(s.Windows) {
+		if s.Windows[i].contains(now.Weekday(), minute) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,188 @@
+package listener
+
+import(
+	"net"
+	"bytes"
+	"bufio"
+	"wgo/peers"
+	"wgo/utp"
+	"wgo/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const(
+	HANDSHAKE_TIMEOUT = 20*time.Second
+	PROTOCOL = "\x13BitTorrent protocol"
+)
+
+var listenerLog = logger.New("listener")
+
+// The listener is shared by all the torrents of the session, incoming
+// connections are handed to the PeerMgr of the requested infohash
+
+type Listener struct {
+	mutex *sync.Mutex
+	listener net.Listener
+	utpListener net.Listener
+	peerMgrs map[string]peers.PeerMgr // By infohash
+	policy int // Encryption policy of the incoming connections
+	handshakeTimeout time.Duration // To receive the handshake
+	quit chan bool
+}
+
+func NewListener(ip, port string, policy int, utpEnabled bool) (l *Listener, cport string, err error) {
+	l = new(Listener)
+	l.listener, err = net.Listen("tcp4", ip + ":" + port)
+	if err != nil {
+		return
+	}
+	l.mutex = new(sync.Mutex)
+	l.peerMgrs = make(map[string]peers.PeerMgr)
+	l.policy = policy
+	l.handshakeTimeout = HANDSHAKE_TIMEOUT
+	l.quit = make(chan bool)
+	listenerLog.Info("Listening", "addr", l.listener.Addr().String())
+	cport = l.listener.Addr().String()[strings.LastIndex(l.listener.Addr().String(), ":")+1:]
+	go l.Run(l.listener)
+	if utpEnabled {
+		// uTP uses the same port number as TCP
+		if l.utpListener, err = utp.Listen(ip + ":" + cport); err != nil {
+			listenerLog.Warn("Unable to listen for uTP connections", "err", err)
+			err = nil
+		} else {
+			go l.Run(l.utpListener)
+		}
+	}
+	return
+}
+
+// Seconds the incoming peers have to send their handshake
+
+func (l *Listener) SetHandshakeTimeout(seconds int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.handshakeTimeout = time.Duration(seconds)*time.Second
+}
+
+// Start accepting the peers of a torrent
+
+func (l *Listener) AddPeerMgr(peerMgr peers.PeerMgr) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.peerMgrs[peerMgr.Infohash()] = peerMgr
+	if v2 := peerMgr.InfohashV2(); len(v2) > 0 {
+		l.peerMgrs[v2] = peerMgr
+	}
+}
+
+// Stop accepting the peers of a torrent, with any of its infohashes
+
+func (l *Listener) RemovePeerMgr(infohash string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if peerMgr, ok := l.peerMgrs[infohash]; ok {
+		if v2 := peerMgr.InfohashV2(); len(v2) > 0 {
+			delete(l.peerMgrs, v2)
+		}
+	}
+	delete(l.peerMgrs, infohash)
+}
+
+func (l *Listener) infohashes() (infohashes []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	infohashes = make([]string, 0, len(l.peerMgrs))
+	for infohash, _ := range(l.peerMgrs) {
+		infohashes = append(infohashes, infohash)
+	}
+	return
+}
+
+func (l *Listener) peerMgr(infohash string) (peerMgr peers.PeerMgr, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	peerMgr, ok = l.peerMgrs[infohash]
+	return
+}
+
+func (l *Listener) Run(listener net.Listener) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			select {
+				case <- l.quit:
+					return
+				default:
+			}
+			listenerLog.Warn("Error accepting connection", "err", err)
+			continue
+		}
+		listenerLog.Debug("New connection", "addr", c.RemoteAddr().String())
+		go l.Handshake(c)
+	}
+}
+
+// Stop accepting connections
+
+func (l *Listener) Close() {
+	close(l.quit)
+	l.listener.Close()
+	if l.utpListener != nil {
+		l.utpListener.Close()
+	}
+}
+
+// Read the handshake of the incoming peer, and hand the
+// connection to the PeerMgr of the requested torrent. Connections
+// that don't start with the protocol string use MSE.
+
+func (l *Listener) Handshake(c net.Conn) {
+	l.mutex.Lock()
+	timeout := l.handshakeTimeout
+	l.mutex.Unlock()
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		c.Close()
+		return
+	}
+	policy := l.policy
+	r := bufio.NewReader(c)
+	header, err := r.Peek(len(PROTOCOL))
+	if err != nil {
+		c.Close()
+		return
+	}
+	var conn net.Conn
+	var mseInfohash string
+	if bytes.Equal(header, []byte(PROTOCOL)) {
+		if policy == peers.ENCRYPTION_REQUIRE {
+			c.Close()
+			return
+		}
+		conn = peers.NewBufferedConn(c, r)
+	} else {
+		if policy == peers.ENCRYPTION_DISABLE {
+			c.Close()
+			return
+		}
+		if conn, mseInfohash, err = peers.MseRespond(c, r, l.infohashes(), policy); err != nil {
+			listenerLog.Debug("Error in the encrypted handshake", "addr", c.RemoteAddr().String(), "err", err)
+			c.Close()
+			return
+		}
+	}
+	reserved, infohash, peerid, err := peers.ReadHandshake(conn)
+	if err != nil {
+		listenerLog.Debug("Error reading the handshake", "addr", c.RemoteAddr().String(), "err", err)
+		c.Close()
+		return
+	}
+	peerMgr, ok := l.peerMgr(infohash)
+	if !ok || (len(mseInfohash) > 0 && mseInfohash != infohash) {
+		listenerLog.Debug("Unknown infohash", "addr", c.RemoteAddr().String())
+		c.Close()
+		return
+	}
+	peerMgr.AddPeer(conn, reserved, infohash, peerid)
+}
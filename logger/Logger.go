@@ -0,0 +1,157 @@
+// Leveled logging with a tag per subsystem (peer, wire, tracker,
+// disk...) and key/value pairs:
+//
+//	2011/03/01 18:30:02 INFO tracker Announce finished url=http://... interval=1800
+//
+// The level can be set globally and for each tag, while running.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package logger
+
+import(
+	"os"
+	"io"
+	"fmt"
+	"log"
+	"sync"
+	"bytes"
+	"strings"
+	"errors"
+	)
+
+const(
+	DEBUG = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// Levels and output shared by every Logger
+
+var(
+	mutex = new(sync.Mutex)
+	level = INFO
+	tagLevels = make(map[string]int)
+	output = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+type Logger struct {
+	tag string
+}
+
+func New(tag string) *Logger {
+	return &Logger{tag: tag}
+}
+
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	output = log.New(w, "", log.LstdFlags)
+}
+
+// Set the default level and the levels of some tags, tags not in
+// the map go back to the default level
+
+func SetLevels(def int, tags map[string]int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	level = def
+	tagLevels = make(map[string]int, len(tags))
+	for tag, l := range(tags) {
+		tagLevels[tag] = l
+	}
+}
+
+func ParseLevel(name string) (int, error) {
+	for l, n := range(levelNames) {
+		if strings.ToUpper(name) == n {
+			return l, nil
+		}
+	}
+	return INFO, errors.New("Unknown log level " + name)
+}
+
+// Parse a list like "info,peer=debug,tracker=warn", the entry
+// without tag is the default level
+
+func ParseLevels(list string) (def int, tags map[string]int, err error) {
+	def = INFO
+	tags = make(map[string]int)
+	for _, entry := range(strings.Split(list, ",")) {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		if i := strings.Index(entry, "="); i >= 0 {
+			if tags[strings.TrimSpace(entry[0:i])], err = ParseLevel(strings.TrimSpace(entry[i+1:])); err != nil {
+				return
+			}
+		} else if def, err = ParseLevel(entry); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (l *Logger) enabled(lvl int) bool {
+	if tl, ok := tagLevels[l.tag]; ok {
+		return lvl >= tl
+	}
+	return lvl >= level
+}
+
+// Whether the messages of a level are written, to avoid building
+// expensive values for nothing
+
+func (l *Logger) Enabled(lvl int) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return l.enabled(lvl)
+}
+
+// Quote the values that would be ambiguous without quotes
+
+func value(v interface{}) string {
+	s := fmt.Sprint(v)
+	if len(s) == 0 || strings.IndexAny(s, " \t\n\"=") >= 0 {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// Write msg followed by the pairs of keys and values in kv
+
+func (l *Logger) Log(lvl int, msg string, kv ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !l.enabled(lvl) {
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(levelNames[lvl] + " " + l.tag + " " + msg)
+	for i := 0; i < len(kv); i += 2 {
+		buf.WriteString(" " + fmt.Sprint(kv[i]) + "=")
+		if i+1 < len(kv) {
+			buf.WriteString(value(kv[i+1]))
+		}
+	}
+	output.Output(3, buf.String())
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.Log(DEBUG, msg, kv...)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.Log(INFO, msg, kv...)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.Log(WARN, msg, kv...)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.Log(ERROR, msg, kv...)
+}
@@ -0,0 +1,192 @@
+// Local Peer Discovery (BEP 14), announce the torrents with
+// multicast messages to find peers in the local network
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package lsd
+
+import(
+	"io"
+	"fmt"
+	"net"
+	"time"
+	"strings"
+	"sync"
+	"crypto/rand"
+	"encoding/hex"
+	"container/list"
+	"wgo/peers"
+	"wgo/logger"
+	"errors"
+	)
+
+const(
+	LSD_ADDR = "239.192.152.143:6771"
+	LSD_PORT = 6771
+	LSD_INTERVAL = 300*time.Second // Between announces
+	MAX_PACKET = 1400
+)
+
+var lsdLog = logger.New("lsd")
+
+// Receives the peers found in the local network
+
+type PeerMgr interface {
+	Infohash() string
+	AddPeers(peers *list.List, source string)
+}
+
+// A single Lsd announces every torrent of the session
+
+type Lsd struct {
+	mutex *sync.Mutex
+	conn *net.UDPConn
+	addr *net.UDPAddr
+	peerMgrs map[string]PeerMgr // By infohash, in lower case hex
+	port, cookie string
+	quit chan bool
+}
+
+func NewLsd(port string) (l *Lsd, err error) {
+	l = new(Lsd)
+	l.mutex = new(sync.Mutex)
+	l.port = port
+	l.peerMgrs = make(map[string]PeerMgr)
+	if l.addr, err = net.ResolveUDPAddr("udp4", LSD_ADDR); err != nil {
+		return
+	}
+	// Listens on LSD_PORT, joined to the group of the announces
+	if l.conn, err = net.ListenMulticastUDP("udp4", nil, l.addr); err != nil {
+		return
+	}
+	// The cookie allows us to ignore our own announces
+	cookie := make([]byte, 8)
+	if _, err = io.ReadFull(rand.Reader, cookie); err != nil {
+		l.conn.Close()
+		return
+	}
+	l.cookie = hex.EncodeToString(cookie)
+	l.quit = make(chan bool)
+	go l.Run()
+	go l.Listen()
+	return
+}
+
+// Start announcing a torrent, private torrents must not be added
+
+func (l *Lsd) Add(peerMgr PeerMgr) {
+	infohash := hex.EncodeToString([]byte(peerMgr.Infohash()))
+	l.mutex.Lock()
+	l.peerMgrs[infohash] = peerMgr
+	l.mutex.Unlock()
+	l.send([]string{infohash})
+}
+
+func (l *Lsd) Remove(infohash string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.peerMgrs, hex.EncodeToString([]byte(infohash)))
+}
+
+func (l *Lsd) Run() {
+	announce := time.NewTicker(LSD_INTERVAL)
+	for {
+		select {
+			case <- l.quit:
+				announce.Stop()
+				return
+			case <- announce.C:
+				l.Announce()
+		}
+	}
+}
+
+// Stop announcing, closing the socket also ends Listen
+
+func (l *Lsd) Stop() {
+	close(l.quit)
+	l.conn.Close()
+}
+
+func (l *Lsd) Announce() {
+	l.mutex.Lock()
+	infohashes := make([]string, 0, len(l.peerMgrs))
+	for infohash, _ := range(l.peerMgrs) {
+		infohashes = append(infohashes, infohash)
+	}
+	l.mutex.Unlock()
+	if len(infohashes) > 0 {
+		l.send(infohashes)
+	}
+}
+
+// Send an announce with one Infohash header for each torrent
+
+func (l *Lsd) send(infohashes []string) {
+	msg := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %s\r\n", LSD_ADDR, l.port)
+	for _, infohash := range(infohashes) {
+		msg += "Infohash: " + infohash + "\r\n"
+	}
+	msg += "cookie: " + l.cookie + "\r\n\r\n\r\n"
+	if _, err := l.conn.WriteToUDP([]byte(msg), l.addr); err != nil {
+		lsdLog.Warn("Error sending announce", "err", err)
+	}
+}
+
+func (l *Lsd) Listen() {
+	buf := make([]byte, MAX_PACKET)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+				case <- l.quit:
+				default:
+					lsdLog.Error("Error reading", "err", err)
+			}
+			return
+		}
+		port, infohashes, cookie, err := parseAnnounce(string(buf[0:n]))
+		if err != nil || cookie == l.cookie {
+			continue
+		}
+		for _, hash := range(infohashes) {
+			l.mutex.Lock()
+			peerMgr, ok := l.peerMgrs[hash]
+			l.mutex.Unlock()
+			if ok {
+				peer := list.New()
+				peer.PushBack(addr.IP.String() + ":" + port)
+				peerMgr.AddPeers(peer, peers.SOURCE_LOCAL)
+			}
+		}
+	}
+}
+
+// Obtain the port, the infohashes (in lower case hex) and the
+// cookie of an announce
+
+func parseAnnounce(msg string) (port string, infohashes []string, cookie string, err error) {
+	lines := strings.Split(msg, "\r\n")
+	if len(lines) == 0 || lines[0] != "BT-SEARCH * HTTP/1.1" {
+		return port, infohashes, cookie, errors.New("Invalid announce")
+	}
+	for _, line := range(lines[1:]) {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch strings.ToLower(strings.TrimSpace(line[0:i])) {
+			case "port":
+				port = value
+			case "infohash":
+				infohashes = append(infohashes, strings.ToLower(value))
+			case "cookie":
+				cookie = value
+		}
+	}
+	if len(port) == 0 || len(infohashes) == 0 {
+		return port, infohashes, cookie, errors.New("Invalid announce")
+	}
+	return
+}
@@ -0,0 +1,132 @@
+// Port mapping in the gateway, so peers outside our network
+// can connect to us
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package nat
+
+import(
+	"time"
+	"wgo/logger"
+	"errors"
+	)
+
+const(
+	LEASE_DURATION = 3600 // Seconds
+	REFRESH_INTERVAL = LEASE_DURATION/2*time.Second
+	DISCOVERY_TIMEOUT = 3*time.Second
+)
+
+var natLog = logger.New("nat")
+
+// Protocols implemented by the gateways
+
+type PortMapper interface {
+	// Returns the external port assigned by the gateway
+	AddPortMapping(protocol string, internalPort, externalPort int, lease int) (mapped int, err error)
+	DeletePortMapping(protocol string, internalPort, externalPort int) (error)
+	// Address of the gateway in the internet
+	ExternalIp() (ip string, err error)
+	Name() string
+}
+
+// TCP and UDP mapping of the listening port, refreshed
+// periodically until Stop is called
+
+type Mapping struct {
+	mapper PortMapper
+	port, external int
+	externalIp string // Empty if the gateway didn't tell it
+	quit chan bool
+}
+
+// Find a protocol the gateway answers to: UPnP, PCP or NAT-PMP
+
+func discover() (mapper PortMapper, err error) {
+	if u, err := discoverUpnp(); err == nil {
+		return u, nil
+	}
+	gateway, err := gatewayIp()
+	if err != nil {
+		return
+	}
+	if p, err := discoverPcp(gateway); err == nil {
+		return p, nil
+	}
+	if p, err := discoverPmp(gateway); err == nil {
+		return p, nil
+	}
+	return mapper, errors.New("The gateway doesn't support UPnP, PCP nor NAT-PMP")
+}
+
+// Find the gateway and map the port
+
+func NewMapping(port int) (m *Mapping, err error) {
+	mapper, err := discover()
+	if err != nil {
+		return
+	}
+	m = &Mapping{mapper: mapper, port: port, external: port, quit: make(chan bool)}
+	if err = m.add(); err != nil {
+		return
+	}
+	if ip, err := mapper.ExternalIp(); err == nil {
+		m.externalIp = ip
+	} else {
+		natLog.Debug("Error getting the external address", "err", err)
+	}
+	natLog.Info("Port mapped", "port", port, "external", m.external, "ip", m.externalIp, "protocol", mapper.Name())
+	go m.Run()
+	return
+}
+
+func (m *Mapping) add() (err error) {
+	for _, protocol := range([]string{"TCP", "UDP"}) {
+		var mapped int
+		if mapped, err = m.mapper.AddPortMapping(protocol, m.port, m.external, LEASE_DURATION); err != nil {
+			return
+		}
+		m.external = mapped
+	}
+	return
+}
+
+func (m *Mapping) Run() {
+	refresh := time.NewTicker(REFRESH_INTERVAL)
+	defer refresh.Stop()
+	for {
+		select {
+			case <- m.quit:
+				for _, protocol := range([]string{"TCP", "UDP"}) {
+					if err := m.mapper.DeletePortMapping(protocol, m.port, m.external); err != nil {
+						natLog.Warn("Error removing port mapping", "err", err)
+					}
+				}
+				m.quit <- true
+				return
+			case <- refresh.C:
+				if err := m.add(); err != nil {
+					natLog.Warn("Error refreshing port mapping", "err", err)
+				}
+		}
+	}
+}
+
+// Port the peers outside our network have to connect to
+
+func (m *Mapping) ExternalPort() int {
+	return m.external
+}
+
+// Our address in the internet, empty if unknown
+
+func (m *Mapping) ExternalIp() string {
+	return m.externalIp
+}
+
+// Remove the mapping from the gateway
+
+func (m *Mapping) Stop() {
+	m.quit <- true
+	<- m.quit
+}
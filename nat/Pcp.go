@@ -0,0 +1,116 @@
+// Port Control Protocol port mapping (RFC 6887)
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package nat
+
+import(
+	"net"
+	"bytes"
+	"strconv"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	)
+
+const(
+	PCP_VERSION = 2
+	PCP_MAP = 1
+	PCP_UNSUPP_VERSION = 1
+)
+
+type pcp struct {
+	gateway string
+	localIp net.IP
+	nonce []byte // Identifies our mappings
+	external net.IP // Assigned to the last mapping
+}
+
+func discoverPcp(gateway string) (p *pcp, err error) {
+	ip, err := localIp("http://" + gateway + ":" + strconv.Itoa(PMP_PORT))
+	if err != nil {
+		return
+	}
+	p = &pcp{gateway: gateway, localIp: net.ParseIP(ip), nonce: make([]byte, 12)}
+	if p.localIp == nil {
+		return p, errors.New("Invalid local address " + ip)
+	}
+	if _, err = rand.Read(p.nonce); err != nil {
+		return
+	}
+	// Any answer with our version to a MAP request means the
+	// gateway speaks PCP, even if the result is an error
+	response, err := p.send(p.mapRequest("TCP", 0, 0, 0))
+	if err == nil && response[0] != PCP_VERSION {
+		err = errors.New("Gateway doesn't support PCP")
+	}
+	return
+}
+
+func pcpProtocol(protocol string) byte {
+	if protocol == "TCP" {
+		return 6
+	}
+	return 17
+}
+
+func (p *pcp) mapRequest(protocol string, internalPort, externalPort, lease int) (request []byte) {
+	request = make([]byte, 60)
+	request[0] = PCP_VERSION
+	request[1] = PCP_MAP
+	binary.BigEndian.PutUint32(request[4:8], uint32(lease))
+	copy(request[8:24], p.localIp.To16())
+	copy(request[24:36], p.nonce)
+	request[36] = pcpProtocol(protocol)
+	binary.BigEndian.PutUint16(request[40:42], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[42:44], uint16(externalPort))
+	// Any external address
+	copy(request[44:60], net.IPv4zero.To16())
+	return
+}
+
+func (p *pcp) send(request []byte) (response []byte, err error) {
+	return gatewayRequest(p.gateway, request, func(b []byte) bool {
+		// NAT-PMP gateways answer with version 0
+		return len(b) >= 4 && (b[0] == 0 || (len(b) >= 60 && b[1] == 128 + PCP_MAP && bytes.Equal(b[24:36], p.nonce)))
+	})
+}
+
+func (p *pcp) request(protocol string, internalPort, externalPort, lease int) (mapped int, err error) {
+	response, err := p.send(p.mapRequest(protocol, internalPort, externalPort, lease))
+	if err != nil {
+		return
+	}
+	if response[0] != PCP_VERSION {
+		return mapped, errors.New("Gateway doesn't support PCP")
+	}
+	if result := response[3]; result != 0 {
+		return mapped, errors.New("PCP error " + strconv.Itoa(int(result)))
+	}
+	if lease > 0 {
+		p.external = net.IP(response[44:60])
+	}
+	return int(binary.BigEndian.Uint16(response[42:44])), nil
+}
+
+func (p *pcp) AddPortMapping(protocol string, internalPort, externalPort int, lease int) (mapped int, err error) {
+	return p.request(protocol, internalPort, externalPort, lease)
+}
+
+func (p *pcp) DeletePortMapping(protocol string, internalPort, externalPort int) (err error) {
+	_, err = p.request(protocol, internalPort, 0, 0)
+	return
+}
+
+// PCP has no request of the external address, it comes with the mappings
+
+func (p *pcp) ExternalIp() (ip string, err error) {
+	if p.external == nil {
+		return ip, errors.New("No mapping yet")
+	}
+	return p.external.String(), nil
+}
+
+func (p *pcp) Name() string {
+	return "PCP"
+}
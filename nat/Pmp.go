@@ -0,0 +1,148 @@
+// NAT-PMP port mapping (RFC 6886)
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package nat
+
+import(
+	"net"
+	"time"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"encoding/binary"
+	"errors"
+	)
+
+const(
+	PMP_PORT = 5351
+	PMP_RETRIES = 4
+	PMP_TIMEOUT = 250*time.Millisecond // Doubled on each retry
+)
+
+type pmp struct {
+	gateway string
+}
+
+// Default gateway, read from the routing table
+
+func gatewayIp() (ip string, err error) {
+	data, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return
+	}
+	for _, line := range(strings.Split(string(data), "\n")[1:]) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		// Gateway in little endian hex
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		return strconv.Itoa(int(gw&0xff)) + "." + strconv.Itoa(int(gw>>8&0xff)) + "." + strconv.Itoa(int(gw>>16&0xff)) + "." + strconv.Itoa(int(gw>>24&0xff)), nil
+	}
+	return ip, errors.New("Default gateway not found")
+}
+
+// Send a request to the gateway, retransmitting it with increasing
+// timeouts, and return the response
+
+func gatewayRequest(gateway string, request []byte, check func([]byte) bool) (response []byte, err error) {
+	addr, err := net.ResolveUDPAddr("udp4", gateway + ":" + strconv.Itoa(PMP_PORT))
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100)
+	timeout := PMP_TIMEOUT
+	for retry := 0; retry < PMP_RETRIES; retry++ {
+		if _, err = conn.Write(request); err != nil {
+			return
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if check(buf[0:n]) {
+				response = make([]byte, n)
+				copy(response, buf[0:n])
+				return response, nil
+			}
+		}
+		timeout *= 2
+	}
+	return response, errors.New("No answer from the gateway")
+}
+
+// Check that the gateway answers to NAT-PMP
+
+func discoverPmp(gateway string) (p *pmp, err error) {
+	p = &pmp{gateway: gateway}
+	// External address request
+	_, err = gatewayRequest(gateway, []byte{0, 0}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == 0 && b[1] == 128
+	})
+	return
+}
+
+func pmpOpcode(protocol string) byte {
+	if protocol == "TCP" {
+		return 2
+	}
+	return 1
+}
+
+func (p *pmp) request(protocol string, internalPort, externalPort, lease int) (mapped int, err error) {
+	request := make([]byte, 12)
+	request[1] = pmpOpcode(protocol)
+	binary.BigEndian.PutUint16(request[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(request[8:12], uint32(lease))
+	response, err := gatewayRequest(p.gateway, request, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == 0 && b[1] == 128 + request[1]
+	})
+	if err != nil {
+		return
+	}
+	if result := binary.BigEndian.Uint16(response[2:4]); result != 0 {
+		return mapped, errors.New("NAT-PMP error " + strconv.Itoa(int(result)))
+	}
+	return int(binary.BigEndian.Uint16(response[10:12])), nil
+}
+
+func (p *pmp) AddPortMapping(protocol string, internalPort, externalPort int, lease int) (mapped int, err error) {
+	return p.request(protocol, internalPort, externalPort, lease)
+}
+
+func (p *pmp) DeletePortMapping(protocol string, internalPort, externalPort int) (err error) {
+	// A lifetime of 0 removes the mapping
+	_, err = p.request(protocol, internalPort, 0, 0)
+	return
+}
+
+func (p *pmp) ExternalIp() (ip string, err error) {
+	response, err := gatewayRequest(p.gateway, []byte{0, 0}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == 0 && b[1] == 128
+	})
+	if err != nil {
+		return
+	}
+	if result := binary.BigEndian.Uint16(response[2:4]); result != 0 {
+		return ip, errors.New("NAT-PMP error " + strconv.Itoa(int(result)))
+	}
+	return net.IP(response[8:12]).String(), nil
+}
+
+func (p *pmp) Name() string {
+	return "NAT-PMP"
+}
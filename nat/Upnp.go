@@ -0,0 +1,246 @@
+// UPnP Internet Gateway Device port mapping
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package nat
+
+import(
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"bytes"
+	"strings"
+	"strconv"
+	"time"
+	"errors"
+	)
+
+const(
+	SSDP_ADDR = "239.255.255.250:1900"
+	UPNP_DEVICE = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	UPNP_DESCRIPTION = "wgo"
+)
+
+// Services that allow port mappings
+
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnp struct {
+	controlUrl, service, localIp string
+}
+
+// Search the gateway with SSDP and obtain its control url
+
+func discoverUpnp() (u *upnp, err error) {
+	addr, err := net.ResolveUDPAddr("udp4", SSDP_ADDR)
+	if err != nil {
+		return
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDP_ADDR + "\r\n" +
+		"ST: " + UPNP_DEVICE + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err = conn.WriteToUDP([]byte(search), addr); err != nil {
+		return
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(DISCOVERY_TIMEOUT)); err != nil {
+		return
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return u, fmt.Errorf("No UPnP gateway found: %w", err)
+		}
+		location := header(string(buf[0:n]), "location")
+		if len(location) == 0 {
+			continue
+		}
+		if u, err = newUpnp(location); err == nil {
+			return u, nil
+		}
+	}
+}
+
+// Value of a header of an HTTP like message
+
+func header(msg, name string) string {
+	for _, line := range(strings.Split(msg, "\r\n")) {
+		if i := strings.Index(line, ":"); i > 0 && strings.ToLower(strings.TrimSpace(line[0:i])) == name {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// Read the device description to find the control url of the service
+
+func newUpnp(location string) (u *upnp, err error) {
+	response, err := http.Get(location)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
+	description := string(data)
+	for _, service := range(upnpServices) {
+		i := strings.Index(description, service)
+		if i < 0 {
+			continue
+		}
+		control := tag(description[i:], "controlURL")
+		if len(control) == 0 {
+			continue
+		}
+		u = &upnp{service: service}
+		if u.controlUrl, err = resolveUrl(location, tag(description, "URLBase"), control); err != nil {
+			return
+		}
+		if u.localIp, err = localIp(u.controlUrl); err != nil {
+			return
+		}
+		return u, nil
+	}
+	return u, errors.New("Gateway without port mapping service")
+}
+
+// Content of the first appearance of a xml tag
+
+func tag(xml, name string) string {
+	start := strings.Index(xml, "<" + name + ">")
+	if start < 0 {
+		return ""
+	}
+	start += len(name) + 2
+	end := strings.Index(xml[start:], "</" + name + ">")
+	if end < 0 {
+		return ""
+	}
+	return strings.TrimSpace(xml[start:start+end])
+}
+
+// The control url can be relative to the base url or the location
+
+func resolveUrl(location, base, control string) (string, error) {
+	if strings.HasPrefix(control, "http://") {
+		return control, nil
+	}
+	if len(base) == 0 {
+		base = location
+	}
+	if !strings.HasPrefix(base, "http://") {
+		return "", errors.New("Invalid gateway url " + base)
+	}
+	host := base[len("http://"):]
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[0:i]
+	}
+	if !strings.HasPrefix(control, "/") {
+		control = "/" + control
+	}
+	return "http://" + host + control, nil
+}
+
+// Our address in the network of the gateway
+
+func localIp(url string) (ip string, err error) {
+	host := url[len("http://"):]
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[0:i]
+	}
+	if strings.Index(host, ":") < 0 {
+		host += ":80"
+	}
+	addr, err := net.ResolveUDPAddr("udp4", host)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().String()
+	return local[0:strings.LastIndex(local, ":")], nil
+}
+
+// Send a SOAP action to the gateway
+
+func (u *upnp) soap(action, arguments string) (body []byte, err error) {
+	envelope := "<?xml version=\"1.0\"?>\r\n" +
+		"<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\" s:encodingStyle=\"http://schemas.xmlsoap.org/soap/encoding/\">" +
+		"<s:Body><u:" + action + " xmlns:u=\"" + u.service + "\">" + arguments + "</u:" + action + "></s:Body></s:Envelope>"
+	req, err := http.NewRequest("POST", u.controlUrl, bytes.NewBufferString(envelope))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	req.Header.Set("SOAPAction", "\"" + u.service + "#" + action + "\"")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return body, errors.New("UPnP " + action + " failed: " + response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+func (u *upnp) AddPortMapping(protocol string, internalPort, externalPort int, lease int) (mapped int, err error) {
+	arguments := "<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.Itoa(externalPort) + "</NewExternalPort>" +
+		"<NewProtocol>" + protocol + "</NewProtocol>" +
+		"<NewInternalPort>" + strconv.Itoa(internalPort) + "</NewInternalPort>" +
+		"<NewInternalClient>" + u.localIp + "</NewInternalClient>" +
+		"<NewEnabled>1</NewEnabled>" +
+		"<NewPortMappingDescription>" + UPNP_DESCRIPTION + "</NewPortMappingDescription>" +
+		"<NewLeaseDuration>" + strconv.Itoa(lease) + "</NewLeaseDuration>"
+	if _, err = u.soap("AddPortMapping", arguments); err != nil {
+		return
+	}
+	return externalPort, nil
+}
+
+func (u *upnp) DeletePortMapping(protocol string, internalPort, externalPort int) (error) {
+	arguments := "<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.Itoa(externalPort) + "</NewExternalPort>" +
+		"<NewProtocol>" + protocol + "</NewProtocol>"
+	_, err := u.soap("DeletePortMapping", arguments)
+	return err
+}
+
+func (u *upnp) ExternalIp() (ip string, err error) {
+	body, err := u.soap("GetExternalIPAddress", "")
+	if err != nil {
+		return
+	}
+	response := string(body)
+	start := strings.Index(response, "<NewExternalIPAddress>")
+	end := strings.Index(response, "</NewExternalIPAddress>")
+	if start < 0 || end < start {
+		return ip, errors.New("No external address in the UPnP answer")
+	}
+	ip = strings.TrimSpace(response[start+len("<NewExternalIPAddress>"):end])
+	if net.ParseIP(ip) == nil {
+		return "", errors.New("Invalid external address " + ip)
+	}
+	return
+}
+
+func (u *upnp) Name() string {
+	return "UPnP"
+}
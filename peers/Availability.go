@@ -0,0 +1,109 @@
+// Availability of the pieces in the swarm: how many of the connected
+// peers have each piece, updated with their bitfields and haves, used
+// to download the rarest pieces first
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"sync"
+	"wgo/bit_field"
+	)
+
+type Availability struct {
+	mutex *sync.Mutex
+	counts []int // Peers that have each piece
+	peers map[string]*bit_field.Bitfield // Pieces counted of each peer
+}
+
+func NewAvailability(numPieces int64) *Availability {
+	return &Availability{mutex: new(sync.Mutex), counts: make([]int, numPieces), peers: make(map[string]*bit_field.Bitfield)}
+}
+
+// The peer sent its bitfield (or have all/none), it replaces the
+// pieces counted before
+
+func (a *Availability) SetBitfield(addr string, bitfield *bit_field.Bitfield) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.remove(addr)
+	// Copied, the peer keeps setting its own
+	counted := bitfield.And(bitfield)
+	counted.Each(func(index int64) {
+		a.counts[index]++
+	})
+	a.peers[addr] = counted
+}
+
+func (a *Availability) Have(addr string, index int64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if index < 0 || index >= int64(len(a.counts)) {
+		return
+	}
+	counted, ok := a.peers[addr]
+	if !ok {
+		counted = bit_field.NewBitfield(int64(len(a.counts)))
+		a.peers[addr] = counted
+	}
+	if !counted.IsSet(index) {
+		counted.Set(index)
+		a.counts[index]++
+	}
+}
+
+// The peer disconnected
+
+func (a *Availability) Remove(addr string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.remove(addr)
+}
+
+func (a *Availability) remove(addr string) {
+	counted, ok := a.peers[addr]
+	if !ok {
+		return
+	}
+	counted.Each(func(index int64) {
+		a.counts[index]--
+	})
+	delete(a.peers, addr)
+}
+
+// Connected peers that have the piece
+
+func (a *Availability) Count(index int64) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if index < 0 || index >= int64(len(a.counts)) {
+		return 0
+	}
+	return a.counts[index]
+}
+
+// Distributed copies of the torrent: the copies of the rarest piece,
+// plus the fraction of the pieces with more copies than it. Below 1
+// some pieces can't be downloaded from the connected peers.
+
+func (a *Availability) Copies() float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.counts) == 0 {
+		return 0
+	}
+	min := a.counts[0]
+	for _, count := range(a.counts) {
+		if count < min {
+			min = count
+		}
+	}
+	above := 0
+	for _, count := range(a.counts) {
+		if count > min {
+			above++
+		}
+	}
+	return float64(min) + float64(above)/float64(len(a.counts))
+}
@@ -0,0 +1,60 @@
+// IPs banned for sending pieces that failed the hash check, shared
+// by the torrents of a session
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"net"
+	"sync"
+	)
+
+const(
+	MAX_BAD_PIECES = 5 // Bad pieces before banning an IP
+)
+
+type BanList struct {
+	mutex *sync.Mutex
+	bad map[string]int // Bad pieces sent by each IP
+	banned map[string]bool
+}
+
+func NewBanList() *BanList {
+	return &BanList{mutex: new(sync.Mutex), bad: make(map[string]int), banned: make(map[string]bool)}
+}
+
+// IP of an address, addresses without port are returned as is
+
+func peerIp(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Count a bad piece sent by ip, and ban it when it has sent max of
+// them (0 never bans). Returns whether the ip is banned.
+
+func (b *BanList) AddBad(ip string, max int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.bad[ip]++
+	if max > 0 && b.bad[ip] >= max && !b.banned[ip] {
+		b.banned[ip] = true
+		peerLog.Info("Banning peer", "ip", ip, "bad", b.bad[ip])
+	}
+	return b.banned[ip]
+}
+
+func (b *BanList) Banned(addr string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.banned[peerIp(addr)]
+}
+
+func (b *BanList) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.banned)
+}
@@ -0,0 +1,154 @@
+// Limits shared by the torrents of a session: the connected peers,
+// and the outgoing connections being opened (half-open) and how fast
+// they are started, so the torrents don't open more connections than
+// the system (or the SYN flood protections of the routers) can handle
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"sync"
+	"time"
+	"container/list"
+	)
+
+const(
+	MAX_CONNECTIONS = 500 // Connected peers of all the torrents
+	MAX_HALF_OPEN = 8 // Outgoing connections being opened at once
+	DIAL_RATE = 10 // Outgoing connections started per second
+)
+
+type ConnLimit struct {
+	mutex *sync.Mutex
+	maxConns, maxHalfOpen int // 0 means no limit
+	dialRate int // Dials started per second, 0 means no limit
+	conns, halfOpen int
+	waiting *list.List // Of chan bool, dials waiting for a half-open slot
+	nextDial time.Time // Earliest start of the next dial
+}
+
+func NewConnLimit() *ConnLimit {
+	return &ConnLimit{mutex: new(sync.Mutex), maxConns: MAX_CONNECTIONS, maxHalfOpen: MAX_HALF_OPEN, dialRate: DIAL_RATE, waiting: list.New()}
+}
+
+// Change the limits, the connections over a lowered limit are kept
+
+func (c *ConnLimit) SetMax(conns, halfOpen int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxConns, c.maxHalfOpen = conns, halfOpen
+	c.wake()
+}
+
+// Dials started per second, 0 starts them as soon as there is a
+// half-open slot
+
+func (c *ConnLimit) SetDialRate(rate int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dialRate = rate
+}
+
+// Count a new connection, false if there are too many
+
+func (c *ConnLimit) Open() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maxConns > 0 && c.conns >= c.maxConns {
+		return false
+	}
+	c.conns++
+	return true
+}
+
+// A connection counted by Open has been closed
+
+func (c *ConnLimit) Release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conns--
+}
+
+// Wait until a new outgoing connection can be opened, EndDial must
+// be called once it's connected or failed. Returns false without a
+// slot if quit is closed first.
+
+func (c *ConnLimit) StartDial(quit <-chan bool) bool {
+	c.mutex.Lock()
+	if c.maxHalfOpen == 0 || c.halfOpen < c.maxHalfOpen {
+		c.halfOpen++
+		c.mutex.Unlock()
+	} else {
+		slot := make(chan bool, 1)
+		waiter := c.waiting.PushBack(slot)
+		c.mutex.Unlock()
+		select {
+			case <- slot:
+			case <- quit:
+				c.mutex.Lock()
+				select {
+					case <- slot:
+						// Woken at the same time, the slot goes to the next one
+						c.halfOpen--
+						c.wake()
+					default:
+						c.waiting.Remove(waiter)
+				}
+				c.mutex.Unlock()
+				return false
+		}
+	}
+	timer := time.NewTimer(c.pace())
+	defer timer.Stop()
+	select {
+		case <- timer.C:
+			return true
+		case <- quit:
+			c.EndDial()
+			return false
+	}
+}
+
+// Reserve the start time of a dial, spread at the dial rate.
+// Returns how long the dial has to wait for it.
+
+func (c *ConnLimit) pace() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.dialRate == 0 {
+		return 0
+	}
+	now := time.Now()
+	if c.nextDial.Before(now) {
+		c.nextDial = now
+	}
+	wait := c.nextDial.Sub(now)
+	c.nextDial = c.nextDial.Add(time.Second/time.Duration(c.dialRate))
+	return wait
+}
+
+func (c *ConnLimit) EndDial() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.halfOpen--
+	c.wake()
+}
+
+// Give the free half-open slots to the waiting dials, in order
+
+func (c *ConnLimit) wake() {
+	for c.waiting.Len() > 0 && (c.maxHalfOpen == 0 || c.halfOpen < c.maxHalfOpen) {
+		slot := c.waiting.Remove(c.waiting.Front()).(chan bool)
+		c.halfOpen++
+		slot <- true
+	}
+}
+
+// Connected peers and connections being opened
+
+func (c *ConnLimit) Connections() (conns, halfOpen int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conns, c.halfOpen
+}
@@ -0,0 +1,48 @@
+package peers
+
+import(
+	"testing"
+	"time"
+	)
+
+func TestStartDialQuit(t *testing.T) {
+	c := NewConnLimit()
+	c.SetMax(0, 1)
+	c.SetDialRate(0)
+	if !c.StartDial(nil) {
+		t.Fatalf("First dial refused")
+	}
+	// Waiting for the only slot
+	quit := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		done <- c.StartDial(quit)
+	}()
+	time.Sleep(10*time.Millisecond)
+	close(quit)
+	if <- done {
+		t.Errorf("Dial started after quit")
+	}
+	if _, halfOpen := c.Connections(); halfOpen != 1 || c.waiting.Len() != 0 {
+		t.Errorf("Half-open %d, waiting %d, expected 1 and 0", halfOpen, c.waiting.Len())
+	}
+	c.EndDial()
+	// Waiting for its turn at the dial rate
+	c.SetDialRate(1)
+	if !c.StartDial(nil) {
+		t.Fatalf("Dial refused")
+	}
+	c.EndDial()
+	quit = make(chan bool)
+	go func() {
+		done <- c.StartDial(quit)
+	}()
+	time.Sleep(10*time.Millisecond)
+	close(quit)
+	if <- done {
+		t.Errorf("Paced dial started after quit")
+	}
+	if _, halfOpen := c.Connections(); halfOpen != 0 {
+		t.Errorf("Half-open %d after the paced dial quit", halfOpen)
+	}
+}
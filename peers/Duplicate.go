@@ -0,0 +1,72 @@
+// Connections that shouldn't be kept: the ones to ourselves, dialed
+// because a tracker or a peer gave us our own address, and a second
+// connection with an IP that is already connected to the torrent
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"net"
+	)
+
+// Addresses that turned out to be ours, not dialed again. Called with
+// the mutex held.
+
+func (p *peerMgr) addSelf(addr string) {
+	if !p.selfAddrs[addr] {
+		peerLog.Info("Our own address, not connecting to it again", "addr", addr)
+		p.selfAddrs[addr] = true
+	}
+}
+
+// Several peers can run in the same machine when testing
+
+func sameHostAllowed(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.IsLoopback()
+}
+
+// How well a connection works, to keep the best one of an IP
+
+func (p *peerMgr) connScore(peer *Peer) int64 {
+	if peer.Snubbed() {
+		return -1
+	}
+	down, up := p.stats.GetRates(peer.addr)
+	return down + up
+}
+
+// Called by a peer once the handshakes are exchanged. If another peer
+// of the same IP (or with the same peer id) is connected, the one that
+// transfers less is closed: the new one unless the old one is snubbed.
+// Returns whether the new peer has to be closed, the ones kept count
+// in the connections of their source.
+
+func (p *peerMgr) Duplicate(peer *Peer) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ip := peerIp(peer.addr)
+	for _, peers := range([]map[string]*Peer{p.activePeers, p.incomingPeers}) {
+		for addr, other := range(peers) {
+			if other == peer || !other.Connected() {
+				continue
+			}
+			samePeer := len(peer.remote_peerId) > 0 && other.remote_peerId == peer.remote_peerId
+			if !samePeer && (peerIp(addr) != ip || sameHostAllowed(ip)) {
+				continue
+			}
+			if p.connScore(other) >= p.connScore(peer) {
+				peerLog.Debug("Duplicate connection, keeping the old one", "addr", peer.addr, "old", addr)
+				peer.duplicate = true
+				return true
+			}
+			peerLog.Debug("Duplicate connection, closing the old one", "addr", peer.addr, "old", addr)
+			other.duplicate = true
+			pr := other
+			go pr.once.Do(func() { pr.Close() })
+		}
+	}
+	p.source(peer.source).Connections++
+	return false
+}
@@ -0,0 +1,153 @@
+// Extension protocol (BEP 10), used to negotiate the
+// extended messages supported by each peer
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"net"
+	"strconv"
+	"strings"
+	"errors"
+	)
+
+const(
+	CLIENT_VERSION = "wgo 0.1"
+	REQQ = 250 // Number of outstanding requests we accept from a peer
+	EXTENSION_HANDSHAKE = 0
+	UT_PEX = 1 // Our id for ut_pex messages
+)
+
+// Extended messages we support, and the id used by the
+// peers to send them to us
+
+var extensions = map[string]int64{
+	"ut_pex": UT_PEX,
+}
+
+// Build our extension handshake
+
+func (p *Peer) extensionHandshake() (msg *message, err error) {
+	m := extensions
+	if p.private {
+		m = make(map[string]int64)
+		for name, id := range(extensions) {
+			if name != "ut_pex" {
+				m[name] = id
+			}
+		}
+	}
+	handshake := map[string]interface{}{
+		"m": m,
+		"v": CLIENT_VERSION,
+		"reqq": int64(REQQ),
+	}
+	if p.listenPort > 0 {
+		handshake["p"] = p.listenPort
+	}
+	if addr, err := net.ResolveTCPAddr("tcp4", p.addr); err == nil {
+		if ip := addr.IP.To4(); ip != nil {
+			handshake["yourip"] = string(ip)
+		}
+	}
+	return NewExtendedMessage(EXTENSION_HANDSHAKE, handshake)
+}
+
+// Returns the id the peer expects for the named extension
+
+func (p *Peer) Extension(name string) (id int64, ok bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	id, ok = p.extensions[name]
+	return
+}
+
+// Client version reported by the peer in the extension handshake,
+// or the one of its peer id
+
+func (p *Peer) Client() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.client) == 0 && len(p.remote_peerId) > 0 {
+		return ClientName(p.remote_peerId)
+	}
+	return p.client
+}
+
+// Client and version of the peer id, to work around the bugs of
+// some clients
+
+func (p *Peer) ClientId() (client, version string) {
+	return ParsePeerId(p.remote_peerId)
+}
+
+// Maximum number of outstanding requests the peer accepts
+
+func (p *Peer) MaxRequests() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.reqq
+}
+
+// Address where the peer accepts connections, for incoming peers
+// this is only known if they sent their port in the extension handshake
+
+func (p *Peer) ListenAddr() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.is_incoming {
+		return p.addr
+	}
+	if p.remotePort == 0 {
+		return ""
+	}
+	return p.addr[0:strings.LastIndex(p.addr, ":")] + ":" + strconv.FormatInt(p.remotePort, 10)
+}
+
+func (p *Peer) ProcessExtended(msg *message) (err error) {
+	if !p.caps.Has(CAP_EXTENSIONS) {
+		return errors.New("Extended message from a peer without support")
+	}
+	id, dict, err := DecodeExtendedMessage(msg)
+	if err != nil {
+		return
+	}
+	switch id {
+		case EXTENSION_HANDSHAKE:
+			p.processExtensionHandshake(dict)
+		case UT_PEX:
+			if !p.private {
+				err = p.ProcessPex(dict)
+			}
+		default:
+			err = errors.New("Unknown extended message")
+	}
+	return
+}
+
+func (p *Peer) processExtensionHandshake(dict map[string]interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range(m) {
+			if id, ok := id.(int64); ok {
+				if id == 0 {
+					// Extension disabled by the peer
+					delete(p.extensions, name)
+				} else {
+					p.extensions[name] = id
+				}
+			}
+		}
+	}
+	if v, ok := dict["v"].(string); ok {
+		p.client = v
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		p.reqq = reqq
+	}
+	if port, ok := dict["p"].(int64); ok && port > 0 && port < 65536 {
+		p.remotePort = port
+	}
+}
@@ -0,0 +1,92 @@
+// Fast extension (BEP 6), have all/none, suggestions,
+// explicit rejection of requests and allowed fast pieces
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"encoding/binary"
+	"wgo/bit_field"
+	"errors"
+	)
+
+// Message with our bitfield, if the peer supports the fast
+// extension use have all / have none when possible
+
+func (p *Peer) bitfieldMessage() *message {
+	if p.fast {
+		if p.our_bitfield.Completed() {
+			return &message{length: 1, msgId: have_all}
+		}
+		if p.our_bitfield.Count() == 0 {
+			return &message{length: 1, msgId: have_none}
+		}
+	}
+	our_bitfield := p.our_bitfield.Bytes()
+	return &message{length: uint32(1 + len(our_bitfield)), msgId: bitfield, payLoad: our_bitfield}
+}
+
+// Reject message for a request or a piece message
+
+func rejectMessage(msg *message) *message {
+	payLoad := make([]byte, 12)
+	copy(payLoad[0:8], msg.payLoad[0:8])
+	if msg.msgId == piece {
+		binary.BigEndian.PutUint32(payLoad[8:12], uint32(len(msg.payLoad)-8))
+	} else {
+		copy(payLoad[8:12], msg.payLoad[8:12])
+	}
+	return &message{length: uint32(1 + len(payLoad)), msgId: reject_request, payLoad: payLoad}
+}
+
+// Tell the peer we are not going to serve a request
+
+func (p *Peer) Reject(msg *message) {
+	if p.fast {
+		p.send(rejectMessage(msg))
+	}
+}
+
+func (p *Peer) ProcessFast(msg *message, f fields) (err error) {
+	if !p.fast {
+		return errors.New("Fast extension message from a peer without support")
+	}
+	switch msg.msgId {
+		case have_all, have_none:
+			p.bitfield = bit_field.NewBitfield(p.numPieces)
+			if msg.msgId == have_all {
+				for i := int64(0); i < p.numPieces; i++ {
+					p.bitfield.Set(i)
+				}
+			}
+			p.availability.SetBitfield(p.addr, p.bitfield)
+			if msg.msgId == have_all && p.our_bitfield.Completed() {
+				return errors.New("Peer not useful")
+			}
+			p.CheckInterested()
+			p.TryToRequestPiece()
+		case suggest:
+			// Suggestions are only advisory, the PieceMgr keeps
+			// choosing the pieces to download
+		case reject_request:
+			p.pieceMgr.Reject(p.addr, f.index, f.begin)
+		case allowed_fast:
+			p.allowedFast[f.index] = true
+			p.TryToRequestPiece()
+	}
+	return
+}
+
+// Pieces we can request while the peer is choking us
+
+func (p *Peer) allowedFastBitfield() (bf *bit_field.Bitfield, ok bool) {
+	bf = bit_field.NewBitfield(p.numPieces)
+	for index, _ := range(p.allowedFast) {
+		if p.bitfield.IsSet(index) && !p.our_bitfield.IsSet(index) {
+			bf.Set(index)
+			ok = true
+		}
+	}
+	return
+}
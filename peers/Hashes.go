@@ -0,0 +1,38 @@
+// Hash messages of the v2 torrents (BEP 52). The piece layers come in
+// the torrent file, so the hashes are never requested, only sent to
+// the peers that ask for them.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"errors"
+	)
+
+const(
+	HASH_REQUEST_LENGTH = 48 // Pieces root, base layer, index, length and proof layers
+)
+
+func (p *Peer) ProcessHashes(msg *message, f fields) (err error) {
+	if !p.v2 {
+		return errors.New("Hash message from a peer without v2 support")
+	}
+	if msg.msgId != hash_request {
+		// Not requested
+		return
+	}
+	list, e := p.files.Hashes(f.root, f.base, f.index, f.length, f.proofs)
+	if e != nil {
+		peerLog.Debug("Rejecting hash request", "addr", p.addr, "err", e)
+		payLoad := make([]byte, HASH_REQUEST_LENGTH)
+		copy(payLoad, msg.payLoad)
+		p.send(&message{length: uint32(1 + len(payLoad)), msgId: hash_reject, payLoad: payLoad})
+		return
+	}
+	payLoad := make([]byte, HASH_REQUEST_LENGTH + len(list))
+	copy(payLoad, msg.payLoad[0:HASH_REQUEST_LENGTH])
+	copy(payLoad[HASH_REQUEST_LENGTH:], list)
+	p.send(&message{length: uint32(1 + len(payLoad)), msgId: hashes, payLoad: payLoad})
+	return
+}
@@ -0,0 +1,316 @@
+// Download of the info dictionary from the peers (BEP 9),
+// used when starting from a magnet link
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"sync"
+	"time"
+	"bytes"
+	"crypto/sha1"
+	"container/list"
+	"wgo/limiter"
+	"wgo/logger"
+	"wgo/proxy"
+	"errors"
+	)
+
+const(
+	UT_METADATA = 2 // Our id for ut_metadata messages
+	METADATA_PIECE_LENGTH = 16 * 1024
+	MAX_METADATA_SIZE = 8 * 1024 * 1024
+	METADATA_PEERS = 20 // Peers to ask for the metadata at the same time
+)
+
+var metadataLog = logger.New("metadata")
+
+// ut_metadata message types
+
+const(
+	metadata_request = iota
+	metadata_data
+	metadata_reject
+)
+
+type metadataMgr struct {
+	mutex *sync.Mutex
+	infohash, peerid string
+	l limiter.Limiter
+	tried map[string]bool
+	active int
+	size int64
+	pieces [][]byte
+	finished bool
+	done chan []byte
+	wires map[*Wire]bool // Of the peers being asked, closed when we stop
+}
+
+type MetadataMgr interface {
+	AddPeers(peers *list.List, source string)
+	RequestPeers() int
+	Metadata(timeout time.Duration) ([]byte, error)
+}
+
+func NewMetadataMgr(infohash, peerid string, l limiter.Limiter) (m MetadataMgr) {
+	mm := new(metadataMgr)
+	mm.mutex = new(sync.Mutex)
+	mm.infohash = infohash
+	mm.peerid = peerid
+	mm.l = l
+	mm.tried = make(map[string]bool)
+	mm.done = make(chan []byte, 1)
+	mm.wires = make(map[*Wire]bool)
+	m = mm
+	return
+}
+
+// Connect to new peers, until we have enough of them asking for
+// the metadata
+
+func (m *metadataMgr) AddPeers(peers *list.List, source string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for addr := peers.Front(); addr != nil && m.active < METADATA_PEERS && !m.finished; addr = addr.Next() {
+		a := addr.Value.(string)
+		if _, ok := m.tried[a]; ok {
+			continue
+		}
+		m.tried[a] = true
+		m.active++
+		go m.fetch(a)
+	}
+}
+
+func (m *metadataMgr) RequestPeers() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.finished || m.active >= METADATA_PEERS {
+		return 0
+	}
+	return UNUSED_PEERS
+}
+
+// Wait until the info dictionary has been downloaded and verified, an
+// error if no peer sent it in timeout. The connections to the peers
+// are closed either way.
+
+func (m *metadataMgr) Metadata(timeout time.Duration) (info []byte, err error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+		case info = <- m.done:
+		case <- timer.C:
+			err = errors.New("No peer sent the metadata in " + timeout.String())
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.finished = true
+	for wire, _ := range(m.wires) {
+		wire.Close()
+	}
+	return
+}
+
+// Keep the connection of a peer to close it when we stop, false if
+// we already stopped
+
+func (m *metadataMgr) addWire(wire *Wire) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.finished {
+		return false
+	}
+	m.wires[wire] = true
+	return true
+}
+
+func (m *metadataMgr) removeWire(wire *Wire) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.wires, wire)
+}
+
+// Ask a peer for the metadata pieces we are missing
+
+func (m *metadataMgr) fetch(addr string) {
+	defer m.peerDone()
+	conn, err := proxy.Dial(addr)
+	if err != nil {
+		return
+	}
+	wire, err := NewWire(m.infohash, m.peerid, conn, m.l)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer wire.Close()
+	if !m.addWire(wire) {
+		return
+	}
+	defer m.removeWire(wire)
+	if _, err = wire.Handshake(); err != nil {
+		return
+	}
+	if !wire.Supports(CAP_EXTENSIONS) {
+		return
+	}
+	msg, err := NewExtendedMessage(EXTENSION_HANDSHAKE, map[string]interface{}{"m": map[string]interface{}{"ut_metadata": int64(UT_METADATA)}, "v": CLIENT_VERSION})
+	if err != nil {
+		return
+	}
+	if err = wire.WriteMsg(msg); err != nil {
+		return
+	}
+	for !m.Finished() {
+		msg, err := wire.ReadMsg()
+		if err != nil {
+			return
+		}
+		if msg.data != nil {
+			// A block the peer sent anyway
+			blockPool.Put(msg.data)
+		}
+		if msg.length == 0 || msg.msgId != extended {
+			continue
+		}
+		id, dict, err := DecodeExtendedMessage(msg)
+		if err != nil {
+			return
+		}
+		switch id {
+			case EXTENSION_HANDSHAKE:
+				if err = m.handshake(wire, dict); err != nil {
+					metadataLog.Debug("Error in the extension handshake", "addr", addr, "err", err)
+					return
+				}
+			case UT_METADATA:
+				if err = m.savePiece(msg, dict); err != nil {
+					metadataLog.Debug("Error saving metadata piece", "addr", addr, "err", err)
+					return
+				}
+		}
+	}
+}
+
+// Read the size of the metadata from the extension handshake,
+// and request all the pieces we don't have yet
+
+func (m *metadataMgr) handshake(wire *Wire, dict map[string]interface{}) (err error) {
+	e, ok := dict["m"].(map[string]interface{})
+	if !ok {
+		return errors.New("Invalid extension handshake")
+	}
+	id, ok := e["ut_metadata"].(int64)
+	if !ok || id == 0 {
+		return errors.New("Peer doesn't support ut_metadata")
+	}
+	size, ok := dict["metadata_size"].(int64)
+	if !ok {
+		return errors.New("Unknown metadata size")
+	}
+	if err = m.setSize(size); err != nil {
+		return
+	}
+	for _, piece := range(m.missing()) {
+		msg, err := NewExtendedMessage(uint8(id), map[string]interface{}{"msg_type": int64(metadata_request), "piece": piece})
+		if err != nil {
+			return err
+		}
+		if err = wire.WriteMsg(msg); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func (m *metadataMgr) setSize(size int64) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if size <= 0 || size > MAX_METADATA_SIZE {
+		return errors.New("Invalid metadata size")
+	}
+	if m.pieces == nil {
+		m.size = size
+		m.pieces = make([][]byte, (size + METADATA_PIECE_LENGTH - 1) / METADATA_PIECE_LENGTH)
+	} else if m.size != size {
+		return errors.New("Metadata size doesn't match")
+	}
+	return
+}
+
+func (m *metadataMgr) missing() (pieces []int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, piece := range(m.pieces) {
+		if piece == nil {
+			pieces = append(pieces, int64(i))
+		}
+	}
+	return
+}
+
+// Save a received metadata piece, the data comes after the
+// bencoded dictionary
+
+func (m *metadataMgr) savePiece(msg *message, dict map[string]interface{}) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	msgType, ok := dict["msg_type"].(int64)
+	if !ok {
+		return errors.New("Invalid ut_metadata message")
+	}
+	if msgType == metadata_reject {
+		return errors.New("Metadata request rejected")
+	}
+	if msgType != metadata_data {
+		return
+	}
+	piece, ok := dict["piece"].(int64)
+	if !ok || piece < 0 || piece >= int64(len(m.pieces)) {
+		return errors.New("Invalid metadata piece")
+	}
+	length := m.size - piece*METADATA_PIECE_LENGTH
+	if length > METADATA_PIECE_LENGTH {
+		length = METADATA_PIECE_LENGTH
+	}
+	if int64(len(msg.payLoad)) < length+1 {
+		return errors.New("Metadata piece too short")
+	}
+	if m.pieces[piece] == nil {
+		m.pieces[piece] = make([]byte, length)
+		copy(m.pieces[piece], msg.payLoad[int64(len(msg.payLoad))-length:])
+	}
+	for _, p := range(m.pieces) {
+		if p == nil {
+			return
+		}
+	}
+	// All pieces downloaded, check the hash
+	info := bytes.Join(m.pieces, nil)
+	hash := sha1.New()
+	hash.Write(info)
+	if string(hash.Sum(nil)) != m.infohash {
+		metadataLog.Warn("Metadata hash doesn't match, starting again")
+		m.pieces = nil
+		return errors.New("Invalid metadata")
+	}
+	if !m.finished {
+		m.finished = true
+		m.done <- info
+	}
+	return
+}
+
+func (m *metadataMgr) Finished() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.finished
+}
+
+func (m *metadataMgr) peerDone() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.active--
+}
@@ -0,0 +1,349 @@
+// Message Stream Encryption (MSE/PE), RC4 obfuscation of the
+// peer connections with a Diffie-Hellman key exchange
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"io"
+	"net"
+	"math/big"
+	"bytes"
+	"bufio"
+	"time"
+	"crypto/rc4"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	)
+
+// Encryption policies
+
+const(
+	ENCRYPTION_DISABLE = iota // Only plaintext connections
+	ENCRYPTION_PREFER // Try encrypted connections, fall back to plaintext
+	ENCRYPTION_REQUIRE // Only encrypted connections
+)
+
+const(
+	MSE_PRIME = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563"
+	MSE_KEY_LENGTH = 96
+	MSE_MAX_PAD = 512
+	MSE_TIMEOUT = 30*time.Second
+	CRYPTO_PLAINTEXT = 0x01
+	CRYPTO_RC4 = 0x02
+)
+
+var mse_prime, _ = new(big.Int).SetString(MSE_PRIME, 16)
+var mse_generator = big.NewInt(2)
+var mse_vc = make([]byte, 8)
+
+// Parse the name of an encryption policy
+
+func ParseEncryption(policy string) (int, error) {
+	switch policy {
+		case "disable":
+			return ENCRYPTION_DISABLE, nil
+		case "prefer":
+			return ENCRYPTION_PREFER, nil
+		case "require":
+			return ENCRYPTION_REQUIRE, nil
+	}
+	return ENCRYPTION_PREFER, errors.New("Unknown encryption policy " + policy)
+}
+
+// Connection that encrypts and decrypts the data with RC4. If the
+// ciphers are nil, the data is sent in plaintext. Pending holds data
+// already decrypted during the handshake.
+
+type cryptoConn struct {
+	net.Conn
+	reader io.Reader
+	enc, dec *rc4.Cipher
+	pending []byte
+}
+
+// Connection that keeps the data already buffered when looking
+// at the first bytes of an incoming connection
+
+func NewBufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	return &cryptoConn{Conn: conn, reader: r}
+}
+
+func (c *cryptoConn) Read(b []byte) (n int, err error) {
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return
+	}
+	n, err = c.reader.Read(b)
+	if c.dec != nil && n > 0 {
+		c.dec.XORKeyStream(b[0:n], b[0:n])
+	}
+	return
+}
+
+func (c *cryptoConn) Write(b []byte) (n int, err error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range(parts) {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+// Generate our private key and the public key to send
+
+func mseKeys() (private *big.Int, public []byte, err error) {
+	x := make([]byte, 20)
+	if _, err = io.ReadFull(rand.Reader, x); err != nil {
+		return
+	}
+	private = new(big.Int).SetBytes(x)
+	public = msePad(new(big.Int).Exp(mse_generator, private, mse_prime).Bytes())
+	return
+}
+
+// Shared secret obtained from the public key of the peer
+
+func mseSecret(private *big.Int, public []byte) []byte {
+	y := new(big.Int).SetBytes(public)
+	return msePad(new(big.Int).Exp(y, private, mse_prime).Bytes())
+}
+
+// Big numbers are sent as 96 bytes big-endian values
+
+func msePad(b []byte) []byte {
+	if len(b) >= MSE_KEY_LENGTH {
+		return b
+	}
+	padded := make([]byte, MSE_KEY_LENGTH)
+	copy(padded[MSE_KEY_LENGTH-len(b):], b)
+	return padded
+}
+
+// Random padding of 0 to 512 bytes
+
+func mseRandomPad() (pad []byte, err error) {
+	length := make([]byte, 2)
+	if _, err = io.ReadFull(rand.Reader, length); err != nil {
+		return
+	}
+	pad = make([]byte, int(binary.BigEndian.Uint16(length)) % (MSE_MAX_PAD+1))
+	_, err = io.ReadFull(rand.Reader, pad)
+	return
+}
+
+// RC4 cipher with the first 1024 bytes discarded
+
+func mseCipher(name string, secret []byte, infohash string) (c *rc4.Cipher, err error) {
+	if c, err = rc4.NewCipher(mseHash([]byte(name), secret, []byte(infohash))); err != nil {
+		return
+	}
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return
+}
+
+// Look for the pattern in the next max bytes of the stream
+
+func mseSync(r *bufio.Reader, pattern []byte, max int) (err error) {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		var c byte
+		if c, err = r.ReadByte(); err != nil {
+			return
+		}
+		window = append(window, c)
+		if len(window) >= len(pattern) && bytes.Equal(window[len(window)-len(pattern):], pattern) {
+			return
+		}
+	}
+	return errors.New("Unable to synchronize the encrypted stream")
+}
+
+func mseRead(r io.Reader, dec *rc4.Cipher, length int) (b []byte, err error) {
+	b = make([]byte, length)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	dec.XORKeyStream(b, b)
+	return
+}
+
+// Start the encrypted handshake on an outgoing connection, provide
+// is the set of methods we accept (CRYPTO_PLAINTEXT | CRYPTO_RC4)
+
+func MseInitiate(conn net.Conn, infohash string, provide uint32) (c net.Conn, err error) {
+	private, public, err := mseKeys()
+	if err != nil {
+		return
+	}
+	pad, err := mseRandomPad()
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(append(public, pad...)); err != nil {
+		return
+	}
+	r := bufio.NewReader(conn)
+	remote := make([]byte, MSE_KEY_LENGTH)
+	if _, err = io.ReadFull(r, remote); err != nil {
+		return
+	}
+	secret := mseSecret(private, remote)
+	enc, err := mseCipher("keyA", secret, infohash)
+	if err != nil {
+		return
+	}
+	dec, err := mseCipher("keyB", secret, infohash)
+	if err != nil {
+		return
+	}
+	// Send the hashes that allow the peer to find the torrent, and the
+	// methods we support. We don't send padding nor initial payload.
+	var b bytes.Buffer
+	b.Write(mseHash([]byte("req1"), secret))
+	req2, req3 := mseHash([]byte("req2"), []byte(infohash)), mseHash([]byte("req3"), secret)
+	for i, _ := range(req2) {
+		req2[i] ^= req3[i]
+	}
+	b.Write(req2)
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	enc.XORKeyStream(plain, plain)
+	b.Write(plain)
+	if _, err = conn.Write(b.Bytes()); err != nil {
+		return
+	}
+	// Find the encrypted VC after the padding of the peer
+	vc, err := mseCipher("keyB", secret, infohash)
+	if err != nil {
+		return
+	}
+	encryptedVC := make([]byte, len(mse_vc))
+	vc.XORKeyStream(encryptedVC, mse_vc)
+	if err = mseSync(r, encryptedVC, MSE_MAX_PAD+len(encryptedVC)); err != nil {
+		return
+	}
+	dec.XORKeyStream(make([]byte, len(mse_vc)), encryptedVC)
+	header, err := mseRead(r, dec, 6)
+	if err != nil {
+		return
+	}
+	selected := binary.BigEndian.Uint32(header[0:4])
+	if _, err = mseRead(r, dec, int(binary.BigEndian.Uint16(header[4:6]))); err != nil {
+		return
+	}
+	switch {
+		case selected == CRYPTO_RC4 && provide&CRYPTO_RC4 != 0:
+			c = &cryptoConn{Conn: conn, reader: r, enc: enc, dec: dec}
+		case selected == CRYPTO_PLAINTEXT && provide&CRYPTO_PLAINTEXT != 0:
+			c = &cryptoConn{Conn: conn, reader: r}
+		default:
+			err = errors.New("Invalid encryption method selected by the peer")
+	}
+	return
+}
+
+// Answer the encrypted handshake of an incoming connection, r holds
+// the data already read from the connection. Returns the infohash
+// requested by the peer.
+
+func MseRespond(conn net.Conn, r *bufio.Reader, infohashes []string, policy int) (c net.Conn, infohash string, err error) {
+	remote := make([]byte, MSE_KEY_LENGTH)
+	if _, err = io.ReadFull(r, remote); err != nil {
+		return
+	}
+	private, public, err := mseKeys()
+	if err != nil {
+		return
+	}
+	pad, err := mseRandomPad()
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(append(public, pad...)); err != nil {
+		return
+	}
+	secret := mseSecret(private, remote)
+	if err = mseSync(r, mseHash([]byte("req1"), secret), MSE_MAX_PAD+sha1.Size); err != nil {
+		return
+	}
+	// Find the torrent requested by the peer
+	req := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(r, req); err != nil {
+		return
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	for i, _ := range(req) {
+		req[i] ^= req3[i]
+	}
+	for _, hash := range(infohashes) {
+		if bytes.Equal(req, mseHash([]byte("req2"), []byte(hash))) {
+			infohash = hash
+		}
+	}
+	if len(infohash) == 0 {
+		return c, infohash, errors.New("Unknown infohash in encrypted handshake")
+	}
+	enc, err := mseCipher("keyB", secret, infohash)
+	if err != nil {
+		return
+	}
+	dec, err := mseCipher("keyA", secret, infohash)
+	if err != nil {
+		return
+	}
+	header, err := mseRead(r, dec, 14)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(header[0:8], mse_vc) {
+		return c, infohash, errors.New("Invalid VC in encrypted handshake")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	if _, err = mseRead(r, dec, int(binary.BigEndian.Uint16(header[12:14]))); err != nil {
+		return
+	}
+	length, err := mseRead(r, dec, 2)
+	if err != nil {
+		return
+	}
+	initial, err := mseRead(r, dec, int(binary.BigEndian.Uint16(length)))
+	if err != nil {
+		return
+	}
+	// Select the method to use
+	var selected uint32
+	switch {
+		case provide&CRYPTO_RC4 != 0 && policy != ENCRYPTION_DISABLE:
+			selected = CRYPTO_RC4
+		case provide&CRYPTO_PLAINTEXT != 0 && policy != ENCRYPTION_REQUIRE:
+			selected = CRYPTO_PLAINTEXT
+		default:
+			return c, infohash, errors.New("No common encryption method")
+	}
+	answer := make([]byte, 14)
+	binary.BigEndian.PutUint32(answer[8:12], selected)
+	enc.XORKeyStream(answer, answer)
+	if _, err = conn.Write(answer); err != nil {
+		return
+	}
+	if selected == CRYPTO_RC4 {
+		c = &cryptoConn{Conn: conn, reader: r, enc: enc, dec: dec, pending: initial}
+	} else {
+		c = &cryptoConn{Conn: conn, reader: r, pending: initial}
+	}
+	return
+}
@@ -0,0 +1,177 @@
+// Checks and decoding of the messages of the peers, without I/O so
+// they can be fuzzed. Wire.ReadMsg checks the length prefix before
+// reading a message, and the Peer decodes its payload before using it:
+// nothing a peer sends can index out of a payload or a bitfield.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"encoding/binary"
+	"errors"
+	)
+
+// Length of the messages that always have the same size
+
+var msgLengths = map[uint8]uint32{
+	choke: 1,
+	unchoke: 1,
+	interested: 1,
+	uninterested: 1,
+	have: 5,
+	request: 13,
+	cancel: 13,
+	port: 3,
+	suggest: 5,
+	have_all: 1,
+	have_none: 1,
+	reject_request: 13,
+	allowed_fast: 5,
+	hash_request: 1 + HASH_REQUEST_LENGTH,
+	hash_reject: 1 + HASH_REQUEST_LENGTH,
+}
+
+const(
+	MAX_HASHES = 512 // Hashes of a hash request (BEP 52)
+	MAX_HASH_LAYER = 63 // Base and proof layers of a hash request, the trees are never deeper
+)
+
+// Check the length prefix of a message, before allocating its payload
+
+func checkLength(msgId uint8, length uint32) (error) {
+	if l, ok := msgLengths[msgId]; ok && length != l {
+		return errors.New("Unexpected message length")
+	}
+	switch {
+		case length == 0:
+			return errors.New("Message without id")
+		case msgId == piece && (length < 9 || length > 9 + MAX_PIECE_LENGTH):
+			return errors.New("Invalid piece message length")
+		case msgId == bitfield && length > MAX_BITFIELD_MSG:
+			return errors.New("Bitfield too long")
+		case msgId != bitfield && length > MAX_PEER_MSG:
+			return errors.New("Message size too large")
+		case msgId == extended && length < 2:
+			return errors.New("Extended message without id")
+		case (msgId == hash_request || msgId == hashes || msgId == hash_reject) && length < 1 + HASH_REQUEST_LENGTH:
+			return errors.New("Unexpected message length")
+	}
+	return nil
+}
+
+// Values of a message payload, the ones its type has
+
+type fields struct {
+	index int64 // Piece of have, request, piece, cancel and the fast messages, hash index of the hash messages
+	begin, length int64 // Block of request, piece, cancel and reject_request, hashes of the hash messages
+	port int64
+	root string // Pieces root of the hash messages
+	base, proofs int64 // Layer and proof layers of the hash messages
+}
+
+// Check and decode the payload of a message (for the piece messages,
+// the index and begin before the block) against a torrent of numPieces
+// of pieceLength, the last one of lastPieceLength. The blocks of the
+// requests and the pieces must fit in their piece, the hash requests
+// in the layers of the torrent, and the bitfield must have one bit per
+// piece, rounded up to whole bytes, with the spare bits at the end
+// cleared.
+
+func parseMessage(msg *message, numPieces, pieceLength, lastPieceLength int64) (f fields, err error) {
+	if err = checkLength(msg.msgId, msg.length); err != nil {
+		return
+	}
+	p := msg.payLoad
+	if msg.msgId == piece {
+		if len(p) != 8 {
+			return f, errors.New("Unexpected message length")
+		}
+	} else if uint32(len(p)) != msg.length - 1 {
+		return f, errors.New("Payload doesn't match the message length")
+	}
+	switch msg.msgId {
+		case have, suggest, allowed_fast:
+			f.index = int64(binary.BigEndian.Uint32(p[0:4]))
+		case request, cancel, reject_request:
+			f.index = int64(binary.BigEndian.Uint32(p[0:4]))
+			f.begin = int64(binary.BigEndian.Uint32(p[4:8]))
+			f.length = int64(binary.BigEndian.Uint32(p[8:12]))
+			if f.length == 0 || f.length > MAX_PIECE_LENGTH {
+				return f, errors.New("Invalid block length")
+			}
+			err = blockInPiece(f, numPieces, pieceLength, lastPieceLength)
+		case piece:
+			f.index = int64(binary.BigEndian.Uint32(p[0:4]))
+			f.begin = int64(binary.BigEndian.Uint32(p[4:8]))
+			f.length = int64(msg.length) - 9
+			err = blockInPiece(f, numPieces, pieceLength, lastPieceLength)
+		case bitfield:
+			return f, checkBitfield(p, numPieces)
+		case port:
+			f.port = int64(binary.BigEndian.Uint16(p[0:2]))
+		case hash_request, hashes, hash_reject:
+			f.root = string(p[0:32])
+			f.base = int64(binary.BigEndian.Uint32(p[32:36]))
+			f.index = int64(binary.BigEndian.Uint32(p[36:40]))
+			f.length = int64(binary.BigEndian.Uint32(p[40:44]))
+			f.proofs = int64(binary.BigEndian.Uint32(p[44:48]))
+			return f, checkHashes(f, numPieces, pieceLength)
+		default:
+			return
+	}
+	if err == nil && f.index >= numPieces {
+		return f, errors.New("Piece out of range")
+	}
+	return
+}
+
+// The block of a request or a piece message, inside its piece
+
+func blockInPiece(f fields, numPieces, pieceLength, lastPieceLength int64) (error) {
+	if f.index >= numPieces {
+		return errors.New("Piece out of range")
+	}
+	if f.index == numPieces-1 {
+		pieceLength = lastPieceLength
+	}
+	if f.begin + f.length > pieceLength {
+		return errors.New("Block out of range")
+	}
+	return nil
+}
+
+// The hashes of a hash message: a power of two of them up to
+// MAX_HASHES, aligned to their number, and inside the layer of the
+// widest tree the torrent can have, one of all its blocks
+
+func checkHashes(f fields, numPieces, pieceLength int64) (error) {
+	if f.length < 1 || f.length > MAX_HASHES || f.length & (f.length - 1) != 0 || f.index%f.length != 0 {
+		return errors.New("Invalid number of hashes")
+	}
+	if f.base > MAX_HASH_LAYER || f.proofs > MAX_HASH_LAYER {
+		return errors.New("Layer out of range")
+	}
+	blocks := numPieces
+	if pieceLength > STANDARD_BLOCK_LENGTH {
+		blocks *= pieceLength/STANDARD_BLOCK_LENGTH
+	}
+	width := int64(1)
+	for width < blocks {
+		width *= 2
+	}
+	if f.index + f.length > (width >> uint(f.base)) {
+		return errors.New("Hashes out of range")
+	}
+	return nil
+}
+
+func checkBitfield(p []byte, numPieces int64) (error) {
+	if int64(len(p)) != (numPieces + 7)/8 {
+		return errors.New("Invalid bitfield length")
+	}
+	if spare := numPieces % 8; spare != 0 && p[len(p)-1] & (0xff >> uint(spare)) != 0 {
+		return errors.New("Spare bits set in the bitfield")
+	}
+	return nil
+}
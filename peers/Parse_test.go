@@ -0,0 +1,98 @@
+package peers
+
+import(
+	"testing"
+	"encoding/binary"
+	)
+
+const(
+	testPieces = 10
+	testPieceLength = 32768
+	testLastPieceLength = 20000
+)
+
+type parseTest struct {
+	id uint8
+	length uint32
+	payLoad []byte
+	ok bool
+}
+
+// Payload of a hash request, the 10 pieces of 2 blocks have 32 hashes
+// in the widest block layer
+
+func hashRequest(base, index, length, proofs uint32) []byte {
+	p := make([]byte, 48)
+	binary.BigEndian.PutUint32(p[32:36], base)
+	binary.BigEndian.PutUint32(p[36:40], index)
+	binary.BigEndian.PutUint32(p[40:44], length)
+	binary.BigEndian.PutUint32(p[44:48], proofs)
+	return p
+}
+
+var parseTests = []parseTest{
+	parseTest{have, 5, []byte{0, 0, 0, 9}, true},
+	parseTest{have, 5, []byte{0, 0, 0, 10}, false},
+	parseTest{have, 5, []byte{0, 0, 9}, false},
+	parseTest{have, 4, []byte{0, 0, 9}, false},
+	parseTest{request, 13, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 64, 0}, true},
+	parseTest{request, 13, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, false},
+	parseTest{request, 13, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 16, 0, 0}, false},
+	parseTest{request, 13, []byte{255, 255, 255, 255, 0, 0, 0, 0, 0, 0, 64, 0}, false},
+	parseTest{cancel, 13, []byte{0, 0, 0, 1, 0, 0}, false},
+	parseTest{request, 13, []byte{0, 0, 0, 9, 0, 0, 64, 0, 0, 0, 64, 0}, false},
+	parseTest{piece, 9 + 16384, []byte{0, 0, 0, 1, 0, 0, 0, 0}, true},
+	parseTest{piece, 9 + 16384, []byte{0, 0, 0, 1, 0, 0, 64, 1}, false},
+	parseTest{piece, 9 + 16384, []byte{0, 0, 0, 9, 0, 0, 64, 0}, false},
+	parseTest{piece, 9 + 3616, []byte{0, 0, 0, 9, 0, 0, 64, 0}, true},
+	parseTest{piece, 9 + 16384, []byte{0, 0, 0, 1}, false},
+	parseTest{piece, 8, []byte{0, 0, 0, 1, 0, 0, 0, 0}, false},
+	parseTest{bitfield, 3, []byte{255, 192}, true},
+	parseTest{bitfield, 3, []byte{255, 224}, false},
+	parseTest{bitfield, 2, []byte{255}, false},
+	parseTest{bitfield, 4, []byte{255, 192, 0}, false},
+	parseTest{port, 3, []byte{26, 225}, true},
+	parseTest{port, 2, []byte{26}, false},
+	parseTest{extended, 1, []byte{}, false},
+	parseTest{hash_request, 1 + 40, make([]byte, 40), false},
+	parseTest{hash_request, 1 + 48, hashRequest(0, 0, 8, 0), true},
+	parseTest{hash_request, 1 + 48, hashRequest(0, 32, 16, 0), false},
+	parseTest{hash_request, 1 + 48, hashRequest(1, 0, 4, 0), true},
+	parseTest{hash_request, 1 + 48, hashRequest(1, 16, 4, 0), false},
+	parseTest{hash_request, 1 + 48, hashRequest(0, 2, 4, 0), false},
+	parseTest{hash_request, 1 + 48, hashRequest(0, 0, 3, 0), false},
+	parseTest{hash_request, 1 + 48, hashRequest(0, 0, 1024, 0), false},
+	parseTest{hash_request, 1 + 48, hashRequest(200, 0, 2, 0), false},
+	parseTest{hash_reject, 1 + 49, append(hashRequest(0, 0, 8, 0), 0), false},
+	parseTest{allowed_fast, 5, []byte{0, 0, 1, 0}, false},
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, pt := range parseTests {
+		_, err := parseMessage(&message{length: pt.length, msgId: pt.id, payLoad: pt.payLoad}, testPieces, testPieceLength, testLastPieceLength)
+		if (err == nil) != pt.ok {
+			t.Errorf("parseMessage(id %d, length %d, % x) = %v, expected ok %v", pt.id, pt.length, pt.payLoad, err, pt.ok)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	f, err := parseMessage(&message{length: 13, msgId: request, payLoad: []byte{0, 0, 0, 3, 0, 0, 64, 0, 0, 0, 32, 0}}, testPieces, testPieceLength, testLastPieceLength)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if f.index != 3 || f.begin != 16384 || f.length != 8192 {
+		t.Errorf("Got index %d, begin %d, length %d, expected 3, 16384, 8192", f.index, f.begin, f.length)
+	}
+}
+
+// Nothing a peer sends can make the parser panic
+
+func FuzzParseMessage(f *testing.F) {
+	for _, pt := range parseTests {
+		f.Add(pt.id, pt.length, pt.payLoad)
+	}
+	f.Fuzz(func(t *testing.T, id uint8, length uint32, payLoad []byte) {
+		parseMessage(&message{length: length, msgId: id, payLoad: payLoad}, testPieces, testPieceLength, testLastPieceLength)
+	})
+}
@@ -0,0 +1,745 @@
+// Handles a peer
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"net"
+	"time"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"wgo/limiter"
+	"wgo/bit_field"
+	"wgo/events"
+	"wgo/files"
+	"wgo/utp"
+	"wgo/stats"
+	"wgo/logger"
+	"wgo/proxy"
+	"errors"
+	)
+	
+const(
+	KEEP_ALIVE_MSG = 120*time.Second
+	UTP_CONNECT_TIMEOUT = 5*time.Second
+)
+
+var peerLog = logger.New("peer")
+
+type Peer struct {
+	addr, remote_peerId, our_peerId, infohash string
+	numPieces int64
+	wire *Wire
+	bitfield *bit_field.Bitfield
+	our_bitfield *bit_field.Bitfield
+	in chan *message
+	incoming chan *message // Exclusive channel, where peer receives messages and PeerMgr sends
+	//outgoing chan *string // Shared channel, peer sends messages and PeerMgr receives
+	peerMgr PeerMgr
+	availability *Availability
+	//requests chan *PieceMgrRequest // Shared channel with the PieceMgr, used to request new pieces
+	pieceMgr PieceMgr
+	delete chan *message
+	//up_limit *time.Ticker
+	//down_limit *time.Ticker
+	l limiter.Limiter
+	am_choking bool
+	am_interested bool
+	peer_choking bool
+	peer_interested bool
+	connected bool
+	last bool
+	received_keepalive int64
+	lastReceived int64 // Seconds, when the last message arrived
+	writeQueue *PeerQueue
+	mutex *sync.Mutex
+	once *sync.Once
+	stats stats.Stats
+	keepAlive *time.Ticker
+	//inFiles chan *FileMsg
+	files files.Files
+	lastPiece int64 // Unix time of the last block received (atomic)
+	pieceLength int64
+	lastPieceLength int64
+	is_incoming bool
+	source string
+	extensions map[string]int64 // Extended messages supported by the peer
+	client string
+	reqq int64
+	listenPort int64 // Our listening port
+	remotePort int64 // Listening port of the peer
+	pexSent map[string]bool // Peers already sent with PEX
+	encryption int // Encryption policy for outgoing connections
+	fast bool // Peer supports the fast extension
+	allowedFast map[int64]bool // Pieces we can request while choked
+	utp bool // Try uTP before TCP
+	conns *ConnLimit // Half-open slots of the outgoing connections
+	keepAliveInterval time.Duration // Between our keep-alives
+	timeout time.Duration // Without receiving anything before closing
+	handshakeTimeout, writeTimeout time.Duration // To finish the handshake, and to send a message
+	snubbed int32 // Didn't send the blocks we requested in SNUB_TIMEOUT, set by the piece manager (atomic)
+	self bool // The connection is to ourselves
+	duplicate bool // Closed for being a second connection with the peer
+	private bool // Torrent without PEX
+	v2 bool // Peer supports the v2 hash messages
+	caps Capabilities // Set in both handshakes
+	events *events.Emitter // Told when the handshake finishes, can be nil
+	traceFolder string // Where the messages are traced, empty for none
+	gotMessage bool // Received a message after the handshake, other than a keep-alive
+	quit chan bool // Closed when the peer is closed, stops its goroutines
+	refused int64 // Requests in a row that didn't fit in the upload queue
+	uploaded, downloaded int64 // Piece data, for the statistics of the source
+}
+
+// Queue a message to the peer, it's dropped if the peer is closed
+
+func (p *Peer) send(msg *message) {
+	select {
+		case p.incoming <- msg:
+		case <- p.quit:
+			if msg.msgId == piece {
+				blockPool.Put(msg.payLoad)
+			}
+	}
+}
+
+func (p *Peer) closing() bool {
+	select {
+		case <- p.quit:
+			return true
+		default:
+	}
+	return false
+}
+
+func (p *Peer) Choke() {
+	p.send(&message{length: 1, msgId: choke})
+}
+
+func (p *Peer) Unchoke() {
+	p.send(&message{length: 1, msgId: unchoke})
+}
+
+// Features that can be used with the peer, nil before the handshake
+
+func (p *Peer) Capabilities() Capabilities {
+	return p.caps
+}
+
+func (p *Peer) Source() string {
+	return p.source
+}
+
+func (p *Peer) Connected() bool {
+	return p.connected
+}
+
+// Seconds since the last message of the peer
+
+func (p *Peer) Idle() int64 {
+	return time.Now().Unix() - p.lastReceived
+}
+
+func (p *Peer) Completed() bool {
+	return p.bitfield.Completed()
+}
+
+func (p *Peer) Am_choking() bool {
+	return p.am_choking
+}
+
+func (p *Peer) Peer_choking() bool {
+	return p.peer_choking
+}
+
+func (p *Peer) Am_interested() bool {
+	return p.am_interested
+}
+
+func (p *Peer) Peer_interested() bool {
+	return p.peer_interested
+}
+
+func (p *Peer) LastPiece() int64 {
+	return atomic.LoadInt64(&p.lastPiece)
+}
+
+func (p *Peer) Snubbed() bool {
+	return atomic.LoadInt32(&p.snubbed) == 1
+}
+
+func (p *Peer) setSnubbed(snubbed bool) {
+	var v int32
+	if snubbed {
+		v = 1
+	}
+	atomic.StoreInt32(&p.snubbed, v)
+}
+
+func (p *Peer) Request(piece int64, block int) {
+	msg := new(message)
+	begin := int64(block) * int64(STANDARD_BLOCK_LENGTH)
+	length := int64(STANDARD_BLOCK_LENGTH)
+	if piece == p.numPieces-1 {
+		left := p.lastPieceLength - begin
+		if left < length {
+			length = left
+		}
+	}
+	msg.msgId = request
+	msg.payLoad = make([]byte, 12)
+	msg.length = uint32(1 + len(msg.payLoad))
+	binary.BigEndian.PutUint32(msg.payLoad[0:4], uint32(piece))
+	binary.BigEndian.PutUint32(msg.payLoad[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(msg.payLoad[8:12], uint32(length))
+	p.send(msg)
+}
+
+func NewPeer(addr, infohash, peerId string, peerMgr PeerMgr, numPieces, pieceLength, lastPieceLength int64, pieceMgr PieceMgr, our_bitfield *bit_field.Bitfield, st stats.Stats, fl files.Files, l limiter.Limiter) (p *Peer, err error) {
+	p = new(Peer)
+	p.mutex = new(sync.Mutex)
+	p.once = new(sync.Once)
+	p.addr = addr
+	//p.log, err = NewLogger(p.addr)
+	p.infohash = infohash
+	p.our_peerId = peerId
+	p.incoming = make(chan *message)
+	p.quit = make(chan bool)
+	//p.in = make(chan *message)
+	//p.outgoing = outgoing
+	//p.inFiles = inFiles
+	p.files = fl
+	p.am_choking = true
+	p.am_interested = false
+	p.peer_choking = true
+	p.peer_interested = false
+	p.connected = false
+	p.bitfield = bit_field.NewBitfield(numPieces)
+	p.our_bitfield = our_bitfield
+	p.numPieces = numPieces
+	p.pieceLength = pieceLength
+	p.lastPieceLength = lastPieceLength
+	//p.requests = requests
+	p.pieceMgr = pieceMgr
+	p.peerMgr = peerMgr
+	p.availability = peerMgr.Availability()
+	p.stats = st
+	p.delete = make(chan *message)
+	p.extensions = make(map[string]int64)
+	p.reqq = MAX_REQUESTS
+	p.pexSent = make(map[string]bool)
+	p.allowedFast = make(map[int64]bool)
+	// Start writting queue
+	p.in = make(chan *message)
+	p.keepAliveInterval, p.timeout = KEEP_ALIVE_MSG, KEEP_ALIVE_RESP
+	p.handshakeTimeout, p.writeTimeout = HANDSHAKE_TIMEOUT, WRITE_TIMEOUT
+	p.keepAlive = time.NewTicker(KEEP_ALIVE_MSG)
+	p.writeQueue = NewQueue(p.incoming, p.in, p.delete, p.quit)
+	//p.up_limit = up_limit
+	//p.down_limit = down_limit
+	p.l = l
+	p.lastPiece = time.Now().Unix()
+	p.lastReceived = p.lastPiece
+	go p.writeQueue.Run()
+	return
+}
+
+func NewPeerFromConn(conn net.Conn, reserved []byte, infohash, peerId, remote_peerId string, peerMgr PeerMgr, numPieces, pieceLength, lastPieceLength int64, pieceMgr PieceMgr, our_bitfield *bit_field.Bitfield, st stats.Stats, fl files.Files, l limiter.Limiter) (p *Peer, err error) {
+	addr := conn.RemoteAddr().String()
+	p, err = NewPeer(addr, infohash, peerId, peerMgr, numPieces, pieceLength, lastPieceLength, pieceMgr, our_bitfield, st, fl, l)
+	if err != nil {
+		return
+	}
+	p.wire, err = NewIncomingWire(p.infohash, p.our_peerId, remote_peerId, reserved, conn, p.l)
+	p.is_incoming = true
+	p.source = SOURCE_INCOMING
+	return
+}
+
+func (p *Peer) preprocessMessage(msg *message) (skip bool, err error) {
+	if msg == nil {
+		err = errors.New("Nil message")
+		return
+	}
+	switch msg.msgId {
+		case unchoke:
+			if !p.am_choking {
+				// Avoid sending repeated unchoke messages
+				skip = true
+			} else {
+				p.am_choking = false
+			}
+		case choke:
+			if p.am_choking {
+				// Avoid sending repeated choke messages
+				skip = true
+			} else {
+				p.am_choking = true
+				// Flush peer request queue
+				p.send(&message{length: 1, msgId: flush, reject: p.fast})
+			}
+		case interested:
+			if p.am_interested {
+				skip = true
+			} else {
+				p.am_interested = true
+			}
+		case uninterested:
+			if !p.am_interested {
+				skip = true
+			} else {
+				p.am_interested = false
+			}
+		case have:
+			p.CheckInterested()
+		case piece:
+			if p.am_choking {
+				// Requests are not served while choking
+				skip = true
+				p.Reject(msg)
+			}
+	}
+	return
+}
+
+// Open a connection to the peer, over uTP if enabled and
+// the peer answers, or over TCP (or the proxy)
+
+func (p *Peer) dial() (conn net.Conn, err error) {
+	// uTP can't go through the proxy
+	if p.utp && !proxy.Enabled() {
+		if conn, err = utp.Dial(proxy.LocalUDP(), p.addr, UTP_CONNECT_TIMEOUT); err == nil {
+			return
+		}
+	}
+	return proxy.Dial(p.addr)
+}
+
+// Open the connection to the peer, using MSE if the
+// encryption policy allows it
+
+func (p *Peer) Connect() (conn net.Conn, err error) {
+	c, err := p.dial()
+	if err != nil || p.encryption == ENCRYPTION_DISABLE {
+		return c, err
+	}
+	provide := uint32(CRYPTO_RC4)
+	if p.encryption == ENCRYPTION_PREFER {
+		provide |= CRYPTO_PLAINTEXT
+	}
+	if err = c.SetDeadline(time.Now().Add(MSE_TIMEOUT)); err != nil {
+		c.Close()
+		return
+	}
+	conn, err = MseInitiate(c, p.infohash, provide)
+	if err == nil || p.encryption == ENCRYPTION_REQUIRE {
+		if err != nil {
+			c.Close()
+		}
+		return
+	}
+	// The peer doesn't support MSE, retry in plaintext
+	c.Close()
+	return p.dial()
+}
+
+func (p *Peer) PeerWriter() {
+	// Create connection
+	defer p.once.Do(func() { p.Close() })
+	var err error
+	if p.wire == nil {
+		if !p.conns.StartDial(p.quit) {
+			return
+		}
+		conn, err := p.Connect()
+		p.conns.EndDial()
+		if err != nil {
+			peerLog.Debug("Error connecting", "addr", p.addr, "err", err)
+			return
+		}
+		/*err = conn.SetTimeout(TIMEOUT)
+		if err != nil {
+			//p.log.Output(err, p.addr)
+			return
+		}*/
+		// Create the wire struct
+		wire, err := NewWire(p.infohash, p.our_peerId, conn, p.l)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		// Close may have run during the dial, it only closes the wire
+		// already set
+		p.mutex.Lock()
+		if p.closing() {
+			p.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		p.wire = wire
+		p.mutex.Unlock()
+	}
+	if len(p.traceFolder) > 0 {
+		if err = p.wire.Trace(p.traceFolder, p.addr); err != nil {
+			peerLog.Warn("Error creating the trace file", "addr", p.addr, "err", err)
+		}
+	}
+	if err = p.wire.SetTimeout(p.handshakeTimeout); err != nil {
+		return
+	}
+	// Send handshake
+	p.remote_peerId, err = p.wire.Handshake()
+	if err != nil {
+		peerLog.Debug("Error in the handshake", "addr", p.addr, "incoming", p.is_incoming, "err", err)
+		return
+	}
+	// The peer sends something at least every keep-alive interval
+	if err = p.wire.SetTimeouts(p.timeout, p.writeTimeout); err != nil {
+		return
+	}
+	if p.remote_peerId == p.our_peerId {
+		peerLog.Debug("Connected to ourselves", "addr", p.addr)
+		p.self = true
+		return
+	}
+	if p.peerMgr.Duplicate(p) {
+		return
+	}
+	p.caps = p.wire.Capabilities()
+	p.fast = p.caps.Has(CAP_FAST)
+	p.v2 = p.caps.Has(CAP_V2)
+	p.events.Emit(events.Event{Type: events.PEER_CONNECTED, Addr: p.addr})
+	// Launch peer reader
+	go p.PeerReader()
+	// Send the have message
+	err = p.wire.WriteMsg(p.bitfieldMessage())
+	if err != nil {
+		peerLog.Debug("Error sending the bitfield", "addr", p.addr, "err", err)
+		return
+	}
+	// Send the extension handshake
+	if p.caps.Has(CAP_EXTENSIONS) {
+		msg, err := p.extensionHandshake()
+		if err != nil {
+			return
+		}
+		if err = p.wire.WriteMsg(msg); err != nil {
+			return
+		}
+	}
+	// Peer writer main bucle
+	p.keepAlive.Stop()
+	p.keepAlive = time.NewTicker(p.keepAliveInterval)
+	p.lastReceived = time.Now().Unix()
+	p.connected = true
+	for {
+		select {
+			// Wait for messages or send keep-alive
+			case <- p.quit:
+				return
+			case msg, ok := <- p.in:
+				if !ok {
+					return
+				}
+				skip, err := p.preprocessMessage(msg)
+				if err != nil {
+					peerLog.Warn("Error", "addr", p.addr, "err", err)
+					return
+				}
+				if skip {
+					if msg.msgId == piece {
+						blockPool.Put(msg.payLoad)
+					}
+					continue
+				}
+				err = p.wire.WriteMsg(msg)
+				if err != nil /*|| n != int(4+msg.length)*/ {
+					peerLog.Debug("Error writing", "addr", p.addr, "err", err)
+					return
+				}
+				// Send message to StatMgr
+				if msg.msgId == piece {
+					p.stats.Update(p.addr, 0, int64(msg.length - 9))
+					atomic.AddInt64(&p.uploaded, int64(msg.length - 9))
+					blockPool.Put(msg.payLoad)
+				}
+				// Reset ticker
+				//close(p.keepAlive)
+				p.keepAlive.Stop()
+				p.keepAlive = time.NewTicker(p.keepAliveInterval)
+			case <- p.keepAlive.C:
+				// Send keep-alive
+				err := p.wire.WriteMsg(&message{length: 0})
+				if err != nil {
+					peerLog.Debug("Error sending keep-alive", "addr", p.addr, "err", err)
+					return
+				}
+		}
+	}
+}
+
+func (p *Peer) PeerReader() {
+	defer p.once.Do(func() { p.Close() })
+	for p.wire != nil {
+		msg, err := p.wire.ReadMsg()
+		if p.closing() {
+			if err == nil && msg.data != nil {
+				blockPool.Put(msg.data)
+			}
+			return
+		}
+		if err != nil {
+			peerLog.Info("Error reading", "addr", p.addr, "err", err)
+			return
+		}
+		p.lastReceived = time.Now().Unix()
+		if msg.length == 0 {
+			p.received_keepalive = time.Now().Unix()
+		} else {
+			f, err := parseMessage(msg, p.numPieces, p.pieceLength, p.lastPieceLength)
+			if err != nil {
+				peerLog.Info("Malformed message", "addr", p.addr, "id", msg.msgId, "length", msg.length, "err", err)
+				if msg.data != nil {
+					blockPool.Put(msg.data)
+				}
+				return
+			}
+			// The pieces of the peer can only be sent right after
+			// the handshake
+			if (msg.msgId == bitfield || msg.msgId == have_all || msg.msgId == have_none) && p.gotMessage {
+				peerLog.Info("Bitfield after other messages", "addr", p.addr, "id", msg.msgId)
+				return
+			}
+			p.gotMessage = true
+			if msg.msgId == piece {
+				p.stats.Update(p.addr, f.length, 0)
+				atomic.AddInt64(&p.downloaded, f.length)
+			}
+			err = p.ProcessMessage(msg, f)
+			if err != nil {
+				peerLog.Info("Error processing message", "addr", p.addr, "id", msg.msgId, "err", err)
+				if msg.msgId == request || msg.msgId == cancel {
+					// Invalid or excessive requests
+					return
+				}
+			}
+		}
+	}
+}
+
+// Queue the block to be written, the PieceMgr gets it once it's on
+// disk, so the hash of a finished piece can be checked
+
+func (p *Peer) savePiece(msg *message, f fields) {
+	index, begin := f.index, f.begin
+	data := msg.data
+	if !p.pieceMgr.Arrived(p.addr, index, begin, int64(len(data))) {
+		peerLog.Debug("Duplicate block", "addr", p.addr, "index", index, "begin", begin)
+		blockPool.Put(data)
+		if p.connected {
+			p.TryToRequestPiece()
+		}
+		return
+	}
+	p.files.WriteAsync(index, begin, data, func(err error) {
+		blockPool.Put(data)
+		if err != nil {
+			p.pieceMgr.WriteFailed(p.addr, index, begin)
+			return
+		}
+		if err = p.pieceMgr.SavePiece(p.addr, index, begin, int64(len(data))); err != nil {
+			peerLog.Info("Error saving block", "addr", p.addr, "index", index, "err", err)
+		}
+		// Try to request another block
+		if p.connected {
+			p.TryToRequestPiece()
+		}
+	})
+}
+
+// Act on a message whose payload parseMessage decoded in f
+
+func (p *Peer) ProcessMessage(msg *message, f fields) (err error){
+	switch msg.msgId {
+		case choke:
+			// Choke peer
+			p.peer_choking = true
+			peerLog.Debug("Choked", "addr", p.addr)
+			// If choked, clear request list. With the fast extension
+			// the peer rejects the requests it won't serve.
+			if !p.fast {
+				p.pieceMgr.PeerExit(p.addr)
+			}
+			//p.requests <- &PieceMgrRequest{msg: &message{length: 1, msgId: exit, addr: []string{p.addr}}}
+		case unchoke:
+			// Unchoke peer
+			p.peer_choking = false
+			peerLog.Debug("Unchoked", "addr", p.addr)
+			// Check if we are still interested on this peer
+			//p.CheckInterested()
+			// Notice PieceMgr of the unchoke
+			p.TryToRequestPiece()
+		case interested:
+			// Mark peer as interested
+			p.peer_interested = true
+			peerLog.Debug("Interested", "addr", p.addr)
+		case uninterested:
+			// Mark peer as uninterested
+			p.peer_interested = false
+			peerLog.Debug("Not interested", "addr", p.addr)
+		case have:
+			// Update peer bitfield
+			p.bitfield.Set(f.index)
+			p.availability.Have(p.addr, f.index)
+			if p.our_bitfield.Completed() && p.bitfield.Completed() {
+				err = errors.New("Peer not useful")
+				return
+			}
+			p.CheckInterested()
+			// If we are unchoked notice PieceMgr of the new piece
+			p.TryToRequestPiece()
+		case bitfield:
+			// Set peer bitfield
+			p.bitfield, err = bit_field.NewBitfieldFromBytes(p.numPieces, msg.payLoad)
+			if err != nil {
+				return errors.New("Invalid bitfield")
+			}
+			p.availability.SetBitfield(p.addr, p.bitfield)
+			if p.our_bitfield.Completed() && p.bitfield.Completed() {
+				err = errors.New("Peer not useful")
+				return
+			}
+			p.CheckInterested()
+			p.TryToRequestPiece()
+			peerLog.Debug("Bitfield received", "addr", p.addr, "pieces", p.bitfield.Count())
+		case request:
+			// Peer requests a block
+			if p.am_choking {
+				// We are choking this peer, drop the request
+				p.Reject(msg)
+				return
+			}
+			err = p.Upload(msg, f)
+		case piece:
+			atomic.StoreInt64(&p.lastPiece, time.Now().Unix())
+			p.setSnubbed(false)
+			p.savePiece(msg, f)
+		case cancel:
+			// Send the message to the sending queue to delete the "piece" message
+			select {
+				case p.delete <- msg:
+				case <- p.quit:
+			}
+		case port:
+			// DHT stuff
+		case have_all, have_none, suggest, reject_request, allowed_fast:
+			err = p.ProcessFast(msg, f)
+		case extended:
+			err = p.ProcessExtended(msg)
+		case hash_request, hashes, hash_reject:
+			err = p.ProcessHashes(msg, f)
+		default:
+			peerLog.Debug("Unknown message", "addr", p.addr, "id", msg.msgId)
+			return errors.New("Unknown message")
+	}
+	return
+}
+
+// Piece, offset and length of a request from the peer, parseMessage
+// checked that the block is inside its piece, the piece must be one
+// we have
+
+func (p *Peer) checkRequest(f fields) (index, begin, length int64, err error) {
+	index, begin, length = f.index, f.begin, f.length
+	if !p.our_bitfield.IsSet(index) {
+		err = errors.New("Peer requests unfinished piece")
+		return
+	}
+	return
+}
+
+// Validate a request from the peer, read the block from
+// disk and queue the corresponding piece message. The errors
+// are invalid or excessive requests, the peer is disconnected.
+
+func (p *Peer) Upload(msg *message, f fields) (err error) {
+	index, begin, length, err := p.checkRequest(f)
+	if err != nil {
+		return
+	}
+	if !p.writeQueue.Reserve(length) {
+		// Too much data queued for the peer already, a peer that
+		// respects our reqq can't go over it by more than REQQ blocks
+		if p.refused++; p.refused > REQQ {
+			return errors.New("Too many outstanding requests")
+		}
+		p.Reject(msg)
+		return
+	}
+	p.refused = 0
+	block := blockPool.Get(int(8+length))
+	copy(block[0:8], msg.payLoad[0:8])
+	if e := p.files.ReadBlock(index, begin, block[8:]); e != nil {
+		peerLog.Warn("Error reading requested block", "addr", p.addr, "index", index, "err", e)
+		p.writeQueue.release(length)
+		blockPool.Put(block)
+		p.Reject(msg)
+		return
+	}
+	p.send(&message{length: uint32(1 + len(block)), msgId: piece, payLoad: block})
+	return
+}
+
+func (p *Peer) CheckInterested() {
+	if p.am_interested && p.our_bitfield.Completed() {
+		p.send(&message{length: 1, msgId: uninterested})
+		return
+	}
+	if p.am_interested && !p.our_bitfield.HasMorePieces(p.bitfield) {
+		//p.am_interested = false
+		p.send(&message{length: 1, msgId: uninterested})
+		peerLog.Debug("Not interesting", "addr", p.addr)
+		return
+	}
+	if !p.am_interested && p.our_bitfield.HasMorePieces(p.bitfield) {
+		//p.am_interested = true
+		p.send(&message{length: 1, msgId: interested})
+		peerLog.Debug("Interesting", "addr", p.addr)
+		return
+	}
+}
+
+func (p *Peer) TryToRequestPiece() {
+	if !p.peer_choking && !p.our_bitfield.Completed() {
+		p.pieceMgr.Request(p.addr, p, p.bitfield)
+		//p.requests <- &PieceMgrRequest{bitfield: p.bitfield, response: p.incoming, our_addr: p.addr, msg: &message{length: 1, msgId: our_request}}
+		return
+	}
+	if p.peer_choking && p.fast && !p.our_bitfield.Completed() {
+		// Request the allowed fast pieces while choked
+		if bf, ok := p.allowedFastBitfield(); ok {
+			p.pieceMgr.Request(p.addr, p, bf)
+		}
+	}
+}
+
+// Stop the goroutines of the peer and close the connection, only
+// called once (p.once)
+
+func (p *Peer) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// The senders to the peer and its queue stop waiting
+	close(p.quit)
+	p.keepAlive.Stop()
+	p.peerMgr.DeletePeer(p.addr)
+	p.pieceMgr.PeerExit(p.addr)
+	p.availability.Remove(p.addr)
+	// Sending message to Stats
+	p.stats.Update(p.addr, 0, 0)
+	if p.wire != nil {
+		p.wire.Close()
+	}
+}
@@ -0,0 +1,124 @@
+// Peer ids in the Azureus style (-WG0100- and 12 random characters),
+// and the client and version of the peers from their ids
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"io"
+	"fmt"
+	crand "crypto/rand"
+	)
+
+const(
+	CLIENT_PREFIX = "-WG0100-" // wgo 0.1.0.0
+	PEER_ID_LENGTH = 20
+)
+
+const peerIdChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// Clients of the Azureus style ids, by their two letters
+
+var azureusClients = map[string]string{
+	"AZ": "Azureus",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "uTorrent",
+	"UM": "uTorrent Mac",
+	"WG": "wgo",
+	"WW": "WebTorrent",
+}
+
+// Clients of the Shadow style ids, a letter and the version
+
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+}
+
+// Our peer id, the random characters are printable so the id
+// doesn't need escaping in the logs
+
+func NewPeerId() (id string, err error) {
+	random := make([]byte, PEER_ID_LENGTH - len(CLIENT_PREFIX))
+	if _, err = io.ReadFull(crand.Reader, random); err != nil {
+		return
+	}
+	for i, b := range(random) {
+		random[i] = peerIdChars[int(b)%len(peerIdChars)]
+	}
+	return CLIENT_PREFIX + string(random), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Client and version of a peer id, the client is empty if the
+// id doesn't follow a known style
+
+func ParsePeerId(id string) (client, version string) {
+	if len(id) != PEER_ID_LENGTH {
+		return
+	}
+	if id[0] == '-' && id[7] == '-' {
+		// Azureus style: -XX1234-
+		name, ok := azureusClients[id[1:3]]
+		if !ok {
+			name = id[1:3]
+		}
+		v := id[3:7]
+		if v[3] == '0' {
+			return name, fmt.Sprintf("%c.%c.%c", v[0], v[1], v[2])
+		}
+		return name, fmt.Sprintf("%c.%c.%c.%c", v[0], v[1], v[2], v[3])
+	}
+	if id[0] == 'M' && isDigit(id[1]) {
+		// Mainline: M4-3-6--
+		end := 1
+		for end < 8 && (isDigit(id[end]) || id[end] == '-') {
+			end++
+		}
+		return "Mainline", trimDashes(id[1:end])
+	}
+	if name, ok := shadowClients[id[0]]; ok && id[6:9] == "---" {
+		// Shadow style: the letter, up to 5 version characters and dashes
+		return name, fmt.Sprintf("%c.%c.%c", id[1], id[2], id[3])
+	}
+	return
+}
+
+// Mainline versions use dashes between the numbers and as padding
+
+func trimDashes(v string) string {
+	b := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] != '-' {
+			b = append(b, v[i])
+		} else if i+1 < len(v) && v[i+1] != '-' {
+			b = append(b, '.')
+		}
+	}
+	return string(b)
+}
+
+// Name and version of a peer id for display, the id itself
+// (escaped) if the style is unknown
+
+func ClientName(id string) string {
+	client, version := ParsePeerId(id)
+	if len(client) == 0 {
+		return fmt.Sprintf("%q", id)
+	}
+	return client + " " + version
+}
@@ -0,0 +1,706 @@
+// Management of a set of peers for a single torrent.
+// Comunicates with the peers (readers/writers)
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"encoding/binary"
+	"container/list"
+	"net"
+	"strings"
+	"math/rand"
+	"time"
+	"wgo/limiter"
+	"wgo/bit_field"
+	"wgo/events"
+	"wgo/files"
+	"wgo/stats"
+	"sync"
+	"errors"
+	)
+	
+const(
+	UNUSED_PEERS = 200
+	PERCENT_UNUSED_PEERS = 20
+	FILL_INTERVAL = 10 // Seconds between tries to connect to unused peers
+	SWEEP_INTERVAL = 30 // Seconds between searches of dead peers
+)
+
+// We will use 1 channel to send the data from all peers (Readers)
+// We will use separate channels to comunicate with the peers (Writers)
+// So this implementation will use 1+num_peers channels
+
+
+// General structure that will hold comunitacion channels
+// and info about peers
+
+type peerMgr struct {
+	mutex *sync.Mutex
+	activePeers map[string] *Peer // List of active peers
+	incomingPeers map[string] *Peer // List of incoming connections
+	bans *BanList
+	conns *ConnLimit // Of the session
+	maxBadPieces int
+	unusedPeers *list.List
+	sources map[string]string // How the unused peers were found
+	retries map[string]*retry // Closed outgoing peers to connect again
+	selfAddrs map[string]bool // Addresses where we connected to ourselves
+	sourceStats map[string]*SourceStats // Of the closed peers, by how they were found
+	pieceMgr PieceMgr
+	stats stats.Stats
+	our_bitfield *bit_field.Bitfield
+	numPieces, pieceLength, lastPieceLength int64
+	infohash, peerid string
+	infohashV2 string // First 20 bytes of the v2 infohash, of hybrid torrents
+	files files.Files
+	l limiter.Limiter
+	unlimited limiter.Limiter // Used by local peers
+	listenPort int64
+	encryption int
+	utp bool
+	private bool // Peers only from the trackers (BEP 27)
+	maxActive, maxIncoming int // Connections per torrent
+	keepAlive, timeout time.Duration
+	handshakeTimeout, writeTimeout time.Duration
+	reaped int64 // Peers disconnected for not sending anything
+	availability *Availability // Of the pieces in the connected peers
+	events *events.Emitter // Of the connected peers, nil if nobody wants them
+	traceFolder string // Of the trace files of the peers, empty for none
+	stopped bool
+	quit chan bool
+}
+
+type PeerMgr interface {
+	DeletePeer(addr string)
+	AddPeers(peers *list.List, source string)
+	AddPeer(conn net.Conn, reserved []byte, infohash, peerid string)
+	Infohash() string
+	InfohashV2() string
+	SetInfohashV2(infohash string)
+	SetListenPort(port int64)
+	SetEncryption(policy int)
+	SetUtp(enabled bool)
+	SetPrivate(private bool)
+	SetMaxPeers(active, incoming int)
+	SetTimeouts(keepAlive, handshake, read, write int64)
+	SetMaxBadPieces(max int)
+	SetEvents(em *events.Emitter)
+	SetTrace(folder string)
+	Encryption() int
+	GetPeers() (map[string]*Peer)
+	SendHave(index int64)
+	SendCancel(addr []string, index, begin, length int64)
+	SetPieceMgr(pm PieceMgr)
+	Duplicate(peer *Peer) bool
+	SourceStats() map[string]SourceStats
+	ActivePeers() int
+	IncomingPeers() int
+	UnusedPeers() int
+	Reaped() int64
+	Availability() *Availability
+	RequestPeers() int
+	AddBadPeers(peers []string)
+	SelectOptimistic() (peer *Peer)
+	SetPeerLimits(addr string, up_limit, down_limit int) (error)
+	Stop()
+}
+
+func (p *peerMgr) DeletePeer(addr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if peer, err := p.SearchPeer(addr); err == nil {
+		p.Remove(peer)
+	}
+	return
+}
+
+func (p *peerMgr) AddPeers(peers *list.List, source string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for addr := peers.Front(); addr != nil; addr = addr.Next() {
+		a := addr.Value.(string)
+		if _, err := p.SearchPeer(a); err == nil {
+			// Already connected
+			continue
+		}
+		if _, ok := p.sources[a]; ok {
+			// Already in the unused list
+			continue
+		}
+		if p.bans.Banned(a) || p.selfAddrs[a] {
+			continue
+		}
+		if p.private && (source == SOURCE_PEX || source == SOURCE_LOCAL) {
+			continue
+		}
+		p.source(source).Found++
+		if len(p.activePeers) < p.maxActive && !p.stopped && p.conns.Open() {
+			peerLog.Debug("Adding active peer", "addr", a, "source", source)
+			peer, err := NewPeer(a, p.infohash, p.peerid, p, p.numPieces, p.pieceLength, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.peerLimiter(source))
+			if err != nil {
+				p.conns.Release()
+				peerLog.Warn("Error creating peer", "addr", a, "err", err)
+				continue
+			}
+			peer.source = source
+			p.setupPeer(peer)
+			p.activePeers[a] = peer
+			go peer.PeerWriter()
+		} else {
+			p.unusedPeers.PushBack(a)
+			p.sources[a] = source
+		}
+	}
+	//p.tracker <- peers
+}
+
+// Add an incoming peer, the infohash of its handshake is used in
+// ours, so the peers of the v2 swarm of a hybrid torrent get the v2 one
+
+func (p *peerMgr) AddPeer(c net.Conn, reserved []byte, infohash, peerid string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.incomingPeers) >= p.maxIncoming || p.stopped {
+		c.Close()
+		return
+	}
+	addr := c.RemoteAddr().String()
+	addr = addr[0:strings.Index(addr, ":")]
+	if p.bans.Banned(addr) {
+		peerLog.Debug("Refusing banned incoming peer", "addr", addr)
+		c.Close()
+		return
+	}
+	// Check if peer has already connected
+	for p_addr, _ := range(p.incomingPeers) {
+		if peerIp(p_addr) == addr && !sameHostAllowed(addr) {
+			peerLog.Debug("Incoming peer is already connected", "addr", addr)
+			c.Close()
+			return
+		}
+	}
+	if peerid == p.peerid {
+		// We connected to ourselves
+		c.Close()
+		return
+	}
+	if infohash != p.infohash && (len(p.infohashV2) == 0 || infohash != p.infohashV2) {
+		c.Close()
+		return
+	}
+	if !p.conns.Open() {
+		peerLog.Debug("Too many connections, refusing incoming peer", "addr", addr)
+		c.Close()
+		return
+	}
+	peerLog.Debug("Adding incoming peer", "addr", addr)
+	peer, err := NewPeerFromConn(c, reserved, infohash, p.peerid, peerid, p, p.numPieces, p.pieceLength, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.peerLimiter(SOURCE_INCOMING))
+	if err != nil {
+		p.conns.Release()
+		c.Close()
+		return
+	}
+	p.setupPeer(peer)
+	p.source(SOURCE_INCOMING).Found++
+	p.incomingPeers[c.RemoteAddr().String()] = peer
+	go peer.PeerWriter()
+}
+
+// Settings that every new peer gets, incoming or outgoing. Called with
+// the mutex held.
+
+func (p *peerMgr) setupPeer(peer *Peer) {
+	peer.listenPort = p.listenPort
+	peer.encryption = p.encryption
+	peer.private = p.private
+	peer.utp = p.utp
+	peer.conns = p.conns
+	peer.keepAliveInterval, peer.timeout = p.keepAlive, p.timeout
+	peer.handshakeTimeout, peer.writeTimeout = p.handshakeTimeout, p.writeTimeout
+	peer.events = p.events
+	peer.traceFolder = p.traceFolder
+}
+
+func (p *peerMgr) GetPeers() (peers map[string]*Peer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	peers = make(map[string]*Peer)
+	for addr, peer := range(p.activePeers) {
+		peers[addr] = peer
+	}
+	for addr, peer := range(p.incomingPeers) {
+		peers[addr] = peer
+	}
+	return
+}
+
+func (p *peerMgr) SendHave(index int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	payLoad := make([]byte, 4)
+	binary.BigEndian.PutUint32(payLoad[0:4], uint32(index))
+	msg := &message{length: uint32(5), msgId: have, payLoad: payLoad}
+	for _, peer := range(p.activePeers) {
+		peer.send(msg)
+	}
+	for _, peer := range(p.incomingPeers) {
+		peer.send(msg)
+	}
+}
+
+func (p *peerMgr) SendCancel(addr []string, index, begin, length int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	payLoad := make([]byte, 12)
+	binary.BigEndian.PutUint32(payLoad[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payLoad[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payLoad[8:12], uint32(length))
+	msg := &message{length: uint32(13), msgId: cancel, payLoad: payLoad, addr: addr}
+	for _, addr := range(addr) {
+		if peer, ok := p.activePeers[addr]; ok {
+			peer.send(msg)
+		} else if peer, ok := p.incomingPeers[addr]; ok {
+			peer.send(msg)
+		}
+	}
+}
+
+func (p *peerMgr) Infohash() string {
+	return p.infohash
+}
+
+// The hybrid torrents are also in the v2 swarm, its peers connect
+// with the truncated v2 infohash
+
+func (p *peerMgr) SetInfohashV2(infohash string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.infohashV2 = infohash
+}
+
+func (p *peerMgr) InfohashV2() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.infohashV2
+}
+
+// Port announced to the peers in the extension handshake
+
+func (p *peerMgr) SetListenPort(port int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.listenPort = port
+}
+
+// Each peer gets its own limiter on top of the global one, peers in
+// the local network are not affected by the global limits
+
+func (p *peerMgr) peerLimiter(source string) limiter.Limiter {
+	if source == SOURCE_LOCAL {
+		return limiter.NewPeerLimiter(p.unlimited)
+	}
+	return limiter.NewPeerLimiter(p.l)
+}
+
+// Limit the bandwidth used by a single peer (in KB/s, 0 means no limit),
+// to throttle it without closing the connection
+
+func (p *peerMgr) SetPeerLimits(addr string, up_limit, down_limit int) (error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	peer, err := p.SearchPeer(addr)
+	if err != nil {
+		return err
+	}
+	return peer.l.SetLimits(up_limit, down_limit)
+}
+
+// Encryption policy used with the peers
+
+func (p *peerMgr) SetEncryption(policy int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.encryption = policy
+}
+
+func (p *peerMgr) Encryption() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.encryption
+}
+
+// Try to connect to the peers with uTP before using TCP
+
+func (p *peerMgr) SetUtp(enabled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.utp = enabled
+}
+
+// Private torrents don't exchange peers with PEX nor accept the
+// ones found in the local network
+
+func (p *peerMgr) SetPrivate(private bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.private = private
+}
+
+// Maximum number of outgoing and incoming connections, when lowered
+// the connected peers are kept until they disconnect
+
+func (p *peerMgr) SetMaxPeers(active, incoming int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.maxActive, p.maxIncoming = active, incoming
+}
+
+// Seconds between our keep-alives, to finish the handshake, without
+// receiving anything before closing a connection, and to send a
+// message. Only used by new peers.
+
+func (p *peerMgr) SetTimeouts(keepAlive, handshake, read, write int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keepAlive, p.timeout = time.Duration(keepAlive)*time.Second, time.Duration(read)*time.Second
+	p.handshakeTimeout, p.writeTimeout = time.Duration(handshake)*time.Second, time.Duration(write)*time.Second
+}
+
+// Bad pieces sent by an IP before banning it, 0 never bans
+
+func (p *peerMgr) SetMaxBadPieces(max int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.maxBadPieces = max
+}
+
+// Where the peers tell that they finished the handshake, only used by
+// new peers
+
+func (p *peerMgr) SetEvents(em *events.Emitter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events = em
+}
+
+// Trace the messages of the new peers to a file per peer in folder,
+// empty stops tracing the new ones
+
+func (p *peerMgr) SetTrace(folder string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.traceFolder = folder
+}
+
+func (p *peerMgr) SetPieceMgr(pm PieceMgr) {
+	p.pieceMgr = pm
+}
+
+func (p *peerMgr) ActivePeers() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.activePeers)
+}
+
+func (p *peerMgr) IncomingPeers() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.incomingPeers)
+}
+
+func (p *peerMgr) UnusedPeers() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.unusedPeers.Len()
+}
+
+func (p *peerMgr) Availability() *Availability {
+	return p.availability
+}
+
+func (p *peerMgr) Reaped() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.reaped
+}
+
+func (p *peerMgr) RequestPeers() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.unusedPeers.Len() == 0 {
+		return (UNUSED_PEERS + (p.maxActive - len(p.activePeers)))
+	} else if ((p.unusedPeers.Len()*100)/UNUSED_PEERS) < PERCENT_UNUSED_PEERS {
+		return (UNUSED_PEERS - p.unusedPeers.Len())
+	}
+	return 0
+}
+
+// The peers in the list sent blocks of a piece that failed the hash
+// check, each IP gets a bad piece at most once. The banned ones are
+// disconnected.
+
+func (p *peerMgr) AddBadPeers(peers []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ips := make(map[string]bool)
+	for _, addr := range(peers) {
+		ips[peerIp(addr)] = true
+	}
+	for ip, _ := range(ips) {
+		if p.bans.AddBad(ip, p.maxBadPieces) {
+			p.closeIp(ip)
+		}
+	}
+}
+
+// Close every connection with the ip
+
+func (p *peerMgr) closeIp(ip string) {
+	for _, peers := range([]map[string]*Peer{p.activePeers, p.incomingPeers}) {
+		for addr, peer := range(peers) {
+			if peerIp(addr) == ip {
+				peerLog.Info("Disconnecting banned peer", "addr", addr)
+				pr := peer
+				go pr.once.Do(func() { pr.Close() })
+			}
+		}
+	}
+}
+
+// Select a random connected peer that we are choking and that
+// is interested in us, to give it an optimistic unchoke
+
+func (p *peerMgr) SelectOptimistic() (peer *Peer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	candidates := make([]*Peer, 0, len(p.activePeers)+len(p.incomingPeers))
+	for _, peer := range(p.activePeers) {
+		if peer.Connected() && peer.Am_choking() && peer.Peer_interested() {
+			candidates = append(candidates, peer)
+		}
+	}
+	for _, peer := range(p.incomingPeers) {
+		if peer.Connected() && peer.Am_choking() && peer.Peer_interested() {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// Create a PeerMgr
+
+func NewPeerMgr(numPieces int64, peerid, infohash string, our_bitfield *bit_field.Bitfield, st stats.Stats, fl files.Files, l limiter.Limiter, bans *BanList, conns *ConnLimit, pieceLength, lastPieceLength int64) (pm PeerMgr, err error) {
+	p := new(peerMgr)
+	p.mutex = new(sync.Mutex)
+	p.numPieces = numPieces
+	p.pieceLength = pieceLength
+	p.lastPieceLength = lastPieceLength
+	p.infohash = infohash
+	p.peerid = peerid
+	p.activePeers = make(map[string] *Peer, ACTIVE_PEERS)
+	p.incomingPeers = make(map[string] *Peer, INCOMING_PEERS)
+	p.bans = bans
+	p.conns = conns
+	p.maxBadPieces = MAX_BAD_PIECES
+	p.unusedPeers = list.New()
+	p.sources = make(map[string]string)
+	p.retries = make(map[string]*retry)
+	p.selfAddrs = make(map[string]bool)
+	p.sourceStats = make(map[string]*SourceStats)
+	p.encryption = ENCRYPTION_PREFER
+	p.maxActive, p.maxIncoming = ACTIVE_PEERS, INCOMING_PEERS
+	p.keepAlive, p.timeout = KEEP_ALIVE_MSG, KEEP_ALIVE_RESP
+	p.handshakeTimeout, p.writeTimeout = HANDSHAKE_TIMEOUT, WRITE_TIMEOUT
+	p.quit = make(chan bool)
+	p.availability = NewAvailability(numPieces)
+	//p.pieceMgr = pieceMgr
+	p.our_bitfield = our_bitfield
+	p.stats = st
+	p.files = fl
+	//p.up_limit = up_limit
+	//p.down_limit = down_limit
+	p.l = l
+	if p.unlimited, err = limiter.NewLimiter(0, 0); err != nil {
+		return
+	}
+	go p.Run()
+	pm = p
+	return
+}
+
+func (p *peerMgr) Run() {
+	pex := time.NewTicker(PEX_INTERVAL*time.Second)
+	fill := time.NewTicker(FILL_INTERVAL*time.Second)
+	sweep := time.NewTicker(SWEEP_INTERVAL*time.Second)
+	for {
+		select {
+			case <- p.quit:
+				pex.Stop()
+				fill.Stop()
+				sweep.Stop()
+				return
+			case <- sweep.C:
+				p.sweep()
+			case <- pex.C:
+				p.Pex()
+			case <- fill.C:
+				p.fill()
+		}
+	}
+}
+
+// Disconnect the connected peers that sent nothing, not even a
+// keep-alive, in twice their keep-alive interval
+
+func (p *peerMgr) sweep() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, peers := range([]map[string]*Peer{p.activePeers, p.incomingPeers}) {
+		for addr, peer := range(peers) {
+			if idle := peer.Idle(); peer.Connected() && idle > int64(2*peer.keepAliveInterval/time.Second) {
+				peerLog.Info("Disconnecting dead peer", "addr", addr, "idle", idle)
+				p.reaped++
+				pr := peer
+				go pr.once.Do(func() { pr.Close() })
+			}
+		}
+	}
+}
+
+// Connect to unused peers while there are free slots, they can be
+// freed by other torrents or by raising the limits. The peers to
+// retry go first.
+
+func (p *peerMgr) fill() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.dueRetries()
+	for len(p.activePeers) < p.maxActive && p.unusedPeers.Len() > 0 {
+		if err := p.AddNewPeer(); err != nil {
+			return
+		}
+	}
+}
+
+// Disconnect from every peer and stop connecting to new ones, the
+// connections are closed when it returns
+
+func (p *peerMgr) Stop() {
+	p.mutex.Lock()
+	if p.stopped {
+		p.mutex.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.quit)
+	p.mutex.Unlock()
+	for _, peer := range(p.GetPeers()) {
+		peer.once.Do(func() { peer.Close() })
+	}
+}
+
+// Send our connected peers to the peers that support PEX. Incoming
+// peers are only sent if we know their listening port.
+
+func (p *peerMgr) Pex() {
+	p.mutex.Lock()
+	private := p.private
+	p.mutex.Unlock()
+	if private {
+		return
+	}
+	connected := make(map[string]bool)
+	peers := p.GetPeers()
+	for _, peer := range(peers) {
+		if addr := peer.ListenAddr(); peer.Connected() && len(addr) > 0 {
+			connected[addr] = true
+		}
+	}
+	for _, peer := range(peers) {
+		peer.SendPex(connected)
+	}
+}
+
+// Search the peer
+
+func (p *peerMgr) SearchPeer(addr string) (peer *Peer, err error) {
+	var ok bool
+	if peer, ok = p.activePeers[addr]; ok {
+		return
+	}
+	if peer, ok = p.incomingPeers[addr]; ok {
+		return
+	}
+	return peer, errors.New("PeerMgr -> Peer " + addr + " not found")
+}
+
+// Remove a peer
+
+func (p *peerMgr) Remove(peer *Peer) {
+	//peer.Close()
+	if peer.self && !peer.is_incoming {
+		p.addSelf(peer.addr)
+	}
+	if _, ok := p.activePeers[peer.addr]; ok {
+		delete(p.activePeers, peer.addr)
+		p.conns.Release()
+		p.closedSource(peer)
+		p.scheduleRetry(peer)
+		p.AddNewPeer()
+		return
+	}
+	if _, ok := p.incomingPeers[peer.addr]; ok {
+		delete(p.incomingPeers, peer.addr)
+		p.conns.Release()
+		p.closedSource(peer)
+		return
+	}
+}
+
+// Add a new peer to the activePeers map
+
+func (p *peerMgr) AddNewPeer() (err error) {
+	if p.stopped {
+		return errors.New("PeerMgr stopped")
+	}
+	addr := p.unusedPeers.Front()
+	for addr != nil && p.bans.Banned(addr.Value.(string)) {
+		// Banned after it was added to the list
+		next := addr.Next()
+		delete(p.sources, addr.Value.(string))
+		p.unusedPeers.Remove(addr)
+		addr = next
+	}
+	if addr == nil {
+		// Requests new peers to the tracker module (check inactive peers & active peers also)
+		//p.inTracker <- (UNUSED_PEERS + (ACTIVE_PEERS - len(p.activePeers)))
+		return errors.New("Unused peers list is empty")
+	}
+	if !p.conns.Open() {
+		return errors.New("Too many connections")
+	}
+	// Check how much of the unsued peers list is used, and request more if needed
+	/*if (p.unusedPeers.Len()/UNUSED_PEERS * 100) < PERCENT_UNUSED_PEERS {
+		// request new peers to tracker
+		p.inTracker <- (UNUSED_PEERS - p.unusedPeers.Len())
+	}*/
+	a := addr.Value.(string)
+	p.unusedPeers.Remove(addr)
+	source := p.sources[a]
+	delete(p.sources, a)
+	peer, err := NewPeer(a, p.infohash, p.peerid, p, p.numPieces, p.pieceLength, p.lastPieceLength, p.pieceMgr, p.our_bitfield, p.stats, p.files, p.peerLimiter(source))
+	if err != nil {
+		p.conns.Release()
+		return
+	}
+	peer.source = source
+	p.setupPeer(peer)
+	p.activePeers[a] = peer
+	go peer.PeerWriter()
+	return
+}
@@ -0,0 +1,247 @@
+// Peer write queue. The piece messages are our uploads to the peer,
+// they are removed when the peer cancels them and flushed when we choke
+// it, and the data they hold is limited to MAX_QUEUED_UPLOADS.
+// The messages are sent in three lanes, each one in order: first the
+// control messages (the state changes, the haves, the requests and the
+// cancels), then the other ones (extended and hash messages, that can be
+// as big as a block) and then the pieces, so a choke or a have waits at
+// most for the message being written on a slow link, not for the
+// megabytes of uploads queued before it.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"sync"
+	"bytes"
+	"errors"
+	)
+
+const(
+	MAX_QUEUED_UPLOADS = 2*1024*1024 // Bytes of blocks waiting to be sent to a peer
+)
+
+type PeerQueue struct {
+	phead, ptail, mhead, mtail, pn, mn int64
+	chead, ctail, cn int64
+	pieces map[int64] *message
+	messages map[int64] *message
+	control map[int64] *message // Sent before the other messages
+	length int
+	in, delete, out chan *message
+	quit chan bool // Closed with the peer
+	mutex *sync.Mutex // Protects uploadBytes
+	uploadBytes int64 // Of the queued pieces, and the ones being read from disk
+}
+
+func NewQueue(in, out, delete chan *message, quit chan bool) (q *PeerQueue) {
+	q = new(PeerQueue)
+	q.mhead, q.mtail, q.phead, q.ptail, q.pn, q.mn = 0, 0, 0, 0, 0, 0
+	q.chead, q.ctail, q.cn = 0, 0, 0
+	q.pieces = make(map[int64] *message/*, MAX_MSG_BUFFER*/)
+	q.messages = make(map[int64] *message/*, MAX_PIECE_BUFFER*/)
+	q.control = make(map[int64] *message)
+	q.in = in
+	q.out = out
+	q.delete = delete
+	q.quit = quit
+	q.mutex = new(sync.Mutex)
+	//q.log = l
+	return
+}
+
+// Make room for a block before reading it, false if the queue is full
+
+func (q *PeerQueue) Reserve(length int64) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.uploadBytes + length > MAX_QUEUED_UPLOADS {
+		return false
+	}
+	q.uploadBytes += length
+	return true
+}
+
+// A block left the queue, or couldn't be read
+
+func (q *PeerQueue) release(length int64) {
+	q.mutex.Lock()
+	q.uploadBytes -= length
+	q.mutex.Unlock()
+}
+
+// Small messages that the peer waits for, sent ahead of the rest. The
+// requests go with the cancels so a cancel never overtakes its request.
+
+func isControl(msgId uint8) bool {
+	switch msgId {
+		case choke, unchoke, interested, uninterested, have, request, cancel,
+			suggest, have_all, have_none, reject_request, allowed_fast:
+			return true
+	}
+	return false
+}
+
+// Drop a piece message that won't be sent
+
+func (q *PeerQueue) discard(m *message) {
+	q.release(int64(len(m.payLoad) - 8))
+	blockPool.Put(m.payLoad)
+}
+
+func (q *PeerQueue) Empty() bool {
+	return (q.phead == q.ptail) && (q.mhead == q.mtail) && (q.chead == q.ctail)
+}
+
+func (q *PeerQueue) Flush() {
+	for key, m := range(q.pieces) {
+		q.discard(m)
+		delete(q.pieces, key)
+	}
+	for key, _ := range(q.messages) {
+		delete(q.messages, key)
+	}
+	for key, _ := range(q.control) {
+		delete(q.control, key)
+	}
+	q.pieces = nil
+	q.messages = nil
+	q.control = nil
+}
+
+func (q *PeerQueue) FlushPieces(reject bool) {
+	for key, m := range(q.pieces) {
+		if reject {
+			q.control[q.chead] = rejectMessage(m)
+			q.chead++
+			q.cn++
+		}
+		q.discard(m)
+		delete(q.pieces, key)
+	}
+	q.phead = 0
+	q.ptail = 0
+	q.pn = 0
+}
+
+func (q *PeerQueue) Push(m *message) {
+	if m.msgId == flush {
+		q.FlushPieces(m.reject)
+		return
+	}
+	if m.msgId == piece {
+		q.pieces[q.phead] = m
+		q.phead++
+		q.pn++
+	} else if isControl(m.msgId) {
+		q.control[q.chead] = m
+		q.chead++
+		q.cn++
+	} else {
+		//if q.mn >= MAX_MSG_BUFFER { return }
+		q.messages[q.mhead] = m
+		q.mhead++
+		q.mn++
+	}
+}
+
+func (q *PeerQueue) Remove(m *message) {
+	if m.msgId == cancel {
+		key, err := q.SearchPiece(m)
+		if err == nil { // Piece found
+			// Delete this piece & reorder queue
+			q.remove(key)
+		}
+		return
+	}
+}
+
+func (q *PeerQueue) remove(key int64) {
+	q.discard(q.pieces[key])
+	for ;key > q.ptail; key-- {
+		q.pieces[key] = q.pieces[key-1]
+	}
+	delete(q.pieces, q.ptail)
+	q.ptail++
+	q.pn--
+	return
+}
+
+func (q *PeerQueue) TryPop() (m *message) {
+	if q.chead != q.ctail {
+		m = q.control[q.ctail]
+	} else if q.mhead != q.mtail {
+		m = q.messages[q.mtail]
+	} else {
+		m = q.pieces[q.ptail]
+	}
+	return
+}
+
+func (q *PeerQueue) Pop() {
+	if q.chead != q.ctail {
+		delete(q.control, q.ctail)
+		q.ctail++
+		q.cn--
+	} else if q.mhead != q.mtail {
+		delete(q.messages, q.mtail)
+		q.mtail++
+		q.mn--
+	} else {
+		q.release(int64(len(q.pieces[q.ptail].payLoad) - 8))
+		delete(q.pieces, q.ptail)
+		q.ptail++
+		q.pn--
+	}
+}
+
+func (q *PeerQueue) SearchPiece(m *message) (key int64, err error) {
+	for key, msg := range(q.pieces) {
+		if bytes.Equal(msg.payLoad[0:8], m.payLoad[0:8]) {
+			return key, err
+		}
+	}
+	return key, errors.New("Piece not found")
+}
+
+func (q *PeerQueue) Run() {
+	for {
+		if q.Empty() {
+			select {
+				case <- q.quit:
+					goto exit
+				case m, ok := <- q.in:
+					if !ok || m == nil {
+						goto exit
+					}
+					q.Push(m)
+				case _, ok := <- q.delete:
+					if !ok {
+						goto exit
+					}
+			}
+		} else {
+			select {
+			case <- q.quit:
+				goto exit
+			case m, ok := <- q.delete:
+				if !ok || m == nil {
+					goto exit
+				}
+				q.Remove(m)
+			case m, ok := <- q.in:
+				if !ok || m == nil {
+					goto exit
+				}
+				q.Push(m)
+			case q.out <- q.TryPop():
+				q.Pop()
+			}
+		}
+	}
+exit:
+	q.Flush()
+	// The queue is the only sender of out
+	close(q.out)
+}
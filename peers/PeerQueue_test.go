@@ -0,0 +1,56 @@
+package peers
+
+import "testing"
+
+func pieceMessage(index byte) *message {
+	payLoad := make([]byte, 8 + 16384)
+	payLoad[3] = index
+	return &message{length: uint32(1 + len(payLoad)), msgId: piece, payLoad: payLoad}
+}
+
+// The control messages overtake the extended ones and the pieces, and
+// each lane keeps its order
+
+func TestQueuePriority(t *testing.T) {
+	q := NewQueue(nil, nil, nil, nil)
+	q.Push(pieceMessage(0))
+	q.Push(pieceMessage(1))
+	q.Push(&message{length: 3, msgId: extended, payLoad: []byte{1, 0}})
+	q.Push(&message{length: 1, msgId: unchoke})
+	q.Push(&message{length: 5, msgId: have, payLoad: []byte{0, 0, 0, 2}})
+	expected := []uint8{unchoke, have, extended, piece, piece}
+	for i, id := range(expected) {
+		m := q.TryPop()
+		if m == nil || m.msgId != id {
+			t.Fatalf("Message %d is %v, expected id %d", i, m, id)
+		}
+		if id == piece && m.payLoad[3] != byte(i - 3) {
+			t.Errorf("Piece %d sent out of order", m.payLoad[3])
+		}
+		q.Pop()
+	}
+	if !q.Empty() {
+		t.Errorf("Queue not empty after popping every message")
+	}
+}
+
+// The rejects of the flushed pieces go with the control messages
+
+func TestQueueFlushReject(t *testing.T) {
+	q := NewQueue(nil, nil, nil, nil)
+	q.Push(&message{length: 3, msgId: extended, payLoad: []byte{1, 0}})
+	q.Push(pieceMessage(0))
+	q.Push(&message{length: 1, msgId: choke})
+	q.Push(&message{msgId: flush, reject: true})
+	expected := []uint8{choke, reject_request, extended}
+	for i, id := range(expected) {
+		m := q.TryPop()
+		if m == nil || m.msgId != id {
+			t.Fatalf("Message %d is %v, expected id %d", i, m, id)
+		}
+		q.Pop()
+	}
+	if !q.Empty() {
+		t.Errorf("Queue not empty after popping every message")
+	}
+}
@@ -0,0 +1,122 @@
+// Peer Exchange (BEP 11), share the list of connected
+// peers with the peers that support ut_pex
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"fmt"
+	"net"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	)
+
+const(
+	PEX_INTERVAL = 60
+	MAX_PEX_PEERS = 50
+)
+
+// How we found a peer
+
+const(
+	SOURCE_TRACKER = "tracker"
+	SOURCE_PEX = "pex"
+	SOURCE_INCOMING = "incoming"
+	SOURCE_LOCAL = "local" // Local peer discovery
+	SOURCE_RESUME = "resume" // Peer cache of the resume data
+	SOURCE_MANUAL = "manual" // Added with Torrent.AddPeer
+)
+
+// Send the peers connected since the last PEX message,
+// and the ones that have been dropped
+
+func (p *Peer) SendPex(connected map[string]bool) (err error) {
+	if p.private {
+		return
+	}
+	id, ok := p.Extension("ut_pex")
+	if !ok || !p.connected {
+		return
+	}
+	added := make([]byte, 0, 6*MAX_PEX_PEERS)
+	dropped := make([]byte, 0, 6*MAX_PEX_PEERS)
+	for addr, _ := range(connected) {
+		if len(added) >= 6*MAX_PEX_PEERS {
+			break
+		}
+		if _, ok := p.pexSent[addr]; !ok && addr != p.addr && addr != p.ListenAddr() {
+			if c, err := compactPeer(addr); err == nil {
+				added = append(added, c...)
+				p.pexSent[addr] = true
+			}
+		}
+	}
+	for addr, _ := range(p.pexSent) {
+		if len(dropped) >= 6*MAX_PEX_PEERS {
+			break
+		}
+		if _, ok := connected[addr]; !ok {
+			if c, err := compactPeer(addr); err == nil {
+				dropped = append(dropped, c...)
+			}
+			delete(p.pexSent, addr)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return
+	}
+	flags := make([]byte, len(added)/6)
+	msg, err := NewExtendedMessage(uint8(id), map[string]interface{}{"added": string(added), "added.f": string(flags), "dropped": string(dropped)})
+	if err != nil {
+		return
+	}
+	p.send(msg)
+	return
+}
+
+// Add the peers received from a PEX message to the candidates pool
+
+func (p *Peer) ProcessPex(dict map[string]interface{}) (err error) {
+	added, ok := dict["added"].(string)
+	if !ok {
+		return
+	}
+	peers, err := ParseCompactPeers(added)
+	if err != nil {
+		return
+	}
+	p.peerMgr.AddPeers(peers, SOURCE_PEX)
+	return
+}
+
+// Convert an ip:port address into the 6 bytes compact format
+
+func compactPeer(addr string) (c []byte, err error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return
+	}
+	ip := tcpAddr.IP.To4()
+	if ip == nil {
+		return c, errors.New("Not an IPv4 address")
+	}
+	c = make([]byte, 6)
+	copy(c[0:4], ip)
+	binary.BigEndian.PutUint16(c[4:6], uint16(tcpAddr.Port))
+	return
+}
+
+// Parse a list of peers in the 6 bytes compact format
+
+func ParseCompactPeers(peers string) (l *list.List, err error) {
+	if len(peers)%6 != 0 {
+		return l, errors.New("Invalid compact peers length")
+	}
+	l = list.New()
+	for i := 0; i < len(peers); i = i+6 {
+		l.PushBack(fmt.Sprintf("%d.%d.%d.%d:%d", peers[i+0], peers[i+1], peers[i+2], peers[i+3], binary.BigEndian.Uint16([]byte(peers[i+4:i+6]))))
+	}
+	return
+}
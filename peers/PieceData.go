@@ -0,0 +1,629 @@
+// Magnagement of pieces requested by peers
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"time"
+	"math/rand"
+	"wgo/bit_field"
+	"wgo/files"
+	"errors"
+	)
+	
+type PieceData struct {
+	pieces map[int64]*Piece
+	peers map[string]map[uint64]int64
+	bitfield *bit_field.Bitfield
+	pieceLength, lastPieceLength int64
+	missing int64 // Number of blocks not downloaded yet
+	endgame bool
+	sequential bool // Pick pieces in file order instead of at random
+	priority []int // Priority of each piece, the highest of its files
+	skipped int64 // Blocks of the skipped pieces not downloaded yet
+	availability *Availability // Of the swarm, nil picks the new pieces at random
+	window []int64 // Pieces read ahead for the sequential readers, the closest first
+	excluded map[int64]map[string]bool // IPs not asked again for the blocks of a piece that failed the hash check
+	checking map[int64]bool // Finished pieces being hashed, not requested until PieceDone or PieceFailed
+}
+
+type Piece struct {
+	downloaderCount []int // -1 means piece is already downloaded
+	peersAddr       []string // Peer that sent each block, empty if read from the resume data
+	owners          []string // Peer each block was requested to first, empty if none
+	arrived         []bool // The first copy of the block is being written
+	pieceLength     int64
+}
+
+func NewPieceData(bitfield *bit_field.Bitfield, pieceLength, lastPieceLength int64) (p *PieceData) {
+	p = new(PieceData)
+	p.pieces = make(map[int64]*Piece, bitfield.Len())
+	p.peers = make(map[string]map[uint64]int64, ACTIVE_PEERS + INCOMING_PEERS)
+	p.bitfield = bitfield
+	p.pieceLength = pieceLength
+	p.lastPieceLength = lastPieceLength
+	p.priority = make([]int, bitfield.Len())
+	p.excluded = make(map[int64]map[string]bool)
+	p.checking = make(map[int64]bool)
+	for i := int64(0); i < bitfield.Len(); i++ {
+		p.priority[i] = files.PRIORITY_NORMAL
+		if !bitfield.IsSet(i) {
+			p.missing += p.NumBlocks(i)
+		}
+	}
+	return
+}
+
+// Number of blocks of a piece
+
+func (pd *PieceData) NumBlocks(pieceNum int64) int64 {
+	pieceLength :=  pd.pieceLength
+	if pieceNum == pd.bitfield.Len()-1 {
+		pieceLength = pd.lastPieceLength
+	}
+	return (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
+}
+
+// Number of blocks that we still have to download
+
+func (pd *PieceData) Missing() int64 {
+	return pd.missing - pd.skipped
+}
+
+// Set the priority of every piece, pieces with PRIORITY_SKIP are
+// never requested and PRIORITY_HIGH pieces are requested first
+
+func (pd *PieceData) SetPriorities(priority []int) {
+	pd.priority = priority
+	pd.skipped = 0
+	for i, prio := range(priority) {
+		if prio == files.PRIORITY_SKIP && !pd.bitfield.IsSet(int64(i)) {
+			pd.skipped += pd.NumBlocks(int64(i))
+		}
+	}
+}
+
+// The pieces the readers need next, they are requested before any
+// other and shared by every peer that has them
+
+func (pd *PieceData) SetWindow(window []int64) {
+	pd.window = window
+}
+
+// When in endgame mode, every remaining block can be requested to all
+// the peers that have it
+
+func (pd *PieceData) SetEndgame(endgame bool) {
+	pd.endgame = endgame
+}
+
+func (pd *PieceData) Endgame() bool {
+	return pd.endgame
+}
+
+func (pd *PieceData) SetSequential(sequential bool) {
+	pd.sequential = sequential
+}
+
+func (pd *PieceData) Sequential() bool {
+	return pd.sequential
+}
+
+// A finished piece didn't pass the hash check, the blocks that aren't
+// kept are downloaded again, from other IPs than the excluded ones if
+// some other peer has the piece
+
+func (pd *PieceData) PieceFailed(pieceNum int64, senders []string, keep []bool, exclude []string) {
+	pieceLength :=  pd.pieceLength
+	if pieceNum == pd.bitfield.Len()-1 {
+		pieceLength = pd.lastPieceLength
+	}
+	piece := NewPiece(pd.NumBlocks(pieceNum), pieceLength)
+	for block, _ := range(piece.downloaderCount) {
+		if block < len(keep) && keep[block] {
+			piece.downloaderCount[block] = -1
+			piece.peersAddr[block] = senders[block]
+		} else {
+			pd.missing++
+		}
+	}
+	pd.pieces[pieceNum] = piece
+	delete(pd.checking, pieceNum)
+	if len(exclude) > 0 && pd.excluded[pieceNum] == nil {
+		pd.excluded[pieceNum] = make(map[string]bool)
+	}
+	for _, addr := range(exclude) {
+		pd.excluded[pieceNum][peerIp(addr)] = true
+	}
+}
+
+// The piece passed the hash check, its excluded IPs can be asked for
+// it again if it's ever downloaded again
+
+func (pd *PieceData) PieceDone(pieceNum int64) {
+	delete(pd.excluded, pieceNum)
+	delete(pd.checking, pieceNum)
+}
+
+// Whether the peer sent bad blocks of the piece
+
+func (pd *PieceData) isExcluded(addr string, pieceNum int64) bool {
+	return pd.excluded[pieceNum][peerIp(addr)]
+}
+
+// Blocks already downloaded of the pieces that aren't finished yet
+
+func (pd *PieceData) Partial() (partial map[int64]*bit_field.Bitfield) {
+	partial = make(map[int64]*bit_field.Bitfield)
+	for k, piece := range(pd.pieces) {
+		var blocks *bit_field.Bitfield
+		for block, downloads := range piece.downloaderCount {
+			if downloads != -1 {
+				continue
+			}
+			if blocks == nil {
+				blocks = bit_field.NewBitfield(int64(len(piece.downloaderCount)))
+			}
+			blocks.Set(int64(block))
+		}
+		if blocks != nil {
+			partial[k] = blocks
+		}
+	}
+	return
+}
+
+// Mark the blocks of an unfinished piece saved in the resume data
+// as downloaded
+
+func (pd *PieceData) RestoreBlocks(pieceNum int64, blocks *bit_field.Bitfield) {
+	if pieceNum < 0 || pieceNum >= pd.bitfield.Len() || pd.bitfield.IsSet(pieceNum) {
+		return
+	}
+	if blocks.Len() < pd.NumBlocks(pieceNum) {
+		return
+	}
+	piece, ok := pd.pieces[pieceNum]
+	if !ok {
+		pieceLength :=  pd.pieceLength
+		if pieceNum == pd.bitfield.Len()-1 {
+			pieceLength = pd.lastPieceLength
+		}
+		piece = NewPiece(pd.NumBlocks(pieceNum), pieceLength)
+		pd.pieces[pieceNum] = piece
+	}
+	for block, downloads := range piece.downloaderCount {
+		if downloads != -1 && blocks.IsSet(int64(block)) {
+			piece.downloaderCount[block] = -1
+			pd.missing--
+		}
+	}
+}
+
+func NewPiece(pieceCount, pieceLength int64) (p *Piece) {
+	p = new(Piece)
+	p.pieceLength = pieceLength
+	p.downloaderCount = make([]int, pieceCount)
+	p.peersAddr = make([]string, pieceCount)
+	p.owners = make([]string, pieceCount)
+	p.arrived = make([]bool, pieceCount)
+	return
+}
+
+// True if some block of the piece is requested to the peer, or none
+// is requested to anybody (left by a peer, or from the resume data)
+
+func (p *Piece) ownedBy(addr string) bool {
+	orphan := true
+	for block, owner := range(p.owners) {
+		if p.downloaderCount[block] <= 0 {
+			continue
+		}
+		if owner == addr {
+			return true
+		}
+		orphan = false
+	}
+	return orphan
+}
+
+func (pd *PieceData) Add(addr string, pieceNum int64, blockNum int) {
+	if _, ok := pd.pieces[pieceNum]; ok {
+		pd.pieces[pieceNum].downloaderCount[blockNum]++
+	} else {
+		pieceLength :=  pd.pieceLength
+		if pieceNum == pd.bitfield.Len()-1 {
+			pieceLength = pd.lastPieceLength
+		}
+		pd.pieces[pieceNum] = NewPiece(pd.NumBlocks(pieceNum), pieceLength)
+		pd.pieces[pieceNum].downloaderCount[blockNum]++
+	}
+	if piece := pd.pieces[pieceNum]; len(piece.owners[blockNum]) == 0 {
+		piece.owners[blockNum] = addr
+	}
+	// Mark peer as downloading this piece
+	ref := uint64(pieceNum) << 32 | uint64(blockNum)
+	if _, ok := pd.peers[addr]; ok {
+		pd.peers[addr][ref] = time.Now().UnixNano()
+	} else {
+		pd.peers[addr] = make(map[uint64]int64)
+		pd.peers[addr][ref] = time.Now().UnixNano()
+	}
+}
+
+func (pd *PieceData) CheckRequested(addr string, pieceNum int64, blockNum int) bool {
+	ref := uint64(pieceNum) << 32 | uint64(blockNum)
+	if peer, ok := pd.peers[addr]; ok {
+		if _, ok := peer[ref]; ok {
+			return true
+		} else {
+			return false
+		}
+	}
+	return false
+}
+
+// Remove the request of a block to a peer, or mark the block as received
+// if finished. When finishing the piece it returns the peer that sent
+// each of its blocks.
+
+func (pd *PieceData) Remove(addr string, pieceNum, blockNum int64, finished bool) (pieceFinished bool, others []string, senders []string) {
+	if _, ok := pd.pieces[pieceNum]; ok {
+		if finished {
+			if pd.pieces[pieceNum].downloaderCount[blockNum] > 1 {
+				others = pd.SearchPeers(pieceNum, blockNum, int64(pd.pieces[pieceNum].downloaderCount[blockNum] - 1), addr)
+			}
+			if pd.pieces[pieceNum].downloaderCount[blockNum] != -1 {
+				pd.missing--
+			}
+			pd.pieces[pieceNum].peersAddr[blockNum] = addr
+			pd.pieces[pieceNum].downloaderCount[blockNum] = -1
+		} else {
+			if pd.pieces[pieceNum].downloaderCount[blockNum] > 0 {
+				pd.pieces[pieceNum].downloaderCount[blockNum]--
+			}
+			if pd.pieces[pieceNum].owners[blockNum] == addr {
+				pd.pieces[pieceNum].owners[blockNum] = ""
+			}
+		}
+		pieceFinished = true
+		for _, block := range(pd.pieces[pieceNum].downloaderCount) {
+			if block != -1 {
+				pieceFinished = false
+				break
+			}
+		}
+		if pieceFinished {
+			senders = pd.pieces[pieceNum].peersAddr
+			delete(pd.pieces, pieceNum)
+			pd.checking[pieceNum] = true
+		}
+	}
+	// Remove from peers
+	if _, ok := pd.peers[addr]; ok {
+		ref := uint64(pieceNum) << 32 | uint64(blockNum)
+		if _, ok := pd.peers[addr][ref]; ok {
+			delete(pd.peers[addr], ref)
+		}
+		if len(pd.peers[addr]) == 0 {
+			delete(pd.peers, addr)
+		}
+	}
+	return
+}
+
+// A block has been received from a peer, false if it's a duplicate:
+// already downloaded, being written, or of a piece not requested.
+// The requests of the block to the other peers are removed and
+// returned in others, to cancel them.
+
+func (pd *PieceData) Arrive(addr string, pieceNum, blockNum int64) (first bool, others []string) {
+	piece, ok := pd.pieces[pieceNum]
+	if !ok || blockNum < 0 || blockNum >= int64(len(piece.downloaderCount)) {
+		return
+	}
+	if piece.downloaderCount[blockNum] == -1 || piece.arrived[blockNum] {
+		return
+	}
+	piece.arrived[blockNum] = true
+	if piece.downloaderCount[blockNum] > 1 {
+		others = pd.SearchPeers(pieceNum, blockNum, int64(piece.downloaderCount[blockNum] - 1), addr)
+		piece.downloaderCount[blockNum] = 0
+		if pd.CheckRequested(addr, pieceNum, int(blockNum)) {
+			piece.downloaderCount[blockNum] = 1
+		}
+	}
+	return true, others
+}
+
+// The block couldn't be written, a copy from another peer is accepted
+
+func (pd *PieceData) WriteFailed(addr string, pieceNum, blockNum int64) {
+	if piece, ok := pd.pieces[pieceNum]; ok && blockNum >= 0 && blockNum < int64(len(piece.arrived)) {
+		piece.arrived[blockNum] = false
+	}
+	pd.Remove(addr, pieceNum, blockNum, false)
+}
+
+// Peers that sent blocks of a piece, once each
+
+func contributors(senders []string) (peers []string) {
+	seen := make(map[string]bool)
+	for _, addr := range(senders) {
+		if len(addr) > 0 && !seen[addr] {
+			seen[addr] = true
+			peers = append(peers, addr)
+		}
+	}
+	return
+}
+
+func (pd *PieceData) RemoveAll(addr string) {
+	if peer, ok := pd.peers[addr]; ok {
+		for ref, _ := range(peer) {
+			pieceNum, blockNum := uint32(ref>>32), uint32(ref)
+			pd.Remove(addr, int64(pieceNum), int64(blockNum), false)
+		}
+	}
+}
+
+func (pd *PieceData) SearchPeers(rpiece, rblock, size int64, our_addr string) (others []string){
+	others = make([]string, 0, size)
+	for addr, _ := range(pd.peers) {
+		if addr != our_addr {
+			for ref, _ := range(pd.peers[addr]) {
+				pieceNum, blockNum := uint32(ref>>32), uint32(ref)
+				if int64(pieceNum) == rpiece && int64(blockNum) == rblock {
+					// Add to return array
+					//others[i] = addr
+					//i++
+					others = append(others, addr)
+					// Remove from list
+					delete(pd.peers[addr], ref)
+					// If peer list is empty, remove peer
+					if len(pd.peers[addr]) == 0 {
+						delete(pd.peers, addr)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// A piece not active yet of the peer with at least the given priority,
+// searching from start and wrapping around. The first one in
+// sequential mode, the rarest in the swarm otherwise. -1 if none.
+
+func (pd *PieceData) newPiece(addr string, start int64, bitfield *bit_field.Bitfield, min int, exclude bool) (rpiece int64) {
+	rpiece = -1
+	rarest := 0
+	check := func(piece int64) bool {
+		if _, ok := pd.pieces[piece]; ok || pd.checking[piece] || pd.priority[piece] < min {
+			return false
+		}
+		if exclude && pd.isExcluded(addr, piece) {
+			return false
+		}
+		if pd.sequential || pd.availability == nil {
+			rpiece = piece
+			return true
+		}
+		count := pd.availability.Count(piece)
+		if rpiece == -1 || count < rarest {
+			rpiece, rarest = piece, count
+		}
+		// Only this peer has it, there is nothing rarer
+		return rarest <= 1
+	}
+	// Search fordward
+	for piece := pd.bitfield.FindNextPiece(start, bitfield); piece != -1; piece = pd.bitfield.FindNextPiece(piece+1, bitfield) {
+		if check(piece) {
+			return
+		}
+	}
+	// Search backwards
+	for piece := pd.bitfield.FindNextPiece(0, bitfield); piece != -1 && piece < start; piece = pd.bitfield.FindNextPiece(piece+1, bitfield) {
+		if check(piece) {
+			return
+		}
+	}
+	return
+}
+
+// A block not requested yet of the pieces in the read ahead window
+// that the peer has, starting the piece if it isn't active
+
+func (pd *PieceData) windowBlock(addr string, bitfield *bit_field.Bitfield, exclude bool) (rpiece int64, rblock int, found bool) {
+	for _, k := range(pd.window) {
+		if pd.bitfield.IsSet(k) || pd.checking[k] || pd.priority[k] == files.PRIORITY_SKIP || !bitfield.IsSet(k) {
+			continue
+		}
+		if exclude && pd.isExcluded(addr, k) {
+			continue
+		}
+		piece, ok := pd.pieces[k]
+		if !ok {
+			return k, 0, true
+		}
+		for block, downloads := range piece.downloaderCount {
+			if downloads == 0 && !piece.arrived[block] {
+				return k, block, true
+			}
+		}
+	}
+	return
+}
+
+// A block not requested yet of the active pieces that the peer has,
+// only of the pieces owned by the peer if owned
+
+func (pd *PieceData) activeBlock(addr string, bitfield *bit_field.Bitfield, owned, exclude bool) (rpiece int64, rblock int, found bool) {
+	for k, piece := range (pd.pieces) {
+		if pd.priority[k] == files.PRIORITY_SKIP || !bitfield.IsSet(k) {
+			continue
+		}
+		if exclude && pd.isExcluded(addr, k) {
+			continue
+		}
+		if pd.sequential && found && k > rpiece {
+			// In sequential mode the active piece with the lowest index goes first
+			continue
+		}
+		if owned && !piece.ownedBy(addr) {
+			continue
+		}
+		for block, downloads := range piece.downloaderCount {
+			if downloads == 0 && !piece.arrived[block] {
+				rpiece, rblock, found = k, block, true
+				break
+			}
+		}
+		if found && !pd.sequential {
+			return
+		}
+	}
+	return
+}
+
+// Select the next block to request to a peer. The peer finishes the
+// pieces it's downloading first and then starts a new one, the blocks
+// of the pieces of other peers are only given to it (striping a piece
+// across several peers) when it has no new piece we want, so the rare
+// pieces don't wait for a single peer. The pieces of the read ahead
+// window go before all of them. The pieces the peer sent bad blocks of
+// are left to the other peers, unless it has nothing else we want.
+
+func (pd *PieceData) SearchPiece(addr string, bitfield *bit_field.Bitfield) (rpiece int64, rblock int, err error) {
+	if rpiece, rblock, err = pd.searchPiece(addr, bitfield, true); err == nil || len(pd.excluded) == 0 {
+		return
+	}
+	return pd.searchPiece(addr, bitfield, false)
+}
+
+func (pd *PieceData) searchPiece(addr string, bitfield *bit_field.Bitfield, exclude bool) (rpiece int64, rblock int, err error) {
+	// The readers are waiting for these
+	var found bool
+	if rpiece, rblock, found = pd.windowBlock(addr, bitfield, exclude); found {
+		pd.Add(addr, rpiece, rblock)
+		return
+	}
+	// Continue the pieces the peer is downloading
+	if rpiece, rblock, found = pd.activeBlock(addr, bitfield, true, exclude); !found && pd.sequential {
+		// The pieces must finish in file order
+		rpiece, rblock, found = pd.activeBlock(addr, bitfield, false, exclude)
+	}
+	if found {
+		pd.Add(addr, rpiece, rblock)
+		return
+	}
+	// Check what piece we can request
+	totalPieces := pd.bitfield.Len()
+	start := int64(0)
+	if !pd.sequential {
+		start = rand.Int63n(totalPieces)
+	}
+	// Pieces of high priority files go first
+	for _, min := range([]int{files.PRIORITY_HIGH, files.PRIORITY_NORMAL}) {
+		if piece := pd.newPiece(addr, start, bitfield, min, exclude); piece != -1 {
+			// Add new piece to set
+			pd.Add(addr, piece, 0)
+			rpiece, rblock = piece, 0
+			return
+		}
+	}
+	// Share the active pieces of the other peers
+	if rpiece, rblock, found = pd.activeBlock(addr, bitfield, false, exclude); found {
+		pd.Add(addr, rpiece, rblock)
+		return
+	}
+	// If all pieces are taken, double up on an active piece
+	// only if we are in endgame mode
+	if !pd.endgame {
+		err = errors.New("No available block found")
+		return
+	}
+	first := true
+	min := 0
+	for k, piece := range (pd.pieces) {
+		if pd.priority[k] == files.PRIORITY_SKIP || (exclude && pd.isExcluded(addr, k)) {
+			continue
+		}
+		for block, downloads := range piece.downloaderCount {
+			if bitfield.IsSet(k) && !piece.arrived[block] && !pd.CheckRequested(addr, k, block) {
+				if first && downloads != -1 {
+					rpiece, rblock, min = k, block, downloads
+					first = false
+				}
+				if downloads != -1 && downloads < min {
+					rpiece, rblock, min = k, block, downloads
+				}
+			}
+		}
+	}
+	if !first {
+		pd.Add(addr, rpiece, rblock)
+		return
+	}
+	err = errors.New("No available block found")
+	return
+}
+
+func (pd *PieceData) NumPieces(addr string) (n int64) {
+	if peer, ok := pd.peers[addr]; ok {
+		n = int64(len(peer))
+	} else {
+		n = 0
+	}
+	return
+}
+
+// Pending requests of every peer
+
+func (pd *PieceData) Requests() (n int64) {
+	for _, peer := range(pd.peers) {
+		n += int64(len(peer))
+	}
+	return
+}
+
+// When the block was requested to the peer (in ns)
+
+func (pd *PieceData) RequestTime(addr string, pieceNum int64, blockNum int) (t int64, ok bool) {
+	ref := uint64(pieceNum) << 32 | uint64(blockNum)
+	t, ok = pd.peers[addr][ref]
+	return
+}
+
+// Whether the peer has a request made before the given time (in ns)
+
+func (pd *PieceData) RequestedBefore(addr string, before int64) bool {
+	for _, t := range(pd.peers[addr]) {
+		if t < before {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the requests sent before the given time (ns), returned by
+// peer so they can be cancelled
+
+func (pd *PieceData) Expire(before int64) (expired map[string][]uint64) {
+	expired = make(map[string][]uint64)
+	for addr, peer := range(pd.peers) {
+		for ref, time := range(peer) {
+			if time < before {
+				expired[addr] = append(expired[addr], ref)
+			}
+		}
+	}
+	for addr, refs := range(expired) {
+		for _, ref := range(refs) {
+			pieceNum, blockNum := uint32(ref>>32), uint32(ref)
+			pd.Remove(addr, int64(pieceNum), int64(blockNum), false)
+		}
+	}
+	return
+}
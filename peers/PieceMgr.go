@@ -0,0 +1,799 @@
+// Management of pieces for a single torrent.
+// Comunicates with PeerMgr (readers/writers) and Files
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"wgo/logger"
+	"time"
+	"bytes"
+	"crypto/sha1"
+	"math"
+	"wgo/bit_field"
+	"wgo/events"
+	"wgo/files"
+	"wgo/stats"
+	"sync"
+	"strconv"
+	"errors"
+	)
+
+const(
+	ACTIVE_PEERS = 45
+	INCOMING_PEERS = 10
+	STANDARD_BLOCK_LENGTH = 16 * 1024
+	MAX_PIECE_REQUESTS = 2
+	REQUEST_TIMEOUT = 60 // Seconds to receive a requested block before requesting it to another peer
+	REQUEST_CHECK = 10 // Seconds between checks of timed out requests
+	DEFAULT_REQUESTS = 20 // Requests to a peer whose speed is not known yet
+	MIN_REQUESTS = 4
+	MAX_QUEUED_REQUESTS = 250
+	REQUEST_QUEUE_TIME = 3 // Seconds of blocks queued on top of the latency
+	NS_PER_S = 1000000000
+	MAX_REQUESTS = 2048
+	MAX_PIECE_LENGTH = 128*1024
+	ENDGAME_BLOCKS = 32 // missing blocks to enter endgame mode
+	SNUB_TIMEOUT = 60 // Seconds without receiving a requested block to snub a peer
+	SNUB_CHECK = 10 // Seconds between checks of snubbed peers
+	READ_AHEAD = 8*1024*1024 // Bytes prefetched after the position of a sequential reader
+	MIN_READ_AHEAD = 2 // Pieces prefetched with large pieces
+)
+
+var pieceLog = logger.New("piece")
+	
+type pieceMgr struct {
+	mutex *sync.Mutex
+	peerMgr PeerMgr
+	stats stats.Stats
+	pieceData *PieceData
+	pieceLength, lastPieceLength, totalPieces, totalSize int64
+	files files.Files
+	bitfield *bit_field.Bitfield
+	priorities []int // Priority of each file
+	hashFailures int64 // Finished pieces that didn't pass the hash check
+	trusted map[string]bool // IPs that sent blocks of pieces that passed the hash check
+	suspects map[int64][]suspectBlock // Of the pieces that failed the hash check once
+	duplicates, wasted int64 // Blocks received more than once, and their bytes
+	requestTimeout int64 // In seconds
+	timeouts int64 // Requests that timed out
+	latency map[string]int64 // Lowest time (ns) a peer took to send a requested block
+	readers map[string]int64 // Offset in the torrent of each sequential reader
+	waiters map[int64][]chan bool // Closed when the piece is finished
+	events *events.Emitter // Of the checked pieces, nil if nobody wants them
+	quit chan bool
+}
+
+// A block of a piece that failed the hash check, sent by a peer that
+// isn't trusted. It's downloaded again and compared with the good one
+// when the piece passes, to find who sent the bad data.
+
+type suspectBlock struct {
+	block int64
+	addr string // Empty if it was read from the resume data
+	sum []byte // SHA-1 of the bad data
+}
+
+type PieceMgr interface {
+	Request(addr string, peer *Peer, bitfield *bit_field.Bitfield)
+	RequestBlock(addr string, bitfield *bit_field.Bitfield) (index, begin, length int64, err error)
+	Arrived(addr string, index, begin, length int64) bool
+	SavePiece(addr string, index, begin, length int64) (error)
+	WriteFailed(addr string, index, begin int64)
+	PeerExit(addr string)
+	Reject(addr string, index, begin int64)
+	SetSequential(sequential bool)
+	Sequential() bool
+	SetRequestTimeout(timeout int64)
+	SetEvents(em *events.Emitter)
+	Partial() map[int64]*bit_field.Bitfield
+	RestoreBlocks(index int64, blocks *bit_field.Bitfield)
+	SetPriority(file, priority int) (error)
+	Priority(file int) int
+	HashFailures() int64
+	Duplicates() (blocks, bytes int64)
+	Timeouts() int64
+	Requests() int64
+	ReadAhead(reader string, offset int64)
+	StopReadAhead(reader string)
+	Wait(offset int64, cancel <-chan bool) (error)
+	Stop()
+}
+
+func (p *pieceMgr) Request(addr string, peer *Peer, bitfield *bit_field.Bitfield) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	requests := p.queueSize(addr)
+	max := peer.MaxRequests()
+	if peer.Snubbed() {
+		// Only one request until it sends something
+		max = 1
+	}
+	for i := p.pieceData.NumPieces(addr); i < max && i < requests; i++ {
+		piece, block, err := p.pieceData.SearchPiece(addr, bitfield)
+		if err != nil {
+			return
+		}
+		// Add a method to peer to do enqueue the request
+		peer.Request(piece, block)
+	}
+}
+
+// Requests to keep queued in a peer: enough blocks to cover the
+// bandwidth-delay product of the link, plus REQUEST_QUEUE_TIME seconds
+// so the peer has blocks to send while our next requests arrive
+
+func (p *pieceMgr) queueSize(addr string) int64 {
+	speed := p.stats.GetSpeed(addr)
+	if speed == 0 {
+		return DEFAULT_REQUESTS
+	}
+	window := float64(REQUEST_QUEUE_TIME)
+	if latency, ok := p.latency[addr]; ok {
+		window += float64(latency)/NS_PER_S
+	}
+	requests := int64(math.Ceil(float64(speed)*window/STANDARD_BLOCK_LENGTH))
+	if requests < MIN_REQUESTS {
+		return MIN_REQUESTS
+	}
+	if requests > MAX_QUEUED_REQUESTS {
+		return MAX_QUEUED_REQUESTS
+	}
+	return requests
+}
+
+// The lowest latency of the blocks received from a peer, the others
+// are slower because they waited in the queue of the peer
+
+func (p *pieceMgr) measure(addr string, index, block int64) {
+	requested, ok := p.pieceData.RequestTime(addr, index, int(block))
+	if !ok {
+		return
+	}
+	sample := time.Now().UnixNano() - requested
+	if latency, ok := p.latency[addr]; !ok || sample < latency {
+		p.latency[addr] = sample
+	}
+}
+
+// Select a block for a source that is not a peer (web seeds)
+
+func (p *pieceMgr) RequestBlock(addr string, bitfield *bit_field.Bitfield) (index, begin, length int64, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	index, block, err := p.pieceData.SearchPiece(addr, bitfield)
+	if err != nil {
+		return
+	}
+	begin = int64(block) * STANDARD_BLOCK_LENGTH
+	length = p.blockLength(index, begin)
+	return
+}
+
+func (p *pieceMgr) blockLength(index, begin int64) (length int64) {
+	length = STANDARD_BLOCK_LENGTH
+	if index == p.totalPieces-1 && p.lastPieceLength - begin < length {
+		length = p.lastPieceLength - begin
+	}
+	return
+}
+
+// Check a received block: a whole block of a piece we don't have, as
+// long as the ones we request. Called with the mutex held.
+
+func (p *pieceMgr) checkBlock(index, begin, length int64) (error) {
+	if index < 0 || index >= p.totalPieces {
+		return errors.New("Piece out of range")
+	}
+	pieceLength := p.pieceLength
+	if index == p.totalPieces-1 {
+		pieceLength = p.lastPieceLength
+	}
+	if begin < 0 || begin >= pieceLength || begin%STANDARD_BLOCK_LENGTH != 0 {
+		return errors.New("Begin out of range")
+	}
+	if length != p.blockLength(index, begin) {
+		return errors.New("Unexpected block length")
+	}
+	if p.bitfield.IsSet(index) {
+		return errors.New("Piece already finished")
+	}
+	return nil
+}
+
+// A block has been received, true if it has to be written and saved
+// with SavePiece. Nothing is written that checkBlock refuses or that
+// we didn't request to the peer, the copies received after the first
+// one are discarded, and the requests of the block to the other peers
+// are cancelled as soon as the first one arrives.
+
+func (p *pieceMgr) Arrived(addr string, index, begin, length int64) bool {
+	p.mutex.Lock()
+	first, others := false, []string(nil)
+	err := p.checkBlock(index, begin, length)
+	if err == nil && !p.pieceData.CheckRequested(addr, index, int(begin/STANDARD_BLOCK_LENGTH)) {
+		err = errors.New("Block not requested")
+	}
+	if err == nil {
+		first, others = p.pieceData.Arrive(addr, index, begin/STANDARD_BLOCK_LENGTH)
+	} else {
+		pieceLog.Debug("Dropping block", "addr", addr, "index", index, "begin", begin, "length", length, "err", err)
+	}
+	if !first {
+		p.duplicates++
+		p.wasted += length
+		p.mutex.Unlock()
+		return false
+	}
+	p.mutex.Unlock()
+	if len(others) > 0 {
+		p.peerMgr.SendCancel(others, index, begin, length)
+	}
+	return true
+}
+
+// A block given by Arrived couldn't be written, it's requested again
+
+func (p *pieceMgr) WriteFailed(addr string, index, begin int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.WriteFailed(addr, index, begin/STANDARD_BLOCK_LENGTH)
+}
+
+// A block given by Arrived is on disk. The peer may have left since,
+// its block is kept. One that doesn't pass the checks any more is
+// requested again. The hash check, the reads of the blocks and the
+// messages to the peers go without the mutex, the piece isn't
+// requested while it's checked.
+
+func (p *pieceMgr) SavePiece(addr string, index, begin, length int64) (error) {
+	p.mutex.Lock()
+	if err := p.checkBlock(index, begin, length); err != nil {
+		p.pieceData.WriteFailed(addr, index, begin/STANDARD_BLOCK_LENGTH)
+		p.mutex.Unlock()
+		return err
+	}
+	p.measure(addr, index, begin/STANDARD_BLOCK_LENGTH)
+	finished, others, senders := p.pieceData.Remove(addr, index, begin/STANDARD_BLOCK_LENGTH, true)
+	endgame := false
+	if !p.pieceData.Endgame() && p.pieceData.Missing() <= ENDGAME_BLOCKS {
+		pieceLog.Info("Entering endgame mode", "blocks", p.pieceData.Missing())
+		p.pieceData.SetEndgame(true)
+		endgame = true
+	}
+	p.mutex.Unlock()
+	if len(others) > 0 {
+		// Send message to cancel request to other peers
+		p.peerMgr.SendCancel(others, index, begin, length)
+	}
+	if endgame {
+		go p.Endgame()
+	}
+	if !finished {
+		return nil
+	}
+	if err := p.files.CheckPiece(index); err != nil {
+		// The blocks are only compared if some peers are blamed
+		p.mutex.Lock()
+		_, again := p.suspects[index]
+		p.mutex.Unlock()
+		var sums [][]byte
+		if !again && len(contributors(senders)) > 1 {
+			sums = p.blockSums(index, len(senders))
+		}
+		p.mutex.Lock()
+		p.hashFailures++
+		p.pieceFailed(index, senders, sums)
+		p.leaveEndgame()
+		p.mutex.Unlock()
+		p.events.Emit(events.Event{Type: events.PIECE_FAILED, Piece: index})
+		return errors.New("Ignoring bad piece " + strconv.FormatInt(index, 10))
+	}
+	p.mutex.Lock()
+	_, suspects := p.suspects[index]
+	p.mutex.Unlock()
+	var sums [][]byte
+	if suspects {
+		sums = p.blockSums(index, len(senders))
+	}
+	p.mutex.Lock()
+	p.piecePassed(index, senders, sums)
+	// Mark piece as finished and delete it from activePieces
+	p.bitfield.Set(index)
+	p.finished(index)
+	done, completed := p.bitfield.Count(), p.bitfield.Completed()
+	p.mutex.Unlock()
+	// Send have message to peerMgr to distribute it across peers
+	p.peerMgr.SendHave(index)
+	pieceLog.Info("Piece finished", "index", index, "done", done, "pieces", p.totalPieces)
+	p.events.Emit(events.Event{Type: events.PIECE_COMPLETED, Piece: index})
+	if completed {
+		p.events.Emit(events.Event{Type: events.TORRENT_FINISHED})
+	}
+	return nil
+}
+
+// Keep the blocks of the trusted peers of a piece that failed the hash
+// check, and download the others again from other peers. The first time
+// nobody is blamed yet: the bad blocks are found when the piece passes.
+// If it fails again, a single peer sent it or every block came from a
+// trusted peer, the whole piece is downloaded again and every peer that
+// sent it gets a bad piece. sums are the ones of the blocks as they
+// were written.
+
+func (p *pieceMgr) pieceFailed(index int64, senders []string, sums [][]byte) {
+	peers := contributors(senders)
+	keep := make([]bool, len(senders))
+	_, again := p.suspects[index]
+	var suspects []suspectBlock
+	exclude := []string{}
+	if !again && len(peers) > 1 {
+		excluded := make(map[string]bool)
+		for block, addr := range(senders) {
+			if len(addr) > 0 && p.trusted[peerIp(addr)] {
+				keep[block] = true
+				continue
+			}
+			suspect := suspectBlock{block: int64(block), addr: addr}
+			if len(addr) > 0 {
+				if block < len(sums) {
+					suspect.sum = sums[block]
+				}
+				if !excluded[addr] {
+					excluded[addr] = true
+					exclude = append(exclude, addr)
+				}
+			}
+			suspects = append(suspects, suspect)
+		}
+	}
+	if len(suspects) == 0 {
+		// Everything again
+		delete(p.suspects, index)
+		keep = nil
+		exclude = peers
+		pieceLog.Warn("Piece failed the hash check", "index", index, "peers", len(peers), "again", again)
+		p.peerMgr.AddBadPeers(peers)
+		for _, addr := range(peers) {
+			delete(p.trusted, peerIp(addr))
+		}
+	} else {
+		p.suspects[index] = suspects
+		pieceLog.Warn("Piece failed the hash check, downloading the blocks of untrusted peers again", "index", index, "peers", len(peers), "blocks", len(suspects))
+	}
+	p.pieceData.PieceFailed(index, senders, keep, exclude)
+}
+
+// The piece is good, the peers that sent it are trusted, and the ones
+// that sent a block that differs from the good one the other time are
+// the ones that corrupted it. sums are the ones of the good blocks, nil
+// if there were no suspects.
+
+func (p *pieceMgr) piecePassed(index int64, senders []string, sums [][]byte) {
+	p.pieceData.PieceDone(index)
+	suspects := p.suspects[index]
+	delete(p.suspects, index)
+	bad := make(map[string]bool)
+	culprits := []string{}
+	for _, suspect := range(suspects) {
+		if suspect.sum == nil || bad[suspect.addr] || suspect.block >= int64(len(sums)) {
+			continue
+		}
+		if sum := sums[suspect.block]; sum != nil && !bytes.Equal(sum, suspect.sum) {
+			pieceLog.Warn("Peer sent a corrupt block", "addr", suspect.addr, "index", index, "block", suspect.block)
+			bad[suspect.addr] = true
+			culprits = append(culprits, suspect.addr)
+			delete(p.trusted, peerIp(suspect.addr))
+		}
+	}
+	if len(culprits) > 0 {
+		p.peerMgr.AddBadPeers(culprits)
+	}
+	for _, addr := range(contributors(senders)) {
+		if !bad[addr] {
+			p.trusted[peerIp(addr)] = true
+		}
+	}
+}
+
+// SHA-1 of each block of a piece as it is in the files, nil for the
+// ones that can't be read
+
+func (p *pieceMgr) blockSums(index int64, blocks int) (sums [][]byte) {
+	sums = make([][]byte, blocks)
+	for block := range(sums) {
+		begin := int64(block)*STANDARD_BLOCK_LENGTH
+		data := make([]byte, p.blockLength(index, begin))
+		if err := p.files.ReadAt(index, begin, data); err != nil {
+			pieceLog.Debug("Error reading block", "index", index, "block", block, "err", err)
+			continue
+		}
+		sum := sha1.Sum(data)
+		sums[block] = sum[:]
+	}
+	return
+}
+
+// Wake up the readers waiting for the piece
+
+func (p *pieceMgr) finished(index int64) {
+	for _, c := range(p.waiters[index]) {
+		close(c)
+	}
+	delete(p.waiters, index)
+	if len(p.readers) > 0 {
+		p.updateWindow()
+	}
+}
+
+// Leave endgame mode if a failed piece or a change of priorities made
+// the missing blocks grow again, SavePiece enters it again when they
+// are few. Called with the mutex held.
+
+func (p *pieceMgr) leaveEndgame() {
+	if p.pieceData.Endgame() && p.pieceData.Missing() > ENDGAME_BLOCKS {
+		pieceLog.Info("Leaving endgame mode", "blocks", p.pieceData.Missing())
+		p.pieceData.SetEndgame(false)
+	}
+}
+
+// Request the remaining blocks to every peer that is not choking us
+
+func (p *pieceMgr) Endgame() {
+	for _, peer := range(p.peerMgr.GetPeers()) {
+		if peer.Connected() && !peer.Peer_choking() {
+			peer.TryToRequestPiece()
+		}
+	}
+}
+
+// Snub the peers that have not sent any of the blocks we requested in
+// SNUB_TIMEOUT seconds, their requests are given to the other peers
+
+func (p *pieceMgr) checkSnubbed() {
+	now := time.Now().Unix()
+	snubbed := 0
+	peers := p.peerMgr.GetPeers()
+	p.mutex.Lock()
+	for addr, peer := range(peers) {
+		if peer.Snubbed() || !peer.Connected() || now - peer.LastPiece() <= SNUB_TIMEOUT {
+			continue
+		}
+		if !p.pieceData.RequestedBefore(addr, (now - SNUB_TIMEOUT)*NS_PER_S) {
+			continue
+		}
+		pieceLog.Info("Snubbing peer", "addr", addr, "requests", p.pieceData.NumPieces(addr))
+		peer.setSnubbed(true)
+		p.pieceData.RemoveAll(addr)
+		snubbed++
+	}
+	p.mutex.Unlock()
+	if snubbed == 0 {
+		return
+	}
+	for _, peer := range(peers) {
+		if peer.Connected() && !peer.Snubbed() {
+			peer.TryToRequestPiece()
+		}
+	}
+}
+
+// The requests not received in requestTimeout are cancelled and the
+// blocks given to the other peers, a lost request would stall its
+// piece otherwise
+
+func (p *pieceMgr) checkRequests() {
+	p.mutex.Lock()
+	expired := p.pieceData.Expire(time.Now().UnixNano() - p.requestTimeout*NS_PER_S)
+	p.mutex.Unlock()
+	if len(expired) == 0 {
+		return
+	}
+	for addr, refs := range(expired) {
+		pieceLog.Debug("Requests timed out", "addr", addr, "blocks", len(refs))
+		for _, ref := range(refs) {
+			index, begin := int64(ref>>32), int64(uint32(ref))*STANDARD_BLOCK_LENGTH
+			p.peerMgr.SendCancel([]string{addr}, index, begin, p.blockLength(index, begin))
+		}
+		p.mutex.Lock()
+		p.timeouts += int64(len(refs))
+		p.mutex.Unlock()
+	}
+	for addr, peer := range(p.peerMgr.GetPeers()) {
+		if _, ok := expired[addr]; !ok && peer.Connected() && !peer.Snubbed() {
+			peer.TryToRequestPiece()
+		}
+	}
+}
+
+func (p *pieceMgr) PeerExit(addr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.RemoveAll(addr)
+	delete(p.latency, addr)
+}
+
+// The peer rejected a request, the block can be requested again
+
+func (p *pieceMgr) Reject(addr string, index, begin int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if index >= p.totalPieces || begin >= p.pieceLength {
+		return
+	}
+	if !p.pieceData.CheckRequested(addr, index, int(begin/STANDARD_BLOCK_LENGTH)) {
+		// We didn't request this block to the peer
+		return
+	}
+	p.pieceData.Remove(addr, index, begin/STANDARD_BLOCK_LENGTH, false)
+}
+
+// Download pieces in file order (useful for streaming) or
+// in random order
+
+func (p *pieceMgr) SetSequential(sequential bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.SetSequential(sequential)
+}
+
+// Where the pieces that pass or fail the hash check are told
+
+func (p *pieceMgr) SetEvents(em *events.Emitter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events = em
+}
+
+func (p *pieceMgr) Sequential() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pieceData.Sequential()
+}
+
+// Seconds to receive a requested block before requesting it to another peer
+
+func (p *pieceMgr) SetRequestTimeout(timeout int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requestTimeout = timeout
+}
+
+// Change the download priority of a file, a piece shared by
+// several files gets the highest priority of them
+
+func (p *pieceMgr) SetPriority(file, priority int) (error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if file < 0 || file >= len(p.priorities) {
+		return errors.New("File out of range")
+	}
+	if priority < files.PRIORITY_SKIP || priority > files.PRIORITY_HIGH {
+		return errors.New("Invalid priority")
+	}
+	p.priorities[file] = priority
+	pieces := make([]int, p.totalPieces)
+	for i, prio := range(p.priorities) {
+		first, last, err := p.files.FilePieces(i)
+		if err != nil {
+			return err
+		}
+		for piece := first; piece <= last; piece++ {
+			if prio > pieces[piece] {
+				pieces[piece] = prio
+			}
+		}
+	}
+	p.pieceData.SetPriorities(pieces)
+	p.leaveEndgame()
+	return nil
+}
+
+func (p *pieceMgr) Priority(file int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if file < 0 || file >= len(p.priorities) {
+		return files.PRIORITY_SKIP
+	}
+	return p.priorities[file]
+}
+
+func (p *pieceMgr) HashFailures() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.hashFailures
+}
+
+// Requests cancelled because the block didn't arrive in time
+
+func (p *pieceMgr) Timeouts() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.timeouts
+}
+
+// Blocks received after a first copy, and the bytes wasted on them
+
+func (p *pieceMgr) Duplicates() (blocks, bytes int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.duplicates, p.wasted
+}
+
+// Blocks requested to the peers and not received yet
+
+func (p *pieceMgr) Requests() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pieceData.Requests()
+}
+
+// A reader is going through the torrent sequentially and is at
+// offset, the READ_AHEAD bytes after it are requested before the
+// other pieces
+
+func (p *pieceMgr) ReadAhead(reader string, offset int64) {
+	p.mutex.Lock()
+	if offset < 0 || offset >= p.totalSize {
+		p.mutex.Unlock()
+		return
+	}
+	old, ok := p.readers[reader]
+	p.readers[reader] = offset
+	moved := !ok || old/p.pieceLength != offset/p.pieceLength
+	if moved {
+		p.updateWindow()
+	}
+	p.mutex.Unlock()
+	if moved {
+		// The peers with free requests start the new pieces now
+		p.Endgame()
+	}
+}
+
+// The reader finished, its pieces go back to the usual order
+
+func (p *pieceMgr) StopReadAhead(reader string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.readers[reader]; ok {
+		delete(p.readers, reader)
+		p.updateWindow()
+	}
+}
+
+// The missing pieces after the readers, the pieces closer to a reader
+// first
+
+func (p *pieceMgr) updateWindow() {
+	ahead := int64(READ_AHEAD)
+	if ahead < MIN_READ_AHEAD*p.pieceLength {
+		ahead = MIN_READ_AHEAD*p.pieceLength
+	}
+	seen := make(map[int64]bool)
+	window := []int64{}
+	for i := int64(0); i < ahead; i += p.pieceLength {
+		for _, offset := range(p.readers) {
+			if offset + i >= p.totalSize {
+				continue
+			}
+			piece := (offset + i) / p.pieceLength
+			if !seen[piece] && !p.bitfield.IsSet(piece) {
+				seen[piece] = true
+				window = append(window, piece)
+			}
+		}
+	}
+	p.pieceData.SetWindow(window)
+}
+
+// Block until the piece with the data at offset is finished, or
+// cancel is closed. The torrent being stopped is an error too.
+
+func (p *pieceMgr) Wait(offset int64, cancel <-chan bool) (error) {
+	p.mutex.Lock()
+	if offset < 0 || offset >= p.totalSize {
+		p.mutex.Unlock()
+		return errors.New("Offset out of range")
+	}
+	index := offset / p.pieceLength
+	if p.bitfield.IsSet(index) {
+		p.mutex.Unlock()
+		return nil
+	}
+	c := make(chan bool)
+	p.waiters[index] = append(p.waiters[index], c)
+	p.mutex.Unlock()
+	select {
+		case <- c:
+			return nil
+		case <- cancel:
+			p.removeWaiter(index, c)
+			return errors.New("Wait cancelled")
+		case <- p.quit:
+			p.removeWaiter(index, c)
+			return errors.New("Torrent stopped")
+	}
+}
+
+func (p *pieceMgr) removeWaiter(index int64, c chan bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	waiters := p.waiters[index]
+	for i, w := range(waiters) {
+		if w == c {
+			p.waiters[index] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(p.waiters[index]) == 0 {
+		delete(p.waiters, index)
+	}
+}
+
+// Partially downloaded pieces, saved in the resume data so
+// their blocks don't have to be downloaded again
+
+func (p *pieceMgr) Partial() map[int64]*bit_field.Bitfield {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pieceData.Partial()
+}
+
+func (p *pieceMgr) RestoreBlocks(index int64, blocks *bit_field.Bitfield) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pieceData.RestoreBlocks(index, blocks)
+}
+
+func NewPieceMgr(peerMgr PeerMgr, st stats.Stats, fl files.Files, bitfield *bit_field.Bitfield, pieceLength, lastPieceLength, totalPieces, totalSize int64) (p PieceMgr, err error){
+	pieceMgr := new(pieceMgr)
+	pieceMgr.mutex = new(sync.Mutex)
+	pieceMgr.files = fl
+	pieceMgr.pieceLength = pieceLength
+	pieceMgr.lastPieceLength = lastPieceLength
+	pieceMgr.totalPieces = totalPieces
+	pieceMgr.bitfield = bitfield
+	pieceMgr.pieceData = NewPieceData(bitfield, pieceLength, lastPieceLength)
+	pieceMgr.pieceData.availability = peerMgr.Availability()
+	pieceMgr.priorities = make([]int, fl.NumFiles())
+	for i, _ := range(pieceMgr.priorities) {
+		pieceMgr.priorities[i] = files.PRIORITY_NORMAL
+	}
+	pieceMgr.totalSize = totalSize
+	pieceMgr.peerMgr = peerMgr
+	pieceMgr.stats = st
+	pieceMgr.files = fl
+	pieceMgr.latency = make(map[string]int64)
+	pieceMgr.trusted = make(map[string]bool)
+	pieceMgr.suspects = make(map[int64][]suspectBlock)
+	pieceMgr.readers = make(map[string]int64)
+	pieceMgr.waiters = make(map[int64][]chan bool)
+	pieceMgr.requestTimeout = REQUEST_TIMEOUT
+	pieceMgr.quit = make(chan bool)
+	p = pieceMgr
+	go pieceMgr.Run()
+	return
+}
+
+func (p *pieceMgr) Stop() {
+	close(p.quit)
+}
+
+func (p *pieceMgr) Run() {
+	requests := time.NewTicker(REQUEST_CHECK*time.Second)
+	snub := time.NewTicker(SNUB_CHECK*time.Second)
+	for {
+		select {
+			case <- p.quit:
+				requests.Stop()
+				snub.Stop()
+				return
+			case <- snub.C:
+				p.checkSnubbed()
+			case <- requests.C:
+				p.checkRequests()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package peers
+
+import(
+	"sync"
+	"testing"
+	"wgo/bit_field"
+	)
+
+// Four pieces of two blocks, the last one of a block and a half
+
+func testPieceMgr() *pieceMgr {
+	bitfield := bit_field.NewBitfield(4)
+	p := &pieceMgr{mutex: new(sync.Mutex), bitfield: bitfield, totalPieces: 4,
+		pieceLength: 2*STANDARD_BLOCK_LENGTH, lastPieceLength: STANDARD_BLOCK_LENGTH + STANDARD_BLOCK_LENGTH/2}
+	p.pieceData = NewPieceData(bitfield, p.pieceLength, p.lastPieceLength)
+	return p
+}
+
+type arriveTest struct {
+	index, begin, length int64
+	ok bool
+}
+
+func TestArrived(t *testing.T) {
+	p := testPieceMgr()
+	p.pieceData.Add("a", 1, 0)
+	p.pieceData.Add("a", 1, 1)
+	p.pieceData.Add("a", 3, 1)
+	tests := []arriveTest{
+		arriveTest{1, 2*STANDARD_BLOCK_LENGTH - 1, 128*1024, false}, // Over the next pieces
+		arriveTest{1, 1, STANDARD_BLOCK_LENGTH, false}, // Unaligned
+		arriveTest{1, 0, STANDARD_BLOCK_LENGTH/2, false}, // Short
+		arriveTest{2, 0, STANDARD_BLOCK_LENGTH, false}, // Not requested
+		arriveTest{3, STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH, false}, // Past the end of the torrent
+		arriveTest{4, 0, STANDARD_BLOCK_LENGTH, false},
+		arriveTest{1, 0, STANDARD_BLOCK_LENGTH, true},
+		arriveTest{1, 0, STANDARD_BLOCK_LENGTH, false}, // Second copy
+		arriveTest{3, STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH/2, true},
+	}
+	for _, at := range(tests) {
+		if ok := p.Arrived("a", at.index, at.begin, at.length); ok != at.ok {
+			t.Errorf("Arrived(%d, %d, %d) = %v, expected %v", at.index, at.begin, at.length, ok, at.ok)
+		}
+	}
+	// The block that was refused can still arrive
+	if !p.Arrived("a", 1, STANDARD_BLOCK_LENGTH, STANDARD_BLOCK_LENGTH) {
+		t.Errorf("Refused block not accepted afterwards")
+	}
+}
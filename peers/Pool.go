@@ -0,0 +1,48 @@
+// Free list of the buffers used for the piece data, so the blocks
+// received and sent don't allocate a buffer each
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+const(
+	POOL_BUFFERS = 256 // Free buffers kept, the rest are left to the GC
+	POOL_BUFFER_LENGTH = MAX_PEER_MSG // Fits every block, with its header
+)
+
+type BufferPool struct {
+	free chan []byte
+	size int
+}
+
+var blockPool = NewBufferPool(POOL_BUFFER_LENGTH, POOL_BUFFERS)
+
+func NewBufferPool(size, buffers int) *BufferPool {
+	return &BufferPool{free: make(chan []byte, buffers), size: size}
+}
+
+// A buffer of length bytes, at most the size of the pool
+
+func (bp *BufferPool) Get(length int) []byte {
+	if length > bp.size {
+		return make([]byte, length)
+	}
+	select {
+		case b := <- bp.free:
+			return b[0:length]
+		default:
+	}
+	return make([]byte, length, bp.size)
+}
+
+// Give back a buffer, it must not be used after this
+
+func (bp *BufferPool) Put(b []byte) {
+	if cap(b) != bp.size {
+		return
+	}
+	select {
+		case bp.free <- b[0:0]:
+		default:
+	}
+}
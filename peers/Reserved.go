@@ -0,0 +1,71 @@
+// Capabilities of the peers, the bits of the reserved bytes of the
+// handshake. A feature is used with a peer only if both sides set
+// its bit.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+const(
+	RESERVED_LENGTH = 8
+)
+
+// A bit of the reserved bytes
+
+type Capability struct {
+	Byte int
+	Mask byte
+	Name string
+}
+
+var(
+	CAP_DHT = Capability{7, 0x01, "dht"} // BEP 5, not supported by wgo
+	CAP_FAST = Capability{7, 0x04, "fast"} // BEP 6
+	CAP_V2 = Capability{7, 0x10, "v2"} // BEP 52
+	CAP_EXTENSIONS = Capability{5, 0x10, "extensions"} // BEP 10
+)
+
+// Every capability we know, and the ones we set in our handshake
+
+var knownCapabilities = []Capability{CAP_DHT, CAP_FAST, CAP_V2, CAP_EXTENSIONS}
+
+var ourCapabilities = NewCapabilities(CAP_FAST, CAP_V2, CAP_EXTENSIONS)
+
+// The reserved bytes of a handshake
+
+type Capabilities []byte
+
+func NewCapabilities(caps ...Capability) Capabilities {
+	c := make(Capabilities, RESERVED_LENGTH)
+	for _, capability := range(caps) {
+		c[capability.Byte] |= capability.Mask
+	}
+	return c
+}
+
+func (c Capabilities) Has(capability Capability) bool {
+	return len(c) == RESERVED_LENGTH && c[capability.Byte]&capability.Mask != 0
+}
+
+// The capabilities set in both, the ones that can be used with a peer
+
+func (c Capabilities) And(other Capabilities) Capabilities {
+	both := make(Capabilities, RESERVED_LENGTH)
+	if len(c) == RESERVED_LENGTH && len(other) == RESERVED_LENGTH {
+		for i, _ := range(both) {
+			both[i] = c[i] & other[i]
+		}
+	}
+	return both
+}
+
+// Names of the known capabilities that are set
+
+func (c Capabilities) Names() (names []string) {
+	for _, capability := range(knownCapabilities) {
+		if c.Has(capability) {
+			names = append(names, capability.Name)
+		}
+	}
+	return
+}
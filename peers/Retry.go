@@ -0,0 +1,84 @@
+// Reconnection to the outgoing peers that failed or dropped, waiting
+// twice as long after each failed attempt. The delays have some jitter
+// so the peers lost at the same time are not retried at once.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"math/rand"
+	"time"
+	)
+
+const(
+	RETRY_DELAY = 30 // Seconds before the first retry
+	MAX_RETRY_DELAY = 1800
+	MAX_RETRIES = 5 // Failed attempts before forgetting the peer
+)
+
+type retry struct {
+	attempts int // Failed attempts in a row
+	next int64 // When to retry, in seconds
+	queued bool // Already in the unused list
+	source string
+}
+
+// Seconds to wait after a number of failed attempts
+
+func retryDelay(attempts int) int64 {
+	delay := int64(RETRY_DELAY)
+	for i := 1; i < attempts && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY {
+		delay = MAX_RETRY_DELAY
+	}
+	// From 75% to 125% of the delay
+	return delay*3/4 + rand.Int63n(delay/2+1)
+}
+
+// Remember a closed outgoing peer to connect again later. A peer
+// that was connected starts again with one attempt, called with the
+// mutex held.
+
+func (p *peerMgr) scheduleRetry(peer *Peer) {
+	if p.stopped || peer.is_incoming || peer.self || peer.duplicate || p.bans.Banned(peer.addr) {
+		return
+	}
+	r, ok := p.retries[peer.addr]
+	if !ok || peer.Connected() {
+		r = &retry{source: peer.source}
+		p.retries[peer.addr] = r
+	}
+	r.attempts++
+	if r.attempts > MAX_RETRIES {
+		peerLog.Debug("Not retrying peer", "addr", peer.addr, "attempts", r.attempts-1)
+		delete(p.retries, peer.addr)
+		return
+	}
+	r.next = time.Now().Unix() + retryDelay(r.attempts)
+	r.queued = false
+}
+
+// Move the peers whose delay has passed to the unused list, called
+// with the mutex held
+
+func (p *peerMgr) dueRetries() {
+	now := time.Now().Unix()
+	for addr, r := range(p.retries) {
+		if r.queued || r.next > now {
+			continue
+		}
+		if _, err := p.SearchPeer(addr); err == nil {
+			// Connected again, on its own or from a tracker
+			continue
+		}
+		if _, ok := p.sources[addr]; !ok {
+			p.unusedPeers.PushFront(addr)
+			p.sources[addr] = r.source
+		}
+		// Kept with its attempts, so the next failure waits longer
+		r.queued = true
+	}
+}
@@ -0,0 +1,62 @@
+// Statistics of the peers by how they were found (the trackers, PEX,
+// local peer discovery, the peer cache of the resume data, the ones
+// added by hand and the incoming connections), to see which sources
+// are worth enabling
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"sync/atomic"
+	)
+
+type SourceStats struct {
+	Found int64 // Addresses received, or incoming connections accepted
+	Connections int64 // Handshakes finished and kept
+	Peers int // Connected now
+	Uploaded, Downloaded int64 // Piece data sent to and received from its peers
+}
+
+// Called with the mutex held
+
+func (p *peerMgr) source(name string) *SourceStats {
+	s, ok := p.sourceStats[name]
+	if !ok {
+		s = new(SourceStats)
+		p.sourceStats[name] = s
+	}
+	return s
+}
+
+// Add the bytes of a closed peer to its source, called once per peer
+// with the mutex held
+
+func (p *peerMgr) closedSource(peer *Peer) {
+	s := p.source(peer.source)
+	s.Uploaded += atomic.LoadInt64(&peer.uploaded)
+	s.Downloaded += atomic.LoadInt64(&peer.downloaded)
+}
+
+// Statistics of each source, with the bytes of the connected peers
+
+func (p *peerMgr) SourceStats() map[string]SourceStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sources := make(map[string]SourceStats)
+	for name, s := range(p.sourceStats) {
+		sources[name] = *s
+	}
+	for _, peers := range([]map[string]*Peer{p.activePeers, p.incomingPeers}) {
+		for _, peer := range(peers) {
+			s := sources[peer.source]
+			if peer.Connected() {
+				s.Peers++
+			}
+			s.Uploaded += atomic.LoadInt64(&peer.uploaded)
+			s.Downloaded += atomic.LoadInt64(&peer.downloaded)
+			sources[peer.source] = s
+		}
+	}
+	return sources
+}
@@ -0,0 +1,123 @@
+// Trace of the messages exchanged with a peer, one line per message
+// with its direction, type and length (and the piece, begin and length
+// of the requests and blocks) in a file per peer, to debug the protocol
+// without capturing the packets:
+//
+//	15:04:05.000123 recv request length=13 index=12 begin=16384 block=16384
+//
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"strings"
+	"encoding/hex"
+	"encoding/binary"
+	"wgo/files"
+	)
+
+const(
+	TRACE_SEND = "send"
+	TRACE_RECV = "recv"
+)
+
+var msgNames = map[uint8]string{
+	choke: "choke",
+	unchoke: "unchoke",
+	interested: "interested",
+	uninterested: "not_interested",
+	have: "have",
+	bitfield: "bitfield",
+	request: "request",
+	piece: "piece",
+	cancel: "cancel",
+	port: "port",
+	suggest: "suggest",
+	have_all: "have_all",
+	have_none: "have_none",
+	reject_request: "reject_request",
+	allowed_fast: "allowed_fast",
+	extended: "extended",
+	hash_request: "hash_request",
+	hashes: "hashes",
+	hash_reject: "hash_reject",
+}
+
+type trace struct {
+	mutex *sync.Mutex
+	file *os.File
+	writer *bufio.Writer
+}
+
+// Create the trace file of a peer in folder, named after the infohash
+// and the address of the peer
+
+func newTrace(folder, infohash, addr string) (t *trace, err error) {
+	if err = os.MkdirAll(folder, files.FOLDER_PERM); err != nil {
+		return
+	}
+	name := hex.EncodeToString([]byte(infohash)) + "-" + strings.NewReplacer(":", "_", "[", "", "]", "").Replace(addr) + ".trace"
+	file, err := os.OpenFile(folder + "/" + name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, files.FILE_PERM)
+	if err != nil {
+		return
+	}
+	return &trace{mutex: new(sync.Mutex), file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Log a message, the keep-alives have no id
+
+func (t *trace) message(direction string, msg *message) {
+	if t == nil {
+		return
+	}
+	line := time.Now().Format("15:04:05.000000") + " " + direction
+	if msg.length == 0 {
+		line += " keep_alive length=0"
+	} else {
+		name, ok := msgNames[msg.msgId]
+		if !ok {
+			name = fmt.Sprintf("unknown_%d", msg.msgId)
+		}
+		line += fmt.Sprintf(" %s length=%d", name, msg.length)
+		p := msg.payLoad
+		switch {
+			case (msg.msgId == request || msg.msgId == cancel || msg.msgId == reject_request) && len(p) >= 12:
+				line += fmt.Sprintf(" index=%d begin=%d block=%d", binary.BigEndian.Uint32(p[0:4]), binary.BigEndian.Uint32(p[4:8]), binary.BigEndian.Uint32(p[8:12]))
+			case msg.msgId == piece && len(p) >= 8:
+				line += fmt.Sprintf(" index=%d begin=%d block=%d", binary.BigEndian.Uint32(p[0:4]), binary.BigEndian.Uint32(p[4:8]), msg.length - 9)
+			case (msg.msgId == have || msg.msgId == suggest || msg.msgId == allowed_fast) && len(p) >= 4:
+				line += fmt.Sprintf(" index=%d", binary.BigEndian.Uint32(p[0:4]))
+			case msg.msgId == extended && len(p) >= 1:
+				line += fmt.Sprintf(" ext=%d", p[0])
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer == nil {
+		return
+	}
+	t.writer.WriteString(line + "\n")
+	// Flushed at once, the last lines are the interesting ones when
+	// the connection breaks
+	t.writer.Flush()
+}
+
+func (t *trace) Close() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer == nil {
+		return
+	}
+	t.writer.Flush()
+	t.file.Close()
+	t.writer = nil
+}
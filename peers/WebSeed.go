@@ -0,0 +1,218 @@
+// Web seeding (BEP 19), download pieces from an HTTP server
+// that holds the files of the torrent. Web seeds act as peers
+// that never choke us.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"io"
+	"net/http"
+	"time"
+	"strings"
+	"strconv"
+	"wgo/bencode"
+	"wgo/bit_field"
+	"wgo/files"
+	"wgo/limiter"
+	"wgo/stats"
+	"wgo/logger"
+	"wgo/proxy"
+	"errors"
+	"net/url"
+	)
+
+const(
+	WEBSEED_CONNECTIONS = 2 // Parallel requests to a web seed
+	WEBSEED_RETRY = 30 // Seconds, doubled on each error
+	MAX_WEBSEED_RETRY = 3600
+	SOURCE_WEBSEED = "webseed"
+)
+
+var webSeedLog = logger.New("webseed")
+
+// File of the torrent the web seed has to be asked for
+
+type webSeedFile struct {
+	url string
+	length int64
+}
+
+type WebSeed struct {
+	url, addr string
+	files []webSeedFile
+	pieceMgr PieceMgr
+	fs files.Files
+	stats stats.Stats
+	l limiter.Limiter
+	our_bitfield, bitfield *bit_field.Bitfield
+	pieceLength, lastPieceLength int64
+	quit chan bool
+}
+
+func NewWebSeed(seed string, info *bencode.InfoDict, pieceMgr PieceMgr, our_bitfield *bit_field.Bitfield, st stats.Stats, fl files.Files, l limiter.Limiter, lastPieceLength int64) (w *WebSeed, err error) {
+	if !strings.HasPrefix(seed, "http://") && !strings.HasPrefix(seed, "https://") {
+		// FTP is not supported by the http package
+		return w, errors.New("Unsupported web seed " + seed)
+	}
+	w = new(WebSeed)
+	w.url = seed
+	w.addr = SOURCE_WEBSEED + ":" + seed
+	w.pieceMgr = pieceMgr
+	w.fs = fl
+	w.stats = st
+	w.l = l
+	w.our_bitfield = our_bitfield
+	w.pieceLength = info.Piece_length
+	w.lastPieceLength = lastPieceLength
+	// The web seed has every piece
+	w.bitfield = bit_field.NewBitfield(our_bitfield.Len())
+	for i := int64(0); i < w.bitfield.Len(); i++ {
+		w.bitfield.Set(i)
+	}
+	if len(info.Files) == 0 {
+		// Single file, the url points to the file unless it ends with /
+		if strings.HasSuffix(seed, "/") {
+			seed += url.PathEscape(info.Name)
+		}
+		w.files = []webSeedFile{webSeedFile{url: seed, length: info.Length}}
+	} else {
+		if !strings.HasSuffix(seed, "/") {
+			seed += "/"
+		}
+		seed += url.PathEscape(info.Name)
+		w.files = make([]webSeedFile, len(info.Files))
+		for i, f := range(info.Files) {
+			path := seed
+			for _, component := range(f.Path) {
+				path += "/" + url.PathEscape(component)
+			}
+			w.files[i] = webSeedFile{url: path, length: f.Length}
+		}
+	}
+	w.quit = make(chan bool)
+	for i := 0; i < WEBSEED_CONNECTIONS; i++ {
+		go w.Run()
+	}
+	return
+}
+
+// Stop downloading from the web seed, blocks being downloaded
+// are finished first
+
+func (w *WebSeed) Stop() {
+	close(w.quit)
+}
+
+// Wait some seconds, returns false if the web seed has been stopped
+
+func (w *WebSeed) wait(seconds int64) bool {
+	select {
+		case <- w.quit:
+			return false
+		case <- time.After(time.Duration(seconds)*time.Second):
+	}
+	return true
+}
+
+func (w *WebSeed) Run() {
+	retry := int64(WEBSEED_RETRY)
+	for !w.our_bitfield.Completed() {
+		select {
+			case <- w.quit:
+				w.pieceMgr.PeerExit(w.addr)
+				return
+			default:
+		}
+		index, begin, length, err := w.pieceMgr.RequestBlock(w.addr, w.bitfield)
+		if err != nil {
+			// Nothing left to request at the moment
+			if !w.wait(WEBSEED_RETRY) {
+				return
+			}
+			continue
+		}
+		if err = w.Download(index, begin, length); err != nil {
+			webSeedLog.Warn("Error downloading", "url", w.url, "err", err)
+			w.pieceMgr.PeerExit(w.addr)
+			if !w.wait(retry) {
+				return
+			}
+			if retry *= 2; retry > MAX_WEBSEED_RETRY {
+				retry = MAX_WEBSEED_RETRY
+			}
+			continue
+		}
+		retry = WEBSEED_RETRY
+	}
+}
+
+// Download a block and pass it to the PieceMgr, which checks
+// the hash when the piece is finished
+
+func (w *WebSeed) Download(index, begin, length int64) (err error) {
+	block := blockPool.Get(int(length))
+	defer blockPool.Put(block)
+	offset := index*w.pieceLength + begin
+	start := int64(0)
+	// The block can span several files
+	for _, f := range(w.files) {
+		if start == length {
+			break
+		}
+		if offset >= f.length {
+			offset -= f.length
+			continue
+		}
+		size := f.length - offset
+		if size > length-start {
+			size = length-start
+		}
+		if err = w.get(f.url, offset, block[start:start+size]); err != nil {
+			return
+		}
+		start += size
+		offset = 0
+	}
+	if start != length {
+		return errors.New("Block out of range of the files")
+	}
+	if !w.pieceMgr.Arrived(w.addr, index, begin, length) {
+		return
+	}
+	if err = w.fs.WriteAt(index, begin, block); err != nil {
+		w.pieceMgr.WriteFailed(w.addr, index, begin)
+		return
+	}
+	w.stats.Update(w.addr, length, 0)
+	return w.pieceMgr.SavePiece(w.addr, index, begin, length)
+}
+
+// Read a byte range of a file from the web seed
+
+func (w *WebSeed) get(url string, offset int64, data []byte) (err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Range", "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset + int64(len(data)) - 1, 10))
+	response, err := proxy.Do(req)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusPartialContent {
+		return errors.New("Unexpected status " + response.Status)
+	}
+	size := int64(len(data))
+	start := int64(0)
+	for start < size {
+		n := w.l.WaitReceive(size - start)
+		if _, err = io.ReadFull(response.Body, data[start:start+n]); err != nil {
+			return
+		}
+		start += n
+	}
+	return
+}
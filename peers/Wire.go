@@ -0,0 +1,432 @@
+// Converts RAW messages into something more simple
+// to use, and also converts messages structs into
+// RAW messages to send to the peers
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package peers
+
+import(
+	"fmt"
+	"net"
+	"encoding/binary"
+	"io"
+	"bufio"
+	"bytes"
+	"time"
+	"wgo/bencode"
+	"wgo/limiter"
+	"wgo/logger"
+	"errors"
+	)
+
+const (
+	choke = iota
+	unchoke
+	interested
+	uninterested
+	have
+	bitfield
+	request
+	piece
+	cancel
+	port
+	exit
+	our_request
+	flush
+)
+
+// Fast extension (BEP 6)
+
+const(
+	suggest = 13 + iota
+	have_all
+	have_none
+	reject_request
+	allowed_fast
+)
+
+const(
+	extended = 20 // BEP 10 extension protocol
+)
+
+// Hashes of the v2 torrents (BEP 52)
+
+const(
+	hash_request = 21 + iota
+	hashes
+	hash_reject
+)
+
+const(
+	PROTOCOL = "BitTorrent protocol"
+	MAX_PEER_MSG = 130*1024 // Longest message, but the bitfield
+	MAX_BITFIELD_MSG = 1 + 256*1024 // Bitfield of 2M pieces
+	KEEP_ALIVE_RESP = 240*time.Second
+	HANDSHAKE_TIMEOUT = 20*time.Second
+	WRITE_TIMEOUT = 60*time.Second
+)
+
+var wireLog = logger.New("wire")
+
+type Wire struct {
+	pstrlen uint8
+	pstr string
+	reserved []byte
+	infohash []byte
+	peerid	[]byte
+	conn net.Conn
+	//up_limit *time.Ticker
+	//down_limit *time.Ticker
+	writer *bufio.Writer
+	l limiter.Limiter
+	incoming bool
+	remote_peerid string
+	remote_reserved []byte
+	readTimeout, writeTimeout time.Duration // Of each message, 0 for none
+	trace *trace // Of the messages, nil if not traced
+}
+	
+type message struct {
+	length	uint32
+	msgId	uint8
+	payLoad	[]byte
+	addr	[]string
+	reject	bool // Flush, reject the flushed requests
+	data	[]byte // Block of a received piece message, from blockPool
+}
+
+func NewWire(infohash, peerid string, conn net.Conn, l limiter.Limiter) (wire *Wire, err error) {
+	wire = new(Wire)
+	wire.pstr = PROTOCOL
+	wire.pstrlen = (uint8)(len(wire.pstr))
+	wire.reserved = make([]byte, RESERVED_LENGTH)
+	copy(wire.reserved, ourCapabilities)
+	wire.infohash = []byte(infohash)
+	wire.peerid = []byte(peerid)
+	wire.conn = conn
+	if err = wire.SetTimeout(HANDSHAKE_TIMEOUT); err != nil {
+		return
+	}
+	wire.writer = bufio.NewWriter(wire.conn)
+	//wire.up_limit = up_limit
+	//wire.down_limit = down_limit
+	wire.l = l
+	return
+}
+
+// Time to complete the handshake
+
+func (wire *Wire) SetTimeout(timeout time.Duration) (error) {
+	return wire.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// Time without receiving anything before the connection is closed,
+// and time to send a message to a slow peer
+
+func (wire *Wire) SetTimeouts(read, write time.Duration) (err error) {
+	wire.readTimeout, wire.writeTimeout = read, write
+	return wire.conn.SetDeadline(time.Time{})
+}
+
+// Move the deadlines forward before reading or writing a message
+
+func (wire *Wire) readDeadline() (error) {
+	if wire.readTimeout == 0 {
+		return nil
+	}
+	return wire.conn.SetReadDeadline(time.Now().Add(wire.readTimeout))
+}
+
+func (wire *Wire) writeDeadline() (error) {
+	if wire.writeTimeout == 0 {
+		return nil
+	}
+	return wire.conn.SetWriteDeadline(time.Now().Add(wire.writeTimeout))
+}
+
+// Create a Wire for a connection whose handshake was already read
+
+func NewIncomingWire(infohash, peerid, remote_peerid string, remote_reserved []byte, conn net.Conn, l limiter.Limiter) (wire *Wire, err error) {
+	if wire, err = NewWire(infohash, peerid, conn, l); err != nil {
+		return
+	}
+	wire.incoming = true
+	wire.remote_peerid = remote_peerid
+	wire.remote_reserved = remote_reserved
+	return
+}
+
+// Write every message after the handshake to a trace file in folder
+
+func (wire *Wire) Trace(folder, addr string) (err error) {
+	wire.trace, err = newTrace(folder, string(wire.infohash), addr)
+	return
+}
+
+func (wire *Wire) Handshake() (peerid string, err error) {
+	// Sending handshake
+	if err = wire.sendHandshake(); err != nil {
+		return
+	}
+	if wire.incoming {
+		// The handshake of the peer has already been read by the listener
+		return wire.remote_peerid, nil
+	}
+	// Reading peer handshake
+	var infohash string
+	if wire.remote_reserved, infohash, peerid, err = ReadHandshake(wire.conn); err != nil {
+		return
+	}
+	// See if infohash matches
+	if infohash != string(wire.infohash) {
+		return peerid, errors.New("InfoHash doesn't match")
+	}
+	return 
+}
+
+func (wire *Wire) sendHandshake() (err error) {
+	var n int
+	
+	if err = wire.writer.WriteByte(wire.pstrlen); err != nil {
+		return
+	}
+	if n, err = wire.writer.WriteString(wire.pstr); err != nil || n != len(wire.pstr) {
+		return
+	}
+	if n, err = wire.writer.Write(wire.reserved); err != nil || n != len(wire.reserved) {
+		return
+	}
+	if n, err = wire.writer.Write(wire.infohash); err != nil || n != len(wire.infohash) {
+		return
+	}
+	if n, err = wire.writer.Write(wire.peerid); err != nil || n != len(wire.peerid) {
+		return
+	}
+	return wire.writer.Flush()
+}
+
+// Read the handshake of a peer. Incoming connections use this
+// before creating the Wire, to know which torrent the peer wants.
+
+func ReadHandshake(conn net.Conn) (reserved []byte, infohash, peerid string, err error) {
+	var n int
+	var header [68]byte
+	n, err = io.ReadFull(conn, header[0:1])
+	if err != nil || n != 1 {
+		return reserved, infohash, peerid, fmt.Errorf("Reading handshake length: %w", err)
+	}
+	if header[0] != 19 {
+		return reserved, infohash, peerid, errors.New("Invalid length")
+	}
+	n, err = io.ReadFull(conn, header[1:20])
+	if err != nil || n != 19 {
+		return reserved, infohash, peerid, fmt.Errorf("Reading protocol string: %w", err)
+	}
+	if string(header[1:20]) != PROTOCOL {
+		return reserved, infohash, peerid, errors.New("Unknown protocol")
+	}
+	// Read rest of header
+	n, err = io.ReadFull(conn, header[20:])
+	if err != nil || n != len(header[20:]) {
+		return reserved, infohash, peerid, fmt.Errorf("Reading payload of the handshake: %w", err)
+	}
+	reserved = header[20:28]
+	infohash = string(header[28:48])
+	peerid = string(header[48:68])
+	return
+}
+
+// Capabilities set by the remote peer in its handshake
+
+func (wire *Wire) RemoteCapabilities() Capabilities {
+	return Capabilities(wire.remote_reserved)
+}
+
+// Capabilities set by both sides, once the handshakes are exchanged
+
+func (wire *Wire) Capabilities() Capabilities {
+	return Capabilities(wire.reserved).And(wire.RemoteCapabilities())
+}
+
+func (wire *Wire) Supports(capability Capability) bool {
+	return wire.Capabilities().Has(capability)
+}
+
+// Read the next message, the block of the piece messages is in
+// data and must be given back to blockPool
+
+func (wire *Wire) ReadMsg() (msg *message, err error) {
+	var n int
+	
+	if wire.conn == nil {
+		return msg, errors.New("Invalid connection")
+	}
+	msg = new(message)
+	addr := wire.conn.RemoteAddr()
+	if addr == nil {
+		return msg, errors.New("Invalid address")
+	}
+	msg.addr = []string{addr.String()}
+	//var length_header [4]byte
+	length_header := make([]byte, 4)
+	if err = wire.readDeadline(); err != nil {
+		return
+	}
+	n, err = io.ReadFull(wire.conn, length_header[0:4]) // read msg length
+	if err != nil || n != 4 {
+		return msg, fmt.Errorf("Read header length %w", err)
+	}
+	msg.length = binary.BigEndian.Uint32(length_header[0:4]) // Convert length
+	if msg.length == 0 {
+		wire.trace.message(TRACE_RECV, msg)
+		return // Keep alive message
+	}
+	if msg.length > MAX_BITFIELD_MSG {
+		wireLog.Debug("Message too long", "addr", addr, "length", msg.length)
+		return msg, errors.New("Message size too large")
+	}
+	//var msgId [1]byte
+	msgId := make([]byte, 1)
+	n, err = io.ReadFull(wire.conn, msgId)
+	if err != nil || n != 1 {
+		return msg, fmt.Errorf("Read message id %w", err)
+	}
+	msg.msgId = msgId[0]
+	if err = checkLength(msg.msgId, msg.length); err != nil {
+		wireLog.Debug("Bad message length", "addr", addr, "id", msg.msgId, "length", msg.length)
+		return
+	}
+	var message_body []byte
+	if msg.msgId == piece {
+		message_body = make([]byte, 8) // allocate mem to read the position of the piece
+	} else {
+		message_body = make([]byte, msg.length - 1) // allocate mem to read the message
+	}
+	n, err = io.ReadFull(wire.conn, message_body) // read the payload
+	if err != nil || n != len(message_body) {
+		return msg, fmt.Errorf("Read message body %w", err)
+	}
+	if msg.msgId == piece {
+		var send int64
+		start := 0
+		piece_buf := blockPool.Get(int(msg.length - 9))
+		size := int64(len(piece_buf))
+		for size > 0 {
+			send = wire.l.WaitReceive(size)
+			size -= send
+			if err = wire.readDeadline(); err != nil {
+				blockPool.Put(piece_buf)
+				return
+			}
+			n, err = io.ReadFull(wire.conn, piece_buf[start:start+int(send)]) // read the piece
+			if err != nil || n != int(send) {
+				blockPool.Put(piece_buf)
+				return msg, fmt.Errorf("Read piece data %w", err)
+			}
+			start += n
+		}
+		msg.data = piece_buf
+	}
+	//n += 4
+	// Assign to the message struct
+	//msg.msgId = message_body[0]
+	msg.payLoad = message_body
+	wire.trace.message(TRACE_RECV, msg)
+	return
+}
+
+func (wire *Wire) WriteMsg(msg *message) (err error) {
+	defer wire.writer.Flush()
+	var n int
+	
+	num := make([]byte, 4)
+	
+	if wire.conn == nil {
+		return errors.New("Invalid connection")
+	}
+	wire.trace.message(TRACE_SEND, msg)
+	if err = wire.writeDeadline(); err != nil {
+		return
+	}
+	binary.BigEndian.PutUint32(num, msg.length)
+	if n, err = wire.writer.Write(num); err != nil || n != 4 {
+		return fmt.Errorf("Error sending message length %w", err)
+	}
+	if msg.length == 0 {
+		return
+	}
+	//buffer := bytes.NewBuffer(msg_byte[0:4])
+	if err = wire.writer.WriteByte(msg.msgId); err != nil {
+		return fmt.Errorf("Error sending msgId %w", err)
+	}
+	if msg.msgId == piece && len(msg.payLoad) > 8 {
+		// Write the position of the block, and then the block data
+		if n, err = wire.writer.Write(msg.payLoad[0:8]); err != nil || n != 8 {
+			return fmt.Errorf("Error sending piece header %w", err)
+		}
+		if err = wire.writer.Flush(); err != nil {
+			return
+		}
+		// Bandwidth restriction
+		var send int64
+		block := msg.payLoad[8:]
+		for len(block) > 0 {
+			send = wire.l.WaitSend(int64(len(block)))
+			if err = wire.writeDeadline(); err != nil {
+				return
+			}
+			if n, err = wire.writer.Write(block[0:send]); err != nil || n != int(send) {
+				return fmt.Errorf("Error writing piece %w", err)
+			}
+			if err = wire.writer.Flush(); err != nil {
+				return
+			}
+			block = block[send:]
+		}
+		return
+	}
+	if len(msg.payLoad) > 0 {
+		if n, err = wire.writer.Write(msg.payLoad); err != nil || n != len(msg.payLoad) {
+			return fmt.Errorf("Error sending payLoad%w", err)
+		}
+	}
+	return
+}
+
+// Build an extended message (BEP 10), the payload is the extended
+// message id followed by a bencoded dictionary
+
+func NewExtendedMessage(id uint8, data map[string]interface{}) (msg *message, err error) {
+	var b bytes.Buffer
+	b.WriteByte(id)
+	if err = bencode.Marshal(&b, data); err != nil {
+		return
+	}
+	payLoad := b.Bytes()
+	msg = &message{length: uint32(1 + len(payLoad)), msgId: extended, payLoad: payLoad}
+	return
+}
+
+// Decode the extended message id and the bencoded dictionary
+
+func DecodeExtendedMessage(msg *message) (id uint8, dict map[string]interface{}, err error) {
+	if msg.msgId != extended || len(msg.payLoad) < 1 {
+		return id, dict, errors.New("Invalid extended message")
+	}
+	id = msg.payLoad[0]
+	data, err := bencode.Decode(bytes.NewBuffer(msg.payLoad[1:]))
+	if err != nil {
+		return
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return id, dict, errors.New("Invalid extended message dictionary")
+	}
+	return
+}
+
+func (wire *Wire) Close() {
+	wire.conn.Close()
+	wire.trace.Close()
+}
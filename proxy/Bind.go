@@ -0,0 +1,94 @@
+// Local address of the outgoing connections, so the traffic of the
+// peers and the trackers only uses one interface (a VPN for example)
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package proxy
+
+import(
+	"net"
+	"net/http"
+	"errors"
+	)
+
+var(
+	bindIp net.IP // nil for any, protected by mutex
+	client = http.DefaultClient // Of the direct HTTP requests
+)
+
+// IPv4 address of bind, an address or the name of an interface
+
+func ResolveBind(bind string) (ip net.IP, err error) {
+	if ip = net.ParseIP(bind); ip != nil {
+		if ip = ip.To4(); ip == nil {
+			err = errors.New("Only IPv4 addresses can be bound")
+		}
+		return
+	}
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return
+	}
+	for _, addr := range(addrs) {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, errors.New("Interface " + bind + " has no IPv4 address")
+}
+
+// Bind the new outgoing connections to a local address or interface,
+// empty uses any
+
+func SetBind(bind string) (err error) {
+	var ip net.IP
+	if len(bind) > 0 {
+		if ip, err = ResolveBind(bind); err != nil {
+			return
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !ip.Equal(bindIp) {
+		proxyLog.Info("Outgoing connections bound", "ip", ip)
+	}
+	bindIp = ip
+	client = http.DefaultClient
+	if ip != nil {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DialContext: dialer.DialContext}}
+	}
+	return
+}
+
+// Local address of the TCP connections, nil for any
+
+func LocalTCP() *net.TCPAddr {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if bindIp == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: bindIp}
+}
+
+// Local address of the UDP sockets (trackers and uTP), nil for any
+
+func LocalUDP() *net.UDPAddr {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if bindIp == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: bindIp}
+}
+
+func httpClient() *http.Client {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return client
+}
@@ -0,0 +1,64 @@
+// HTTP requests over the connections of Dial, redirects are not
+// followed when using the proxy
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package proxy
+
+import(
+	"io"
+	"net"
+	"net/http"
+	"bufio"
+	"errors"
+	)
+
+// Body of a response, closes the connection with it
+
+type body struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *body) Close() error {
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+// Send req, through the proxy if there is one
+
+func Do(req *http.Request) (response *http.Response, err error) {
+	if !Enabled() {
+		return httpClient().Do(req)
+	}
+	if req.URL.Scheme != "http" {
+		return nil, errors.New("Only http urls can be used with the proxy")
+	}
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr += ":80"
+	}
+	conn, err := Dial(addr)
+	if err != nil {
+		return
+	}
+	req.Close = true
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return
+	}
+	if response, err = http.ReadResponse(bufio.NewReader(conn), req); err != nil {
+		conn.Close()
+		return
+	}
+	response.Body = &body{response.Body, conn}
+	return
+}
+
+func Get(url string) (response *http.Response, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	return Do(req)
+}
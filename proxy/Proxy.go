@@ -0,0 +1,208 @@
+// Outgoing TCP connections, direct or through a SOCKS5 proxy
+// (RFC 1928) with optional user/password authentication (RFC 1929).
+// The proxy is global, used by the peers and the HTTP trackers.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package proxy
+
+import(
+	"io"
+	"net"
+	"sync"
+	"strconv"
+	"encoding/binary"
+	"wgo/logger"
+	"errors"
+	)
+
+const(
+	SOCKS_VERSION = 5
+	AUTH_NONE = 0
+	AUTH_PASSWORD = 2
+	CMD_CONNECT = 1
+	ATYP_IPV4 = 1
+	ATYP_DOMAIN = 3
+	ATYP_IPV6 = 4
+)
+
+var proxyLog = logger.New("proxy")
+
+var(
+	mutex = new(sync.Mutex)
+	proxyAddr, user, password string // No proxy if proxyAddr is empty
+)
+
+var replies = []string{"succeeded", "general failure", "connection not allowed", "network unreachable",
+	"host unreachable", "connection refused", "TTL expired", "command not supported", "address type not supported"}
+
+// Use the proxy at addr (host:port) for the new connections, an
+// empty addr connects directly. The user is optional.
+
+func Set(addr, proxyUser, proxyPassword string) (err error) {
+	if len(addr) > 0 {
+		if _, _, err = net.SplitHostPort(addr); err != nil {
+			return
+		}
+	}
+	if len(proxyUser) > 255 || len(proxyPassword) > 255 {
+		return errors.New("Proxy user and password must be shorter than 256 bytes")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if addr != proxyAddr {
+		proxyLog.Info("Proxy changed", "addr", addr)
+	}
+	proxyAddr, user, password = addr, proxyUser, proxyPassword
+	return
+}
+
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(proxyAddr) > 0
+}
+
+func dialTCP(addr string) (conn net.Conn, err error) {
+	addrTCP, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return
+	}
+	c, err := net.DialTCP("tcp4", LocalTCP(), addrTCP)
+	if err != nil {
+		return
+	}
+	return c, nil
+}
+
+// Open a TCP connection to addr (host:port), through the proxy if
+// there is one. The host is resolved by the proxy.
+
+func Dial(addr string) (conn net.Conn, err error) {
+	mutex.Lock()
+	server, u, pw := proxyAddr, user, password
+	mutex.Unlock()
+	if len(server) == 0 {
+		return dialTCP(addr)
+	}
+	if conn, err = dialTCP(server); err != nil {
+		return
+	}
+	if err = connect(conn, addr, u, pw); err != nil {
+		proxyLog.Debug("Error connecting through the proxy", "addr", addr, "err", err)
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+// SOCKS5 negotiation, asking the proxy to connect to addr
+
+func connect(conn net.Conn, addr, u, pw string) (err error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 0xffff {
+		return errors.New("Invalid port " + portString)
+	}
+	methods := []byte{AUTH_NONE}
+	if len(u) > 0 {
+		methods = append(methods, AUTH_PASSWORD)
+	}
+	if _, err = conn.Write(append([]byte{SOCKS_VERSION, byte(len(methods))}, methods...)); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	if reply[0] != SOCKS_VERSION {
+		return errors.New("Proxy is not SOCKS5")
+	}
+	switch reply[1] {
+		case AUTH_NONE:
+		case AUTH_PASSWORD:
+			if len(u) == 0 {
+				return errors.New("Proxy requires authentication")
+			}
+			if err = authenticate(conn, u, pw); err != nil {
+				return
+			}
+		default:
+			return errors.New("Proxy refused the authentication methods")
+	}
+	// Connect request
+	req := []byte{SOCKS_VERSION, CMD_CONNECT, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, ATYP_IPV4)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, ATYP_IPV6)
+		req = append(req, ip...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("Host name too long")
+		}
+		req = append(req, ATYP_DOMAIN, byte(len(host)))
+		req = append(req, []byte(host)...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	// Reply, the bound address is read and ignored
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != SOCKS_VERSION {
+		return errors.New("Invalid proxy reply")
+	}
+	if header[1] != 0 {
+		if int(header[1]) < len(replies) {
+			return errors.New("Proxy error: " + replies[header[1]])
+		}
+		return errors.New("Proxy error " + strconv.Itoa(int(header[1])))
+	}
+	var length int
+	switch header[3] {
+		case ATYP_IPV4:
+			length = 4
+		case ATYP_IPV6:
+			length = 16
+		case ATYP_DOMAIN:
+			size := make([]byte, 1)
+			if _, err = io.ReadFull(conn, size); err != nil {
+				return
+			}
+			length = int(size[0])
+		default:
+			return errors.New("Invalid address type in the proxy reply")
+	}
+	bound := make([]byte, length+2)
+	if _, err = io.ReadFull(conn, bound); err != nil {
+		return
+	}
+	proxyLog.Debug("Connected through the proxy", "addr", addr, "bound_port", binary.BigEndian.Uint16(bound[length:]))
+	return
+}
+
+func authenticate(conn net.Conn, u, pw string) (err error) {
+	req := []byte{1, byte(len(u))}
+	req = append(req, []byte(u)...)
+	req = append(req, byte(len(pw)))
+	req = append(req, []byte(pw)...)
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	if reply[1] != 0 {
+		return errors.New("Proxy authentication failed")
+	}
+	return
+}
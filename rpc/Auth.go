@@ -0,0 +1,69 @@
+// Protection of the control API from the web pages open in the browser
+// of the user: a page can send forms to 127.0.0.1, or point a name of
+// its own to it (DNS rebinding), but it can't set a header of ours
+// without our consent. The requests that change something must carry
+// the X-Wgo-Token header, with the token when one is set, and then
+// every other request needs the token too.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package rpc
+
+import(
+	"net"
+	"net/url"
+	"net/http"
+	"crypto/subtle"
+	"errors"
+	)
+
+const(
+	TOKEN_HEADER = "X-Wgo-Token"
+)
+
+// Without a token only the addresses and localhost are accepted as
+// the host, a name could point anywhere
+
+func localHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == "localhost" || net.ParseIP(host) != nil
+}
+
+func (s *Server) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) guard(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.token) == 0 && !localHost(r.Host) {
+			fail(w, http.StatusForbidden, errors.New("Unknown host, set a token to use a name"))
+			return
+		}
+		if origin := r.Header.Get("Origin"); len(origin) > 0 {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				fail(w, http.StatusForbidden, errors.New("Cross-origin request"))
+				return
+			}
+		}
+		header, sent := r.Header[http.CanonicalHeaderKey(TOKEN_HEADER)]
+		if r.Method != "GET" && r.Method != "HEAD" && !sent {
+			fail(w, http.StatusForbidden, errors.New("Missing " + TOKEN_HEADER + " header"))
+			return
+		}
+		// The page of the UI takes the token from its address (/#TOKEN), and the
+		// streams and the metrics can take it as a parameter
+		if len(s.token) > 0 && r.URL.Path != "/" {
+			token := r.URL.Query().Get("token")
+			if sent {
+				token = header[0]
+			}
+			if !s.validToken(token) {
+				fail(w, http.StatusUnauthorized, errors.New("Invalid token"))
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
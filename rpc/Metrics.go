@@ -0,0 +1,152 @@
+// Metrics of the torrents in the Prometheus text format, served
+// at /metrics to monitor wgo with the usual tools
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package rpc
+
+import(
+	"fmt"
+	"net/http"
+	"bytes"
+	"strings"
+	"encoding/hex"
+	"wgo/wgo"
+	"wgo/files"
+	"wgo/peers"
+	)
+
+// Escape a label value
+
+func label(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+func header(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	torrents := s.session.Torrents()
+	stats := make([]*wgo.TorrentStats, len(torrents))
+	labels := make([]string, len(torrents))
+	for i, t := range(torrents) {
+		stats[i] = t.Stats()
+		labels[i] = fmt.Sprintf("infohash=\"%s\",name=\"%s\"", hex.EncodeToString([]byte(t.Infohash())), label(t.Name()))
+	}
+	buf := new(bytes.Buffer)
+	header(buf, "wgo_torrents", "gauge", "Torrents in the session.")
+	fmt.Fprintf(buf, "wgo_torrents %d\n", len(torrents))
+	// One sample per torrent
+	each := func(name, kind, help string, value func(st *wgo.TorrentStats) int64) {
+		header(buf, name, kind, help)
+		for i, st := range(stats) {
+			fmt.Fprintf(buf, "%s{%s} %d\n", name, labels[i], value(st))
+		}
+	}
+	each("wgo_torrent_running", "gauge", "Whether the torrent is started.", func(st *wgo.TorrentStats) int64 {
+		if st.Running {
+			return 1
+		}
+		return 0
+	})
+	each("wgo_size_bytes", "gauge", "Size of the torrent.", func(st *wgo.TorrentStats) int64 { return st.Size })
+	each("wgo_left_bytes", "gauge", "Bytes not downloaded yet.", func(st *wgo.TorrentStats) int64 { return st.Left })
+	each("wgo_pieces_done", "gauge", "Pieces downloaded and checked.", func(st *wgo.TorrentStats) int64 { return st.Done })
+	each("wgo_uploaded_bytes_total", "counter", "Piece data sent to the peers.", func(st *wgo.TorrentStats) int64 { return st.Uploaded })
+	each("wgo_downloaded_bytes_total", "counter", "Piece data received from the peers.", func(st *wgo.TorrentStats) int64 { return st.Downloaded })
+	header(buf, "wgo_speed_bytes_per_second", "gauge", "Transfer speed, averaged over the last seconds.")
+	for i, st := range(stats) {
+		fmt.Fprintf(buf, "wgo_speed_bytes_per_second{%s,direction=\"down\"} %d\n", labels[i], st.DownSpeed)
+		fmt.Fprintf(buf, "wgo_speed_bytes_per_second{%s,direction=\"up\"} %d\n", labels[i], st.UpSpeed)
+	}
+	each("wgo_active_seconds_total", "counter", "Seconds the torrent has been running, over all its runs.", func(st *wgo.TorrentStats) int64 { return st.Active })
+	each("wgo_hash_failures_total", "counter", "Pieces that didn't pass the hash check.", func(st *wgo.TorrentStats) int64 { return st.HashFailures })
+	each("wgo_duplicate_blocks_total", "counter", "Blocks received after a first copy, discarded.", func(st *wgo.TorrentStats) int64 { return st.Duplicates })
+	each("wgo_wasted_bytes_total", "counter", "Bytes of the duplicate blocks.", func(st *wgo.TorrentStats) int64 { return st.Wasted })
+	each("wgo_request_timeouts_total", "counter", "Requests cancelled because the block didn't arrive in time.", func(st *wgo.TorrentStats) int64 { return st.Timeouts })
+	each("wgo_requests", "gauge", "Blocks requested to the peers and not received yet.", func(st *wgo.TorrentStats) int64 { return st.Requests })
+	each("wgo_disk_queue", "gauge", "Blocks waiting to be written to disk.", func(st *wgo.TorrentStats) int64 { return int64(st.DiskQueue) })
+	each("wgo_reaped_peers_total", "counter", "Peers disconnected for not sending anything, not even a keep-alive.", func(st *wgo.TorrentStats) int64 { return st.Reaped })
+	each("wgo_unused_peers", "gauge", "Known peers we are not connected to.", func(st *wgo.TorrentStats) int64 { return int64(st.UnusedPeers) })
+	header(buf, "wgo_peers", "gauge", "Connected peers.")
+	for i, st := range(stats) {
+		fmt.Fprintf(buf, "wgo_peers{%s,direction=\"outgoing\"} %d\n", labels[i], st.ActivePeers)
+		fmt.Fprintf(buf, "wgo_peers{%s,direction=\"incoming\"} %d\n", labels[i], st.IncomingPeers)
+	}
+	sources := make([]map[string]peers.SourceStats, len(torrents))
+	for i, t := range(torrents) {
+		sources[i] = t.Sources()
+	}
+	header(buf, "wgo_source_peers", "gauge", "Connected peers by how they were found.")
+	for i := range(torrents) {
+		for name, st := range(sources[i]) {
+			fmt.Fprintf(buf, "wgo_source_peers{%s,source=\"%s\"} %d\n", labels[i], name, st.Peers)
+		}
+	}
+	header(buf, "wgo_source_connections_total", "counter", "Handshakes finished with the peers of each source.")
+	for i := range(torrents) {
+		for name, st := range(sources[i]) {
+			fmt.Fprintf(buf, "wgo_source_connections_total{%s,source=\"%s\"} %d\n", labels[i], name, st.Connections)
+		}
+	}
+	header(buf, "wgo_source_bytes_total", "counter", "Piece data transferred with the peers of each source.")
+	for i := range(torrents) {
+		for name, st := range(sources[i]) {
+			fmt.Fprintf(buf, "wgo_source_bytes_total{%s,source=\"%s\",direction=\"up\"} %d\n", labels[i], name, st.Uploaded)
+			fmt.Fprintf(buf, "wgo_source_bytes_total{%s,source=\"%s\",direction=\"down\"} %d\n", labels[i], name, st.Downloaded)
+		}
+	}
+	header(buf, "wgo_availability", "gauge", "Distributed copies of the torrent in the connected peers.")
+	for i, st := range(stats) {
+		fmt.Fprintf(buf, "wgo_availability{%s} %.3f\n", labels[i], st.Availability)
+	}
+	header(buf, "wgo_tracker_announces_total", "counter", "Announces to each tracker by result.")
+	for i, t := range(torrents) {
+		for _, as := range(t.Trackers()) {
+			fmt.Fprintf(buf, "wgo_tracker_announces_total{%s,tracker=\"%s\",result=\"ok\"} %d\n", labels[i], label(as.Url), as.Announces-as.Failures)
+			fmt.Fprintf(buf, "wgo_tracker_announces_total{%s,tracker=\"%s\",result=\"error\"} %d\n", labels[i], label(as.Url), as.Failures)
+		}
+	}
+	header(buf, "wgo_tracker_errors", "gauge", "Failed announces in a row to each tracker, 0 if it's working.")
+	for i, t := range(torrents) {
+		for _, as := range(t.Trackers()) {
+			fmt.Fprintf(buf, "wgo_tracker_errors{%s,tracker=\"%s\"} %d\n", labels[i], label(as.Url), as.Errors)
+		}
+	}
+	conns, halfOpen := s.session.Connections()
+	header(buf, "wgo_connections", "gauge", "Connected peers of all the torrents.")
+	fmt.Fprintf(buf, "wgo_connections %d\n", conns)
+	header(buf, "wgo_half_open", "gauge", "Outgoing connections being opened.")
+	fmt.Fprintf(buf, "wgo_half_open %d\n", halfOpen)
+	header(buf, "wgo_banned_ips", "gauge", "IPs banned for sending pieces that failed the hash check.")
+	fmt.Fprintf(buf, "wgo_banned_ips %d\n", s.session.Banned())
+	if ip, source := s.session.ExternalIp(); len(ip) > 0 {
+		header(buf, "wgo_external_ip_info", "gauge", "Our address in the internet, and how it was found.")
+		fmt.Fprintf(buf, "wgo_external_ip_info{ip=\"%s\",source=\"%s\"} 1\n", label(ip), source)
+	}
+	totals := s.session.Totals()
+	header(buf, "wgo_session_bytes_total", "counter", "Piece data transferred by every torrent, over all the runs of the session.")
+	fmt.Fprintf(buf, "wgo_session_bytes_total{direction=\"up\"} %d\n", totals.Uploaded)
+	fmt.Fprintf(buf, "wgo_session_bytes_total{direction=\"down\"} %d\n", totals.Downloaded)
+	header(buf, "wgo_session_active_seconds_total", "counter", "Seconds the session has been running, over all its runs.")
+	fmt.Fprintf(buf, "wgo_session_active_seconds_total %d\n", totals.Active)
+	used, hits, misses := files.CacheStats()
+	header(buf, "wgo_cache_bytes", "gauge", "Piece data kept in the read cache.")
+	fmt.Fprintf(buf, "wgo_cache_bytes %d\n", used)
+	header(buf, "wgo_cache_reads_total", "counter", "Blocks served to the peers by result of the read cache.")
+	fmt.Fprintf(buf, "wgo_cache_reads_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(buf, "wgo_cache_reads_total{result=\"miss\"} %d\n", misses)
+	up, down := s.session.Limits()
+	header(buf, "wgo_limit_kilobytes_per_second", "gauge", "Global bandwidth limits, 0 means no limit.")
+	fmt.Fprintf(buf, "wgo_limit_kilobytes_per_second{direction=\"up\"} %d\n", up)
+	fmt.Fprintf(buf, "wgo_limit_kilobytes_per_second{direction=\"down\"} %d\n", down)
+	up, down, scheduled := s.session.ActiveLimits()
+	header(buf, "wgo_active_limit_kilobytes_per_second", "gauge", "Global bandwidth limits in effect, the ones of the schedule inside its windows.")
+	fmt.Fprintf(buf, "wgo_active_limit_kilobytes_per_second{direction=\"up\",scheduled=\"%t\"} %d\n", scheduled, up)
+	fmt.Fprintf(buf, "wgo_active_limit_kilobytes_per_second{direction=\"down\",scheduled=\"%t\"} %d\n", scheduled, down)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
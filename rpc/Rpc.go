@@ -0,0 +1,382 @@
+// HTTP control API, JSON endpoints to manage the torrents of a
+// Session from other programs, and the web UI that uses them
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package rpc
+
+import(
+	"net"
+	"net/http"
+	"encoding/json"
+	"strconv"
+	"encoding/hex"
+	"wgo/wgo"
+	"wgo/files"
+	"wgo/logger"
+	"errors"
+	)
+
+var rpcLog = logger.New("rpc")
+
+// Torrent as returned by the API, the infohash is in hex
+
+type Torrent struct {
+	Infohash, Name string
+	Stats *wgo.TorrentStats
+}
+
+type Limits struct {
+	Up, Down int // In KB/s, 0 means no limit
+}
+
+// The global limits and the ones in effect, which are the ones of the
+// schedule inside its windows
+
+type GlobalLimits struct {
+	Limits
+	ActiveUp, ActiveDown int
+	Scheduled bool
+}
+
+type Server struct {
+	session *wgo.Session
+	listener net.Listener
+	token string // Needed by every request if not empty
+}
+
+// Start serving the API at addr (ip:port), with token if it isn't
+// empty
+
+func NewServer(session *wgo.Session, addr, token string) (s *Server, err error) {
+	s = new(Server)
+	s.session = session
+	s.token = token
+	if s.listener, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+	rpcLog.Info("Listening", "addr", s.listener.Addr().String())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/torrents", s.torrents)
+	mux.HandleFunc("/api/add", s.post(s.add))
+	mux.HandleFunc("/api/remove", s.post(s.torrent(s.remove)))
+	mux.HandleFunc("/api/pause", s.post(s.torrent(s.pause)))
+	mux.HandleFunc("/api/resume", s.post(s.torrent(s.resume)))
+	mux.HandleFunc("/api/recheck", s.post(s.torrent(s.recheck)))
+	mux.HandleFunc("/api/reannounce", s.post(s.torrent(s.reannounce)))
+	mux.HandleFunc("/api/add_peer", s.post(s.torrent(s.addPeer)))
+	mux.HandleFunc("/api/queue", s.post(s.torrent(s.queue)))
+	mux.HandleFunc("/api/files", s.torrent(s.files))
+	mux.HandleFunc("/api/priority", s.post(s.torrent(s.priority)))
+	mux.HandleFunc("/api/seed_limits", s.torrent(s.seedLimits))
+	mux.HandleFunc("/api/peers", s.torrent(s.peers))
+	mux.HandleFunc("/api/trackers", s.torrent(s.trackers))
+	mux.HandleFunc("/api/sources", s.torrent(s.sources))
+	mux.HandleFunc("/api/peer_limits", s.post(s.torrent(s.peerLimits)))
+	mux.HandleFunc("/api/limits", s.limits)
+	mux.HandleFunc("/api/totals", s.totals)
+	mux.HandleFunc("/api/pieces", s.torrent(s.pieces))
+	mux.HandleFunc("/metrics", s.metrics)
+	mux.HandleFunc("/stream/", s.stream)
+	mux.HandleFunc("/", ui)
+	go http.Serve(s.listener, s.guard(mux))
+	return
+}
+
+func (s *Server) Close() {
+	s.listener.Close()
+}
+
+// Write v as the JSON response
+
+func reply(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func fail(w http.ResponseWriter, code int, err error) {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// Handlers that change the state only accept POST requests
+
+func (s *Server) post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fail(w, http.StatusMethodNotAllowed, errors.New("Use POST"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Handlers of a single torrent, selected by the infohash parameter
+
+func (s *Server) torrent(handler func(w http.ResponseWriter, r *http.Request, t *wgo.Torrent)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		infohash, err := hex.DecodeString(r.FormValue("infohash"))
+		if err != nil {
+			fail(w, http.StatusBadRequest, errors.New("Invalid infohash"))
+			return
+		}
+		t, ok := s.session.Torrent(string(infohash))
+		if !ok {
+			fail(w, http.StatusNotFound, errors.New("Torrent not found"))
+			return
+		}
+		handler(w, r, t)
+	}
+}
+
+func info(t *wgo.Torrent) *Torrent {
+	return &Torrent{Infohash: hex.EncodeToString([]byte(t.Infohash())), Name: t.Name(), Stats: t.Stats()}
+}
+
+func (s *Server) torrents(w http.ResponseWriter, r *http.Request) {
+	torrents := s.session.Torrents()
+	list := make([]*Torrent, len(torrents))
+	for i, t := range(torrents) {
+		list[i] = info(t)
+	}
+	reply(w, list)
+}
+
+// Add a torrent (uri is a path, an url or a magnet link) and start it,
+// allocation overrides the one of the session
+
+func (s *Server) add(w http.ResponseWriter, r *http.Request) {
+	allocation := s.session.Config().Allocation
+	if name := r.FormValue("allocation"); len(name) > 0 {
+		var err error
+		if allocation, err = files.ParseAllocation(name); err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	t, err := s.session.AddTorrentAllocation(r.FormValue("uri"), allocation)
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = t.Start(); err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	reply(w, info(t))
+}
+
+// Remove a torrent, with delete=true its files are deleted too
+
+func (s *Server) remove(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	deleteFiles := false
+	if value := r.FormValue("delete"); len(value) > 0 {
+		var err error
+		if deleteFiles, err = strconv.ParseBool(value); err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := s.session.RemoveTorrent(t.Infohash(), deleteFiles); err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	reply(w, info(t))
+}
+
+func (s *Server) pause(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	if err := t.Pause(); err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	reply(w, info(t))
+}
+
+func (s *Server) resume(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	if err := t.Resume(); err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	reply(w, info(t))
+}
+
+// Check the files again in the background, the stats show Checking
+// until it finishes
+
+func (s *Server) recheck(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	go func() {
+		if err := t.Recheck(); err != nil {
+			rpcLog.Error("Error checking the files", "name", t.Name(), "err", err)
+		}
+	}()
+	reply(w, info(t))
+}
+
+func (s *Server) reannounce(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	if err := t.Reannounce(); err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, info(t))
+}
+
+func (s *Server) addPeer(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	if err := t.AddPeer(r.FormValue("addr")); err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, info(t))
+}
+
+// Move a torrent in the queue of the active slots
+
+func (s *Server) queue(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	position, err := strconv.Atoi(r.FormValue("position"))
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = s.session.SetQueuePosition(t.Infohash(), position); err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, info(t))
+}
+
+func (s *Server) files(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	reply(w, t.Files())
+}
+
+// Change the priority of the file with the given index
+
+func (s *Server) priority(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	file, err := strconv.Atoi(r.FormValue("file"))
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	priority, err := strconv.Atoi(r.FormValue("priority"))
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = t.SetPriority(file, priority); err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, t.Files())
+}
+
+// Seed limits of a torrent, changed with a POST request (ratio and
+// time in minutes, 0 means no limit)
+
+func (s *Server) seedLimits(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	if r.Method == "POST" {
+		seedRatio, seedTime := t.SeedLimits()
+		var err error
+		if value := r.FormValue("ratio"); len(value) > 0 {
+			if seedRatio, err = strconv.ParseFloat(value, 64); err != nil {
+				fail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if value := r.FormValue("time"); len(value) > 0 {
+			if seedTime, err = strconv.ParseInt(value, 10, 64); err != nil {
+				fail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if err = t.SetSeedLimits(seedRatio, seedTime); err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	seedRatio, seedTime := t.SeedLimits()
+	reply(w, map[string]interface{}{"Ratio": seedRatio, "Time": seedTime})
+}
+
+func (s *Server) peers(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	reply(w, t.Peers())
+}
+
+// Trackers of a torrent with the results of their announces
+
+func (s *Server) trackers(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	reply(w, t.Trackers())
+}
+
+// Peers found by each source of a torrent and the data they transferred
+
+func (s *Server) sources(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	reply(w, t.Sources())
+}
+
+// Piece map of a torrent, the bitfield in hex
+
+func (s *Server) pieces(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	st := t.Stats()
+	reply(w, map[string]interface{}{"Pieces": st.Pieces, "Bitfield": hex.EncodeToString(t.Pieces())})
+}
+
+// Parse the up and down parameters (KB/s), missing ones are 0
+
+func parseLimits(r *http.Request) (l *Limits, err error) {
+	l = new(Limits)
+	if up := r.FormValue("up"); len(up) > 0 {
+		if l.Up, err = strconv.Atoi(up); err != nil {
+			return
+		}
+	}
+	if down := r.FormValue("down"); len(down) > 0 {
+		if l.Down, err = strconv.Atoi(down); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Server) peerLimits(w http.ResponseWriter, r *http.Request, t *wgo.Torrent) {
+	l, err := parseLimits(r)
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = t.SetPeerLimits(r.FormValue("addr"), l.Up, l.Down); err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, l)
+}
+
+// Global limits, changed with a POST request
+
+func (s *Server) limits(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		l, err := parseLimits(r)
+		if err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+		if err = s.session.SetLimits(l.Up, l.Down); err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	l := new(GlobalLimits)
+	l.Up, l.Down = s.session.Limits()
+	l.ActiveUp, l.ActiveDown, l.Scheduled = s.session.ActiveLimits()
+	reply(w, l)
+}
+
+// Lifetime transfers of the session, over all its runs
+
+func (s *Server) totals(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.session.Totals())
+}
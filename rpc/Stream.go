@@ -0,0 +1,72 @@
+// Streaming of the files of the torrents over HTTP while they are
+// downloaded, a media player can play /stream/INFOHASH/path/of/file
+// and seek with Range requests
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package rpc
+
+import(
+	"time"
+	"strings"
+	"net/url"
+	"net/http"
+	"html"
+	"encoding/hex"
+	"errors"
+	)
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/stream/"), "/", 2)
+	infohash, err := hex.DecodeString(parts[0])
+	if err != nil {
+		fail(w, http.StatusBadRequest, errors.New("Invalid infohash"))
+		return
+	}
+	t, ok := s.session.Torrent(string(infohash))
+	if !ok {
+		fail(w, http.StatusNotFound, errors.New("Torrent not found"))
+		return
+	}
+	path := ""
+	if len(parts) > 1 {
+		path = parts[1]
+	}
+	file := -1
+	list := t.Files()
+	for i, f := range(list) {
+		if strings.Join(f.Path, "/") == path {
+			file = i
+			break
+		}
+	}
+	if file == -1 {
+		if len(path) > 0 {
+			http.NotFound(w, r)
+			return
+		}
+		// A page with the links of the files
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		page := "<!DOCTYPE html>\n<html><head><title>" + html.EscapeString(t.Name()) + "</title></head><body><ul>\n"
+		for _, f := range(list) {
+			name := strings.Join(f.Path, "/")
+			link := (&url.URL{Path: parts[0] + "/" + name}).EscapedPath()
+			page += "<li><a href=\"/stream/" + link + "\">" + html.EscapeString(name) + "</a></li>\n"
+		}
+		w.Write([]byte(page + "</ul></body></html>\n"))
+		return
+	}
+	reader, err := t.OpenFile(file)
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer reader.Close()
+	go func() {
+		// The player closed the connection while a read was waiting
+		<- r.Context().Done()
+		reader.Close()
+	}()
+	rpcLog.Debug("Streaming", "name", t.Name(), "file", path, "range", r.Header.Get("Range"))
+	http.ServeContent(w, r, path, time.Time{}, reader)
+}
@@ -0,0 +1,217 @@
+// Web interface served at the root of the control API, it only
+// uses the JSON endpoints
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package rpc
+
+import(
+	"net/http"
+	)
+
+func ui(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(UI_PAGE))
+}
+
+const UI_PAGE = `<!DOCTYPE html>
+<html>
+<head>
+<title>wgo</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 20px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; }
+tr.selected { background: #eef; }
+.bar { width: 200px; height: 12px; border: 1px solid #888; }
+.bar div { height: 100%; background: #4a4; }
+canvas { border: 1px solid #888; }
+#error { color: #a00; }
+</style>
+</head>
+<body>
+<h1>wgo</h1>
+<p>
+<input id="uri" size="60" placeholder="Path, url or magnet link">
+<button onclick="add()">Add</button>
+Limits (KB/s): up <input id="up" size="5"> down <input id="down" size="5">
+<button onclick="limits()">Set</button>
+<span id="error"></span>
+</p>
+<table>
+<thead><tr><th>Name</th><th>Progress</th><th>Size</th><th>Downloaded</th><th>Uploaded</th><th>Down</th><th>Up</th><th>ETA</th><th>Peers</th><th></th></tr></thead>
+<tbody id="torrents"></tbody>
+</table>
+<div id="details" style="display: none">
+<h2 id="name"></h2>
+<canvas id="pieces" width="800" height="40"></canvas>
+<table>
+<thead><tr><th>Address</th><th>Client</th><th>Source</th><th>Down</th><th>Up</th><th>Choking</th><th>Choked</th><th>Seed</th></tr></thead>
+<tbody id="peers"></tbody>
+</table>
+</div>
+<script>
+var selected = "";
+// Opened as /#TOKEN when the API has a token
+var token = location.hash.substring(1);
+
+function request(method, url, done) {
+	var xhr = new XMLHttpRequest();
+	xhr.open(method, url, true);
+	xhr.setRequestHeader("X-Wgo-Token", token);
+	xhr.onreadystatechange = function() {
+		if (xhr.readyState != 4) {
+			return;
+		}
+		var data = JSON.parse(xhr.responseText);
+		if (xhr.status != 200) {
+			document.getElementById("error").textContent = data.error;
+			return;
+		}
+		document.getElementById("error").textContent = "";
+		if (done) {
+			done(data);
+		}
+	};
+	xhr.send(null);
+}
+
+function size(bytes) {
+	var units = ["B", "KB", "MB", "GB", "TB"];
+	var i = 0;
+	while (bytes >= 1000 && i < units.length-1) {
+		bytes /= 1000;
+		i++;
+	}
+	return bytes.toFixed(1) + " " + units[i];
+}
+
+function eta(seconds) {
+	if (seconds < 0) {
+		return "";
+	}
+	var m = Math.floor(seconds/60) % 60, s = seconds % 60;
+	return Math.floor(seconds/3600) + ":" + (m < 10 ? "0" : "") + m + ":" + (s < 10 ? "0" : "") + s;
+}
+
+function cell(row, text) {
+	var td = document.createElement("td");
+	td.textContent = text;
+	row.appendChild(td);
+	return td;
+}
+
+function button(td, text, action, infohash) {
+	var b = document.createElement("button");
+	b.textContent = text;
+	b.onclick = function(e) {
+		e.stopPropagation();
+		request("POST", "/api/" + action + "?infohash=" + infohash, update);
+	};
+	td.appendChild(b);
+}
+
+function update() {
+	request("GET", "/api/torrents", function(torrents) {
+		var body = document.getElementById("torrents");
+		body.innerHTML = "";
+		for (var i = 0; i < torrents.length; i++) {
+			var t = torrents[i], st = t.Stats;
+			var row = document.createElement("tr");
+			if (t.Infohash == selected) {
+				row.className = "selected";
+			}
+			row.onclick = (function(infohash) {
+				return function() { selected = infohash; update(); };
+			})(t.Infohash);
+			cell(row, t.Name);
+			var bar = document.createElement("div");
+			bar.className = "bar";
+			var done = document.createElement("div");
+			done.style.width = st.Progress + "%";
+			bar.appendChild(done);
+			cell(row, "").appendChild(bar);
+			cell(row, size(st.Size));
+			cell(row, size(st.Downloaded));
+			cell(row, size(st.Uploaded));
+			cell(row, size(st.DownSpeed) + "/s");
+			cell(row, size(st.UpSpeed) + "/s");
+			cell(row, st.Running ? eta(st.Eta) : "");
+			cell(row, st.ActivePeers + st.IncomingPeers);
+			var td = cell(row, "");
+			button(td, st.Running ? "Pause" : "Resume", st.Running ? "pause" : "resume", t.Infohash);
+			button(td, "Remove", "remove", t.Infohash);
+			body.appendChild(row);
+			if (t.Infohash == selected) {
+				document.getElementById("name").textContent = t.Name;
+			}
+		}
+		details();
+	});
+}
+
+function details() {
+	document.getElementById("details").style.display = selected ? "block" : "none";
+	if (!selected) {
+		return;
+	}
+	request("GET", "/api/pieces?infohash=" + selected, function(p) {
+		var canvas = document.getElementById("pieces");
+		var ctx = canvas.getContext("2d");
+		var width = canvas.width / p.Pieces;
+		ctx.fillStyle = "#fff";
+		ctx.fillRect(0, 0, canvas.width, canvas.height);
+		ctx.fillStyle = "#4a4";
+		for (var i = 0; i < p.Pieces; i++) {
+			var b = parseInt(p.Bitfield.substr((i >> 3)*2, 2), 16);
+			if (b & (128 >> (i & 7))) {
+				ctx.fillRect(i*width, 0, Math.max(width, 1), canvas.height);
+			}
+		}
+	});
+	request("GET", "/api/peers?infohash=" + selected, function(peers) {
+		var body = document.getElementById("peers");
+		body.innerHTML = "";
+		for (var i = 0; peers && i < peers.length; i++) {
+			var p = peers[i];
+			var row = document.createElement("tr");
+			cell(row, p.Addr);
+			cell(row, p.Client);
+			cell(row, p.Source);
+			cell(row, size(p.DownSpeed) + "/s");
+			cell(row, size(p.UpSpeed) + "/s");
+			cell(row, p.Am_choking ? "yes" : "no");
+			cell(row, p.Peer_choking ? "yes" : "no");
+			cell(row, p.Completed ? "yes" : "no");
+			body.appendChild(row);
+		}
+	});
+}
+
+function add() {
+	var uri = document.getElementById("uri").value;
+	request("POST", "/api/add?uri=" + encodeURIComponent(uri), update);
+}
+
+function limits() {
+	var up = document.getElementById("up").value || 0;
+	var down = document.getElementById("down").value || 0;
+	request("POST", "/api/limits?up=" + up + "&down=" + down, showLimits);
+}
+
+function showLimits(l) {
+	document.getElementById("up").value = l.Up;
+	document.getElementById("down").value = l.Down;
+}
+
+request("GET", "/api/limits", showLimits);
+update();
+setInterval(update, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,249 @@
+// Keeps track of the speed of each peer and of the torrent, the speeds
+// are exponentially weighted moving averages updated every second
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package stats
+
+import(
+	"time"
+	//"math"
+	"fmt"
+	"wgo/bit_field"
+	"wgo/logger"
+	"sync"
+	)
+	
+const(
+	PONDERATION_TIME = 10 // in seconds
+	TRACKER_UPDATE = 60
+	// Weight of the last second in the speeds, the moving average of
+	// PONDERATION_TIME seconds
+	ALPHA = 2.0/(PONDERATION_TIME+1)
+)
+
+var statsLog = logger.New("stats")
+
+type Status struct {
+	Uploaded, Downloaded, Speed int64
+	Addr string
+}
+
+// The peer uploads to us (up) and downloads from us (down)
+
+type PeerStat struct {
+	size_up int64 // bytes in the current second
+	size_down int64
+	rate_up, rate_down float64 // bytes/s
+}
+
+type stats struct {
+	mutex *sync.Mutex
+	peers map[string] *PeerStat
+	size, uploaded, downloaded int64
+	rate_up, rate_down float64 // Of all the peers
+	bitfield *bit_field.Bitfield
+	pieceLength int64
+	quit chan bool
+}
+
+type Stats interface {
+	Update(addr string, uploaded, downloaded int64)
+	GetStats() (map[string]*Status)
+	GetSpeed(addr string) (speed int64)
+	GetRates(addr string) (down, up int64)
+	GetGlobalStats() (uploaded, downloaded int64)
+	GetGlobalRates() (down, up int64)
+	SetGlobalStats(uploaded, downloaded int64)
+	Stop()
+}
+
+func (s *stats) Update(addr string, uploaded, downloaded int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if uploaded > 0 || downloaded > 0 {
+		s.update(addr, uploaded, downloaded)
+	} else {
+		s.remove(addr)
+	}
+}
+
+func (s *stats) GetStats() (map[string]*Status) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peers := make(map[string]*Status)
+	for addr, peer := range(s.peers) {
+		choke := new(Status)
+		// use bitfield instead of "left"
+		if s.bitfield.Completed() {
+			choke.Speed = int64(peer.rate_down)
+		} else { 
+			choke.Speed = int64(peer.rate_up)
+		}
+		peers[addr] = choke
+	}
+	return peers
+}
+
+func (s *stats) GetSpeed(addr string) (speed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if peer, ok := s.peers[addr]; ok {
+		if !s.bitfield.Completed() {
+			speed = int64(peer.rate_up)
+		} else {
+			speed = int64(peer.rate_down)
+		}
+	}
+	return speed
+}
+
+// Speeds of a peer in bytes/s, what we download from it and what we
+// upload to it
+
+func (s *stats) GetRates(addr string) (down, up int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if peer, ok := s.peers[addr]; ok {
+		return int64(peer.rate_up), int64(peer.rate_down)
+	}
+	return
+}
+
+func (s *stats) GetGlobalRates() (down, up int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int64(s.rate_up), int64(s.rate_down)
+}
+
+// Totals of the torrent, with the bytes of the current second that
+// the round hasn't added yet
+
+func (s *stats) GetGlobalStats() (uploaded, downloaded int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	uploaded, downloaded = s.uploaded, s.downloaded
+	for _, peer := range(s.peers) {
+		uploaded += peer.size_down
+		downloaded += peer.size_up
+	}
+	return
+}
+
+// Restore the totals saved in the resume data
+
+func (s *stats) SetGlobalStats(uploaded, downloaded int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.uploaded, s.downloaded = uploaded, downloaded
+}
+
+func NewStats(left, size int64, bitfield *bit_field.Bitfield, pieceLength int64) (st Stats) {
+	s := new(stats)
+	s.mutex = new(sync.Mutex)
+	s.size = size
+	s.peers = make(map[string] *PeerStat)
+	s.bitfield = bitfield
+	s.pieceLength = pieceLength
+	s.quit = make(chan bool)
+	go s.run()
+	st = s
+	return
+}
+
+func (s *stats) update(addr string, uploaded, downloaded int64) {
+	if _, ok := s.peers[addr]; !ok {
+		s.peers[addr] = new(PeerStat)
+	}
+	s.peers[addr].size_up += uploaded
+	s.peers[addr].size_down += downloaded
+}
+
+// The bytes of the current second of a disconnected peer still count
+// in the totals
+
+func (s *stats) remove(addr string) {
+	if peer, ok := s.peers[addr]; ok {
+		s.downloaded += peer.size_up
+		s.uploaded += peer.size_down
+		delete(s.peers, addr)
+	}
+}
+
+func ewma(rate float64, sample int64) float64 {
+	return rate + ALPHA*(float64(sample) - rate)
+}
+
+// Percentage of the torrent downloaded
+
+func Progress(left, size int64) float64 {
+	if size <= 0 {
+		return 0
+	}
+	return float64(size - left)*100/float64(size)
+}
+
+// Seconds to download left bytes at speed, -1 if it's not downloading
+
+func Eta(left, speed int64) int64 {
+	if left == 0 {
+		return 0
+	}
+	if speed <= 0 {
+		return -1
+	}
+	return (left + speed - 1)/speed
+}
+
+func (s *stats) round() {
+	total_up := int64(0)
+	total_down := int64(0)
+	for _, peer := range(s.peers) {
+		// Update global size
+		total_up += peer.size_up
+		total_down += peer.size_down
+		// Update peer uploading/downloading speeds
+		peer.rate_up = ewma(peer.rate_up, peer.size_up)
+		peer.rate_down = ewma(peer.rate_down, peer.size_down)
+		// Reset counters
+		peer.size_up = 0
+		peer.size_down = 0
+	}
+	s.downloaded += total_up
+	s.uploaded += total_down
+	s.rate_up = ewma(s.rate_up, total_up)
+	s.rate_down = ewma(s.rate_down, total_down)
+	var ratio float64
+	if s.uploaded == 0 {
+		ratio = 0
+	} else if s.downloaded == 0 {
+		if s.bitfield.Completed() {
+			ratio = float64(s.uploaded)/float64(s.size)
+		}
+	} else {
+		ratio = float64(s.uploaded)/float64(s.downloaded)
+	}
+	total_up = int64(s.rate_up)
+	total_down = int64(s.rate_down)
+	statsLog.Debug("Speed", "down_kbps", total_up/1000, "up_kbps", total_down/1000, "left_mb", (s.bitfield.Len() - s.bitfield.Count())*s.pieceLength/1000000,
+		"downloaded_mb", s.downloaded/1000000, "uploaded_mb", s.uploaded/1000000, "ratio", fmt.Sprintf("%4.2f", ratio))
+}
+
+func (s *stats) Stop() {
+	close(s.quit)
+}
+
+func (s *stats) run() {
+	round := time.NewTicker(time.Second)
+	for {
+		select {
+			case <- s.quit:
+				round.Stop()
+				return
+			case <- round.C:
+				s.mutex.Lock()
+				s.round()
+				s.mutex.Unlock()
+		}
+	}
+}
@@ -1,107 +1,354 @@
-// Test functions
+// Command line client, a thin layer over the wgo library
 // Roger Pau Monné - 2010
 // Distributed under the terms of the GNU GPLv3
 
 package main
 
 import(
-	"log"
+	"fmt"
 	"flag"
 	"time"
 	"runtime"
-	"wgo/limiter"
+	"wgo/wgo"
+	"wgo/rpc"
+	"wgo/events"
 	"wgo/files"
-	"wgo/stats"
-	"wgo/peers"
-	"wgo/choke"
-	"wgo/listener"
-	"wgo/tracker"
+	"wgo/logger"
 	"strconv"
+	"strings"
+	"path"
+	"encoding/hex"
 	"os"
-	"rand"
-	"http"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"errors"
 	)
 	
-import _ "http/pprof"
+import _ "net/http/pprof"
 
-var torrent *string = flag.String("torrent", "", "url or path to a torrent file")
+var mainLog = logger.New("main")
+
+var config_file *string = flag.String("config", "", "Config file, re-read when receiving SIGHUP (the flags take precedence)")
+var torrent *string = flag.String("torrent", "", "url, path to a torrent file or magnet link")
 var folder *string = flag.String("folder", ".", "local folder to save the download")
 var ip *string = flag.String("ip", "", "local address to listen to")
 var listen_port *string = flag.String("port", "0", "local port to listen to")
 var procs *int = flag.Int("procs", 1, "number of processes")
 var up_limit *int = flag.Int("up_limit", 0, "Upload limit in KB/s")
 var down_limit *int = flag.Int("down_limit", 0, "Download limit in KB/s")
+var sequential *bool = flag.Bool("sequential", false, "Download pieces in file order (for streaming)")
+var encryption *string = flag.String("encryption", "prefer", "Encryption of the peer connections: prefer, require or disable")
+var local_discovery *bool = flag.Bool("lsd", true, "Find peers in the local network (Local Peer Discovery)")
+var use_utp *bool = flag.Bool("utp", true, "Connect to the peers with uTP, falling back to TCP")
+var port_mapping *bool = flag.Bool("nat", true, "Map the listening port in the gateway (UPnP, PCP or NAT-PMP)")
+var skip_files *string = flag.String("skip", "", "Comma separated list of files (by index) not to download")
+var high_files *string = flag.String("high", "", "Comma separated list of files (by index) to download first")
+var add_peers *string = flag.String("peers", "", "Comma separated peers (ip:port) to connect to, added to every torrent")
+var rpc_addr *string = flag.String("rpc", "", "Address (ip:port) of the HTTP control API, disabled if empty")
+var rpc_token *string = flag.String("rpc_token", "", "Token needed by every request to the control API")
+var log_levels *string = flag.String("log", "info", "Log level (debug, info, warn or error), for every subsystem or some of them: info,peer=debug,tracker=warn")
+// Options of wgo create
+var announce *string = flag.String("announce", "", "create: comma separated trackers, each one in its own tier")
+var comment *string = flag.String("comment", "", "create: comment of the torrent")
+var private *bool = flag.Bool("private", false, "create: private torrent, peers only from the trackers")
+var piece_length *int = flag.Int("piece_length", 0, "create: piece length in KB, picked from the size if 0")
+var web_seeds *string = flag.String("web_seeds", "", "create: comma separated urls of web seeds")
+var output *string = flag.String("output", "", "create: torrent file to write, name.torrent if empty")
 var pprof_port *int = flag.Int("pprof_port", 0, "Pprof port to listen for connections (debug only)")
 
 func prof(port int) {
 	err := http.ListenAndServe(":" + strconv.Itoa(port), nil)
 	if err != nil {
-		panic("Pprof ListenAndServe: " + err.String())
+		panic("Pprof ListenAndServe: " + err.Error())
 	}
 }
 
-func main() {
-	flag.Parse()
-	if *pprof_port > 0 {
-		go prof(*pprof_port)
-		log.Println("Pprof listening at port:", *pprof_port)
+// Build the configuration from the config file (if any) and the
+// flags given in the command line
+
+func loadConfig() (config *wgo.Config, err error) {
+	config = wgo.DefaultConfig()
+	if len(*config_file) > 0 {
+		if err = wgo.LoadConfig(*config_file, config); err != nil {
+			return
+		}
 	}
-	runtime.GOMAXPROCS(*procs)
-	peerId := (CLIENT_ID + "-" + strconv.Itoa(os.Getpid()) + strconv.Itoa64(rand.Int63()))[0:20]
-	log.Println("Peer ID:", peerId)
-	// Load torrent file
-	torr, err := NewTorrent(*torrent)
-	if err != nil {
-		log.Println("Error parsing torrent metainfo:", err)
-		return
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil && wgo.IsOption(f.Name) {
+			err = config.Set(f.Name, f.Value.String())
+		}
+	})
+	return
+}
+
+// Stop the session when interrupted, which saves the resume data,
+// sends the stopped event to the trackers and removes the port
+// mapping from the gateway. SIGHUP reloads the config file, and
+// SIGUSR1 announces every torrent to all its trackers.
+
+func signals(session *wgo.Session) {
+	closing := false
+	incoming := make(chan os.Signal, 1)
+	signal.Notify(incoming, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range(incoming) {
+		switch sig {
+			case syscall.SIGINT, syscall.SIGTERM:
+				if closing {
+					mainLog.Warn("Exiting without waiting for the shutdown")
+					os.Exit(1)
+				}
+				closing = true
+				mainLog.Info("Shutting down, interrupt again to exit at once")
+				go func() {
+					session.Close()
+					totals := session.Totals()
+					mainLog.Info("Session totals", "uploaded_mb", totals.Uploaded/1000000, "downloaded_mb", totals.Downloaded/1000000,
+						"ratio", fmt.Sprintf("%.2f", totals.Ratio), "active", totals.Active)
+					os.Exit(0)
+				}()
+			case syscall.SIGUSR1:
+				for _, t := range(session.Torrents()) {
+					if err := t.Reannounce(); err != nil {
+						mainLog.Warn("Error announcing", "name", t.Name(), "err", err)
+					}
+				}
+			case syscall.SIGHUP:
+				config, err := loadConfig()
+				if err == nil {
+					err = session.Reload(config)
+				}
+				if err != nil {
+					mainLog.Error("Error reloading the configuration", "err", err)
+				} else {
+					mainLog.Info("Configuration reloaded")
+				}
+		}
+	}
+}
+
+// Log the events of the session, the progress is logged apart
+
+func printEvents(c <-chan events.Event) {
+	for e := range(c) {
+		switch e.Type {
+			case events.TORRENT_ADDED:
+				mainLog.Info("Torrent added", "name", e.Name, "infohash", hex.EncodeToString([]byte(e.Infohash)))
+			case events.TORRENT_FINISHED:
+				mainLog.Info("Torrent finished", "name", e.Name)
+			case events.PIECE_FAILED:
+				mainLog.Warn("Piece failed the hash check", "name", e.Name, "index", e.Piece)
+			case events.TRACKER_ERROR:
+				mainLog.Warn("Tracker error", "name", e.Name, "url", e.Addr, "err", e.Error)
+			case events.PIECE_COMPLETED, events.PEER_CONNECTED:
+				mainLog.Debug(e.TypeName(), "name", e.Name, "index", e.Piece, "addr", e.Addr)
+		}
 	}
-	// Create File Store
-	fs, size, err := files.NewFiles(&torr.Info, *folder)
-	if err != nil || size <= 0 {
-		log.Println("Error parsing files:", err)
+}
+
+// Set the priority of a comma separated list of file indexes
+
+func setPriorities(t *wgo.Torrent, list string, priority int) (err error) {
+	if len(list) == 0 {
 		return
 	}
-	log.Println("Files -> Total size:", size)
-	left, bitfield, err := fs.CheckPieces()
+	for _, index := range(strings.Split(list, ",")) {
+		file, err := strconv.Atoi(strings.TrimSpace(index))
+		if err != nil {
+			return err
+		}
+		if err = t.SetPriority(file, priority); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// Seconds as hours, minutes and seconds
+
+func eta(seconds int64) string {
+	if seconds < 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, (seconds/60)%60, seconds%60)
+}
+
+// Comma separated list, without the empty items
+
+func split(list string) (items []string) {
+	for _, item := range(strings.Split(list, ",")) {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// wgo [options] create path: write a torrent of the file or folder
+
+func create(args []string) (err error) {
+	if len(args) != 1 {
+		return errors.New("Usage: wgo [-announce=url,...] [-comment=...] [-private] [-piece_length=KB] [-web_seeds=url,...] [-output=file] create path")
+	}
+	opt := &wgo.CreateOptions{Comment: *comment, Private: *private, PieceLength: int64(*piece_length)*1024, WebSeeds: split(*web_seeds), Threads: *procs}
+	for _, tracker := range(split(*announce)) {
+		opt.Announce = append(opt.Announce, []string{tracker})
+	}
+	name := *output
+	if len(name) == 0 {
+		_, base := path.Split(path.Clean(args[0]))
+		name = base + ".torrent"
+	}
+	f, err := os.Create(name)
 	if err != nil {
-		log.Println("Error checking pieces:",err)
 		return
 	}
-	// BW Limiter
-	limiter, err := limiter.NewLimiter(*up_limit, *down_limit)
+	infohash, err := wgo.CreateTorrent(args[0], opt, f)
+	f.Close()
 	if err != nil {
+		os.Remove(name)
 		return
 	}
-	// Perform test of the tracker request
-	// Initilize Stats
-	s := stats.NewStats(left, size, bitfield, torr.Info.Piece_length)
-	//go s.Run()
-	// Initialize peerMgr
-	lastPieceLength := size % torr.Info.Piece_length
-	peerMgr, err := peers.NewPeerMgr(int64(bitfield.Len()), peerId, torr.Infohash, bitfield, s, fs, limiter, lastPieceLength)
+	mainLog.Info("Torrent created", "file", name, "infohash", hex.EncodeToString([]byte(infohash)))
+	return
+}
+
+// wgo info file.torrent: print the metainfo of a torrent, without
+// downloading it
+
+func info(args []string) (err error) {
+	if len(args) != 1 {
+		return errors.New("Usage: wgo info file.torrent")
+	}
+	m, err := wgo.NewMetaInfo(args[0])
 	if err != nil {
-		log.Println("Error creating peer manager:", err)
 		return
 	}
-	if _, *listen_port, err = listener.NewListener(*ip, *listen_port, peerMgr); err != nil {
-		log.Println("Error creating listener:", err)
+	fmt.Printf("Name: %s\n", m.Info.Name)
+	fmt.Printf("Infohash: %s\n", hex.EncodeToString([]byte(m.Infohash)))
+	if len(m.InfohashV2) > 0 {
+		fmt.Printf("Infohash v2: %s\n", hex.EncodeToString([]byte(m.InfohashV2)))
+	}
+	size, total := m.Info.Length, m.Info.Length
+	for _, f := range(m.Info.Files) {
+		if strings.Index(f.Attr, "p") < 0 {
+			size += f.Length
+		}
+		total += f.Length
+	}
+	fmt.Printf("Size: %d\n", size)
+	if m.Info.Piece_length > 0 {
+		fmt.Printf("Pieces: %d of %d bytes\n", (total + m.Info.Piece_length - 1)/m.Info.Piece_length, m.Info.Piece_length)
+	}
+	fmt.Printf("Private: %v\n", m.Info.Private == 1)
+	if m.CreationDate > 0 {
+		fmt.Printf("Created: %s\n", time.Unix(m.CreationDate, 0).UTC().Format(time.RFC3339))
+	}
+	if len(m.CreatedBy) > 0 {
+		fmt.Printf("Created by: %s\n", m.CreatedBy)
+	}
+	if len(m.Comment) > 0 {
+		fmt.Printf("Comment: %s\n", m.Comment)
+	}
+	for i, tier := range(m.Announce_list) {
+		fmt.Printf("Tier %d: %s\n", i, strings.Join(tier, " "))
+	}
+	for _, url := range(m.Url_list) {
+		fmt.Printf("Web seed: %s\n", url)
+	}
+	if len(m.Info.Files) == 0 {
+		fmt.Printf("File 0: %s (%d)\n", m.Info.Name, m.Info.Length)
+	}
+	for i, f := range(m.Info.Files) {
+		if strings.Index(f.Attr, "p") >= 0 {
+			// Padding
+			continue
+		}
+		fmt.Printf("File %d: %s (%d)\n", i, path.Join(append([]string{m.Info.Name}, f.Path...)...), f.Length)
+	}
+	return
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() > 0 && flag.Arg(0) == "create" {
+		runtime.GOMAXPROCS(*procs)
+		if err := create(flag.Args()[1:]); err != nil {
+			mainLog.Error("Error creating the torrent", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "info" {
+		if err := info(flag.Args()[1:]); err != nil {
+			mainLog.Error("Error reading the torrent", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *pprof_port > 0 {
+		go prof(*pprof_port)
+		mainLog.Info("Pprof listening", "port", *pprof_port)
+	}
+	runtime.GOMAXPROCS(*procs)
+	config, err := loadConfig()
+	if err != nil {
+		mainLog.Error("Error reading the configuration", "err", err)
 		return
 	}
-	//go peerMgr.Run()
-	// Initialize ChokeMgr
-	choke.NewChokeMgr(s, peerMgr)
-	// Initialize pieceMgr
-	pieceMgr, err := peers.NewPieceMgr(peerMgr, s, fs, bitfield, torr.Info.Piece_length, lastPieceLength, bitfield.Len(), size)
+	session, err := wgo.NewSession(config)
 	if err != nil {
-		log.Println("Error creating piece manager:", err)
+		mainLog.Error("Error creating the session", "err", err)
 		return
 	}
-	peerMgr.SetPieceMgr(pieceMgr)
-	tracker.NewTrackerMgr(torr.Announce_list, torr.Infohash, *listen_port, peerMgr, left, bitfield, torr.Info.Piece_length, peerId, s)
+	go signals(session)
+	// Subscribed before adding the torrents, to log them
+	go printEvents(session.Subscribe())
+	if len(*rpc_addr) > 0 {
+		if _, err = rpc.NewServer(session, *rpc_addr, *rpc_token); err != nil {
+			mainLog.Error("Error starting the control API", "err", err)
+		}
+	}
+	// Other torrents can be given as arguments, the file options
+	// only apply to the -torrent one
+	list := flag.Args()
+	if len(*torrent) > 0 {
+		list = append([]string{*torrent}, list...)
+	}
+	for i, uri := range(list) {
+		t, err := session.AddTorrent(uri)
+		if err != nil {
+			mainLog.Error("Error adding torrent", "uri", uri, "err", err)
+			continue
+		}
+		t.SetSequential(*sequential)
+		if i == 0 && len(*torrent) > 0 {
+			if err = setPriorities(t, *skip_files, files.PRIORITY_SKIP); err != nil {
+				mainLog.Error("Error setting the skipped files", "err", err)
+			}
+			if err = setPriorities(t, *high_files, files.PRIORITY_HIGH); err != nil {
+				mainLog.Error("Error setting the high priority files", "err", err)
+			}
+		}
+		if err = t.Start(); err != nil {
+			mainLog.Error("Error starting torrent", "name", t.Name(), "err", err)
+			continue
+		}
+		if len(*add_peers) == 0 {
+			continue
+		}
+		for _, addr := range(strings.Split(*add_peers, ",")) {
+			if err = t.AddPeer(strings.TrimSpace(addr)); err != nil {
+				mainLog.Error("Error adding peer", "addr", addr, "err", err)
+			}
+		}
+	}
 	for {
-		log.Println("Active Peers:", peerMgr.ActivePeers(), "Incoming Peers:", peerMgr.IncomingPeers(), "Unused Peers:", peerMgr.UnusedPeers())
-		log.Println("Done:", (bitfield.Count()*100)/bitfield.Len(), "%")
-		//log.Println("Bitfield:", bitfield.Bytes())
-		time.Sleep(30*NS_PER_S)
+		for _, t := range(session.Torrents()) {
+			st := t.Stats()
+			mainLog.Info("Progress", "name", t.Name(), "done", fmt.Sprintf("%.1f", st.Progress), "down_kbps", st.DownSpeed/1000, "up_kbps", st.UpSpeed/1000,
+				"eta", eta(st.Eta), "active", st.ActivePeers, "incoming", st.IncomingPeers, "unused", st.UnusedPeers, "availability", fmt.Sprintf("%.2f", st.Availability))
+		}
+		time.Sleep(30*time.Second)
 	}
 }
@@ -0,0 +1,69 @@
+// Parameters of the announces, the ones of the config and the ones
+// of each request, and the query string of the HTTP announces
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package tracker
+
+import(
+	"fmt"
+	"strconv"
+	"net/url"
+	"wgo/events"
+	)
+
+// Announce settings of a torrent
+
+type Params struct {
+	Port string // Reported port, the listening one or its mapping in the gateway
+	Ip string // Reported address, empty to let the tracker use the one of the connection
+	NumWant int // Peers asked for in each announce at most, 0 for as many as we need
+	NoPeerId bool // Ask the trackers to leave the peer ids out of the peer list
+	ExternalIp func(ip string) // Called with our address seen by the trackers, can be nil
+	Events *events.Emitter // Told about the failed announces, can be nil
+}
+
+// Peers to ask for when we need num_peers
+
+func (p *Params) numWant(num_peers int) int {
+	if p.NumWant > 0 && num_peers > p.NumWant {
+		return p.NumWant
+	}
+	return num_peers
+}
+
+// Values of an announce
+
+type announceRequest struct {
+	infohash, peerId, event, trackerId string
+	uploaded, downloaded, left int64
+	numWant int
+	key uint32
+	params *Params
+}
+
+func (r *announceRequest) query() string {
+	q := fmt.Sprint("info_hash=", url.QueryEscape(r.infohash),
+		"&peer_id=", url.QueryEscape(r.peerId),
+		"&port=", url.QueryEscape(r.params.Port),
+		"&uploaded=", strconv.FormatInt(r.uploaded, 10),
+		"&downloaded=", strconv.FormatInt(r.downloaded, 10),
+		"&left=", strconv.FormatInt(r.left, 10),
+		"&numwant=", strconv.Itoa(r.numWant),
+		"&key=", fmt.Sprintf("%08x", r.key),
+		"&compact=1")
+	if len(r.event) > 0 {
+		q += "&event=" + url.QueryEscape(r.event)
+	}
+	if r.params.NoPeerId {
+		q += "&no_peer_id=1"
+	}
+	if len(r.params.Ip) > 0 {
+		q += "&ip=" + url.QueryEscape(r.params.Ip)
+	}
+	if len(r.trackerId) > 0 {
+		// Echo the tracker id of the previous answer
+		q += "&trackerid=" + url.QueryEscape(r.trackerId)
+	}
+	return q
+}
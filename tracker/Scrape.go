@@ -0,0 +1,89 @@
+// Tracker scrape, obtain the number of seeders, leechers and
+// completed downloads without announcing
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package tracker
+
+import(
+	"net/http"
+	"net/url"
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+	"wgo/bencode"
+	"errors"
+	)
+
+// Counts obtained from a scrape
+
+type ScrapeResult struct {
+	Seeders, Completed, Leechers int64
+}
+
+// Url of the scrape, obtained replacing the last "announce" in
+// the path of the announce url. Only works if the last component
+// of the path starts with "announce".
+
+func scrapeUrl(url string) (scrape string, err error) {
+	slash := strings.LastIndex(url, "/")
+	if slash < 0 || !strings.HasPrefix(url[slash+1:], "announce") {
+		return scrape, errors.New("Tracker doesn't support scrape")
+	}
+	return url[0:slash+1] + "scrape" + url[slash+1+len("announce"):], nil
+}
+
+func (t *Tracker) Scrape() (result *ScrapeResult, err error) {
+	t.deadline = time.Now().Add(ANNOUNCE_TIMEOUT*time.Second)
+	if strings.HasPrefix(t.url, "udp://") {
+		result = new(ScrapeResult)
+		result.Seeders, result.Completed, result.Leechers, err = t.scrapeUdp()
+		return
+	}
+	return t.scrapeHttp()
+}
+
+func (t *Tracker) scrapeHttp() (result *ScrapeResult, err error) {
+	scrape, err := scrapeUrl(t.url)
+	if err != nil {
+		return
+	}
+	if strings.Index(scrape, "?") >= 0 {
+		scrape += "&"
+	} else {
+		scrape += "?"
+	}
+	scrape += "info_hash=" + url.QueryEscape(t.infohash)
+	status, body, err := get(scrape, t.deadline)
+	if err != nil {
+		return
+	}
+	if status != http.StatusOK {
+		return result, errors.New("Bad scrape request " + strconv.Itoa(status))
+	}
+	data, err := bencode.Decode(bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return result, errors.New("Invalid scrape response")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return result, errors.New("Tracker error: " + reason)
+	}
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return result, errors.New("Invalid scrape response")
+	}
+	file, ok := files[t.infohash].(map[string]interface{})
+	if !ok {
+		return result, errors.New("Torrent not found in scrape response")
+	}
+	result = new(ScrapeResult)
+	result.Seeders, _ = file["complete"].(int64)
+	result.Completed, _ = file["downloaded"].(int64)
+	result.Leechers, _ = file["incomplete"].(int64)
+	return
+}
@@ -0,0 +1,358 @@
+// Communication with the tracker.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package tracker
+
+import(
+	"net/http"
+	"strconv"
+	"fmt"
+	"io/ioutil"
+	"container/list"
+	"strings"
+	"net"
+	"bytes"
+	"wgo/bencode"
+	"wgo/bit_field"
+	"wgo/events"
+	"encoding/binary"
+	"wgo/logger"
+	"wgo/proxy"
+	"time"
+	"errors"
+	)
+	
+const(
+	TRACKER_ERR_INTERVAL = 60
+	DEFAULT_TRACKER_INTERVAL = 1200
+	DEFAULT_MIN_INTERVAL = 300 // If the tracker doesn't send the min interval
+	ACTIVE_PEERS = 45
+	UNUSED_PEERS = 200
+	ANNOUNCE_TIMEOUT = 30 // Seconds an announce or a scrape can take, with the UDP retransmissions
+	STOPPED_TIMEOUT = 5 // Seconds to wait for the stopped announces
+	STOPPED_ANNOUNCE_TIMEOUT = 4 // Seconds the stopped announce of a tracker can take, less than STOPPED_TIMEOUT
+	COMPLETED_CHECK = 5 // Seconds between checks of the end of the download
+	IDLE_INTERVAL = 140 // Percent of the interval between the announces of a seeder without leechers, trackers drop the peers after 150%
+)
+
+var trackerLog = logger.New("tracker")
+
+// 1 channel to send new peers to peerMgr
+// 1 channel to comunicate with the status goroutine
+// 1 channel to receive the number of peers to ask for
+// 1 channel to receive stats
+
+type Tracker struct {
+	// Chanels
+	trackerMgr *TrackerMgr
+	//inStatus		<- chan statusMsg
+	// Internal data for tracker requests
+	infohash, peerId, url, trackerId string
+	infohashV2 string // Also announced for the hybrid torrents
+	interval, min_interval int64
+	// Updated from the Status module
+	uploaded, downloaded int64
+	completed bool
+	announced bool // The tracker knows we are in the swarm
+	announces, failures int64 // Results of the announces
+	lastError, warning string // Of the last announce
+	errors int64 // Failures in a row
+	backoff int64 // Seconds to wait after the last failure
+	lastAnnounce, retryAt int64 // Of the last success, and the next try after a failure
+	status string
+	// Bitfield
+	bitfield *bit_field.Bitfield
+	pieceLength int64
+	udp *udpTracker // Connection with UDP trackers
+	deadline time.Time // Of the announce or scrape being sent, for all its requests
+}
+
+// Struct to send data to the PeerMgr goroutine
+
+/*type peersList struct {
+	peers *list.List;
+}*/
+
+// Struct to send data to the Status goroutine
+
+type trackerStatusMsg struct {
+	FailureReason, WarningMessage, TrackerId string
+	Complete, Incomplete, Interval int
+}
+
+func NewTracker(url, infohash, infohashV2 string, tm *TrackerMgr, left int64, bf *bit_field.Bitfield, pieceLength int64, peerId string) (t *Tracker) {
+	t = &Tracker{url: url, 
+		infohash: infohash, 
+		infohashV2: infohashV2, 
+		status: "started", 
+		peerId: peerId, 
+		trackerMgr: tm,
+		bitfield: bf,
+		pieceLength: pieceLength}
+	if t.bitfield.Completed() {
+		t.completed = true
+	}
+	return
+}
+
+// Seconds to wait before the next announce
+
+func (t *Tracker) Interval() int64 {
+	if t.interval > 0 {
+		return t.interval
+	}
+	return DEFAULT_TRACKER_INTERVAL
+}
+
+// Seconds to wait at least before announcing again, even when we
+// need more peers
+
+func (t *Tracker) MinInterval() int64 {
+	min := t.min_interval
+	if min <= 0 {
+		min = DEFAULT_MIN_INTERVAL
+	}
+	if interval := t.Interval(); min > interval {
+		min = interval
+	}
+	return min
+}
+
+// Wait before trying again, doubling the wait after each failure in a
+// row up to the announce interval
+
+func (t *Tracker) failed(err error) {
+	t.failures++
+	t.errors++
+	t.lastError = err.Error()
+	if t.backoff == 0 {
+		t.backoff = TRACKER_ERR_INTERVAL
+	} else {
+		t.backoff *= 2
+	}
+	if interval := t.Interval(); t.backoff > interval {
+		t.backoff = interval
+	}
+	t.retryAt = time.Now().Unix() + t.backoff
+	t.trackerMgr.params.Events.Emit(events.Event{Type: events.TRACKER_ERROR, Addr: t.url, Error: t.lastError})
+}
+
+func (t *Tracker) succeeded() {
+	t.errors, t.backoff, t.retryAt = 0, 0, 0
+	t.lastError = ""
+	t.lastAnnounce = time.Now().Unix()
+}
+
+func (t *Tracker) Url() string {
+	return t.url
+}
+
+func (t *Tracker) left() int64 {
+	return t.trackerMgr.Left()
+}
+
+func (t *Tracker) Request(num_peers int) (err error) {
+	// Prepare request to make to the tracker
+	t.uploaded, t.downloaded = t.trackerMgr.Stats()
+	t.deadline = time.Now().Add(ANNOUNCE_TIMEOUT*time.Second)
+	// The started event goes in the first announce to each tracker,
+	// and the completed one only to the trackers that saw us downloading
+	left := t.left()
+	if len(t.status) == 0 && !t.completed && left == 0 {
+		t.status = "completed"
+	}
+	peers, err := t.announce(t.infohash, num_peers, left)
+	if err != nil {
+		return
+	}
+	if len(t.infohashV2) > 0 {
+		// The v2 swarm of a hybrid torrent
+		if more, err := t.announce(t.infohashV2, num_peers, left); err != nil {
+			trackerLog.Info("Error announcing the v2 infohash", "url", t.url, "err", err)
+		} else {
+			peers.PushBackList(more)
+		}
+	}
+	trackerLog.Debug("Peers received", "url", t.url, "peers", peers.Len())
+	// Send the new data to the PeerMgr process
+	t.trackerMgr.SavePeers(peers)
+	if left == 0 {
+		t.completed = true
+	}
+	t.status = ""
+	t.announced = true
+	return
+}
+
+// Tell the tracker we are leaving the swarm, if we announced to it
+
+func (t *Tracker) Stopped(uploaded, downloaded int64) (err error) {
+	if !t.announced {
+		return
+	}
+	t.status = "stopped"
+	t.uploaded, t.downloaded = uploaded, downloaded
+	// Sent before TrackerMgr.Stop gives up, never after a new start
+	t.deadline = time.Now().Add(STOPPED_ANNOUNCE_TIMEOUT*time.Second)
+	_, err = t.announce(t.infohash, 0, t.left())
+	if len(t.infohashV2) > 0 {
+		if _, e := t.announce(t.infohashV2, 0, t.left()); e != nil && err == nil {
+			err = e
+		}
+	}
+	t.announced = false
+	return
+}
+
+func (t *Tracker) announce(infohash string, num_peers int, left int64) (peers *list.List, err error) {
+	r := &announceRequest{infohash: infohash,
+		peerId: t.peerId,
+		event: t.status,
+		trackerId: t.trackerId,
+		uploaded: t.uploaded,
+		downloaded: t.downloaded,
+		left: left,
+		numWant: num_peers,
+		key: t.trackerMgr.key,
+		params: &t.trackerMgr.params}
+	if strings.HasPrefix(t.url, "udp://") {
+		return t.announceUdp(r)
+	}
+	return t.announceHttp(r)
+}
+
+func (t *Tracker) announceHttp(r *announceRequest) (peers *list.List, err error) {
+	url := t.url + "?" + r.query()
+	if strings.Index(t.url, "?") >= 0 {
+		url = t.url + "&" + r.query()
+	}
+	status, data, err := get(url, t.deadline)
+	if err != nil { return }
+	
+	// Check if request was succesful
+	if status != http.StatusOK {
+		reason := "Bad Request " + string(data)
+		err = errors.New(reason)
+		return
+	}
+	
+	// Create new TrackerResponse and decode the data
+	var tr bencode.TrackerResponse
+	err = bencode.Unmarshal(bytes.NewBuffer(data), &tr)
+	if err != nil {
+		return
+	}
+	if len(tr.FailureReason) > 0 {
+		return nil, errors.New("Tracker error: " + tr.FailureReason)
+	}
+	if len(tr.WarningMessage) > 0 {
+		trackerLog.Warn("Tracker warning", "url", t.url, "warning", tr.WarningMessage)
+	}
+	// Read by AnnounceStats and the backoff
+	t.trackerMgr.mutex.Lock()
+	t.warning = tr.WarningMessage
+	t.interval = tr.Interval
+	t.min_interval = tr.Min_interval
+	if len(tr.Tracker_id) > 0 {
+		t.trackerId = tr.Tracker_id
+	}
+	t.trackerMgr.mutex.Unlock()
+	// Obtain new peers list
+	peers = parsePeers(tr.Peers)
+	if len(tr.Peers) == 0 {
+		// Some trackers ignore compact=1
+		peers = parsePeerDicts(data)
+	}
+	peers.PushBackList(parsePeers6(tr.Peers6))
+	if len(tr.External_ip) == net.IPv4len || len(tr.External_ip) == net.IPv6len {
+		if r.params.ExternalIp != nil {
+			r.params.ExternalIp(net.IP(tr.External_ip).String())
+		}
+	}
+	return peers, nil
+}
+
+// Status and body of an HTTP request, failing if the tracker doesn't
+// answer before the deadline
+
+func get(url string, deadline time.Time) (status int, data []byte, err error) {
+	type result struct {
+		status int
+		data []byte
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		response, err := proxy.Get(url)
+		if err != nil {
+			c <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		data, err := ioutil.ReadAll(response.Body)
+		c <- result{response.StatusCode, data, err}
+	}()
+	select {
+		case r := <- c:
+			return r.status, r.data, r.err
+		case <- time.After(time.Until(deadline)):
+	}
+	return 0, nil, errors.New("Timeout waiting for the tracker")
+}
+
+// Convert the compact peer list (6 bytes per peer) to addresses
+
+func parsePeers(compact string) (peers *list.List) {
+	peers = list.New()
+	for i := 0; i+6 <= len(compact); i = i+6 {
+		peers.PushFront(fmt.Sprintf("%d.%d.%d.%d:%d", compact[i+0], compact[i+1], compact[i+2], compact[i+3], binary.BigEndian.Uint16([]byte(compact[i+4:i+6]))))
+	}
+	return
+}
+
+// Convert the compact IPv6 peer list (18 bytes per peer) to addresses
+
+func parsePeers6(compact string) (peers *list.List) {
+	peers = list.New()
+	for i := 0; i+18 <= len(compact); i = i+18 {
+		ip := net.IP([]byte(compact[i:i+16]))
+		peers.PushFront(fmt.Sprintf("[%s]:%d", ip.String(), binary.BigEndian.Uint16([]byte(compact[i+16:i+18]))))
+	}
+	return
+}
+
+// Peers of the dictionary model, a list of dictionaries with the
+// ip and port of each peer
+
+func parsePeerDicts(data []byte) (peers *list.List) {
+	peers = list.New()
+	m, err := bencode.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+	top, ok := m.(map[string]interface{})
+	if !ok {
+		return
+	}
+	dicts, ok := top["peers"].([]interface{})
+	if !ok {
+		return
+	}
+	for _, d := range(dicts) {
+		peer, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ip, ok := peer["ip"].(string)
+		port, ok2 := peer["port"].(int64)
+		if !ok || !ok2 || port <= 0 || port > 65535 {
+			continue
+		}
+		if strings.Index(ip, ":") >= 0 {
+			ip = "[" + ip + "]"
+		}
+		peers.PushFront(ip + ":" + strconv.FormatInt(port, 10))
+	}
+	return
+}
@@ -0,0 +1,443 @@
+// Communication with the tracker.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package tracker
+
+import(
+	"math/rand"
+	"time"
+	"strings"
+	"sync"
+	"wgo/bit_field"
+	"wgo/stats"
+	"container/list"
+	"wgo/peers"
+	"errors"
+	)
+
+// Receives the peers obtained from the trackers, implemented
+// by the PeerMgr and by the MetadataMgr
+
+type PeerMgr interface {
+	RequestPeers() int
+	AddPeers(peers *list.List, source string)
+}
+
+
+// Results of the announces to a tracker
+
+type AnnounceStats struct {
+	Url string
+	Announces, Failures int64
+	Errors int64 // Failures in a row, 0 if the tracker is working
+	LastError, Warning string
+	LastAnnounce, NextRetry int64 // Seconds since the epoch
+}
+
+type TrackerMgr struct {
+	mutex *sync.Mutex // Protects the tiers against AnnounceStats
+	// Chanels
+	tiers [][]*Tracker // Trackers of each tier, the working ones first
+	//outPeerMgr chan <- *list.List
+	peerMgr PeerMgr
+	// outStatus chan <- *Status
+	stats stats.Stats
+	//stats stats.Stats
+	//inStatus		<- chan statusMsg
+	// Internal data for tracker requests
+	infohash, peerId, url, trackerId string
+	params Params
+	interval, min_interval int64 // Of the last tracker that answered
+	lastAnnounce int64
+	key uint32 // Sent to every tracker, identifies us if our IP changes
+	// Updated from the Status module
+	uploaded, downloaded, left int64
+	completed bool
+	status string
+	num_peers int
+	// Bitfield
+	bitfield *bit_field.Bitfield
+	pieceLength, lastPieceLength int64
+	announced bool // An announce succeeded, the trackers know we are in the swarm
+	baseUploaded, baseDownloaded int64 // Of the previous runs, not reported
+	reannounce chan bool // Announce to every tracker now
+	gaveUp bool // Stop didn't wait for the stopped announces, they aren't sent any more
+	quit chan bool
+	done chan bool // Closed once the stopped announces are sent
+}
+
+func (t *TrackerMgr) RequestPeers() int {
+	return t.peerMgr.RequestPeers()
+}
+
+// Bytes uploaded and downloaded since the started event
+
+func (t *TrackerMgr) Stats() (int64, int64) {
+	if t.stats == nil {
+		// No stats while downloading the metadata
+		return 0, 0
+	}
+	uploaded, downloaded := t.stats.GetGlobalStats()
+	return uploaded - t.baseUploaded, downloaded - t.baseDownloaded
+}
+
+// Stop announcing to the trackers, and wait (STOPPED_TIMEOUT at most)
+// until the trackers are told that we left the swarm
+
+func (t *TrackerMgr) Stop() {
+	close(t.quit)
+	select {
+		case <- t.done:
+		case <- time.After(STOPPED_TIMEOUT*time.Second):
+			// Still announcing, a late stopped could follow the
+			// started of the next run
+			t.mutex.Lock()
+			t.gaveUp = true
+			t.mutex.Unlock()
+			trackerLog.Warn("Timeout sending the stopped announces")
+	}
+}
+
+func (t* TrackerMgr) SavePeers(newPeers *list.List) {
+	t.peerMgr.AddPeers(newPeers, peers.SOURCE_TRACKER)
+}
+
+func NewTrackerMgr(urls [][]string, infohash, infohashV2 string, params Params, peerMgr PeerMgr, left int64, bf *bit_field.Bitfield, pieceLength, lastPieceLength int64, peerId string, s stats.Stats) (t *TrackerMgr) {
+	//sid := CLIENT_ID + "-" + strconv.Itoa(os.Getpid()) + strconv.FormatInt(rand.Int63(), 10)
+	t = new(TrackerMgr)
+	t.mutex = new(sync.Mutex)
+	t.peerId = peerId
+	t.params = params
+	t.key = uint32(rand.Int63())
+	t.tiers = make([][]*Tracker, 0, len(urls))
+	t.reannounce = make(chan bool, 1)
+	t.quit = make(chan bool)
+	t.done = make(chan bool)
+	//t.outPeerMgr = outPeerMgr
+	t.peerMgr = peerMgr
+	t.stats = s
+	t.baseUploaded, t.baseDownloaded = t.Stats()
+	t.num_peers = ACTIVE_PEERS + UNUSED_PEERS
+	t.bitfield = bf
+	t.pieceLength, t.lastPieceLength = pieceLength, lastPieceLength
+	added := make(map[string]bool)
+	for _, tier := range(urls) {
+		trackers := make([]*Tracker, 0, len(tier))
+		// Trackers inside a tier are tried in random order
+		for _, i := range(rand.Perm(len(tier))) {
+			url := tier[i]
+			if _, ok := added[url]; (strings.HasPrefix(url, "http") || strings.HasPrefix(url, "udp://")) && !ok {
+				trackerLog.Debug("Adding tracker", "url", url)
+				added[url] = true
+				trackers = append(trackers, NewTracker(url, infohash, infohashV2, t, left, bf, pieceLength, t.peerId))
+			}
+		}
+		if len(trackers) > 0 {
+			t.tiers = append(t.tiers, trackers)
+		}
+	}
+	go t.Run()
+	return
+}
+
+// Bytes left to download, the last piece can be shorter
+
+func (t *TrackerMgr) Left() (left int64) {
+	n := t.bitfield.Len()
+	left = (n - t.bitfield.Count())*t.pieceLength
+	if n > 0 && !t.bitfield.IsSet(n-1) {
+		left += t.lastPieceLength - t.pieceLength
+	}
+	return
+}
+
+func (t *TrackerMgr) Run() {
+	announce := time.NewTicker(1*time.Second)
+	check := time.NewTicker(COMPLETED_CHECK*time.Second)
+	for {
+		select {
+			case <- t.quit:
+				announce.Stop()
+				check.Stop()
+				t.stopped()
+				return
+			case <- check.C:
+				if !t.announced {
+					continue
+				}
+				num_peers := t.RequestPeers()
+				if !t.completed && t.bitfield.Completed() {
+					// Send the completed event as soon as the download
+					// finishes, not at the next announce
+					if num_peers < 0 {
+						num_peers = 0
+					}
+					if tracker, err := t.Announce(num_peers); err == nil {
+						trackerLog.Info("Completed announce finished", "url", tracker.Url())
+						t.announceDone(tracker)
+						announce.Stop()
+						announce = time.NewTicker(time.Duration(tracker.Interval())*time.Second)
+					}
+				} else if num_peers > UNUSED_PEERS && time.Now().Unix() - t.lastAnnounce >= t.min_interval {
+					// Out of peers, announce again without waiting for
+					// the interval, but never before the min interval
+					trackerLog.Info("Out of peers, announcing again", "peers", num_peers)
+					if tracker, err := t.Announce(num_peers); err == nil {
+						t.announceDone(tracker)
+						announce.Stop()
+						announce = time.NewTicker(time.Duration(tracker.Interval())*time.Second)
+					}
+				}
+			case <- t.reannounce:
+				num_peers := t.RequestPeers()
+				if num_peers < 0 {
+					num_peers = 0
+				}
+				if tracker := t.announceAll(num_peers); tracker != nil {
+					t.announceDone(tracker)
+					announce.Stop()
+					announce = time.NewTicker(time.Duration(tracker.Interval())*time.Second)
+				}
+			case <- announce.C:
+				num_peers := t.RequestPeers()
+				if num_peers < 0 {
+					num_peers = 0
+				}
+				tracker, err := t.Announce(num_peers)
+				announce.Stop()
+				if err != nil {
+					retry := t.nextRetry()
+					trackerLog.Warn("Every tracker failed", "err", err, "retry", retry)
+					announce = time.NewTicker(time.Duration(retry)*time.Second)
+				} else {
+					trackerLog.Info("Announce finished", "url", tracker.Url(), "interval", tracker.Interval(), "min_interval", tracker.MinInterval())
+					t.announceDone(tracker)
+					interval := tracker.Interval()
+					if t.completed && t.noLeechers() {
+						// Nobody to upload to, announce less often but
+						// before the trackers forget us
+						interval = interval*IDLE_INTERVAL/100
+						trackerLog.Info("No leechers, stretching the interval", "interval", interval)
+					}
+					announce = time.NewTicker(time.Duration(interval)*time.Second)
+				}
+		}
+	}
+}
+
+// Keep the intervals of the tracker that answered, the next regular
+// announce is after the interval and an early one after the min interval
+
+func (t *TrackerMgr) announceDone(tracker *Tracker) {
+	t.announced = true
+	t.completed = t.bitfield.Completed()
+	t.interval, t.min_interval = tracker.Interval(), tracker.MinInterval()
+	t.lastAnnounce = time.Now().Unix()
+}
+
+// Announce to every tracker without waiting for the interval or the
+// backoff of the failed ones, to debug the connectivity or get more
+// peers at once
+
+func (t *TrackerMgr) Reannounce() {
+	select {
+		case t.reannounce <- true:
+		default:
+			// One is pending already
+	}
+}
+
+// Announce to every tracker at the same time, the first one of the
+// tiers that answered is returned, nil if none
+
+func (t *TrackerMgr) announceAll(num_peers int) (first *Tracker) {
+	trackerLog.Info("Announcing to every tracker")
+	answered := make(map[*Tracker]bool)
+	sent := make(chan bool)
+	n := 0
+	for _, tier := range(t.tiers) {
+		for _, tracker := range(tier) {
+			n++
+			go func(tracker *Tracker) {
+				err := tracker.Request(t.params.numWant(num_peers))
+				t.mutex.Lock()
+				tracker.announces++
+				if err != nil {
+					tracker.failed(err)
+					trackerLog.Info("Error announcing", "url", tracker.Url(), "err", err)
+				} else {
+					tracker.succeeded()
+					answered[tracker] = true
+				}
+				t.mutex.Unlock()
+				sent <- true
+			}(tracker)
+		}
+	}
+	for ; n > 0; n-- {
+		<- sent
+	}
+	for _, tier := range(t.tiers) {
+		for _, tracker := range(tier) {
+			if answered[tracker] {
+				trackerLog.Info("Announce finished", "url", tracker.Url(), "trackers", len(answered))
+				return tracker
+			}
+		}
+	}
+	return
+}
+
+// Send the stopped event to every tracker at the same time
+
+func (t *TrackerMgr) stopped() {
+	t.mutex.Lock()
+	gaveUp := t.gaveUp
+	t.mutex.Unlock()
+	if gaveUp {
+		close(t.done)
+		return
+	}
+	uploaded, downloaded := t.Stats()
+	sent := make(chan bool)
+	n := 0
+	for _, tier := range(t.tiers) {
+		for _, tracker := range(tier) {
+			n++
+			go func(tracker *Tracker) {
+				if err := tracker.Stopped(uploaded, downloaded); err != nil {
+					trackerLog.Warn("Error sending stopped event", "url", tracker.Url(), "err", err)
+				}
+				tracker.closeUdp()
+				sent <- true
+			}(tracker)
+		}
+	}
+	for ; n > 0; n-- {
+		<- sent
+	}
+	close(t.done)
+}
+
+// Seconds until the first of the failed trackers can be tried again
+
+func (t *TrackerMgr) nextRetry() (retry int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now().Unix()
+	retry = DEFAULT_TRACKER_INTERVAL
+	for _, tier := range(t.tiers) {
+		for _, tracker := range(tier) {
+			if wait := tracker.retryAt - now; wait < retry {
+				retry = wait
+			}
+		}
+	}
+	if retry < 1 {
+		retry = 1
+	}
+	return
+}
+
+// Announce to the first tracker that answers, going through the
+// tiers in order (BEP 12): a tier is only tried if every tracker of
+// the previous ones failed or is waiting to retry
+
+func (t *TrackerMgr) Announce(num_peers int) (tracker *Tracker, err error) {
+	err = errors.New("No trackers available")
+	for _, tier := range(t.tiers) {
+		if tracker, err = t.announceTier(tier, num_peers); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Announce to the first tracker of the tier that answers, in order. The
+// working tracker is moved to the front of its tier, and the ones that
+// failed are skipped until their backoff expires.
+
+func (t *TrackerMgr) announceTier(tier []*Tracker, num_peers int) (tracker *Tracker, err error) {
+	err = errors.New("No trackers available")
+	for i, tracker := range(tier) {
+		t.mutex.Lock()
+		waiting := tracker.retryAt > time.Now().Unix()
+		t.mutex.Unlock()
+		if waiting {
+			trackerLog.Debug("Waiting to retry", "url", tracker.Url())
+			continue
+		}
+		trackerLog.Debug("Announcing", "url", tracker.Url(), "peers", num_peers)
+		err = tracker.Request(t.params.numWant(num_peers))
+		t.mutex.Lock()
+		tracker.announces++
+		if err != nil {
+			tracker.failed(err)
+			t.mutex.Unlock()
+			trackerLog.Info("Error announcing", "url", tracker.Url(), "err", err)
+			continue
+		}
+		tracker.succeeded()
+		copy(tier[1:i+1], tier[0:i])
+		tier[0] = tracker
+		t.mutex.Unlock()
+		return tracker, nil
+	}
+	return
+}
+
+func (t *TrackerMgr) AnnounceStats() (as []AnnounceStats) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, tier := range(t.tiers) {
+		for _, tracker := range(tier) {
+			as = append(as, AnnounceStats{Url: tracker.Url(),
+				Announces: tracker.announces,
+				Failures: tracker.failures,
+				Errors: tracker.errors,
+				LastError: tracker.lastError,
+				Warning: tracker.warning,
+				LastAnnounce: tracker.lastAnnounce,
+				NextRetry: tracker.retryAt})
+		}
+	}
+	return
+}
+
+// True if the first tracker that answers the scrape in every tier has
+// no leechers. A tier that can't be scraped may have some.
+
+func (t *TrackerMgr) noLeechers() bool {
+	for _, tier := range(t.tiers) {
+		scraped := false
+		for _, tracker := range(tier) {
+			if result, err := tracker.Scrape(); err == nil {
+				if result.Leechers > 0 {
+					return false
+				}
+				scraped = true
+				break
+			}
+		}
+		if !scraped {
+			return false
+		}
+	}
+	return len(t.tiers) > 0
+}
+
+// Scrape the first tracker that answers, going through the tiers in order
+
+func (t *TrackerMgr) Scrape() (result *ScrapeResult, tracker *Tracker, err error) {
+	err = errors.New("No trackers available")
+	for _, tier := range(t.tiers) {
+		for _, tracker := range(tier) {
+			if result, err = tracker.Scrape(); err == nil {
+				trackerLog.Info("Scrape", "url", tracker.Url(), "seeders", result.Seeders, "leechers", result.Leechers, "completed", result.Completed)
+				return result, tracker, nil
+			}
+		}
+	}
+	return
+}
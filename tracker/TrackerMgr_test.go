@@ -0,0 +1,164 @@
+package tracker
+
+import(
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"container/list"
+	"wgo/bit_field"
+	)
+
+const testInfohash = "01234567890123456789"
+
+// Keeps the peers received from the trackers
+
+type testPeers struct {
+	mutex *sync.Mutex
+	peers []string
+}
+
+func (p *testPeers) RequestPeers() int {
+	return 50
+}
+
+func (p *testPeers) AddPeers(peers *list.List, source string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for e := peers.Front(); e != nil; e = e.Next() {
+		p.peers = append(p.peers, e.Value.(string))
+	}
+}
+
+func (p *testPeers) received(addr string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, peer := range(p.peers) {
+		if peer == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// A TrackerMgr with the trackers in the order given and without its
+// Run goroutine, the announces are made by the tests
+
+func testTrackerMgr(urls [][]string) (t *TrackerMgr, pm *testPeers) {
+	pm = &testPeers{mutex: new(sync.Mutex)}
+	bf := bit_field.NewBitfield(4)
+	t = &TrackerMgr{mutex: new(sync.Mutex), peerMgr: pm, params: Params{Port: "6881"}, peerId: "-WG0001-abcdefghijkl",
+		bitfield: bf, pieceLength: 16384, lastPieceLength: 16384}
+	for _, tier := range(urls) {
+		trackers := []*Tracker{}
+		for _, url := range(tier) {
+			trackers = append(trackers, NewTracker(url, testInfohash, "", t, t.Left(), bf, t.pieceLength, t.peerId))
+		}
+		t.tiers = append(t.tiers, trackers)
+	}
+	return
+}
+
+// An HTTP tracker that counts its announces, and answers with a peer
+// or fails
+
+type httpTracker struct {
+	*httptest.Server
+	mutex *sync.Mutex
+	announces int
+}
+
+func newHttpTracker(working bool) (h *httpTracker) {
+	h = &httpTracker{mutex: new(sync.Mutex)}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mutex.Lock()
+		h.announces++
+		h.mutex.Unlock()
+		if !working {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		// 127.0.0.1:6881
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	return
+}
+
+func (h *httpTracker) Announces() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.announces
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	failing, working, next := newHttpTracker(false), newHttpTracker(true), newHttpTracker(true)
+	defer failing.Close()
+	defer working.Close()
+	defer next.Close()
+	tm, pm := testTrackerMgr([][]string{[]string{failing.URL, working.URL}, []string{next.URL}})
+	tracker, err := tm.Announce(50)
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if tracker.Url() != working.URL || tm.tiers[0][0] != tracker {
+		t.Errorf("Working tracker %s not moved to the front of its tier", tracker.Url())
+	}
+	if next.Announces() != 0 {
+		t.Errorf("Second tier announced when the first one answered")
+	}
+	if !pm.received("127.0.0.1:6881") {
+		t.Errorf("Peers not received: %v", pm.peers)
+	}
+	failed := tm.tiers[0][1]
+	if failed.errors != 1 || failed.retryAt <= time.Now().Unix() {
+		t.Errorf("Failing tracker errors %d, retry at %d", failed.errors, failed.retryAt)
+	}
+	// The working tracker goes first, the failed one waits for its backoff
+	if _, err = tm.Announce(50); err != nil || failing.Announces() != 1 || working.Announces() != 2 {
+		t.Errorf("Second announce: err %v, failing %d, working %d announces", err, failing.Announces(), working.Announces())
+	}
+}
+
+func TestAnnounceNextTier(t *testing.T) {
+	failing, next := newHttpTracker(false), newHttpTracker(true)
+	defer failing.Close()
+	defer next.Close()
+	tm, _ := testTrackerMgr([][]string{[]string{failing.URL}, []string{next.URL}})
+	tracker, err := tm.Announce(50)
+	if err != nil || tracker.Url() != next.URL {
+		t.Fatalf("Announce = %v, %v, expected the tracker of the second tier", tracker, err)
+	}
+	// Every tracker failed or is waiting
+	next.Close()
+	tm.tiers[1][0].retryAt = 0
+	if _, err = tm.Announce(50); err == nil {
+		t.Errorf("Announce succeeded without trackers")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tm, _ := testTrackerMgr([][]string{[]string{"http://127.0.0.1:1/announce"}})
+	tracker := tm.tiers[0][0]
+	for _, backoff := range([]int64{60, 120, 240, 480, 960, DEFAULT_TRACKER_INTERVAL, DEFAULT_TRACKER_INTERVAL}) {
+		tracker.failed(errors.New("Failed"))
+		if tracker.backoff != backoff {
+			t.Errorf("Backoff %d, expected %d", tracker.backoff, backoff)
+		}
+		if wait := tracker.retryAt - time.Now().Unix(); wait < backoff - 1 || wait > backoff {
+			t.Errorf("Retry in %d seconds, expected %d", wait, backoff)
+		}
+	}
+	tracker.succeeded()
+	if tracker.backoff != 0 || tracker.retryAt != 0 || tracker.errors != 0 {
+		t.Errorf("Backoff not reset after a success")
+	}
+	// Capped at the interval of the tracker
+	tracker.interval = 100
+	tracker.failed(errors.New("Failed"))
+	tracker.failed(errors.New("Failed"))
+	if tracker.backoff != 100 {
+		t.Errorf("Backoff %d over the interval", tracker.backoff)
+	}
+}
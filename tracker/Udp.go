@@ -0,0 +1,242 @@
+// UDP tracker protocol (BEP 15)
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package tracker
+
+import(
+	"net"
+	"math/rand"
+	"time"
+	"bytes"
+	"strings"
+	"strconv"
+	"container/list"
+	"encoding/binary"
+	"wgo/proxy"
+	"errors"
+	)
+
+const(
+	UDP_PROTOCOL_ID = 0x41727101980
+	UDP_TIMEOUT = 15 // Seconds, doubled on each retransmission until the deadline of the announce
+	UDP_CONNECTION_ID_TTL = 60 // Seconds a connection id can be used
+	UDP_MAX_PACKET = 2048
+)
+
+// Actions
+
+const(
+	udp_connect = iota
+	udp_announce
+	udp_scrape
+	udp_error
+)
+
+// Events
+
+const(
+	udp_none = iota
+	udp_completed
+	udp_started
+	udp_stopped
+)
+
+// Cached connection with an UDP tracker
+
+type udpTracker struct {
+	conn *net.UDPConn
+	connectionId uint64
+	connected int64 // Time when the connection id was obtained
+	deadline time.Time // Of the announce or scrape, the retransmissions stop there
+}
+
+// Host and port of an udp://host:port/ url
+
+func udpHost(url string) string {
+	host := url[len("udp://"):]
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[0:i]
+	}
+	return host
+}
+
+func (t *Tracker) udpConnection() (u *udpTracker, err error) {
+	if t.udp != nil {
+		return t.udp, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp4", udpHost(t.url))
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp4", proxy.LocalUDP(), addr)
+	if err != nil {
+		return
+	}
+	t.udp = &udpTracker{conn: conn}
+	return t.udp, nil
+}
+
+// Close the UDP socket, the next request opens a new one
+
+func (t *Tracker) closeUdp() {
+	if t.udp != nil {
+		t.udp.conn.Close()
+		t.udp = nil
+	}
+}
+
+// Send a request and wait for the response with the same action and
+// transaction id, retransmitting with increasing timeouts until the
+// deadline
+
+func (u *udpTracker) transaction(request []byte, action uint32) (response []byte, err error) {
+	transactionId := uint32(rand.Int63())
+	binary.BigEndian.PutUint32(request[12:16], transactionId)
+	buf := make([]byte, UDP_MAX_PACKET)
+	timeout := UDP_TIMEOUT*time.Second
+	for time.Now().Before(u.deadline) {
+		if _, err = u.conn.Write(request); err != nil {
+			return
+		}
+		deadline := time.Now().Add(timeout)
+		if deadline.After(u.deadline) {
+			deadline = u.deadline
+		}
+		for time.Now().Before(deadline) {
+			if err = u.conn.SetReadDeadline(deadline); err != nil {
+				return
+			}
+			n, err := u.conn.Read(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return response, err
+			}
+			if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionId {
+				// Not the answer to our request
+				continue
+			}
+			switch binary.BigEndian.Uint32(buf[0:4]) {
+				case action:
+					response = make([]byte, n-8)
+					copy(response, buf[8:n])
+					return response, nil
+				case udp_error:
+					return response, errors.New("Tracker error: " + string(bytes.TrimRight(buf[8:n], "\x00")))
+			}
+		}
+		timeout *= 2
+	}
+	return response, errors.New("UDP tracker timeout")
+}
+
+// Obtain a connection id, or use the cached one if still valid
+
+func (u *udpTracker) connect() (err error) {
+	if u.connectionId != 0 && time.Now().Unix() - u.connected < UDP_CONNECTION_ID_TTL {
+		return
+	}
+	request := make([]byte, 16)
+	binary.BigEndian.PutUint64(request[0:8], UDP_PROTOCOL_ID)
+	binary.BigEndian.PutUint32(request[8:12], udp_connect)
+	response, err := u.transaction(request, udp_connect)
+	if err != nil {
+		return
+	}
+	if len(response) < 8 {
+		return errors.New("Invalid connect response")
+	}
+	u.connectionId = binary.BigEndian.Uint64(response[0:8])
+	u.connected = time.Now().Unix()
+	return
+}
+
+func (t *Tracker) udpEvent() uint32 {
+	switch t.status {
+		case "started":
+			return udp_started
+		case "completed":
+			return udp_completed
+		case "stopped":
+			return udp_stopped
+	}
+	return udp_none
+}
+
+func (t *Tracker) announceUdp(r *announceRequest) (peers *list.List, err error) {
+	u, err := t.udpConnection()
+	if err != nil {
+		return
+	}
+	u.deadline = t.deadline
+	if err = u.connect(); err != nil {
+		t.closeUdp()
+		return
+	}
+	port, err := strconv.Atoi(r.params.Port)
+	if err != nil {
+		return
+	}
+	request := make([]byte, 98)
+	binary.BigEndian.PutUint64(request[0:8], u.connectionId)
+	binary.BigEndian.PutUint32(request[8:12], udp_announce)
+	copy(request[16:36], r.infohash)
+	copy(request[36:56], r.peerId)
+	binary.BigEndian.PutUint64(request[56:64], uint64(r.downloaded))
+	binary.BigEndian.PutUint64(request[64:72], uint64(r.left))
+	binary.BigEndian.PutUint64(request[72:80], uint64(r.uploaded))
+	binary.BigEndian.PutUint32(request[80:84], t.udpEvent())
+	if ip := net.ParseIP(r.params.Ip); ip != nil && ip.To4() != nil {
+		// Only IPv4 addresses fit, 0 is the address of the packet
+		copy(request[84:88], ip.To4())
+	}
+	binary.BigEndian.PutUint32(request[88:92], r.key)
+	binary.BigEndian.PutUint32(request[92:96], uint32(r.numWant))
+	binary.BigEndian.PutUint16(request[96:98], uint16(port))
+	response, err := u.transaction(request, udp_announce)
+	if err != nil {
+		t.closeUdp()
+		return
+	}
+	if len(response) < 12 {
+		return peers, errors.New("Invalid announce response")
+	}
+	t.trackerMgr.mutex.Lock()
+	t.interval = int64(binary.BigEndian.Uint32(response[0:4]))
+	t.min_interval = 0
+	t.trackerMgr.mutex.Unlock()
+	return parsePeers(string(response[12:])), nil
+}
+
+// Number of seeders, completed downloads and leechers of the torrent
+
+func (t *Tracker) scrapeUdp() (seeders, completed, leechers int64, err error) {
+	u, err := t.udpConnection()
+	if err != nil {
+		return
+	}
+	u.deadline = t.deadline
+	if err = u.connect(); err != nil {
+		t.closeUdp()
+		return
+	}
+	request := make([]byte, 36)
+	binary.BigEndian.PutUint64(request[0:8], u.connectionId)
+	binary.BigEndian.PutUint32(request[8:12], udp_scrape)
+	copy(request[16:36], t.infohash)
+	response, err := u.transaction(request, udp_scrape)
+	if err != nil {
+		t.closeUdp()
+		return
+	}
+	if len(response) < 12 {
+		err = errors.New("Invalid scrape response")
+		return
+	}
+	seeders = int64(binary.BigEndian.Uint32(response[0:4]))
+	completed = int64(binary.BigEndian.Uint32(response[4:8]))
+	leechers = int64(binary.BigEndian.Uint32(response[8:12]))
+	return
+}
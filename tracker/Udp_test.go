@@ -0,0 +1,105 @@
+package tracker
+
+import(
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"encoding/binary"
+	)
+
+const testConnectionId = 0x1122334455667788
+
+// A UDP tracker (BEP 15) on loopback. The announces are checked and
+// answered with a peer, or with an error if fail is set.
+
+func udpTrackerServer(t *testing.T, fail string) (url string, sock *net.UDPConn) {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	sock, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, UDP_MAX_PACKET)
+		for {
+			n, raddr, err := sock.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+			req := buf[0:n]
+			action := binary.BigEndian.Uint32(req[8:12])
+			response := make([]byte, 8)
+			binary.BigEndian.PutUint32(response[0:4], action)
+			copy(response[4:8], req[12:16])
+			switch {
+				case action == udp_connect && binary.BigEndian.Uint64(req[0:8]) == UDP_PROTOCOL_ID:
+					response = binary.BigEndian.AppendUint64(response, testConnectionId)
+				case binary.BigEndian.Uint64(req[0:8]) != testConnectionId:
+					t.Errorf("Request with connection id %x", req[0:8])
+					continue
+				case action == udp_announce && n == 98:
+					if !bytes.Equal(req[16:36], []byte(testInfohash)) || binary.BigEndian.Uint32(req[80:84]) != udp_started ||
+						binary.BigEndian.Uint16(req[96:98]) != 6881 || binary.BigEndian.Uint32(req[92:96]) != 50 {
+						t.Errorf("Bad announce %x", req)
+					}
+					if len(fail) > 0 {
+						binary.BigEndian.PutUint32(response[0:4], udp_error)
+						response = append(response, fail...)
+						break
+					}
+					// Interval, leechers, seeders and 10.0.0.1:6881
+					response = binary.BigEndian.AppendUint32(response, 900)
+					response = binary.BigEndian.AppendUint32(response, 3)
+					response = binary.BigEndian.AppendUint32(response, 5)
+					response = append(response, 10, 0, 0, 1, 0x1a, 0xe1)
+				case action == udp_scrape && n == 36:
+					response = binary.BigEndian.AppendUint32(response, 5)
+					response = binary.BigEndian.AppendUint32(response, 7)
+					response = binary.BigEndian.AppendUint32(response, 3)
+				default:
+					t.Errorf("Unknown request %x", req)
+					continue
+			}
+			sock.WriteToUDP(response, raddr)
+		}
+	}()
+	url = "udp://127.0.0.1:" + strconv.Itoa(sock.LocalAddr().(*net.UDPAddr).Port) + "/announce"
+	return
+}
+
+func TestUdpAnnounce(t *testing.T) {
+	url, sock := udpTrackerServer(t, "")
+	defer sock.Close()
+	tm, pm := testTrackerMgr([][]string{[]string{url}})
+	tracker, err := tm.Announce(50)
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	defer tracker.closeUdp()
+	if tracker.Interval() != 900 {
+		t.Errorf("Interval %d, expected 900", tracker.Interval())
+	}
+	if !pm.received("10.0.0.1:6881") {
+		t.Errorf("Peers not received: %v", pm.peers)
+	}
+	result, err := tracker.Scrape()
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if result.Seeders != 5 || result.Completed != 7 || result.Leechers != 3 {
+		t.Errorf("Scrape %+v", result)
+	}
+}
+
+func TestUdpError(t *testing.T) {
+	url, sock := udpTrackerServer(t, "unregistered torrent")
+	defer sock.Close()
+	tm, _ := testTrackerMgr([][]string{[]string{url}})
+	if _, err := tm.Announce(50); err == nil || !strings.Contains(err.Error(), "unregistered torrent") {
+		t.Errorf("Announce = %v, expected the error of the tracker", err)
+	}
+}
@@ -0,0 +1,491 @@
+// uTP connection (BEP 29), reliable stream over UDP with
+// LEDBAT congestion control
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package utp
+
+import(
+	"io"
+	"net"
+	"sync"
+	"time"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	)
+
+const(
+	US_PER_S = 1000000
+	TICK = 100*time.Millisecond // Between timeout checks
+	TARGET_DELAY = 100*1000 // LEDBAT target delay in us
+	MAX_CWND_INCREASE = 3000 // Bytes per RTT
+	BASE_DELAY_WINDOW = 120*US_PER_S
+	MIN_WINDOW = MAX_PAYLOAD
+	MAX_WINDOW = 1024*1024
+	RECV_WINDOW = 1024*1024
+	MIN_RTO = 500*1000 // us
+	MAX_RTO = 60*US_PER_S
+	MAX_TRANSMISSIONS = 6
+	REORDER_BUFFER = 1024 // Packets ahead of ack_nr we accept
+	PACKET_QUEUE = 64
+)
+
+// Connection states
+
+const(
+	state_syn_sent = iota
+	state_connected
+	state_fin_sent
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string { return "uTP timeout" }
+func (e *timeoutError) Timeout() bool { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type outPacket struct {
+	kind uint8
+	seq uint16
+	payload []byte
+	sent int64 // us
+	transmissions int
+}
+
+type inPacket struct {
+	payload []byte
+	fin bool
+}
+
+type Conn struct {
+	send func([]byte) error
+	onClose func()
+	laddr, raddr net.Addr
+	sendId, recvId uint16
+	packets chan []byte // Raw packets from the socket
+	writes chan []byte
+	data chan []byte // Data in order for the reader
+	connected, closing, done chan bool
+	closeOnce *sync.Once
+	err error
+	readDeadline, writeDeadline time.Time
+	pendingRead []byte
+	// State owned by the run goroutine
+	state int
+	seq, ack, lastAck uint16
+	dupAcks int
+	inflight map[uint16]*outPacket
+	curWindow, maxWindow, peerWindow int64
+	rtt, rttVar, rto int64
+	baseDelay uint32
+	baseDelayTime int64
+	replyMicro uint32
+	reorder map[uint16]*inPacket
+	received [][]byte
+	eof, dataClosed bool
+}
+
+func randomId() uint16 {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
+
+func microseconds() int64 {
+	return time.Now().UnixNano() / 1000
+}
+
+func newConn(send func([]byte) error, laddr, raddr net.Addr, recvId, sendId uint16) (c *Conn) {
+	c = new(Conn)
+	c.send = send
+	c.onClose = func() {}
+	c.laddr, c.raddr = laddr, raddr
+	c.recvId, c.sendId = recvId, sendId
+	c.packets = make(chan []byte, PACKET_QUEUE)
+	c.writes = make(chan []byte)
+	c.data = make(chan []byte)
+	c.connected = make(chan bool)
+	c.closing = make(chan bool)
+	c.done = make(chan bool)
+	c.closeOnce = new(sync.Once)
+	c.inflight = make(map[uint16]*outPacket)
+	c.reorder = make(map[uint16]*inPacket)
+	c.maxWindow = MIN_WINDOW
+	c.peerWindow = RECV_WINDOW
+	c.rto = 1000*1000
+	return
+}
+
+// Connect to a peer from laddr (nil for any), waiting at most timeout
+// for the handshake
+
+func Dial(laddr *net.UDPAddr, addr string, timeout time.Duration) (c *Conn, err error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return
+	}
+	sock, err := net.DialUDP("udp4", laddr, raddr)
+	if err != nil {
+		return
+	}
+	id := randomId()
+	c = newConn(func(b []byte) (err error) {
+		_, err = sock.Write(b)
+		return
+	}, sock.LocalAddr(), raddr, id, id+1)
+	c.onClose = func() { sock.Close() }
+	c.state = state_syn_sent
+	c.seq = 1
+	c.sendPacket(st_syn, nil)
+	go c.run()
+	go c.readSocket(sock)
+	select {
+		case <- c.connected:
+			return c, nil
+		case <- c.done:
+			return nil, c.err
+		case <- time.After(timeout):
+			c.Close()
+			return nil, &timeoutError{}
+	}
+}
+
+// Receive the packets of a dialed connection
+
+func (c *Conn) readSocket(sock *net.UDPConn) {
+	buf := make([]byte, MAX_PACKET*2)
+	for {
+		n, err := sock.Read(buf)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[0:n])
+		c.deliver(packet)
+	}
+}
+
+// Queue a packet for the connection, dropped if the queue is full
+
+func (c *Conn) deliver(packet []byte) {
+	select {
+		case c.packets <- packet:
+		default:
+	}
+}
+
+func (c *Conn) run() {
+	ticker := time.NewTicker(TICK)
+	defer func() {
+		ticker.Stop()
+		if !c.dataClosed {
+			close(c.data)
+		}
+		close(c.done)
+		c.onClose()
+	}()
+	closing := c.closing
+	for {
+		var writes chan []byte
+		if c.state == state_connected && c.curWindow + MAX_PAYLOAD <= c.window() {
+			writes = c.writes
+		}
+		var data chan []byte
+		var next []byte
+		if len(c.received) > 0 {
+			data, next = c.data, c.received[0]
+		}
+		select {
+			case packet := <- c.packets:
+				c.processPacket(packet)
+			case b := <- writes:
+				c.sendPacket(st_data, b)
+			case data <- next:
+				c.received = c.received[1:]
+			case <- ticker.C:
+				c.checkTimeouts()
+			case <- closing:
+				closing = nil
+				if c.state == state_syn_sent {
+					c.err = errors.New("Connection closed")
+				} else {
+					c.sendPacket(st_fin, nil)
+					c.state = state_fin_sent
+				}
+		}
+		if c.eof && len(c.received) == 0 && !c.dataClosed {
+			close(c.data)
+			c.dataClosed = true
+		}
+		if c.err != nil || (c.state == state_fin_sent && len(c.inflight) == 0) {
+			return
+		}
+	}
+}
+
+func (c *Conn) window() int64 {
+	if c.peerWindow < c.maxWindow {
+		return c.peerWindow
+	}
+	return c.maxWindow
+}
+
+func (c *Conn) sendPacket(kind uint8, payload []byte) {
+	p := &outPacket{kind: kind, seq: c.seq, payload: payload}
+	c.inflight[c.seq] = p
+	c.curWindow += int64(len(payload))
+	c.seq++
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sent = microseconds()
+	p.transmissions++
+	h := &header{kind: p.kind, connId: c.sendId, timestamp: timestamp(), timestampDiff: c.replyMicro, wndSize: RECV_WINDOW, seq: p.seq, ack: c.ack}
+	if p.kind == st_syn {
+		h.connId = c.recvId
+	}
+	c.send(h.Bytes(p.payload))
+}
+
+// Acknowledge the received packets
+
+func (c *Conn) sendState() {
+	h := &header{kind: st_state, connId: c.sendId, timestamp: timestamp(), timestampDiff: c.replyMicro, wndSize: RECV_WINDOW, seq: c.seq, ack: c.ack}
+	c.send(h.Bytes(nil))
+}
+
+func (c *Conn) processPacket(packet []byte) {
+	h, payload, err := parsePacket(packet)
+	if err != nil {
+		return
+	}
+	c.replyMicro = timestamp() - h.timestamp
+	c.peerWindow = int64(h.wndSize)
+	switch h.kind {
+		case st_reset:
+			c.err = errors.New("Connection reset by peer")
+			return
+		case st_syn:
+			// Our state packet was lost, acknowledge again
+			c.sendState()
+			return
+	}
+	if c.state == state_syn_sent {
+		if h.kind != st_state {
+			return
+		}
+		c.ack = h.seq - 1
+		c.state = state_connected
+		close(c.connected)
+	}
+	c.processAck(h)
+	switch h.kind {
+		case st_data:
+			c.receive(h.seq, payload, false)
+		case st_fin:
+			c.receive(h.seq, nil, true)
+	}
+}
+
+func (c *Conn) processAck(h *header) {
+	now := microseconds()
+	bytesAcked := int64(0)
+	rttSample := int64(-1)
+	for seq, p := range(c.inflight) {
+		if !seqLess(h.ack, seq) {
+			bytesAcked += int64(len(p.payload))
+			if p.transmissions == 1 {
+				rttSample = now - p.sent
+			}
+			c.curWindow -= int64(len(p.payload))
+			delete(c.inflight, seq)
+		}
+	}
+	if bytesAcked == 0 && h.kind == st_state && len(c.inflight) > 0 && h.ack == c.lastAck {
+		// Fast retransmit after 3 duplicate acks
+		if c.dupAcks++; c.dupAcks == 3 {
+			if p, ok := c.inflight[h.ack+1]; ok {
+				c.transmit(p)
+			}
+			c.dupAcks = 0
+		}
+	} else if !seqLess(h.ack, c.lastAck) {
+		c.dupAcks = 0
+		c.lastAck = h.ack
+	}
+	if rttSample >= 0 {
+		if c.rtt == 0 {
+			c.rtt, c.rttVar = rttSample, rttSample/2
+		} else {
+			delta := c.rtt - rttSample
+			if delta < 0 {
+				delta = -delta
+			}
+			c.rttVar += (delta - c.rttVar) / 4
+			c.rtt += (rttSample - c.rtt) / 8
+		}
+		if c.rto = c.rtt + 4*c.rttVar; c.rto < MIN_RTO {
+			c.rto = MIN_RTO
+		}
+	}
+	c.ledbat(h.timestampDiff, bytesAcked, now)
+}
+
+// LEDBAT, grow the window while the delay is below the target
+// and shrink it when the delay goes over it
+
+func (c *Conn) ledbat(delay uint32, bytesAcked, now int64) {
+	if delay == 0 || bytesAcked == 0 {
+		return
+	}
+	if c.baseDelay == 0 || delay < c.baseDelay || now - c.baseDelayTime > BASE_DELAY_WINDOW {
+		c.baseDelay = delay
+		c.baseDelayTime = now
+	}
+	ourDelay := int64(delay) - int64(c.baseDelay)
+	offTarget := float64(TARGET_DELAY - ourDelay) / float64(TARGET_DELAY)
+	c.maxWindow += int64(MAX_CWND_INCREASE * offTarget * float64(bytesAcked) / float64(c.maxWindow))
+	if c.maxWindow < MIN_WINDOW {
+		c.maxWindow = MIN_WINDOW
+	} else if c.maxWindow > MAX_WINDOW {
+		c.maxWindow = MAX_WINDOW
+	}
+}
+
+func (c *Conn) receive(seq uint16, payload []byte, fin bool) {
+	if !seqLess(c.ack, seq) {
+		// Duplicate packet
+		c.sendState()
+		return
+	}
+	if seq - c.ack > REORDER_BUFFER {
+		return
+	}
+	c.reorder[seq] = &inPacket{payload: payload, fin: fin}
+	for {
+		p, ok := c.reorder[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ack+1)
+		c.ack++
+		if p.fin {
+			c.eof = true
+		} else if len(p.payload) > 0 {
+			c.received = append(c.received, p.payload)
+		}
+	}
+	c.sendState()
+}
+
+// Retransmit the packets not acknowledged in time
+
+func (c *Conn) checkTimeouts() {
+	now := microseconds()
+	expired := false
+	for _, p := range(c.inflight) {
+		if now - p.sent < c.rto {
+			continue
+		}
+		if p.transmissions >= MAX_TRANSMISSIONS {
+			c.err = &timeoutError{}
+			return
+		}
+		expired = true
+		c.transmit(p)
+	}
+	if expired {
+		c.maxWindow = MIN_WINDOW
+		if c.rto *= 2; c.rto > MAX_RTO {
+			c.rto = MAX_RTO
+		}
+	}
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if len(c.pendingRead) == 0 {
+		timeout := deadline(c.readDeadline)
+		select {
+			case data, ok := <- c.data:
+				if !ok {
+					if c.err != nil {
+						return 0, c.err
+					}
+					return 0, io.EOF
+				}
+				c.pendingRead = data
+			case <- timeout:
+				return 0, &timeoutError{}
+		}
+	}
+	n = copy(b, c.pendingRead)
+	c.pendingRead = c.pendingRead[n:]
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	timeout := deadline(c.writeDeadline)
+	for len(b) > 0 {
+		size := len(b)
+		if size > MAX_PAYLOAD {
+			size = MAX_PAYLOAD
+		}
+		payload := make([]byte, size)
+		copy(payload, b[0:size])
+		select {
+			case c.writes <- payload:
+			case <- c.done:
+				if c.err != nil {
+					return n, c.err
+				}
+				return n, errors.New("Connection closed")
+			case <- timeout:
+				return n, &timeoutError{}
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// Send the pending data and a FIN, the connection is released
+// when the peer acknowledges it
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline, c.writeDeadline = t, t
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return nil
+}
+
+// Channel firing at t, nil (never) for the zero time
+
+func deadline(t time.Time) <-chan time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(t))
+}
@@ -0,0 +1,203 @@
+package utp
+
+import(
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	)
+
+// A UDP relay between a dialed connection and a listener, the packets
+// drop returns true for are lost
+
+type relay struct {
+	sock, upstream *net.UDPConn
+	mutex *sync.Mutex
+	client *net.UDPAddr
+	clientId uint16 // Of the SYN, the id the client receives with
+	drop func(h *header, fromClient bool) bool
+}
+
+func newRelay(t *testing.T, target net.Addr, drop func(h *header, fromClient bool) bool) (r *relay) {
+	laddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	sock, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.DialUDP("udp4", nil, target.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &relay{sock: sock, upstream: upstream, mutex: new(sync.Mutex), drop: drop}
+	go r.fromClient()
+	go r.fromListener()
+	return
+}
+
+func (r *relay) fromClient() {
+	buf := make([]byte, MAX_PACKET*2)
+	for {
+		n, addr, err := r.sock.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		h, _, err := parsePacket(buf[0:n])
+		if err != nil {
+			continue
+		}
+		r.mutex.Lock()
+		r.client = addr
+		if h.kind == st_syn {
+			r.clientId = h.connId
+		}
+		lost := r.drop != nil && r.drop(h, true)
+		r.mutex.Unlock()
+		if !lost {
+			r.upstream.Write(buf[0:n])
+		}
+	}
+}
+
+func (r *relay) fromListener() {
+	buf := make([]byte, MAX_PACKET*2)
+	for {
+		n, err := r.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		h, _, err := parsePacket(buf[0:n])
+		if err != nil {
+			continue
+		}
+		r.mutex.Lock()
+		lost := r.drop != nil && r.drop(h, false)
+		client := r.client
+		r.mutex.Unlock()
+		if !lost && client != nil {
+			r.sock.WriteToUDP(buf[0:n], client)
+		}
+	}
+}
+
+// Send a packet to the client as if the listener did
+
+func (r *relay) toClient(h *header) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	h.connId = r.clientId
+	r.sock.WriteToUDP(h.Bytes(nil), r.client)
+}
+
+func (r *relay) Close() {
+	r.sock.Close()
+	r.upstream.Close()
+}
+
+func testListener(t *testing.T) *Listener {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range(data) {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// Send data from the dialed side, close it and read everything on the
+// accepted side until the EOF of the FIN
+
+func transfer(t *testing.T, addr string, l *Listener, data []byte) {
+	received := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			received <- nil
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(20*time.Second))
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			t.Errorf("Read: %v", err)
+		}
+		conn.Close()
+		received <- b
+	}()
+	c, err := Dial(nil, addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.SetWriteDeadline(time.Now().Add(20*time.Second))
+	if n, err := c.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	c.Close()
+	if b := <- received; !bytes.Equal(b, data) {
+		t.Errorf("Received %d bytes, sent %d, equal %v", len(b), len(data), bytes.Equal(b, data))
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	l := testListener(t)
+	defer l.Close()
+	transfer(t, l.Addr().String(), l, testData(300*1024))
+}
+
+func TestRetransmission(t *testing.T) {
+	l := testListener(t)
+	defer l.Close()
+	dropped := 0
+	r := newRelay(t, l.Addr(), func(h *header, fromClient bool) bool {
+		// The first data packet is lost, the rest arrive out of order
+		if fromClient && h.kind == st_data && dropped == 0 {
+			dropped++
+			return true
+		}
+		return false
+	})
+	defer r.Close()
+	transfer(t, r.sock.LocalAddr().String(), l, testData(100*1024))
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if dropped == 0 {
+		t.Errorf("No packet dropped")
+	}
+}
+
+func TestReset(t *testing.T) {
+	l := testListener(t)
+	defer l.Close()
+	r := newRelay(t, l.Addr(), nil)
+	defer r.Close()
+	end := make(chan bool)
+	defer close(end)
+	go func() {
+		// Open until the end of the test, the connection is reset below
+		if conn, err := l.Accept(); err == nil {
+			<- end
+			conn.Close()
+		}
+	}()
+	c, err := Dial(nil, r.sock.LocalAddr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	r.toClient(&header{kind: st_reset})
+	c.SetReadDeadline(time.Now().Add(5*time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("Read after a reset = %v", err)
+	}
+	if _, err := c.Write([]byte("data")); err == nil {
+		t.Errorf("Write after a reset succeeded")
+	}
+}
@@ -0,0 +1,125 @@
+// uTP listener, accepts the connections of one UDP socket
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package utp
+
+import(
+	"net"
+	"sync"
+	"strconv"
+	"errors"
+	)
+
+const(
+	ACCEPT_BACKLOG = 16
+)
+
+type Listener struct {
+	sock *net.UDPConn
+	mutex *sync.Mutex
+	conns map[string]*Conn // Indexed by remote address and connection id
+	accept chan *Conn
+}
+
+func Listen(addr string) (l *Listener, err error) {
+	laddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return
+	}
+	l = new(Listener)
+	if l.sock, err = net.ListenUDP("udp4", laddr); err != nil {
+		return
+	}
+	l.mutex = new(sync.Mutex)
+	l.conns = make(map[string]*Conn)
+	l.accept = make(chan *Conn, ACCEPT_BACKLOG)
+	go l.run()
+	return
+}
+
+func connKey(addr *net.UDPAddr, id uint16) string {
+	return addr.String() + "/" + strconv.Itoa(int(id))
+}
+
+func (l *Listener) run() {
+	buf := make([]byte, MAX_PACKET*2)
+	for {
+		n, raddr, err := l.sock.ReadFromUDP(buf)
+		if err != nil {
+			close(l.accept)
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[0:n])
+		h, _, err := parsePacket(packet)
+		if err != nil {
+			continue
+		}
+		id := h.connId
+		if h.kind == st_syn {
+			// The peer sends the rest of the packets with id + 1
+			id++
+		}
+		key := connKey(raddr, id)
+		l.mutex.Lock()
+		c, ok := l.conns[key]
+		l.mutex.Unlock()
+		if ok {
+			c.deliver(packet)
+			continue
+		}
+		if h.kind != st_syn {
+			continue
+		}
+		c = l.newConn(raddr, h)
+		l.mutex.Lock()
+		l.conns[key] = c
+		l.mutex.Unlock()
+		select {
+			case l.accept <- c:
+			default:
+				// Backlog full
+				c.Close()
+		}
+	}
+}
+
+// Create the connection for an incoming SYN
+
+func (l *Listener) newConn(raddr *net.UDPAddr, h *header) (c *Conn) {
+	c = newConn(func(b []byte) (err error) {
+		_, err = l.sock.WriteToUDP(b, raddr)
+		return
+	}, l.sock.LocalAddr(), raddr, h.connId+1, h.connId)
+	key := connKey(raddr, h.connId+1)
+	c.onClose = func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		delete(l.conns, key)
+	}
+	c.ack = h.seq
+	c.seq = randomId()
+	c.lastAck = c.seq - 1
+	c.state = state_connected
+	close(c.connected)
+	c.sendState()
+	go c.run()
+	return
+}
+
+func (l *Listener) Accept() (c net.Conn, err error) {
+	conn, ok := <- l.accept
+	if !ok {
+		return nil, errors.New("Listener closed")
+	}
+	return conn, nil
+}
+
+func (l *Listener) Close() error {
+	return l.sock.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.sock.LocalAddr()
+}
@@ -0,0 +1,98 @@
+// uTP packet header (BEP 29)
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package utp
+
+import(
+	"time"
+	"encoding/binary"
+	"errors"
+	)
+
+// Packet types
+
+const(
+	st_data = iota
+	st_fin
+	st_state
+	st_reset
+	st_syn
+)
+
+const(
+	VERSION = 1
+	HEADER_SIZE = 20
+	MAX_PACKET = 1400
+	MAX_PAYLOAD = MAX_PACKET - HEADER_SIZE
+)
+
+type header struct {
+	kind uint8
+	connId uint16
+	timestamp, timestampDiff, wndSize uint32
+	seq, ack uint16
+}
+
+// Header followed by the payload, we don't send extensions
+
+func (h *header) Bytes(payload []byte) []byte {
+	b := make([]byte, HEADER_SIZE + len(payload))
+	b[0] = h.kind << 4 | VERSION
+	b[1] = 0
+	binary.BigEndian.PutUint16(b[2:4], h.connId)
+	binary.BigEndian.PutUint32(b[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:18], h.seq)
+	binary.BigEndian.PutUint16(b[18:20], h.ack)
+	copy(b[HEADER_SIZE:], payload)
+	return b
+}
+
+// Decode the header and skip the extensions
+
+func parsePacket(b []byte) (h *header, payload []byte, err error) {
+	if len(b) < HEADER_SIZE {
+		return h, payload, errors.New("Packet too short")
+	}
+	if b[0] & 0x0f != VERSION {
+		return h, payload, errors.New("Unknown uTP version")
+	}
+	h = new(header)
+	h.kind = b[0] >> 4
+	if h.kind > st_syn {
+		return h, payload, errors.New("Unknown packet type")
+	}
+	h.connId = binary.BigEndian.Uint16(b[2:4])
+	h.timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:12])
+	h.wndSize = binary.BigEndian.Uint32(b[12:16])
+	h.seq = binary.BigEndian.Uint16(b[16:18])
+	h.ack = binary.BigEndian.Uint16(b[18:20])
+	next, start := b[1], HEADER_SIZE
+	for next != 0 {
+		if len(b) < start+2 {
+			return h, payload, errors.New("Invalid extension")
+		}
+		next = b[start]
+		start += 2 + int(b[start+1])
+		if start > len(b) {
+			return h, payload, errors.New("Invalid extension")
+		}
+	}
+	payload = b[start:]
+	return
+}
+
+// Timestamp in microseconds
+
+func timestamp() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+// Compare sequence numbers taking care of wrapping
+
+func seqLess(a, b uint16) bool {
+	return int16(a - b) < 0
+}
@@ -0,0 +1,48 @@
+// Separate folders for the downloads and the finished torrents, the
+// files are moved to the complete folder once every piece is there
+// and the torrent keeps seeding from it
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"path/filepath"
+	"wgo/files"
+	)
+
+// Move the files of a finished torrent to the complete folder, if
+// there's one and they aren't there yet. Called when it finishes and
+// periodically, the second call waits for the move of the first one.
+
+func (t *Torrent) checkComplete() {
+	t.moveMutex.Lock()
+	defer t.moveMutex.Unlock()
+	config := t.session.Config()
+	folder := config.CompleteFolder
+	t.mutex.Lock()
+	move := len(folder) > 0 && len(t.completeFolder) == 0 && folder != t.moveFailed && t.running &&
+		t.bitfield.Completed() && t.allocation != files.ALLOCATE_MEMORY && filepath.Clean(folder) != filepath.Clean(config.Folder)
+	t.mutex.Unlock()
+	if !move {
+		return
+	}
+	// Without the mutex, the stats and the API don't wait for a copy
+	// to another filesystem
+	if err := t.files.Move(folder); err != nil {
+		torrentLog.Error("Error moving the finished files", "name", t.Name(), "folder", folder, "err", err)
+		t.mutex.Lock()
+		t.moveFailed = folder
+		t.mutex.Unlock()
+		return
+	}
+	torrentLog.Info("Files moved", "name", t.Name(), "folder", folder)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.completeFolder = folder
+	if t.running {
+		if err := t.saveResume(); err != nil {
+			torrentLog.Error("Error saving resume data", "name", t.Name(), "err", err)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+// Configuration of a Session, and the config file it can be read
+// from. The file has one "option = value" per line, lines starting
+// with # are comments:
+//
+//	port = 6881
+//	folder = /home/user/downloads
+//	down_limit = 100
+//	encryption = require
+//	log = info,peer=debug
+//
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"fmt"
+	"net"
+	"time"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"wgo/peers"
+	"wgo/choke"
+	"wgo/files"
+	"wgo/limiter"
+	"wgo/logger"
+	"wgo/proxy"
+	"errors"
+	)
+
+const(
+	KEEP_ALIVE = 120 // Seconds between our keep-alives
+	TIMEOUT = 240 // Seconds without receiving anything from a peer
+	HANDSHAKE_TIMEOUT = 20 // Seconds to exchange the handshakes
+	WRITE_TIMEOUT = 60 // Seconds to send a message to a peer
+)
+
+type Config struct {
+	Ip, Port string // Local address to listen to, port "0" picks a random one
+	Bind string // Local address or interface of the connections to the peers and trackers, empty for any
+	Folder string // Where the files are saved
+	CompleteFolder string // Where the files are moved when the download finishes, empty to leave them
+	Allocation int // files.ALLOCATE_*
+	CacheSize int // In MB, memory for the pieces read to serve the peers, 0 disables it
+	MemorySpill int // In MB, of each torrent allocated in memory before writing to disk, 0 means no limit
+	UpLimit, DownLimit int // In KB/s, 0 means no limit
+	Schedule []limiter.Window // Other limits for some hours, UpLimit and DownLimit apply outside of them
+	Timezone string // Of the times of the schedule, empty for the local one
+	Encryption int // peers.ENCRYPTION_*
+	Utp bool // Connect to the peers with uTP, falling back to TCP
+	Lsd bool // Local Peer Discovery
+	Nat bool // Map the listening port in the gateway
+	MaxPeers, MaxIncoming int // Outgoing and incoming connections per torrent
+	MaxConnections, MaxHalfOpen int // Connections of all the torrents, and outgoing ones being opened, 0 means no limit
+	DialRate int // Outgoing connections started per second, 0 means no limit
+	UploadSlots int // Unchoked peers per torrent, with the optimistic unchoke
+	MaxDownloads, MaxSeeds int // Torrents downloading and seeding at once, the others are queued, 0 means no limit
+	KeepAlive, Timeout int64 // In seconds
+	HandshakeTimeout, WriteTimeout int64 // In seconds
+	RequestTimeout int64 // Seconds to receive a requested block before requesting it to another peer
+	MaxBadPieces int // Bad pieces sent by an IP before banning it, 0 never bans
+	SeedRatio float64 // Stop seeding after uploading this times the size, 0 means no limit
+	SeedTime int64 // Minutes seeding before stopping, 0 means no limit
+	SeedAction int // SEED_STOP or SEED_REMOVE
+	Proxy, ProxyUser, ProxyPassword string // SOCKS5 proxy (host:port) of the TCP connections, empty for none
+	AnnounceIp, AnnouncePort string // Reported to the trackers, empty for the address of the connection and the listening port
+	NumWant int // Peers asked to the trackers in each announce at most, 0 for as many as we need
+	NoPeerId bool // Ask the trackers to leave the peer ids out of the peer lists
+	OnComplete string // Command run when a torrent finishes, empty for none
+	OnCompleteUrl string // Webhook called with a POST when a torrent finishes, empty for none
+	TraceFolder string // Where the messages of each peer are traced, empty for none
+	LogLevel int // logger.DEBUG...logger.ERROR
+	LogTags map[string]int // Level of some subsystems (peer, wire, tracker, disk...)
+}
+
+func DefaultConfig() *Config {
+	return &Config{Port: "0", Folder: ".", CacheSize: files.DEFAULT_CACHE_SIZE, Encryption: peers.ENCRYPTION_PREFER, Utp: true, Lsd: true, Nat: true,
+		MaxPeers: ACTIVE_PEERS, MaxIncoming: INCOMING_PEERS, MaxConnections: peers.MAX_CONNECTIONS, MaxHalfOpen: peers.MAX_HALF_OPEN, DialRate: peers.DIAL_RATE,
+		UploadSlots: choke.UPLOADING_PEERS, KeepAlive: KEEP_ALIVE, Timeout: TIMEOUT,
+		HandshakeTimeout: HANDSHAKE_TIMEOUT, WriteTimeout: WRITE_TIMEOUT, RequestTimeout: peers.REQUEST_TIMEOUT,
+		MaxBadPieces: peers.MAX_BAD_PIECES, LogLevel: logger.INFO}
+}
+
+// Options of the config file, the ones that are also flags of the
+// command line client have the same name
+
+var options = map[string]func(c *Config, value string) error{
+	"ip": func(c *Config, value string) error { c.Ip = value; return nil },
+	"port": func(c *Config, value string) (err error) {
+		if _, err = strconv.Atoi(value); err == nil {
+			c.Port = value
+		}
+		return
+	},
+	"folder": func(c *Config, value string) error { c.Folder = value; return nil },
+	"complete_folder": func(c *Config, value string) error { c.CompleteFolder = value; return nil },
+	"allocation": func(c *Config, value string) (err error) {
+		c.Allocation, err = files.ParseAllocation(value)
+		return
+	},
+	"memory_spill": func(c *Config, value string) (err error) {
+		c.MemorySpill, err = positive(value)
+		return
+	},
+	"cache_size": func(c *Config, value string) (err error) {
+		c.CacheSize, err = positive(value)
+		return
+	},
+	"up_limit": func(c *Config, value string) (err error) {
+		c.UpLimit, err = positive(value)
+		return
+	},
+	"down_limit": func(c *Config, value string) (err error) {
+		c.DownLimit, err = positive(value)
+		return
+	},
+	"schedule": func(c *Config, value string) (err error) {
+		c.Schedule, err = limiter.ParseSchedule(value)
+		return
+	},
+	"timezone": func(c *Config, value string) (err error) {
+		if len(value) > 0 {
+			_, err = time.LoadLocation(value)
+		}
+		c.Timezone = value
+		return
+	},
+	"encryption": func(c *Config, value string) (err error) {
+		c.Encryption, err = peers.ParseEncryption(value)
+		return
+	},
+	"utp": func(c *Config, value string) (err error) {
+		c.Utp, err = strconv.ParseBool(value)
+		return
+	},
+	"lsd": func(c *Config, value string) (err error) {
+		c.Lsd, err = strconv.ParseBool(value)
+		return
+	},
+	"nat": func(c *Config, value string) (err error) {
+		c.Nat, err = strconv.ParseBool(value)
+		return
+	},
+	"max_peers": func(c *Config, value string) (err error) {
+		if c.MaxPeers, err = positive(value); err == nil && c.MaxPeers == 0 {
+			err = errors.New("Must be greater than 0")
+		}
+		return
+	},
+	"max_incoming": func(c *Config, value string) (err error) {
+		c.MaxIncoming, err = positive(value)
+		return
+	},
+	"max_downloads": func(c *Config, value string) (err error) {
+		c.MaxDownloads, err = positive(value)
+		return
+	},
+	"max_seeds": func(c *Config, value string) (err error) {
+		c.MaxSeeds, err = positive(value)
+		return
+	},
+	"max_connections": func(c *Config, value string) (err error) {
+		c.MaxConnections, err = positive(value)
+		return
+	},
+	"max_half_open": func(c *Config, value string) (err error) {
+		c.MaxHalfOpen, err = positive(value)
+		return
+	},
+	"dial_rate": func(c *Config, value string) (err error) {
+		c.DialRate, err = positive(value)
+		return
+	},
+	"upload_slots": func(c *Config, value string) (err error) {
+		if c.UploadSlots, err = positive(value); err == nil && c.UploadSlots == 0 {
+			err = errors.New("Must be greater than 0")
+		}
+		return
+	},
+	"keep_alive": func(c *Config, value string) (err error) {
+		c.KeepAlive, err = seconds(value)
+		return
+	},
+	"timeout": func(c *Config, value string) (err error) {
+		c.Timeout, err = seconds(value)
+		return
+	},
+	"handshake_timeout": func(c *Config, value string) (err error) {
+		c.HandshakeTimeout, err = seconds(value)
+		return
+	},
+	"write_timeout": func(c *Config, value string) (err error) {
+		c.WriteTimeout, err = seconds(value)
+		return
+	},
+	"request_timeout": func(c *Config, value string) (err error) {
+		c.RequestTimeout, err = seconds(value)
+		return
+	},
+	"max_bad_pieces": func(c *Config, value string) (err error) {
+		c.MaxBadPieces, err = positive(value)
+		return
+	},
+	"seed_ratio": func(c *Config, value string) (err error) {
+		if c.SeedRatio, err = strconv.ParseFloat(value, 64); err == nil && c.SeedRatio < 0 {
+			err = errors.New("Negative value")
+		}
+		return
+	},
+	"seed_time": func(c *Config, value string) (err error) {
+		if c.SeedTime, err = strconv.ParseInt(value, 10, 64); err == nil && c.SeedTime < 0 {
+			err = errors.New("Negative value")
+		}
+		return
+	},
+	"seed_action": func(c *Config, value string) (err error) {
+		c.SeedAction, err = ParseSeedAction(value)
+		return
+	},
+	"proxy": func(c *Config, value string) (err error) {
+		if len(value) > 0 {
+			_, _, err = net.SplitHostPort(value)
+		}
+		c.Proxy = value
+		return
+	},
+	"bind": func(c *Config, value string) (err error) {
+		if len(value) > 0 {
+			_, err = proxy.ResolveBind(value)
+		}
+		c.Bind = value
+		return
+	},
+	"announce_ip": func(c *Config, value string) (err error) {
+		if len(value) > 0 && net.ParseIP(value) == nil {
+			err = errors.New("Invalid IP address")
+		}
+		c.AnnounceIp = value
+		return
+	},
+	"announce_port": func(c *Config, value string) (err error) {
+		if len(value) > 0 {
+			var port int
+			if port, err = strconv.Atoi(value); err == nil && (port <= 0 || port > 65535) {
+				err = errors.New("Invalid port")
+			}
+		}
+		c.AnnouncePort = value
+		return
+	},
+	"numwant": func(c *Config, value string) (err error) {
+		c.NumWant, err = positive(value)
+		return
+	},
+	"no_peer_id": func(c *Config, value string) (err error) {
+		c.NoPeerId, err = strconv.ParseBool(value)
+		return
+	},
+	"on_complete": func(c *Config, value string) error { c.OnComplete = value; return nil },
+	"on_complete_url": func(c *Config, value string) (err error) {
+		if len(value) > 0 && !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+			err = errors.New("Must be an http or https url")
+		}
+		c.OnCompleteUrl = value
+		return
+	},
+	"proxy_user": func(c *Config, value string) error { c.ProxyUser = value; return nil },
+	"proxy_password": func(c *Config, value string) error { c.ProxyPassword = value; return nil },
+	"trace_folder": func(c *Config, value string) error { c.TraceFolder = value; return nil },
+	"log": func(c *Config, value string) (err error) {
+		c.LogLevel, c.LogTags, err = logger.ParseLevels(value)
+		return
+	},
+}
+
+func positive(value string) (n int, err error) {
+	if n, err = strconv.Atoi(value); err == nil && n < 0 {
+		err = errors.New("Negative value")
+	}
+	return
+}
+
+func seconds(value string) (n int64, err error) {
+	if n, err = strconv.ParseInt(value, 10, 64); err == nil && n <= 0 {
+		err = errors.New("Must be greater than 0")
+	}
+	return
+}
+
+// Whether name is an option of the config file
+
+func IsOption(name string) bool {
+	_, ok := options[name]
+	return ok
+}
+
+// Set an option from its text value
+
+func (c *Config) Set(name, value string) (err error) {
+	set, ok := options[name]
+	if !ok {
+		return errors.New("Unknown option " + name)
+	}
+	if err = set(c, value); err != nil {
+		return fmt.Errorf("Bad value for %s: %w", name, err)
+	}
+	return
+}
+
+// Read the config file over the values of c, so options missing
+// from the file keep their value
+
+func LoadConfig(path string, c *Config) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for i, line := range(strings.Split(string(data), "\n")) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pos := strings.Index(line, "=")
+		if pos < 0 {
+			return errors.New(path + ":" + strconv.Itoa(i+1) + ": Expected option = value")
+		}
+		if err = c.Set(strings.TrimSpace(line[0:pos]), strings.TrimSpace(line[pos+1:])); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+	}
+	return
+}
+
+// The schedule of the limiter, nil if there isn't one
+
+func (c *Config) schedule() (*limiter.Schedule) {
+	if len(c.Schedule) == 0 {
+		return nil
+	}
+	location := time.Local
+	if len(c.Timezone) > 0 {
+		var err error
+		if location, err = time.LoadLocation(c.Timezone); err != nil {
+			sessionLog.Warn("Unknown time zone, using the local one", "timezone", c.Timezone, "err", err)
+			location = time.Local
+		}
+	}
+	return &limiter.Schedule{Windows: c.Schedule, Location: location}
+}
+
+// Values that are only wrong together
+
+func (c *Config) check() (error) {
+	if c.KeepAlive >= c.Timeout {
+		return errors.New("keep_alive must be lower than timeout")
+	}
+	if len(c.ProxyUser) > 255 || len(c.ProxyPassword) > 255 {
+		return errors.New("proxy_user and proxy_password must be shorter than 256 bytes")
+	}
+	return nil
+}
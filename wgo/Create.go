@@ -0,0 +1,223 @@
+// Creation of torrent files from a file or a folder, the pieces are
+// hashed by several goroutines at once
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"os"
+	"io"
+	"path"
+	"sort"
+	"time"
+	"bytes"
+	"crypto/sha1"
+	"wgo/bencode"
+	"wgo/wgo_io"
+	"errors"
+	)
+
+const(
+	MIN_CREATE_PIECE = 32*1024
+	MAX_CREATE_PIECE = 16*1024*1024
+	TARGET_PIECES = 1500 // Pieces of the torrents created with the default piece length
+	HASH_THREADS = 4
+)
+
+type CreateOptions struct {
+	Announce [][]string // Tiers of trackers, the first one is also the announce key
+	Comment string
+	Private bool
+	PieceLength int64 // Power of 2, 0 picks one from the size
+	WebSeeds []string
+	Threads int // Goroutines hashing the pieces, 0 means HASH_THREADS
+}
+
+// A file of the torrent, with its path inside the folder
+
+type createFile struct {
+	name string
+	path []string
+	length int64
+}
+
+// Smallest power of 2 that makes about TARGET_PIECES pieces
+
+func PieceLengthFor(size int64) int64 {
+	length := int64(MIN_CREATE_PIECE)
+	for size/length > TARGET_PIECES && length < MAX_CREATE_PIECE {
+		length *= 2
+	}
+	return length
+}
+
+// Files of a folder and its subfolders, sorted by path
+
+func listFiles(name string, parts []string) (list []createFile, err error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	if fi.Mode().IsRegular() {
+		return []createFile{createFile{name, parts, fi.Size()}}, nil
+	}
+	if !fi.IsDir() {
+		return
+	}
+	dir, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, n := range(names) {
+		sub := make([]string, len(parts)+1)
+		copy(sub, parts)
+		sub[len(parts)] = n
+		files, err := listFiles(name + "/" + n, sub)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, files...)
+	}
+	return
+}
+
+// SHA1 of every piece of the data read from r
+
+func hashPieces(r io.ReaderAt, size, pieceLength int64, threads int) (pieces []byte, err error) {
+	numPieces := (size + pieceLength - 1)/pieceLength
+	pieces = make([]byte, numPieces*sha1.Size)
+	indexes := make(chan int64)
+	errs := make(chan error, threads)
+	for i := 0; i < threads; i++ {
+		go func() {
+			buf := make([]byte, pieceLength)
+			var e error
+			for index := range(indexes) {
+				if e != nil {
+					continue
+				}
+				length := pieceLength
+				if index == numPieces-1 {
+					length = size - index*pieceLength
+				}
+				if _, e = r.ReadAt(buf[0:length], index*pieceLength); e != nil {
+					continue
+				}
+				hash := sha1.New()
+				hash.Write(buf[0:length])
+				copy(pieces[index*sha1.Size:], hash.Sum(nil))
+			}
+			errs <- e
+		}()
+	}
+	for index := int64(0); index < numPieces; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	for i := 0; i < threads; i++ {
+		if e := <- errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Create a torrent of the file or folder in name, writing the torrent
+// file to w. Returns the infohash of the new torrent.
+
+func CreateTorrent(name string, opt *CreateOptions, w io.Writer) (infohash string, err error) {
+	_, base := path.Split(path.Clean(name))
+	list, err := listFiles(name, nil)
+	if err != nil {
+		return
+	}
+	if len(list) == 0 {
+		return "", errors.New("No files in " + name)
+	}
+	var size int64
+	for _, f := range(list) {
+		size += f.length
+	}
+	if size == 0 {
+		return "", errors.New("Empty torrent")
+	}
+	pieceLength := opt.PieceLength
+	if pieceLength == 0 {
+		pieceLength = PieceLengthFor(size)
+	}
+	if pieceLength < 16*1024 || pieceLength&(pieceLength-1) != 0 {
+		return "", errors.New("The piece length must be a power of 2 of at least 16 KB")
+	}
+	threads := opt.Threads
+	if threads <= 0 {
+		threads = HASH_THREADS
+	}
+	fds := make([]*os.File, len(list))
+	for i, f := range(list) {
+		if fds[i], err = os.Open(f.name); err != nil {
+			break
+		}
+	}
+	defer func() {
+		for _, fd := range(fds) {
+			if fd != nil {
+				fd.Close()
+			}
+		}
+	}()
+	if err != nil {
+		return
+	}
+	r, err := wgo_io.MultiReaderAt(fds)
+	if err != nil {
+		return
+	}
+	pieces, err := hashPieces(r, size, pieceLength, threads)
+	if err != nil {
+		return
+	}
+	info := map[string]interface{}{"name": base, "piece length": pieceLength, "pieces": string(pieces)}
+	if list[0].path == nil {
+		// A single file
+		info["length"] = size
+	} else {
+		files := make([]interface{}, len(list))
+		for i, f := range(list) {
+			files[i] = map[string]interface{}{"length": f.length, "path": f.path}
+		}
+		info["files"] = files
+	}
+	if opt.Private {
+		info["private"] = int64(1)
+	}
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, info); err != nil {
+		return
+	}
+	hash := sha1.New()
+	hash.Write(b.Bytes())
+	torrent := map[string]interface{}{"info": info, "creation date": time.Now().Unix(), "created by": "wgo"}
+	if len(opt.Announce) > 0 && len(opt.Announce[0]) > 0 {
+		torrent["announce"] = opt.Announce[0][0]
+		if len(opt.Announce) > 1 || len(opt.Announce[0]) > 1 {
+			torrent["announce-list"] = opt.Announce
+		}
+	}
+	if len(opt.Comment) > 0 {
+		torrent["comment"] = opt.Comment
+	}
+	if len(opt.WebSeeds) > 0 {
+		torrent["url-list"] = opt.WebSeeds
+	}
+	if err = bencode.Marshal(w, torrent); err != nil {
+		return
+	}
+	return string(hash.Sum(nil)), nil
+}
@@ -0,0 +1,108 @@
+// Commands and webhooks run when a torrent finishes downloading, for
+// the post-processing of the files. The command gets the torrent in
+// WGO_NAME, WGO_PATH (of the files, after moving them to the complete
+// folder) and WGO_INFOHASH (in hex), and the webhook a POST with the
+// same values in a JSON object.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"os"
+	"os/exec"
+	"time"
+	"bytes"
+	"net/http"
+	"encoding/hex"
+	"encoding/json"
+	"wgo/events"
+	"errors"
+	)
+
+const(
+	HOOK_TIMEOUT = 30 // Seconds to answer the webhook
+)
+
+type hookInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Infohash string `json:"infohash"`
+}
+
+// Run the hooks of the torrents that finish, until the session is
+// closed
+
+func (s *Session) runHooks(c <-chan events.Event) {
+	for e := range(c) {
+		if e.Type != events.TORRENT_FINISHED {
+			continue
+		}
+		if t, ok := s.Torrent(e.Infohash); ok {
+			go t.finished()
+		}
+	}
+}
+
+// Where the files of the torrent are, the folder of a multi-file
+// torrent or the file of a single one
+
+func (t *Torrent) Path() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	folder := t.folder
+	if len(t.completeFolder) > 0 {
+		folder = t.completeFolder
+	}
+	return folder + "/" + t.Name()
+}
+
+// Move the files first, so the hooks get the final path
+
+func (t *Torrent) finished() {
+	t.checkComplete()
+	config := t.session.Config()
+	if len(config.OnComplete) == 0 && len(config.OnCompleteUrl) == 0 {
+		return
+	}
+	info := hookInfo{Name: t.Name(), Path: t.Path(), Infohash: hex.EncodeToString([]byte(t.Infohash()))}
+	if len(config.OnComplete) > 0 {
+		if err := runCommand(config.OnComplete, &info); err != nil {
+			torrentLog.Error("Error running the completion command", "name", info.Name, "command", config.OnComplete, "err", err)
+		} else {
+			torrentLog.Info("Completion command finished", "name", info.Name, "command", config.OnComplete)
+		}
+	}
+	if len(config.OnCompleteUrl) > 0 {
+		if err := postWebhook(config.OnCompleteUrl, &info); err != nil {
+			torrentLog.Error("Error calling the completion webhook", "name", info.Name, "url", config.OnCompleteUrl, "err", err)
+		} else {
+			torrentLog.Info("Completion webhook called", "name", info.Name, "url", config.OnCompleteUrl)
+		}
+	}
+}
+
+func runCommand(command string, info *hookInfo) error {
+	cmd := exec.Command(command)
+	cmd.Env = append(os.Environ(), "WGO_NAME=" + info.Name, "WGO_PATH=" + info.Path, "WGO_INFOHASH=" + info.Infohash)
+	return cmd.Run()
+}
+
+// The webhook is called directly, not through the proxy of the peers
+
+func postWebhook(url string, info *hookInfo) (err error) {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: HOOK_TIMEOUT*time.Second}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("Webhook answered " + response.Status)
+	}
+	return
+}
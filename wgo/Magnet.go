@@ -0,0 +1,90 @@
+// Magnet links, the info dictionary is downloaded from
+// the peers before starting the download
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"time"
+	"net/url"
+	"strings"
+	"encoding/hex"
+	"encoding/base32"
+	"wgo/bit_field"
+	"wgo/bencode"
+	"wgo/limiter"
+	"wgo/peers"
+	"wgo/tracker"
+	"errors"
+	)
+
+const(
+	MAGNET_PREFIX = "magnet:?"
+	BTIH_PREFIX = "urn:btih:"
+	MAGNET_TIMEOUT = 180 // Seconds to get the metadata from the peers
+)
+
+// Obtain the infohash, the name and the trackers of a magnet link
+
+func ParseMagnet(uri string) (infohash, name string, trackers []string, err error) {
+	if !strings.HasPrefix(uri, MAGNET_PREFIX) {
+		return infohash, name, trackers, errors.New("Not a magnet link")
+	}
+	values, err := url.ParseQuery(uri[len(MAGNET_PREFIX):])
+	if err != nil {
+		return
+	}
+	for _, xt := range(values["xt"]) {
+		if !strings.HasPrefix(xt, BTIH_PREFIX) {
+			continue
+		}
+		var hash []byte
+		switch hexhash := xt[len(BTIH_PREFIX):]; len(hexhash) {
+			case 40:
+				hash, err = hex.DecodeString(hexhash)
+			case 32:
+				hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hexhash))
+			default:
+				err = errors.New("Invalid infohash length")
+		}
+		if err != nil {
+			return
+		}
+		infohash = string(hash)
+	}
+	if len(infohash) != 20 {
+		return infohash, name, trackers, errors.New("Magnet link without infohash")
+	}
+	if dn, ok := values["dn"]; ok && len(dn) > 0 {
+		name = dn[0]
+	}
+	trackers = values["tr"]
+	return
+}
+
+// Download the info dictionary from the peers returned by the
+// trackers of the magnet link, there is no DHT to find them without
+// trackers. It gives up after MAGNET_TIMEOUT seconds.
+
+func NewMetaInfoFromMagnet(uri, peerId string, params tracker.Params, l limiter.Limiter) (metaInfo *bencode.MetaInfo, err error) {
+	infohash, name, trackers, err := ParseMagnet(uri)
+	if err != nil {
+		return
+	}
+	if len(trackers) == 0 {
+		return metaInfo, errors.New("Magnet link without trackers")
+	}
+	sessionLog.Info("Downloading metadata", "name", name)
+	metadataMgr := peers.NewMetadataMgr(infohash, peerId, l)
+	// The size of the torrent is unknown until we have the metadata
+	bf := bit_field.NewBitfield(1)
+	trackerMgr := tracker.NewTrackerMgr([][]string{trackers}, infohash, "", params, metadataMgr, 1, bf, 1, 1, peerId, nil)
+	info, err := metadataMgr.Metadata(MAGNET_TIMEOUT*time.Second)
+	trackerMgr.Stop()
+	if err != nil {
+		return metaInfo, err
+	}
+	sessionLog.Info("Metadata downloaded", "name", name)
+	return NewMetaInfoFromMetadata(info, trackers)
+}
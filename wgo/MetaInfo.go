@@ -0,0 +1,195 @@
+package wgo
+
+import(
+	"fmt"
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"wgo/bencode"
+	"wgo/proxy"
+	"net/http"
+	"os"
+	"strings"
+	"strconv"
+	"errors"
+)
+
+func getString(m map[string]interface{}, k string) string {
+	if v, ok := m[k]; ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func getInt(m map[string]interface{}, k string) int64 {
+	if v, ok := m[k]; ok {
+		if i, ok := v.(int64); ok {
+			return i
+		}
+	}
+	return 0
+}
+
+// Tiers of trackers of the announce-list (BEP 12)
+
+func getTiers(m map[string]interface{}, k string) (tiers [][]string) {
+	tiers = make([][]string, 0)
+	if v, ok := m[k]; ok {
+		if f, ok := v.([]interface{}); ok {
+			for _, s := range f {
+				if l, ok := s.([]interface{}); ok {
+					tier := make([]string, 0, len(l))
+					for _, q := range l {
+						if e, ok := q.(string); ok {
+							tier = append(tier, e)
+						}
+					}
+					if len(tier) > 0 {
+						tiers = append(tiers, tier)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// Web seeds (BEP 19), url-list can be a single url or a list
+
+func getUrlList(m map[string]interface{}, k string) (list []string) {
+	list = make([]string, 0)
+	if v, ok := m[k]; ok {
+		switch f := v.(type) {
+			case string:
+				list = append(list, f)
+			case []interface{}:
+				for _, s := range f {
+					if e, ok := s.(string); ok {
+						list = append(list, e)
+					}
+				}
+		}
+	}
+	return
+}
+
+func NewMetaInfo(torrent string) (metaInfo *bencode.MetaInfo, err error) {
+	var input io.ReadCloser
+	if strings.HasPrefix(torrent, "http:") {
+		// 6g compiler bug prevents us from writing r, err :=
+		var r *http.Response
+		if r, err = proxy.Get(torrent); err != nil {
+			return
+		}
+		input = r.Body
+	} else {
+		if input, err = os.Open(torrent); err != nil {
+			return
+		}
+	}
+
+	// We need to calcuate the sha1 of the Info map, including every value in the
+	// map. The easiest way to do this is to read the data using the Decode
+	// API, and then pick through it manually.
+	// The info dictionary is encoded again to hash it, which only gives
+	// the infohash of the swarm if the torrent is canonical bencode.
+	data, err := ioutil.ReadAll(input)
+	input.Close()
+	if err != nil {
+		return
+	}
+	var m interface{}
+	if m, err = bencode.DecodeStrict(bytes.NewBuffer(data)); err != nil {
+		torrentLog.Warn("Torrent file is not canonical bencode, the infohash may not match the swarm", "torrent", torrent, "err", err)
+		m, err = bencode.Decode(bytes.NewBuffer(data))
+	}
+	if err != nil {
+		err = fmt.Errorf("Couldn't parse torrent file phase 1: %w", err)
+		return
+	}
+
+	topMap, ok := m.(map[string]interface{})
+	if !ok {
+		err = errors.New("Couldn't parse torrent file phase 2.")
+		return
+	}
+
+	infoMap, ok := topMap["info"]
+	if !ok {
+		err = errors.New("Couldn't parse torrent file. info")
+		return
+	}
+	var b bytes.Buffer
+	if err = bencode.Marshal(&b, infoMap); err != nil {
+		return
+	}
+	hash := sha1.New()
+	hash.Write(b.Bytes())
+	infoData := b.Bytes()
+
+	var m2 bencode.MetaInfo
+	err = bencode.Unmarshal(&b, &m2.Info)
+	if err != nil {
+		return
+	}
+	m2.Infohash = string(hash.Sum(nil))
+	if m2.Info.Meta_version == META_VERSION_2 {
+		m2.InfohashV2 = infohashV2(infoData)
+		if len(m2.Info.Pieces) == 0 {
+			// Only v2, the hybrid torrents also have the v1 pieces
+			info, _ := infoMap.(map[string]interface{})
+			layers, _ := topMap["piece layers"].(map[string]interface{})
+			if err = parseV2(info, layers, &m2); err != nil {
+				return
+			}
+			m2.Infohash = m2.InfohashV2[0:20]
+		} else if err = parseHybrid(infoMap, topMap, &m2); err != nil {
+			return
+		}
+	} else if m2.Info.Meta_version != 0 {
+		err = errors.New("Unknown meta version " + strconv.FormatInt(m2.Info.Meta_version, 10))
+		return
+	}
+	m2.Announce = getString(topMap, "announce")
+	m2.CreationDate = getInt(topMap, "creation date")
+	m2.Comment = getString(topMap, "comment")
+	m2.CreatedBy = getString(topMap, "created by")
+	m2.Encoding = getString(topMap, "encoding")
+	// If the announce-list is present the announce key is ignored
+	m2.Announce_list = getTiers(topMap, "announce-list")
+	if len(m2.Announce_list) == 0 && len(m2.Announce) > 0 {
+		m2.Announce_list = [][]string{[]string{m2.Announce}}
+	}
+
+	m2.Url_list = getUrlList(topMap, "url-list")
+
+	metaInfo = &m2
+	return
+}
+
+// Create the MetaInfo from a bencoded info dictionary, as
+// downloaded from the peers when using magnet links
+
+func NewMetaInfoFromMetadata(info []byte, trackers []string) (metaInfo *bencode.MetaInfo, err error) {
+	var m bencode.MetaInfo
+	if err = bencode.Unmarshal(bytes.NewBuffer(info), &m.Info); err != nil {
+		return
+	}
+	if m.Info.Meta_version == META_VERSION_2 && len(m.Info.Pieces) == 0 {
+		// The piece layers are not in the metadata
+		return nil, errors.New("Magnet links of v2 torrents are not supported")
+	}
+	hash := sha1.New()
+	hash.Write(info)
+	m.Infohash = string(hash.Sum(nil))
+	if len(trackers) > 0 {
+		m.Announce = trackers[0]
+	}
+	// All the trackers of the magnet link in the same tier
+	m.Announce_list = [][]string{trackers}
+	metaInfo = &m
+	return
+}
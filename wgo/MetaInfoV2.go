@@ -0,0 +1,166 @@
+// BitTorrent v2 metainfo (BEP 52): the files are in a tree, each one
+// with the root of the merkle tree of its 16 KB blocks, and the hashes
+// of the pieces are in the piece layers outside of the info dictionary.
+// Every file starts at a piece boundary, so padding files are added
+// between them to keep the layout of the v1 torrents.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"crypto/sha256"
+	"wgo/bencode"
+	"errors"
+	)
+
+const(
+	META_VERSION_2 = 2
+	V2_HASH = 32 // Length of the SHA-256 hashes
+)
+
+// Files of the file tree with their path, in the order of the tree
+// (sorted by name at every level)
+
+func walkFileTree(tree map[string]interface{}, parts []string, list *[]bencode.FileDict) (err error) {
+	names := make([]string, 0, len(tree))
+	for name, _ := range(tree) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range(names) {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return errors.New("Bad node in the file tree: " + name)
+		}
+		if name == "" {
+			// The file itself
+			length, ok := node["length"].(int64)
+			if !ok || length < 0 {
+				return errors.New("Bad file length in the file tree")
+			}
+			f := bencode.FileDict{Length: length, Path: parts}
+			if length > 0 {
+				if f.Pieces_root, ok = node["pieces root"].(string); !ok || len(f.Pieces_root) != V2_HASH {
+					return errors.New("Bad pieces root in the file tree")
+				}
+			}
+			*list = append(*list, f)
+			continue
+		}
+		sub := make([]string, len(parts)+1)
+		copy(sub, parts)
+		sub[len(parts)] = name
+		if err = walkFileTree(node, sub, list); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Fill the files of a v2 info from its file tree and the piece layers
+// of the torrent
+
+func parseV2(info map[string]interface{}, layers map[string]interface{}, m *bencode.MetaInfo) (err error) {
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return errors.New("No file tree in the v2 torrent")
+	}
+	pieceLength := m.Info.Piece_length
+	if pieceLength < 16*1024 || pieceLength&(pieceLength-1) != 0 {
+		return errors.New("Bad piece length of the v2 torrent")
+	}
+	var list []bencode.FileDict
+	if err = walkFileTree(tree, nil, &list); err != nil {
+		return
+	}
+	if len(list) == 0 {
+		return errors.New("Empty file tree")
+	}
+	for i, _ := range(list) {
+		f := &list[i]
+		if f.Length <= pieceLength {
+			// The pieces root is the hash of the only piece
+			continue
+		}
+		layer, ok := layers[f.Pieces_root].(string)
+		if !ok {
+			return errors.New("Missing piece layer of " + f.Path[len(f.Path)-1])
+		}
+		if int64(len(layer)) != (f.Length + pieceLength - 1)/pieceLength*V2_HASH {
+			return errors.New("Bad piece layer length of " + f.Path[len(f.Path)-1])
+		}
+		f.Layer = layer
+	}
+	if len(list) == 1 && len(list[0].Path) == 1 && list[0].Path[0] == m.Info.Name {
+		// A single file, as the single file mode of v1
+		m.Info.Length = list[0].Length
+		m.Info.Pieces_root = list[0].Pieces_root
+		m.Info.Layer = list[0].Layer
+		return
+	}
+	if len(list) == 1 && len(list[0].Path) == 0 {
+		return errors.New("File without name in the file tree")
+	}
+	files := make([]bencode.FileDict, 0, len(list))
+	for i, f := range(list) {
+		files = append(files, f)
+		if pad := f.Length % pieceLength; pad > 0 && i < len(list)-1 {
+			pad = pieceLength - pad
+			files = append(files, bencode.FileDict{Length: pad, Path: []string{".pad", strconv.FormatInt(pad, 10)}, Attr: "p"})
+		}
+	}
+	m.Info.Files = files
+	return
+}
+
+// SHA-256 of the bencoded info, the first 20 bytes are used as the
+// infohash in the handshakes and trackers
+
+func infohashV2(info []byte) string {
+	hash := sha256.New()
+	hash.Write(info)
+	return string(hash.Sum(nil))
+}
+
+// A hybrid torrent has the v1 and v2 versions of the same files, with
+// padding files (BEP 47) in the v1 list. The pieces are checked with
+// SHA-1, the merkle roots and piece layers are kept to answer the hash
+// requests of the v2 peers.
+
+func parseHybrid(infoMap interface{}, topMap map[string]interface{}, m *bencode.MetaInfo) (err error) {
+	info, _ := infoMap.(map[string]interface{})
+	layers, _ := topMap["piece layers"].(map[string]interface{})
+	v2 := &bencode.MetaInfo{Info: bencode.InfoDict{Name: m.Info.Name, Piece_length: m.Info.Piece_length}}
+	if err = parseV2(info, layers, v2); err != nil {
+		return fmt.Errorf("Bad v2 part of the hybrid torrent: %w", err)
+	}
+	if len(m.Info.Files) == 0 {
+		if len(v2.Info.Files) > 0 || v2.Info.Length != m.Info.Length {
+			return errors.New("The v1 and v2 files of the hybrid torrent don't match")
+		}
+		m.Info.Pieces_root, m.Info.Layer = v2.Info.Pieces_root, v2.Info.Layer
+		return
+	}
+	// Both lists have the same files, in the same order
+	j := 0
+	for i, _ := range(m.Info.Files) {
+		f := &m.Info.Files[i]
+		if strings.Index(f.Attr, "p") >= 0 {
+			continue
+		}
+		for j < len(v2.Info.Files) && strings.Index(v2.Info.Files[j].Attr, "p") >= 0 {
+			j++
+		}
+		if j == len(v2.Info.Files) || v2.Info.Files[j].Length != f.Length {
+			return errors.New("The v1 and v2 files of the hybrid torrent don't match")
+		}
+		f.Pieces_root, f.Layer = v2.Info.Files[j].Pieces_root, v2.Info.Files[j].Layer
+		j++
+	}
+	return
+}
@@ -0,0 +1,154 @@
+// Limits of the torrents downloading and seeding at once, the ones
+// over the limits wait queued until a slot frees up. The slots go to
+// the torrents in the order of the queue, the order they were added in
+// unless they are moved.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"time"
+	"errors"
+	)
+
+const(
+	QUEUE_CHECK = 5 // Seconds between checks of the queue
+)
+
+func (s *Session) runQueue(quit chan bool) {
+	check := time.NewTicker(QUEUE_CHECK*time.Second)
+	for {
+		select {
+			case <- quit:
+				check.Stop()
+				return
+			case <- check.C:
+				s.checkQueue()
+		}
+	}
+}
+
+// The torrents in the order of the queue
+
+func (s *Session) queueOrder() (torrents []*Torrent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, infohash := range(s.queue) {
+		torrents = append(torrents, s.torrents[infohash])
+	}
+	return
+}
+
+// Called with the mutex held
+
+func (s *Session) removeQueued(infohash string) {
+	for i, queued := range(s.queue) {
+		if queued == infohash {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Active slots of a torrent, max_seeds if it's complete and
+// max_downloads otherwise, 0 means no limit
+
+func (c *Config) activeLimit(complete bool) int {
+	if complete {
+		return c.MaxSeeds
+	}
+	return c.MaxDownloads
+}
+
+// True if the slots of the kind of the torrent are taken by the others
+
+func (s *Session) mustQueue(t *Torrent) bool {
+	config := s.Config()
+	_, _, complete := t.queueState()
+	limit := config.activeLimit(complete)
+	if limit == 0 {
+		return false
+	}
+	active := 0
+	for _, other := range(s.queueOrder()) {
+		if other == t {
+			continue
+		}
+		if running, _, otherComplete := other.queueState(); running && otherComplete == complete {
+			active++
+		}
+	}
+	return active >= limit
+}
+
+// Give the slots to the first torrents of the queue that want to run:
+// the queued ones are started if they get one, and the running ones
+// that don't (because a download finished and became a seed, a torrent
+// was moved up or the limits were lowered) are stopped and queued
+
+func (s *Session) checkQueue() {
+	config := s.Config()
+	if config.MaxDownloads == 0 && config.MaxSeeds == 0 {
+		return
+	}
+	active := make(map[bool]int) // By complete
+	for _, t := range(s.queueOrder()) {
+		running, queued, complete := t.queueState()
+		if !running && !queued {
+			// Paused or stopped
+			continue
+		}
+		if limit := config.activeLimit(complete); limit == 0 || active[complete] < limit {
+			active[complete]++
+			if queued {
+				torrentLog.Info("Starting queued torrent", "name", t.Name(), "seed", complete)
+				if err := t.start(); err != nil {
+					torrentLog.Error("Error starting torrent", "name", t.Name(), "err", err)
+				}
+			}
+			continue
+		}
+		if running {
+			torrentLog.Info("No active slot, queueing torrent", "name", t.Name(), "seed", complete)
+			if err := t.Stop(); err != nil {
+				torrentLog.Error("Error stopping torrent", "name", t.Name(), "err", err)
+			}
+			t.mutex.Lock()
+			t.queued = true
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// Move a torrent to a position of the queue, 0 is the first one
+
+func (s *Session) SetQueuePosition(infohash string, position int) (error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.torrents[infohash]; !ok {
+		return errors.New("Torrent not found")
+	}
+	if position < 0 {
+		return errors.New("Negative queue position")
+	}
+	s.removeQueued(infohash)
+	if position > len(s.queue) {
+		position = len(s.queue)
+	}
+	s.queue = append(s.queue[:position], append([]string{infohash}, s.queue[position:]...)...)
+	return nil
+}
+
+// Position of a torrent in the queue, -1 if it isn't in the session
+
+func (s *Session) QueuePosition(infohash string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, queued := range(s.queue) {
+		if queued == infohash {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,253 @@
+// Fast-resume data of the torrents
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"sort"
+	"time"
+	"wgo/bit_field"
+	"wgo/files"
+	"wgo/peers"
+	"errors"
+	)
+
+const(
+	PEER_CACHE = 100 // Peers kept in the resume data
+	PEER_CACHE_AGE = 7*24*3600 // Seconds since a cached peer was seen to forget it
+)
+
+// The resume file is kept in the download folder, next to the files
+
+func resumePath(folder, infohash string) string {
+	return folder + "/.wgo-" + hex.EncodeToString([]byte(infohash)) + ".resume"
+}
+
+// Delete the resume file of a torrent being removed
+
+func (t *Torrent) removeResume() (err error) {
+	if err = os.Remove(t.resumeFile); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// Load the resume data, returning an error if it doesn't exist or the
+// files have changed since it was saved (so they have to be checked).
+// If they changed, which happens when wgo didn't stop cleanly, the
+// resume data is returned too but its pieces can't be used until the
+// files are checked.
+
+func (t *Torrent) loadResume() (r *files.ResumeData, bitfield *bit_field.Bitfield, err error) {
+	if r, err = files.LoadResume(t.resumeFile); err != nil {
+		return nil, nil, err
+	}
+	if !r.Valid(t.files) {
+		err = errors.New("Files modified since the resume data was saved")
+		return
+	}
+	pieceLength := t.metaInfo.Info.Piece_length
+	numPieces := (t.size + pieceLength - 1) / pieceLength
+	if bitfield, err = bit_field.NewBitfieldFromBytes(numPieces, []byte(r.Bitfield)); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// Offset in the piece and length of a block
+
+func (t *Torrent) block(index, block int64) (begin, length int64) {
+	pieceLength := t.metaInfo.Info.Piece_length
+	if index == t.bitfield.Len()-1 {
+		pieceLength = t.lastPieceLength
+	}
+	begin = block*peers.STANDARD_BLOCK_LENGTH
+	length = pieceLength - begin
+	if length > peers.STANDARD_BLOCK_LENGTH {
+		length = peers.STANDARD_BLOCK_LENGTH
+	}
+	return
+}
+
+// SHA-1 of the data of a block in the files, empty if it can't be read
+
+func (t *Torrent) blockHash(index, block int64) string {
+	begin, length := t.block(index, block)
+	if length <= 0 {
+		return ""
+	}
+	data := make([]byte, length)
+	if err := t.files.ReadAt(index, begin, data); err != nil {
+		return ""
+	}
+	sum := sha1.Sum(data)
+	return string(sum[:])
+}
+
+// The hashes of the blocks of a partial piece, in order
+
+func (t *Torrent) blockHashes(index int64, blocks *bit_field.Bitfield) (hashes string) {
+	for block := int64(0); block < blocks.Len(); block++ {
+		if !blocks.IsSet(block) {
+			continue
+		}
+		hash := t.blockHash(index, block)
+		if len(hash) == 0 {
+			return ""
+		}
+		hashes += hash
+	}
+	return
+}
+
+// After checking the files, keep the blocks of the partial pieces that
+// still have the data they had when the resume data was saved. The
+// pieces without hashes, of older versions, are downloaded again.
+
+func (t *Torrent) verifyPartial(r *files.ResumeData) {
+	partial := r.Partial
+	r.Partial = nil
+	kept := 0
+	for _, piece := range(partial) {
+		if piece.Index < 0 || piece.Index >= t.bitfield.Len() || t.bitfield.IsSet(piece.Index) {
+			continue
+		}
+		blocks, err := bit_field.NewBitfieldFromBytes(int64(len(piece.Blocks))*8, []byte(piece.Blocks))
+		if err != nil {
+			continue
+		}
+		good, goodHashes := bit_field.NewBitfield(blocks.Len()), ""
+		hashes := piece.Hashes
+		for block := int64(0); block < blocks.Len() && len(hashes) >= sha1.Size; block++ {
+			if !blocks.IsSet(block) {
+				continue
+			}
+			if hash := hashes[0:sha1.Size]; t.blockHash(piece.Index, block) == hash {
+				good.Set(block)
+				goodHashes += hash
+				kept++
+			}
+			hashes = hashes[sha1.Size:]
+		}
+		if good.Count() > 0 {
+			r.Partial = append(r.Partial, files.ResumePiece{Index: piece.Index, Blocks: string(good.Bytes()), Hashes: goodHashes})
+		}
+	}
+	torrentLog.Info("Partial pieces checked", "name", t.Name(), "pieces", len(r.Partial), "blocks", kept)
+}
+
+// Restore the partial pieces, the stats and the peer cache
+
+func (t *Torrent) restoreResume(r *files.ResumeData) {
+	for _, piece := range(r.Partial) {
+		blocks, err := bit_field.NewBitfieldFromBytes(int64(len(piece.Blocks))*8, []byte(piece.Blocks))
+		if err != nil {
+			continue
+		}
+		t.pieceMgr.RestoreBlocks(piece.Index, blocks)
+	}
+	t.stats.SetGlobalStats(r.Uploaded, r.Downloaded)
+	// The best peers are connected first, before the trackers answer
+	t.peerCache = r.PeerCache
+	if len(t.peerCache) == 0 {
+		for _, addr := range(r.Peers) {
+			t.peerCache = append(t.peerCache, files.ResumePeer{Addr: addr, Seen: time.Now().Unix()})
+		}
+	}
+	sortPeerCache(t.peerCache)
+	cache := list.New()
+	for _, peer := range(t.peerCache) {
+		cache.PushBack(peer.Addr)
+	}
+	t.peerMgr.AddPeers(cache, peers.SOURCE_RESUME)
+}
+
+// Best score first, the most recently seen on a tie
+
+func sortPeerCache(cache []files.ResumePeer) {
+	sort.SliceStable(cache, func(i, j int) bool {
+		if cache[i].Score != cache[j].Score {
+			return cache[i].Score > cache[j].Score
+		}
+		return cache[i].Seen > cache[j].Seen
+	})
+}
+
+// Add the connected peers to the cache, their score is averaged with
+// the one they had so a peer idle for a moment isn't forgotten. The
+// peers not seen in PEER_CACHE_AGE are dropped.
+
+func (t *Torrent) updatePeerCache() {
+	now := time.Now().Unix()
+	cache := make(map[string]files.ResumePeer)
+	for _, peer := range(t.peerCache) {
+		if now - peer.Seen <= PEER_CACHE_AGE {
+			cache[peer.Addr] = peer
+		}
+	}
+	for addr, peer := range(t.peerMgr.GetPeers()) {
+		listen := peer.ListenAddr()
+		if len(listen) == 0 {
+			continue
+		}
+		down, up := t.stats.GetRates(addr)
+		cached, ok := cache[listen]
+		score := down + up
+		if ok {
+			score = (cached.Score + score)/2
+		}
+		cache[listen] = files.ResumePeer{Addr: listen, Seen: now, Score: score}
+	}
+	t.peerCache = make([]files.ResumePeer, 0, len(cache))
+	for _, peer := range(cache) {
+		t.peerCache = append(t.peerCache, peer)
+	}
+	sortPeerCache(t.peerCache)
+	if len(t.peerCache) > PEER_CACHE {
+		t.peerCache = t.peerCache[:PEER_CACHE]
+	}
+}
+
+// The state of the torrent kept between runs, the files of the
+// memory allocation can't be checked
+
+func (t *Torrent) resumeData() (r *files.ResumeData, err error) {
+	r = new(files.ResumeData)
+	// Stat the files first, a block written afterwards makes the
+	// resume data stale instead of silently missing
+	if t.allocation != files.ALLOCATE_MEMORY {
+		if r.Files, err = t.files.Stat(); err != nil {
+			return
+		}
+	}
+	r.Bitfield = string(t.bitfield.Bytes())
+	for index, blocks := range(t.pieceMgr.Partial()) {
+		piece := files.ResumePiece{Index: index, Blocks: string(blocks.Bytes())}
+		if t.allocation != files.ALLOCATE_MEMORY {
+			piece.Hashes = t.blockHashes(index, blocks)
+		}
+		r.Partial = append(r.Partial, piece)
+	}
+	r.Uploaded, r.Downloaded = t.stats.GetGlobalStats()
+	r.Seeding, r.Active = t.seedingTime(), t.activeTime()
+	t.updatePeerCache()
+	r.PeerCache = t.peerCache
+	r.Folder = t.completeFolder
+	return
+}
+
+func (t *Torrent) saveResume() (err error) {
+	if t.allocation == files.ALLOCATE_MEMORY {
+		return
+	}
+	r, err := t.resumeData()
+	if err != nil {
+		return
+	}
+	return files.SaveResume(t.resumeFile, r)
+}
@@ -0,0 +1,113 @@
+// Limits of the seeding, a finished torrent is stopped (or removed
+// from the session) once it has uploaded ratio times its size or has
+// been seeding for some time
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"time"
+	"errors"
+	)
+
+const(
+	SEED_CHECK = 60 // Seconds between checks of the seed limits
+)
+
+const(
+	SEED_STOP = iota // Stop the torrent, it stays in the session
+	SEED_REMOVE // Remove the torrent from the session, keeping the files
+)
+
+func ParseSeedAction(action string) (int, error) {
+	switch action {
+		case "stop":
+			return SEED_STOP, nil
+		case "remove":
+			return SEED_REMOVE, nil
+	}
+	return SEED_STOP, errors.New("Unknown seed action " + action)
+}
+
+// Uploaded bytes over the size of the torrent
+
+func ratio(uploaded, size int64) float64 {
+	if size <= 0 {
+		return 0
+	}
+	return float64(uploaded)/float64(size)
+}
+
+// Change the seed limits of the torrent, the ones of the session
+// configuration are not used anymore. 0 means no limit, the time
+// is in minutes.
+
+func (t *Torrent) SetSeedLimits(seedRatio float64, seedTime int64) (error) {
+	if seedRatio < 0 || seedTime < 0 {
+		return errors.New("Negative seed limit")
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.seedRatio, t.seedTime = seedRatio, seedTime
+	t.customSeed = true
+	return nil
+}
+
+func (t *Torrent) SeedLimits() (seedRatio float64, seedTime int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.seedRatio, t.seedTime
+}
+
+// Seconds the torrent has been seeding, over all its runs
+
+func (t *Torrent) seedingTime() int64 {
+	if t.running && t.seedingSince > 0 {
+		return t.seeding + time.Now().Unix() - t.seedingSince
+	}
+	return t.seeding
+}
+
+// Account the seeding time and whether a limit has been reached, called
+// with the mutex held
+
+func (t *Torrent) seedLimitReached() bool {
+	if !t.running || !t.bitfield.Completed() {
+		return false
+	}
+	now := time.Now().Unix()
+	if t.seedingSince == 0 {
+		t.seedingSince = now
+		return false
+	}
+	t.seeding += now - t.seedingSince
+	t.seedingSince = now
+	if t.seedTime > 0 && t.seeding >= t.seedTime*60 {
+		return true
+	}
+	uploaded, _ := t.stats.GetGlobalStats()
+	return t.seedRatio > 0 && ratio(uploaded, t.size) >= t.seedRatio
+}
+
+// Stop seeding if a limit has been reached
+
+func (t *Torrent) checkSeed() {
+	t.mutex.Lock()
+	reached := t.seedLimitReached()
+	t.mutex.Unlock()
+	if !reached {
+		return
+	}
+	action := t.session.Config().SeedAction
+	torrentLog.Info("Seed limit reached", "name", t.Name(), "remove", action == SEED_REMOVE)
+	var err error
+	if action == SEED_REMOVE {
+		err = t.session.RemoveTorrent(t.Infohash(), false)
+	} else {
+		err = t.Stop()
+	}
+	if err != nil {
+		torrentLog.Error("Error stopping torrent", "name", t.Name(), "err", err)
+	}
+}
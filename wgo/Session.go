@@ -0,0 +1,416 @@
+// Session, global configuration and state shared by the torrents
+// (listener, port mapping, local peer discovery and limits).
+// This is the entry point to use wgo as a library.
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"sync"
+	"strings"
+	"strconv"
+	"wgo/limiter"
+	"wgo/listener"
+	"wgo/nat"
+	"wgo/lsd"
+	"wgo/bencode"
+	"wgo/events"
+	"wgo/logger"
+	"wgo/peers"
+	"wgo/files"
+	"wgo/proxy"
+	"wgo/tracker"
+	"errors"
+	)
+
+var sessionLog = logger.New("session")
+
+// How the external address was found, the first ones are preferred
+
+const(
+	IP_CONFIG = "config" // The announce_ip option
+	IP_NAT = "nat" // Told by the gateway of the port mapping
+	IP_TRACKER = "tracker" // Seen by a tracker (BEP 24)
+)
+
+var ipSources = map[string]int{IP_CONFIG: 0, IP_NAT: 1, IP_TRACKER: 2}
+
+type Session struct {
+	mutex *sync.Mutex
+	config Config
+	peerId string
+	limiter limiter.Limiter
+	bans *peers.BanList // IPs that sent bad pieces to any torrent
+	conns *peers.ConnLimit // Connections of all the torrents
+	listener *listener.Listener
+	listenPort, announcePort string
+	mapping *nat.Mapping
+	externalIp, externalSource string // Our address in the internet, empty if unknown
+	lsd *lsd.Lsd
+	torrents map[string]*Torrent // By infohash
+	queue []string // Infohashes of the torrents, the first ones get the active slots
+	totals files.Totals // Of the previous runs and the accounted transfers of this one
+	totalsFile string
+	started int64 // When the session was created
+	events *events.Bus
+	hooks <-chan events.Event // Of runHooks
+	quit chan bool
+}
+
+func NewSession(config *Config) (s *Session, err error) {
+	if err = config.check(); err != nil {
+		return
+	}
+	s = new(Session)
+	s.mutex = new(sync.Mutex)
+	s.config = *config
+	logger.SetLevels(config.LogLevel, config.LogTags)
+	if err = proxy.Set(config.Proxy, config.ProxyUser, config.ProxyPassword); err != nil {
+		return
+	}
+	if err = proxy.SetBind(config.Bind); err != nil {
+		return
+	}
+	files.SetCacheSize(config.CacheSize)
+	files.SetMemorySpill(config.MemorySpill)
+	if s.peerId, err = peers.NewPeerId(); err != nil {
+		return
+	}
+	sessionLog.Info("Session created", "peer_id", s.peerId)
+	if s.limiter, err = limiter.NewLimiter(config.UpLimit, config.DownLimit); err != nil {
+		return
+	}
+	s.limiter.SetSchedule(config.schedule())
+	s.torrents = make(map[string]*Torrent)
+	s.events = events.NewBus()
+	s.hooks = s.events.Subscribe()
+	go s.runHooks(s.hooks)
+	s.loadTotals(config.Folder)
+	if len(config.AnnounceIp) > 0 {
+		s.setExternalIp(config.AnnounceIp, IP_CONFIG)
+	}
+	s.bans = peers.NewBanList()
+	s.conns = peers.NewConnLimit()
+	s.conns.SetMax(config.MaxConnections, config.MaxHalfOpen)
+	s.conns.SetDialRate(config.DialRate)
+	// The incoming connections use the bound address too
+	ip := config.Ip
+	if local := proxy.LocalTCP(); len(ip) == 0 && local != nil {
+		ip = local.IP.String()
+	}
+	if s.listener, s.listenPort, err = listener.NewListener(ip, config.Port, config.Encryption, config.Utp); err != nil {
+		return
+	}
+	s.listener.SetHandshakeTimeout(config.HandshakeTimeout)
+	// Port announced to the trackers and the peers
+	s.announcePort = s.listenPort
+	if config.Nat {
+		if port, err := strconv.Atoi(s.listenPort); err == nil {
+			if s.mapping, err = nat.NewMapping(port); err != nil {
+				sessionLog.Warn("Error mapping the port in the gateway", "err", err)
+				s.mapping = nil
+			} else {
+				s.announcePort = strconv.Itoa(s.mapping.ExternalPort())
+				if ip := s.mapping.ExternalIp(); len(ip) > 0 {
+					s.setExternalIp(ip, IP_NAT)
+				}
+			}
+		}
+	}
+	if config.Lsd {
+		if s.lsd, err = lsd.NewLsd(s.listenPort); err != nil {
+			sessionLog.Warn("Error starting local peer discovery", "err", err)
+			s.lsd, err = nil, nil
+		}
+	}
+	s.quit = make(chan bool)
+	go s.runQueue(s.quit)
+	return
+}
+
+func (s *Session) PeerId() string {
+	return s.peerId
+}
+
+// Copy of the current configuration
+
+func (s *Session) Config() (config Config) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.config
+}
+
+// Apply a new configuration. The limits and the download folder change
+// at once, and the peer settings are used by the new connections of the
+// running torrents. The listening and bound addresses, LSD and port mapping can't
+// be changed without creating a new Session.
+
+func (s *Session) Reload(config *Config) (err error) {
+	if err = config.check(); err != nil {
+		return
+	}
+	if err = s.SetLimits(config.UpLimit, config.DownLimit); err != nil {
+		return
+	}
+	s.limiter.SetSchedule(config.schedule())
+	if err = proxy.Set(config.Proxy, config.ProxyUser, config.ProxyPassword); err != nil {
+		return
+	}
+	files.SetCacheSize(config.CacheSize)
+	files.SetMemorySpill(config.MemorySpill)
+	s.conns.SetMax(config.MaxConnections, config.MaxHalfOpen)
+	s.conns.SetDialRate(config.DialRate)
+	s.listener.SetHandshakeTimeout(config.HandshakeTimeout)
+	s.mutex.Lock()
+	old := s.config
+	if config.Ip != old.Ip || config.Port != old.Port || config.Bind != old.Bind || config.Lsd != old.Lsd || config.Nat != old.Nat {
+		sessionLog.Warn("The listening address, bind, lsd and nat options need a restart")
+	}
+	logger.SetLevels(config.LogLevel, config.LogTags)
+	s.config = *config
+	s.config.Ip, s.config.Port, s.config.Lsd, s.config.Nat = old.Ip, old.Port, old.Lsd, old.Nat
+	s.config.Bind = old.Bind
+	if len(config.AnnounceIp) > 0 {
+		s.externalIp, s.externalSource = config.AnnounceIp, IP_CONFIG
+	} else if s.externalSource == IP_CONFIG {
+		s.externalIp, s.externalSource = "", ""
+	}
+	s.mutex.Unlock()
+	for _, t := range(s.Torrents()) {
+		t.reload(config)
+	}
+	return
+}
+
+// Global bandwidth limits, can be changed while the torrents are running
+
+func (s *Session) SetLimits(up_limit, down_limit int) (error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.limiter.SetLimits(up_limit, down_limit); err != nil {
+		return err
+	}
+	s.config.UpLimit, s.config.DownLimit = up_limit, down_limit
+	return nil
+}
+
+func (s *Session) Limits() (up_limit, down_limit int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.config.UpLimit, s.config.DownLimit
+}
+
+// The global limits in effect, the ones of a window of the schedule if
+// scheduled
+
+func (s *Session) ActiveLimits() (up_limit, down_limit int, scheduled bool) {
+	return s.limiter.Limits()
+}
+
+// Number of IPs banned for sending bad pieces
+
+func (s *Session) Banned() int {
+	return s.bans.Len()
+}
+
+// Our address in the internet and how it was found, empty if unknown
+
+func (s *Session) ExternalIp() (ip, source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.externalIp, s.externalSource
+}
+
+// Keep the address unless it was found by a better source
+
+func (s *Session) setExternalIp(ip, source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.externalSource) > 0 && ipSources[source] > ipSources[s.externalSource] {
+		return
+	}
+	if ip != s.externalIp {
+		sessionLog.Info("External address", "ip", ip, "source", source)
+	}
+	s.externalIp, s.externalSource = ip, source
+}
+
+func (s *Session) trackerIp(ip string) {
+	s.setExternalIp(ip, IP_TRACKER)
+}
+
+// Connected peers of all the torrents, and outgoing connections
+// being opened
+
+func (s *Session) Connections() (conns, halfOpen int) {
+	return s.conns.Connections()
+}
+
+// Add a torrent from a path, an url or a magnet link. The torrent
+// is not started.
+
+func (s *Session) AddTorrent(torrent string) (t *Torrent, err error) {
+	return s.AddTorrentAllocation(torrent, s.Config().Allocation)
+}
+
+// Add a torrent allocating its files in a different way than the one
+// of the session configuration (files.ALLOCATE_*)
+
+func (s *Session) AddTorrentAllocation(torrent string, allocation int) (t *Torrent, err error) {
+	var metaInfo *bencode.MetaInfo
+	if strings.HasPrefix(torrent, MAGNET_PREFIX) {
+		metaInfo, err = NewMetaInfoFromMagnet(torrent, s.peerId, s.trackerParams(), s.limiter)
+	} else {
+		metaInfo, err = NewMetaInfo(torrent)
+	}
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	if _, ok := s.torrents[metaInfo.Infohash]; ok {
+		s.mutex.Unlock()
+		return t, errors.New("Torrent already added")
+	}
+	s.mutex.Unlock()
+	if t, err = newTorrent(s, metaInfo, allocation); err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.torrents[metaInfo.Infohash] = t
+	s.queue = append(s.queue, metaInfo.Infohash)
+	s.events.Emit(events.Event{Type: events.TORRENT_ADDED, Infohash: metaInfo.Infohash, Name: t.Name()})
+	return
+}
+
+// Channel receiving the events of every torrent (events.Event) until
+// Unsubscribe. The events that don't fit in the channel are dropped,
+// so it has to be read all the time.
+
+func (s *Session) Subscribe() <-chan events.Event {
+	return s.events.Subscribe()
+}
+
+func (s *Session) Unsubscribe(c <-chan events.Event) {
+	s.events.Unsubscribe(c)
+}
+
+func (s *Session) Torrent(infohash string) (t *Torrent, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, ok = s.torrents[infohash]
+	return
+}
+
+// Stop a torrent and remove it from the session with its resume data,
+// the downloaded files are deleted too with deleteFiles. The other
+// torrents keep running.
+
+func (s *Session) RemoveTorrent(infohash string, deleteFiles bool) (err error) {
+	s.mutex.Lock()
+	t, ok := s.torrents[infohash]
+	delete(s.torrents, infohash)
+	s.removeQueued(infohash)
+	s.mutex.Unlock()
+	if !ok {
+		return errors.New("Torrent not found")
+	}
+	err = t.Stop()
+	if e := t.removeResume(); e != nil && err == nil {
+		err = e
+	}
+	if !deleteFiles {
+		t.files.Close()
+		return
+	}
+	torrentLog.Info("Deleting files", "name", t.Name())
+	if e := t.files.Delete(); e != nil && err == nil {
+		err = e
+	}
+	return
+}
+
+// The torrents in the order of the queue
+
+func (s *Session) Torrents() (torrents []*Torrent) {
+	return s.queueOrder()
+}
+
+// Announce settings of the config, the port is the external one if it
+// has been mapped. The address told by the gateway is reported when
+// announce_ip isn't given, the trackers already see the others.
+
+func (s *Session) trackerParams() tracker.Params {
+	config := s.Config()
+	params := tracker.Params{Port: s.announcePort, Ip: config.AnnounceIp, NumWant: config.NumWant, NoPeerId: config.NoPeerId, ExternalIp: s.trackerIp}
+	if ip, source := s.ExternalIp(); len(params.Ip) == 0 && source == IP_NAT {
+		params.Ip = ip
+	}
+	if len(config.AnnouncePort) > 0 {
+		params.Port = config.AnnouncePort
+	}
+	return params
+}
+
+// Accept the incoming peers of a torrent and announce it in the local
+// network, returns the settings of its announces to the trackers
+
+func (s *Session) register(t *Torrent) (params tracker.Params) {
+	s.listener.AddPeerMgr(t.peerMgr)
+	if port, err := strconv.ParseInt(s.announcePort, 10, 64); err == nil {
+		t.peerMgr.SetListenPort(port)
+	}
+	if s.lsd != nil && !t.Private() {
+		s.lsd.Add(t.peerMgr)
+	}
+	return s.trackerParams()
+}
+
+// A torrent has been stopped
+
+func (s *Session) unregister(t *Torrent) {
+	s.listener.RemovePeerMgr(t.metaInfo.Infohash)
+	if s.lsd != nil {
+		s.lsd.Remove(t.metaInfo.Infohash)
+	}
+}
+
+// Stop every torrent (saving their resume data and the session
+// totals), stop listening and remove the port mapping. The torrents
+// are stopped at the same time, so the trackers of one don't delay
+// the others.
+
+func (s *Session) Close() {
+	// The queued torrents aren't started anymore
+	close(s.quit)
+	s.events.Unsubscribe(s.hooks)
+	torrents := s.Torrents()
+	stopped := make(chan bool)
+	for _, t := range(torrents) {
+		go func(t *Torrent) {
+			if err := t.Stop(); err != nil {
+				sessionLog.Error("Error stopping torrent", "name", t.Name(), "err", err)
+			}
+			stopped <- true
+		}(t)
+	}
+	for _ = range(torrents) {
+		<- stopped
+	}
+	if err := s.saveTotals(); err != nil {
+		sessionLog.Error("Error saving the session totals", "err", err)
+	}
+	s.limiter.SetSchedule(nil)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listener.Close()
+	if s.lsd != nil {
+		s.lsd.Stop()
+		s.lsd = nil
+	}
+	if s.mapping != nil {
+		s.mapping.Stop()
+		s.mapping = nil
+	}
+}
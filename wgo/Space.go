@@ -0,0 +1,60 @@
+// Checks of the free space of the disk, a torrent that doesn't fit in
+// it (or whose writes fail because the disk filled up) is paused with
+// the error until Resume, instead of failing every write
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"fmt"
+	"wgo/files"
+	)
+
+const(
+	SPACE_CHECK = 30 // Seconds between checks of the free space while downloading
+)
+
+// Bytes still to write to disk: the pieces left with sparse files, the
+// other allocations took the space when the files were created.
+// Called with the mutex held.
+
+func (t *Torrent) spaceNeeded() int64 {
+	if t.allocation != files.ALLOCATE_SPARSE || t.bitfield.Completed() {
+		return 0
+	}
+	return t.left()
+}
+
+// Error if the pieces left don't fit in the disk, nil if they do or the
+// free space is unknown. Called with the mutex held.
+
+func (t *Torrent) checkSpace() (error) {
+	needed := t.spaceNeeded()
+	if needed == 0 {
+		return nil
+	}
+	free, err := t.files.FreeSpace()
+	if err != nil {
+		torrentLog.Debug("Unknown free space", "name", t.Name(), "err", err)
+		return nil
+	}
+	if free >= 0 && free < needed {
+		return fmt.Errorf("Not enough disk space: %d bytes needed, %d free", needed, free)
+	}
+	return nil
+}
+
+// Pause the torrent because of a disk problem, the error is in the
+// stats until it's resumed. It's paused even if the resume data can't
+// be saved, which is likely with a full disk.
+
+func (t *Torrent) diskFailed(err error) {
+	torrentLog.Error("Pausing torrent", "name", t.Name(), "err", err)
+	if e := t.Stop(); e != nil {
+		torrentLog.Error("Error stopping torrent", "name", t.Name(), "err", e)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.paused, t.diskError = true, err.Error()
+}
@@ -0,0 +1,118 @@
+// Reading the files of a torrent while they are being downloaded, the
+// reads wait for the pieces and the pieces after the position of the
+// reader are downloaded first
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"io"
+	"fmt"
+	"sync"
+	"errors"
+	)
+
+// An io.ReadSeeker of a file of the torrent
+
+type FileReader struct {
+	t *Torrent
+	id string // Of the read ahead
+	offset, length int64 // Of the file in the torrent
+	pos int64
+	cancel chan bool
+	once *sync.Once
+}
+
+// Open the file with the given index in the torrent for reading
+
+func (t *Torrent) OpenFile(file int) (r *FileReader, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	info := &t.metaInfo.Info
+	r = &FileReader{t: t, cancel: make(chan bool), once: new(sync.Once)}
+	r.id = fmt.Sprintf("reader %p", r)
+	if len(info.Files) == 0 {
+		if file != 0 {
+			return nil, errors.New("File out of range")
+		}
+		r.length = t.size
+		return
+	}
+	if file < 0 || file >= len(info.Files) {
+		return nil, errors.New("File out of range")
+	}
+	for i := 0; i < file; i++ {
+		r.offset += info.Files[i].Length
+	}
+	r.length = info.Files[file].Length
+	return
+}
+
+func (r *FileReader) Length() int64 {
+	return r.length
+}
+
+// Read from the current position, waiting for the piece if it hasn't
+// been downloaded yet. Only the data of one piece is read at a time.
+
+func (r *FileReader) Read(p []byte) (n int, err error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return
+	}
+	select {
+		case <- r.cancel:
+			return 0, errors.New("Reader closed")
+		default:
+	}
+	offset := r.offset + r.pos
+	r.t.ReadAhead(r.id, offset)
+	if err = r.t.WaitOffset(offset, r.cancel); err != nil {
+		return
+	}
+	pieceLength := r.t.metaInfo.Info.Piece_length
+	index, begin := offset / pieceLength, offset % pieceLength
+	chunk := int64(len(p))
+	if chunk > pieceLength - begin {
+		chunk = pieceLength - begin
+	}
+	if chunk > r.length - r.pos {
+		chunk = r.length - r.pos
+	}
+	if err = r.t.files.ReadBlock(index, begin, p[0:chunk]); err != nil {
+		return
+	}
+	r.pos += chunk
+	return int(chunk), nil
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+		case io.SeekStart:
+		case io.SeekCurrent:
+			offset += r.pos
+		case io.SeekEnd:
+			offset += r.length
+		default:
+			return r.pos, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return r.pos, errors.New("Negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Stop reading, a Read waiting for a piece returns an error. It can be
+// called from another goroutine.
+
+func (r *FileReader) Close() (error) {
+	r.once.Do(func() {
+		close(r.cancel)
+		r.t.StopReadAhead(r.id)
+	})
+	return nil
+}
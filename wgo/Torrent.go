@@ -0,0 +1,757 @@
+// A torrent of a Session, holds every module needed to download
+// and seed it
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"net"
+	"sync"
+	"time"
+	"container/list"
+	"wgo/bencode"
+	"wgo/bit_field"
+	"wgo/files"
+	"wgo/stats"
+	"wgo/peers"
+	"wgo/choke"
+	"wgo/tracker"
+	"wgo/logger"
+	"errors"
+	)
+
+const(
+	RESUME_INTERVAL = 30 // Seconds between saves of the resume data
+)
+
+var torrentLog = logger.New("torrent")
+
+// Information about a file of the torrent
+
+type FileInfo struct {
+	Path []string
+	Length int64
+	Priority int
+}
+
+// State of a connected peer
+
+type PeerInfo struct {
+	Addr, Client, Source string
+	Capabilities []string // Of the handshake, set by both sides
+	Speed int64 // In bytes/s, the one used to choke it
+	DownSpeed, UpSpeed int64 // In bytes/s
+	Am_choking, Am_interested, Peer_choking, Peer_interested bool
+	Completed bool // The peer is a seed
+}
+
+// State of the download
+
+type TorrentStats struct {
+	Size, Left int64
+	Pieces, Done int64
+	Uploaded, Downloaded int64
+	DownSpeed, UpSpeed int64 // In bytes/s
+	Progress float64 // Percentage downloaded
+	Eta int64 // Seconds to finish, -1 if unknown
+	ActivePeers, IncomingPeers, UnusedPeers int
+	Availability float64 // Distributed copies in the connected peers
+	Reaped int64 // Peers disconnected for not sending anything
+	HashFailures, Requests int64
+	Duplicates, Wasted int64 // Blocks received more than once, and their bytes
+	Timeouts int64 // Requests that weren't received in time
+	DiskQueue int // Blocks waiting to be written
+	Ratio float64 // Uploaded over the size
+	Seeding int64 // Seconds seeding
+	Active int64 // Seconds running
+	Running bool
+	Paused bool
+	Checking bool // Hashing the files again
+	Queued bool // Waiting for an active slot
+	QueuePosition int // 0 is the first one
+	Error string // Why the torrent was paused, like a full disk, empty if it wasn't
+}
+
+type Torrent struct {
+	mutex *sync.Mutex
+	session *Session
+	metaInfo *bencode.MetaInfo
+	files files.Files
+	size, lastPieceLength int64
+	bitfield *bit_field.Bitfield
+	resume *files.ResumeData
+	resumeFile string
+	priorities []int
+	sequential bool
+	allocation int // files.ALLOCATE_*
+	seedRatio float64
+	seedTime int64 // In minutes
+	customSeed bool // The seed limits are not the ones of the session
+	seeding, seedingSince int64 // Seconds seeding before the current one
+	active, activeSince int64 // Seconds running before the current run
+	accountedUp, accountedDown int64 // Transfers already added to the session totals
+	running bool
+	paused bool // Stopped with Pause
+	queued bool // Waiting for an active slot of the session
+	checking bool // Recheck is hashing the files
+	diskError string // Of the pause after a disk problem
+	quit chan bool
+	// Modules used while the torrent is running
+	stats stats.Stats
+	peerMgr peers.PeerMgr
+	pieceMgr peers.PieceMgr
+	chokeMgr *choke.ChokeMgr
+	trackerMgr *tracker.TrackerMgr
+	webSeeds []*peers.WebSeed
+	peerCache []files.ResumePeer // Best peers first
+	folder string // Download folder, where the resume data is
+	completeFolder string // Where the files were moved when finished, empty if not moved
+	moveMutex *sync.Mutex // Only one checkComplete moves the files
+	moveFailed string // Complete folder the files couldn't be moved to
+}
+
+// Open the files of the torrent, and find the pieces we already have
+// using the resume data or checking the files
+
+func newTorrent(s *Session, metaInfo *bencode.MetaInfo, allocation int) (t *Torrent, err error) {
+	t = new(Torrent)
+	t.mutex = new(sync.Mutex)
+	t.moveMutex = new(sync.Mutex)
+	t.session = s
+	t.metaInfo = metaInfo
+	t.allocation = allocation
+	config := s.Config()
+	t.seedRatio, t.seedTime = config.SeedRatio, config.SeedTime
+	folder := config.Folder
+	t.folder = folder
+	t.resumeFile = resumePath(folder, metaInfo.Infohash)
+	if r, e := files.LoadResume(t.resumeFile); e == nil && allocation != files.ALLOCATE_MEMORY {
+		// The resume data stays in the download folder
+		t.completeFolder = r.Folder
+	}
+	filesFolder := folder
+	if len(t.completeFolder) > 0 {
+		filesFolder = t.completeFolder
+	}
+	if t.files, t.size, err = files.NewFiles(&metaInfo.Info, filesFolder, allocation); err != nil {
+		return
+	}
+	if t.size <= 0 {
+		return t, errors.New("Empty torrent")
+	}
+	torrentLog.Info("Files opened", "name", t.Name(), "size", t.size)
+	t.lastPieceLength = t.size % metaInfo.Info.Piece_length
+	if t.lastPieceLength == 0 {
+		t.lastPieceLength = metaInfo.Info.Piece_length
+	}
+	// Use the resume data if the files haven't changed, check
+	// every piece otherwise
+	if allocation == files.ALLOCATE_MEMORY {
+		// Nothing survives a restart
+		pieceLength := metaInfo.Info.Piece_length
+		t.bitfield = bit_field.NewBitfield((t.size + pieceLength - 1) / pieceLength)
+	} else if t.resume, t.bitfield, err = t.loadResume(); err != nil {
+		torrentLog.Info("Not using the pieces of the resume data", "name", t.Name(), "err", err)
+		if _, t.bitfield, err = t.files.CheckPieces(checkProgress(t.Name())); err != nil {
+			return
+		}
+		if t.resume != nil {
+			// The rest of the resume data is still good
+			t.verifyPartial(t.resume)
+			t.seeding, t.active = t.resume.Seeding, t.resume.Active
+		}
+	} else {
+		t.seeding, t.active = t.resume.Seeding, t.resume.Active
+	}
+	t.priorities = make([]int, t.files.NumFiles())
+	for i, _ := range(t.priorities) {
+		t.priorities[i] = files.PRIORITY_NORMAL
+	}
+	return
+}
+
+// Log the progress of the hash check each time the percentage changes
+
+func checkProgress(name string) func(checked, total int64) {
+	last := int64(-1)
+	return func(checked, total int64) {
+		if percent := (checked*100)/total; percent != last {
+			last = percent
+			torrentLog.Info("Checking pieces", "name", name, "percent", percent)
+		}
+	}
+}
+
+func (t *Torrent) Infohash() string {
+	return t.metaInfo.Infohash
+}
+
+func (t *Torrent) Name() string {
+	return t.metaInfo.Info.Name
+}
+
+// Private torrents (BEP 27) only get peers from their trackers, without
+// PEX nor local peer discovery
+
+func (t *Torrent) Private() bool {
+	return t.metaInfo.Info.Private == 1
+}
+
+// Truncated v2 infohash of a hybrid torrent, empty for the others. The
+// v1 one stays the infohash of the torrent.
+
+func (t *Torrent) hybridInfohash() string {
+	if len(t.metaInfo.InfohashV2) == 0 || t.metaInfo.Infohash == t.metaInfo.InfohashV2[0:20] {
+		return ""
+	}
+	return t.metaInfo.InfohashV2[0:20]
+}
+
+// How the files were allocated when the torrent was added
+
+func (t *Torrent) Allocation() int {
+	return t.allocation
+}
+
+func (t *Torrent) MetaInfo() *bencode.MetaInfo {
+	return t.metaInfo
+}
+
+// Bytes of the pieces we don't have yet
+
+func (t *Torrent) left() (left int64) {
+	n := t.bitfield.Len()
+	left = (n - t.bitfield.Count()) * t.metaInfo.Info.Piece_length
+	if n > 0 && !t.bitfield.IsSet(n-1) {
+		left += t.lastPieceLength - t.metaInfo.Info.Piece_length
+	}
+	return
+}
+
+// Start connecting to the peers, trackers and web seeds, or queue the
+// torrent if the session has no active slot for it
+
+func (t *Torrent) Start() (err error) {
+	if !t.session.mustQueue(t) {
+		return t.start()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running && !t.queued {
+		torrentLog.Info("Torrent queued", "name", t.Name())
+		t.queued = true
+	}
+	return
+}
+
+func (t *Torrent) start() (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.queued = false
+	if t.running {
+		return
+	}
+	if t.checking {
+		return errors.New("Checking the files")
+	}
+	if err = t.checkSpace(); err != nil {
+		torrentLog.Error("Pausing torrent", "name", t.Name(), "err", err)
+		t.paused, t.diskError = true, err.Error()
+		return
+	}
+	t.diskError = ""
+	s := t.session
+	info := &t.metaInfo.Info
+	left := t.left()
+	t.stats = stats.NewStats(left, t.size, t.bitfield, info.Piece_length)
+	if t.peerMgr, err = peers.NewPeerMgr(t.bitfield.Len(), s.peerId, t.metaInfo.Infohash, t.bitfield, t.stats, t.files, s.limiter, s.bans, s.conns, info.Piece_length, t.lastPieceLength); err != nil {
+		t.stats.Stop()
+		return
+	}
+	if t.chokeMgr, err = choke.NewChokeMgr(t.stats, t.peerMgr); err != nil {
+		t.peerMgr.Stop()
+		t.stats.Stop()
+		return
+	}
+	em := s.events.Emitter(t.metaInfo.Infohash, t.Name())
+	t.peerMgr.SetEvents(em)
+	t.peerMgr.SetPrivate(t.Private())
+	t.peerMgr.SetInfohashV2(t.hybridInfohash())
+	config := s.Config()
+	t.setPeerConfig(&config)
+	if t.pieceMgr, err = peers.NewPieceMgr(t.peerMgr, t.stats, t.files, t.bitfield, info.Piece_length, t.lastPieceLength, t.bitfield.Len(), t.size); err != nil {
+		t.chokeMgr.Stop()
+		t.peerMgr.Stop()
+		t.stats.Stop()
+		return
+	}
+	t.pieceMgr.SetSequential(t.sequential)
+	t.pieceMgr.SetEvents(em)
+	t.pieceMgr.SetRequestTimeout(config.RequestTimeout)
+	for file, priority := range(t.priorities) {
+		if priority != files.PRIORITY_NORMAL {
+			t.pieceMgr.SetPriority(file, priority)
+		}
+	}
+	t.peerMgr.SetPieceMgr(t.pieceMgr)
+	if t.resume != nil {
+		t.restoreResume(t.resume)
+		t.resume = nil
+	}
+	t.accountedUp, t.accountedDown = t.stats.GetGlobalStats()
+	t.webSeeds = make([]*peers.WebSeed, 0, len(t.metaInfo.Url_list))
+	for _, url := range(t.metaInfo.Url_list) {
+		if w, err := peers.NewWebSeed(url, info, t.pieceMgr, t.bitfield, t.stats, t.files, s.limiter, t.lastPieceLength); err != nil {
+			torrentLog.Warn("Error adding web seed", "name", t.Name(), "url", url, "err", err)
+		} else {
+			t.webSeeds = append(t.webSeeds, w)
+		}
+	}
+	params := s.register(t)
+	params.Events = em
+	t.trackerMgr = tracker.NewTrackerMgr(t.metaInfo.Announce_list, t.metaInfo.Infohash, t.hybridInfohash(), params, t.peerMgr, left, t.bitfield, info.Piece_length, t.lastPieceLength, s.peerId, t.stats)
+	t.quit = make(chan bool)
+	go t.run(t.quit)
+	t.running = true
+	t.activeSince = time.Now().Unix()
+	if t.bitfield.Completed() {
+		t.seedingSince = time.Now().Unix()
+	}
+	return nil
+}
+
+// Peer settings of the session configuration
+
+func (t *Torrent) setPeerConfig(config *Config) {
+	t.peerMgr.SetEncryption(config.Encryption)
+	t.peerMgr.SetUtp(config.Utp)
+	t.peerMgr.SetMaxPeers(config.MaxPeers, config.MaxIncoming)
+	t.peerMgr.SetTimeouts(config.KeepAlive, config.HandshakeTimeout, config.Timeout, config.WriteTimeout)
+	t.peerMgr.SetMaxBadPieces(config.MaxBadPieces)
+	t.peerMgr.SetTrace(config.TraceFolder)
+	t.chokeMgr.SetUploadSlots(config.UploadSlots)
+}
+
+// The session configuration changed
+
+func (t *Torrent) reload(config *Config) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.customSeed {
+		t.seedRatio, t.seedTime = config.SeedRatio, config.SeedTime
+	}
+	if t.running {
+		t.setPeerConfig(config)
+		t.pieceMgr.SetRequestTimeout(config.RequestTimeout)
+	}
+}
+
+// Save the resume data periodically while the torrent is running,
+// and stop it when the seed limits are reached
+
+func (t *Torrent) run(quit chan bool) {
+	save := time.NewTicker(RESUME_INTERVAL*time.Second)
+	seed := time.NewTicker(SEED_CHECK*time.Second)
+	space := time.NewTicker(SPACE_CHECK*time.Second)
+	for {
+		select {
+			case <- quit:
+				save.Stop()
+				seed.Stop()
+				space.Stop()
+				return
+			case <- seed.C:
+				t.checkSeed()
+			case <- space.C:
+				t.mutex.Lock()
+				err := t.checkSpace()
+				t.mutex.Unlock()
+				if err != nil {
+					t.diskFailed(err)
+				}
+			case err := <- t.files.WriteErrors():
+				if files.IsNoSpace(err) {
+					t.diskFailed(err)
+				}
+			case <- save.C:
+				t.checkComplete()
+				if err := t.Save(); err != nil {
+					torrentLog.Error("Error saving resume data", "name", t.Name(), "err", err)
+				}
+		}
+	}
+}
+
+// Disconnect from every peer, flush the files and save the resume
+// data so the torrent can be started again, and tell the trackers
+// that we left the swarm
+
+func (t *Torrent) Stop() (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.queued = false
+	if !t.running {
+		return
+	}
+	close(t.quit)
+	t.seeding = t.seedingTime()
+	t.seedingSince = 0
+	t.session.unregister(t)
+	for _, w := range(t.webSeeds) {
+		w.Stop()
+	}
+	t.chokeMgr.Stop()
+	t.peerMgr.Stop()
+	// No more blocks are written, so the resume data matches the files
+	if err = t.files.Sync(); err != nil {
+		torrentLog.Error("Error flushing the files", "name", t.Name(), "err", err)
+	}
+	// Keep the state of the download for the next Start
+	var r *files.ResumeData
+	if r, err = t.resumeData(); err == nil {
+		t.resume = r
+		if t.allocation != files.ALLOCATE_MEMORY {
+			err = files.SaveResume(t.resumeFile, r)
+		}
+	}
+	t.accountTotals()
+	if e := t.session.saveTotals(); e != nil {
+		torrentLog.Error("Error saving the session totals", "name", t.Name(), "err", e)
+	}
+	t.trackerMgr.Stop()
+	t.pieceMgr.Stop()
+	t.stats.Stop()
+	t.active = t.activeTime()
+	t.running = false
+	return
+}
+
+// Stop the torrent until Resume: the peers are disconnected and the
+// trackers told that we left, and the pieces checked, the partial
+// pieces and the stats are kept in memory
+
+func (t *Torrent) Pause() (err error) {
+	if err = t.Stop(); err != nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.paused = true
+	return
+}
+
+// Start a paused torrent, it announces to the trackers again and
+// reconnects to the peers of its cache. A torrent paused by a disk
+// problem is checked again.
+
+func (t *Torrent) Resume() (err error) {
+	if err = t.Start(); err != nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.paused, t.diskError = false, ""
+	return
+}
+
+// Hash the files again, after a disk problem or if they were edited.
+// A running torrent is stopped while the files are checked and started
+// again with the new pieces, so the peers get the corrected bitfield
+// when they reconnect. The blocks of the partial pieces are kept if
+// their data didn't change.
+
+func (t *Torrent) Recheck() (err error) {
+	var bitfield *bit_field.Bitfield
+	t.mutex.Lock()
+	if t.checking {
+		t.mutex.Unlock()
+		return errors.New("Already checking the files")
+	}
+	if t.allocation == files.ALLOCATE_MEMORY {
+		t.mutex.Unlock()
+		return errors.New("The pieces in memory can't be checked")
+	}
+	// Nothing starts it until the check finishes
+	running := t.running
+	t.checking = true
+	t.mutex.Unlock()
+	if running {
+		err = t.Stop()
+	}
+	if err == nil {
+		torrentLog.Info("Checking the files again", "name", t.Name())
+		_, bitfield, err = t.files.CheckPieces(checkProgress(t.Name()))
+	}
+	t.mutex.Lock()
+	t.checking = false
+	if err == nil {
+		torrentLog.Info("Files checked", "name", t.Name(), "done", bitfield.Count(), "before", t.bitfield.Count(), "pieces", bitfield.Len())
+		t.bitfield = bitfield
+		err = t.recheckedResume()
+	}
+	t.mutex.Unlock()
+	if err != nil || !running {
+		return
+	}
+	return t.Start()
+}
+
+// The resume data with the pieces found by Recheck, called with the
+// mutex held
+
+func (t *Torrent) recheckedResume() (err error) {
+	if t.resume == nil {
+		t.resume = new(files.ResumeData)
+		t.resume.Seeding, t.resume.Active = t.seeding, t.active
+		t.resume.Folder = t.completeFolder
+	}
+	if t.resume.Files, err = t.files.Stat(); err != nil {
+		return
+	}
+	t.resume.Bitfield = string(t.bitfield.Bytes())
+	t.verifyPartial(t.resume)
+	return files.SaveResume(t.resumeFile, t.resume)
+}
+
+// Whether the torrent wants an active slot of the session queue, and
+// of which kind
+
+func (t *Torrent) queueState() (running, queued, complete bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.running, t.queued, t.bitfield.Completed()
+}
+
+func (t *Torrent) Paused() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.paused
+}
+
+func (t *Torrent) Running() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.running
+}
+
+// Save the resume data of a running torrent
+
+func (t *Torrent) Save() (error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running {
+		return nil
+	}
+	t.accountTotals()
+	if err := t.session.saveTotals(); err != nil {
+		return err
+	}
+	return t.saveResume()
+}
+
+func (t *Torrent) Stats() (ts *TorrentStats) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ts = new(TorrentStats)
+	ts.Size, ts.Left = t.size, t.left()
+	ts.Progress = stats.Progress(ts.Left, ts.Size)
+	ts.Eta = -1
+	ts.Pieces, ts.Done = t.bitfield.Len(), t.bitfield.Count()
+	ts.Running, ts.Paused, ts.Checking = t.running, t.paused, t.checking
+	ts.Queued, ts.QueuePosition = t.queued, t.session.QueuePosition(t.Infohash())
+	ts.Error = t.diskError
+	ts.Seeding, ts.Active = t.seedingTime(), t.activeTime()
+	if t.running {
+		ts.Uploaded, ts.Downloaded = t.stats.GetGlobalStats()
+		ts.DownSpeed, ts.UpSpeed = t.stats.GetGlobalRates()
+		ts.Eta = stats.Eta(ts.Left, ts.DownSpeed)
+		ts.ActivePeers, ts.IncomingPeers, ts.UnusedPeers = t.peerMgr.ActivePeers(), t.peerMgr.IncomingPeers(), t.peerMgr.UnusedPeers()
+		ts.Reaped = t.peerMgr.Reaped()
+		ts.Availability = t.peerMgr.Availability().Copies()
+		ts.HashFailures, ts.Requests = t.pieceMgr.HashFailures(), t.pieceMgr.Requests()
+		ts.Duplicates, ts.Wasted = t.pieceMgr.Duplicates()
+		ts.Timeouts = t.pieceMgr.Timeouts()
+		ts.DiskQueue = t.files.QueueDepth()
+	} else if t.resume != nil {
+		ts.Uploaded, ts.Downloaded = t.resume.Uploaded, t.resume.Downloaded
+	}
+	ts.Ratio = ratio(ts.Uploaded, t.size)
+	return
+}
+
+func (t *Torrent) Peers() (pi []PeerInfo) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running {
+		return
+	}
+	for addr, peer := range(t.peerMgr.GetPeers()) {
+		down, up := t.stats.GetRates(addr)
+		pi = append(pi, PeerInfo{Addr: addr, Client: peer.Client(), Source: peer.Source(), Capabilities: peer.Capabilities().Names(), Speed: t.stats.GetSpeed(addr),
+			DownSpeed: down, UpSpeed: up, Am_choking: peer.Am_choking(), Am_interested: peer.Am_interested(), Peer_choking: peer.Peer_choking(),
+			Peer_interested: peer.Peer_interested(), Completed: peer.Completed()})
+	}
+	return
+}
+
+// Peers of each source (tracker, pex, local, resume, manual and
+// incoming), the counters start again with each Start
+
+func (t *Torrent) Sources() map[string]peers.SourceStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running {
+		return nil
+	}
+	return t.peerMgr.SourceStats()
+}
+
+// Results of the announces, the counters start again with each Start
+
+func (t *Torrent) Trackers() (as []tracker.AnnounceStats) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running {
+		return
+	}
+	return t.trackerMgr.AnnounceStats()
+}
+
+// Limit the bandwidth used by a peer of the torrent
+
+func (t *Torrent) SetPeerLimits(addr string, up_limit, down_limit int) (error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running {
+		return errors.New("Torrent not running")
+	}
+	return t.peerMgr.SetPeerLimits(addr, up_limit, down_limit)
+}
+
+// Pieces we have, one bit per piece as in the bitfield message
+
+func (t *Torrent) Pieces() []byte {
+	return t.bitfield.Bytes()
+}
+
+func (t *Torrent) Files() (fi []FileInfo) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	info := &t.metaInfo.Info
+	if len(info.Files) == 0 {
+		return []FileInfo{FileInfo{Path: []string{info.Name}, Length: info.Length, Priority: t.priorities[0]}}
+	}
+	fi = make([]FileInfo, len(info.Files))
+	for i, f := range(info.Files) {
+		fi[i] = FileInfo{Path: f.Path, Length: f.Length, Priority: t.priorities[i]}
+	}
+	return
+}
+
+// Announce to every tracker now
+
+func (t *Torrent) Reannounce() (error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running {
+		return errors.New("Torrent not running")
+	}
+	t.trackerMgr.Reannounce()
+	return nil
+}
+
+// Connect to a peer given by hand (ip:port or host:port), also in
+// private torrents
+
+func (t *Torrent) AddPeer(addr string) (error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return err
+	}
+	if tcpAddr.Port == 0 || tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		return errors.New("Invalid peer address " + addr)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.running {
+		return errors.New("Torrent not running")
+	}
+	addrs := list.New()
+	addrs.PushBack(tcpAddr.String())
+	t.peerMgr.AddPeers(addrs, peers.SOURCE_MANUAL)
+	torrentLog.Info("Peer added", "name", t.Name(), "addr", tcpAddr.String())
+	return nil
+}
+
+// Change the download priority of a file (files.PRIORITY_*)
+
+func (t *Torrent) SetPriority(file, priority int) (error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if file < 0 || file >= len(t.priorities) {
+		return errors.New("File out of range")
+	}
+	if priority < files.PRIORITY_SKIP || priority > files.PRIORITY_HIGH {
+		return errors.New("Invalid priority")
+	}
+	if t.running {
+		if err := t.pieceMgr.SetPriority(file, priority); err != nil {
+			return err
+		}
+	}
+	t.priorities[file] = priority
+	return nil
+}
+
+// Download the pieces in file order instead of at random
+
+func (t *Torrent) SetSequential(sequential bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sequential = sequential
+	if t.running {
+		t.pieceMgr.SetSequential(sequential)
+	}
+}
+
+// A reader of the torrent data is at offset (in the whole torrent),
+// the pieces after it are downloaded before the others
+
+func (t *Torrent) ReadAhead(reader string, offset int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.running {
+		t.pieceMgr.ReadAhead(reader, offset)
+	}
+}
+
+func (t *Torrent) StopReadAhead(reader string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.running {
+		t.pieceMgr.StopReadAhead(reader)
+	}
+}
+
+// Block until the data at offset has been downloaded and checked, or
+// cancel is closed
+
+func (t *Torrent) WaitOffset(offset int64, cancel <-chan bool) (error) {
+	t.mutex.Lock()
+	if offset < 0 || offset >= t.size {
+		t.mutex.Unlock()
+		return errors.New("Offset out of range")
+	}
+	if t.bitfield.IsSet(offset / t.metaInfo.Info.Piece_length) {
+		t.mutex.Unlock()
+		return nil
+	}
+	if !t.running {
+		t.mutex.Unlock()
+		return errors.New("Torrent not running")
+	}
+	pieceMgr := t.pieceMgr
+	t.mutex.Unlock()
+	return pieceMgr.Wait(offset, cancel)
+}
@@ -0,0 +1,104 @@
+// Lifetime statistics of the torrents and of the session, kept between
+// runs: the torrents save theirs in the resume data and the session in
+// a file of the download folder, so the removed torrents still count
+// Roger Pau Monné - 2010
+// Distributed under the terms of the GNU GPLv3
+
+package wgo
+
+import(
+	"os"
+	"time"
+	"wgo/files"
+	)
+
+// Transfers of every torrent, over all the runs of the session
+
+type SessionStats struct {
+	Uploaded, Downloaded int64
+	Ratio float64 // Uploaded over downloaded
+	Active int64 // Seconds running
+}
+
+func totalsPath(folder string) string {
+	return folder + "/.wgo-totals"
+}
+
+// Load the totals of the previous runs, starting from zero the first
+// time
+
+func (s *Session) loadTotals(folder string) {
+	s.totalsFile = totalsPath(folder)
+	s.started = time.Now().Unix()
+	totals, err := files.LoadTotals(s.totalsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			sessionLog.Warn("Error loading the session totals", "err", err)
+		}
+		return
+	}
+	s.totals = *totals
+}
+
+// Called by the torrents with the bytes transferred since they were
+// last accounted
+
+func (s *Session) addTotals(uploaded, downloaded int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.totals.Uploaded += uploaded
+	s.totals.Downloaded += downloaded
+}
+
+// Called with the mutex held
+
+func (s *Session) currentTotals() (totals files.Totals) {
+	totals = s.totals
+	totals.Active += time.Now().Unix() - s.started
+	return
+}
+
+func (s *Session) saveTotals() (err error) {
+	s.mutex.Lock()
+	totals := s.currentTotals()
+	s.mutex.Unlock()
+	return files.SaveTotals(s.totalsFile, &totals)
+}
+
+// Lifetime transfers of the session, with the ones of the running
+// torrents up to now
+
+func (s *Session) Totals() (ss SessionStats) {
+	for _, t := range(s.Torrents()) {
+		t.mutex.Lock()
+		t.accountTotals()
+		t.mutex.Unlock()
+	}
+	s.mutex.Lock()
+	totals := s.currentTotals()
+	s.mutex.Unlock()
+	ss.Uploaded, ss.Downloaded, ss.Active = totals.Uploaded, totals.Downloaded, totals.Active
+	ss.Ratio = ratio(ss.Uploaded, ss.Downloaded)
+	return
+}
+
+// Seconds the torrent has been running, over all its runs
+
+func (t *Torrent) activeTime() int64 {
+	if t.running {
+		return t.active + time.Now().Unix() - t.activeSince
+	}
+	return t.active
+}
+
+// Add the transfers since the last call to the totals of the session,
+// called with the mutex held
+
+func (t *Torrent) accountTotals() {
+	if !t.running {
+		return
+	}
+	uploaded, downloaded := t.stats.GetGlobalStats()
+	t.session.addTotals(uploaded - t.accountedUp, downloaded - t.accountedDown)
+	t.accountedUp, t.accountedDown = uploaded, downloaded
+}
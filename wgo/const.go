@@ -2,10 +2,10 @@
 // Roger Pau Monné - 2010
 // Distributed under the terms of the GNU GPLv3
 
-package main
+package wgo
 
 const(
-	CLIENT_ID = "-wg0001"
+	CLIENT_ID = "-WG0100-"
 	FILE_PERM = 0666
 	FOLDER_PERM = 0755
 	PROTOCOL = "BitTorrent protocol"
@@ -16,10 +16,6 @@ const(
 	PERCENT_UNUSED_PEERS = 20
 	TRACKER_ERR_INTERVAL = 60
 	DEFAULT_TRACKER_INTERVAL = 1200
-	NS_PER_S = 1000000000
-	KEEP_ALIVE_MSG = 120*NS_PER_S
-	KEEP_ALIVE_RESP = 240*NS_PER_S
-	TIMEOUT = 6*60*NS_PER_S
 	STANDARD_BLOCK_LENGTH = 16 * 1024
 	MAX_PIECE_LENGTH = 128*1024
 	NUM_PEERS = 100
@@ -32,8 +28,8 @@ const(
 	CHOKE_ROUND = 10
 	OPTIMISTIC_UNCHOKE = 30
 	UPLOADING_PEERS = 5
-	SNUBBED_PERIOD = 60
-	REQUESTS_LENGTH = 10 // time of requests to ask to a peer (10s of pieces)
+	SNUB_TIMEOUT = 60
+	REQUEST_QUEUE_TIME = 3 // Seconds of blocks queued on top of the latency
 	MAX_PIECE_REQUESTS = 4
 	)
 
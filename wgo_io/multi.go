@@ -3,6 +3,7 @@ package wgo_io
 import(
 	"os"
 	"io"
+	"errors"
 	)
 
 type multiReaderAt struct {
@@ -30,7 +31,7 @@ func (mr *multiReaderAt) find(offset int64) int {
 
 // Read a block starting from a certain offset
 
-func (mr *multiReaderAt) ReadAt(p []byte, off int64) (n int, err os.Error) {
+func (mr *multiReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
 	for index := mr.find(off); len(p) > 0 && index < len(mr.offsets); index++ {
 		chunk := int64(len(p))
 		//entry := &mr.files[index]
@@ -40,7 +41,16 @@ func (mr *multiReaderAt) ReadAt(p []byte, off int64) (n int, err os.Error) {
 			if space < chunk {
 				chunk = space
 			}
-			nThisTime, err := mr.files[index].ReadAt(p[0:chunk], itemOffset)
+			var nThisTime int
+			if mr.files[index] == nil {
+				// Padding, only zeros
+				for i := int64(0); i < chunk; i++ {
+					p[i] = 0
+				}
+				nThisTime = int(chunk)
+			} else {
+				nThisTime, err = mr.files[index].ReadAt(p[0:chunk], itemOffset)
+			}
 			n += nThisTime
 			if err != nil {
 				return
@@ -60,7 +70,7 @@ func (mr *multiReaderAt) ReadAt(p []byte, off int64) (n int, err os.Error) {
 
 // MultiReaderAt returns a ReaderAt that's the logical concatenation of
 // the provided input files.
-func MultiReaderAt(files []*os.File) (io.ReaderAt, os.Error) {
+func MultiReaderAt(files []*os.File) (io.ReaderAt, error) {
 	mr := &multiReaderAt{files, make([]int64, len(files)), make([]int64, len(files))}
 	offset := int64(0)
 	for i, file := range files {
@@ -69,8 +79,23 @@ func MultiReaderAt(files []*os.File) (io.ReaderAt, os.Error) {
 		if err != nil {
 			return mr, err
 		}
-		mr.sizes[i] = info.Size
-		offset += info.Size
+		mr.sizes[i] = info.Size()
+		offset += info.Size()
+	}
+	return mr, nil
+}
+
+// MultiReaderAtSizes is MultiReaderAt with the sizes of the files,
+// the nil files are read as zeros (padding files)
+func MultiReaderAtSizes(files []*os.File, sizes []int64) (io.ReaderAt, error) {
+	if len(files) != len(sizes) {
+		return nil, errors.New("Wrong number of sizes")
+	}
+	mr := &multiReaderAt{files, make([]int64, len(files)), sizes}
+	offset := int64(0)
+	for i, size := range sizes {
+		mr.offsets[i] = offset
+		offset += size
 	}
 	return mr, nil
 }